@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Tags of the entries of a POSIX ACL as stored in the system.posix_acl_access extended attribute
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// decodePosixACL converts the binary value of a Linux POSIX ACL extended attribute into the short text form
+// used by getfacl, e.g. "user::rw-,user:1000:r--,group::r--,mask::r--,other::---". It returns an empty string
+// for a trivial ACL, which only repeats the mode bits.
+func decodePosixACL(value []byte) (string, error) {
+	const headerSize, entrySize, version = 4, 8, 2
+	if len(value) < headerSize || (len(value)-headerSize)%entrySize != 0 {
+		return "", fmt.Errorf("invalid ACL size %d", len(value))
+	}
+	if v := binary.LittleEndian.Uint32(value); v != version {
+		return "", fmt.Errorf("unsupported ACL version %d", v)
+	}
+
+	var entries []string
+	trivial := true
+	for entry := value[headerSize:]; len(entry) > 0; entry = entry[entrySize:] {
+		tag := binary.LittleEndian.Uint16(entry)
+		perm := binary.LittleEndian.Uint16(entry[2:])
+		id := binary.LittleEndian.Uint32(entry[4:])
+
+		var text string
+		switch tag {
+		case aclUserObj:
+			text = "user::"
+		case aclUser:
+			text = fmt.Sprintf("user:%d:", id)
+		case aclGroupObj:
+			text = "group::"
+		case aclGroup:
+			text = fmt.Sprintf("group:%d:", id)
+		case aclMask:
+			text = "mask::"
+		case aclOther:
+			text = "other::"
+		default:
+			return "", fmt.Errorf("unknown ACL tag %#x", tag)
+		}
+		if tag != aclUserObj && tag != aclGroupObj && tag != aclOther {
+			trivial = false
+		}
+		entries = append(entries, text+aclPermString(perm))
+	}
+	if trivial {
+		return "", nil
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// aclPermString formats the read, write and execute bits of an ACL entry
+func aclPermString(perm uint16) string {
+	s := []byte("---")
+	if perm&4 != 0 {
+		s[0] = 'r'
+	}
+	if perm&2 != 0 {
+		s[1] = 'w'
+	}
+	if perm&1 != 0 {
+		s[2] = 'x'
+	}
+	return string(s)
+}
@@ -0,0 +1,43 @@
+//go:build darwin
+
+package main
+
+/*
+#include <errno.h>
+#include <stdlib.h>
+#include <sys/acl.h>
+*/
+import "C"
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// readACL returns the text form of the extended ACL of path, or an empty string if it has none
+func readACL(path string) (string, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	acl, err := C.acl_get_link_np(cPath, C.ACL_TYPE_EXTENDED)
+	if acl == nil {
+		if err == syscall.ENOENT {
+			return "", nil
+		}
+		return "", err
+	}
+	defer C.acl_free(unsafe.Pointer(acl))
+
+	text, err := C.acl_to_text(acl, nil)
+	if text == nil {
+		return "", err
+	}
+	defer C.acl_free(unsafe.Pointer(text))
+	// acl_to_text produces a "!#acl 1" header line followed by one entry per line
+	lines := strings.Split(strings.TrimSpace(C.GoString(text)), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "!#acl") {
+		lines = lines[1:]
+	}
+	return strings.Join(lines, ","), nil
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// readACL returns the text form of the access ACL of path, or an empty string if it has none. Files without
+// an ACL cost a single getxattr call.
+func readACL(path string) (string, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, "system.posix_acl_access", buf)
+		switch {
+		case errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP):
+			return "", nil
+		case errors.Is(err, syscall.ERANGE):
+			// The ACL is larger than the buffer, ask for its size
+			n, err = syscall.Getxattr(path, "system.posix_acl_access", nil)
+			if err != nil {
+				return "", err
+			}
+			buf = make([]byte, n)
+			continue
+		case err != nil:
+			return "", err
+		}
+		return decodePosixACL(buf[:n])
+	}
+}
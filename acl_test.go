@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodePosixACL(t *testing.T) {
+	// Values of system.posix_acl_access as returned by getfattr -e hex
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		// setfacl -m u:1000:rw-,g:100:r-x file
+		{"02000000" + "01000600ffffffff" + "02000600e8030000" +
+			"04000400ffffffff" + "0800050064000000" + "10000700ffffffff" + "20000400ffffffff",
+			"user::rw-,user:1000:rw-,group::r--,group:100:r-x,mask::rwx,other::r--"},
+		// A trivial ACL only repeats the mode bits
+		{"02000000" + "01000700ffffffff" + "04000500ffffffff" + "20000000ffffffff", ""},
+	}
+	for _, tc := range testCases {
+		value, err := hex.DecodeString(tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl, err := decodePosixACL(value)
+		if err != nil {
+			t.Errorf("decodePosixACL(%s) failed: %v", tc.value, err)
+		} else if acl != tc.expected {
+			t.Errorf("decodePosixACL(%s) = %q, want %q", tc.value, acl, tc.expected)
+		}
+	}
+
+	for _, value := range []string{"", "01000000", "020000000100", "02000000" + "4000070000000000"} {
+		b, _ := hex.DecodeString(value)
+		if _, err := decodePosixACL(b); err == nil {
+			t.Errorf("decodePosixACL(%s) succeeded, want an error", value)
+		}
+	}
+}
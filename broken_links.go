@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runBrokenLinks implements the broken-links subcommand, which lists the dangling symlinks found by the last
+// crawl of each path
+func runBrokenLinks(args []string) error {
+	var dbFile string
+	var root string
+
+	flags := flag.NewFlagSet("broken-links", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&root, "root", "", "Only list links equal to or below this path")
+	_ = flags.Parse(args)
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	return brokenLinksReport(db, root, os.Stdout)
+}
+
+// brokenLinksReport writes the dangling symlinks grouped by directory, with the number of links in each
+func brokenLinksReport(db *sql.DB, root string, w io.Writer) error {
+	condition := "target_type IN " + brokenTargetTypes
+	var args []any
+	if root != "" {
+		condition += " AND " + underRootCondition
+		args = underRootArgs(root)
+	}
+	rows, err := db.Query(`
+	SELECT folders.path, links.name, links.symlink, links.target_type,
+	       COUNT(*) OVER (PARTITION BY links.folder_id)
+	FROM (SELECT * FROM files WHERE `+condition+`) AS links JOIN folders ON links.folder_id = folders.id
+	ORDER BY folders.path, links.name`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	previousDir := ""
+	total := 0
+	for rows.Next() {
+		var dir, name, target, targetType string
+		var count int
+		if err := rows.Scan(&dir, &name, &target, &targetType, &count); err != nil {
+			return err
+		}
+		if dir != previousDir {
+			if _, err := fmt.Fprintf(w, "%s (%d)\n", dir, count); err != nil {
+				return err
+			}
+			previousDir = dir
+		}
+		note := ""
+		if targetType == "loop" {
+			note = " (loop)"
+		}
+		if _, err := fmt.Fprintf(w, "  %s -> %s%s\n", name, target, note); err != nil {
+			return err
+		}
+		total++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Broken links: %d\n", total)
+	return err
+}
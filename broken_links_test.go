@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBrokenLinksReport(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := filepath.Join(root, "target.txt")
+	if err := os.WriteFile(target, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"a/ok":      "../target.txt",
+		"a/missing": "../nothing.txt",
+		"b/later":   "../target.txt",
+		"b/loop1":   "loop2",
+		"b/loop2":   "loop1",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crawlAndReport := func() string {
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, Roots: []string{root}}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := brokenLinksReport(db, root, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	expected := root + "/a (1)\n" +
+		"  missing -> ../nothing.txt\n" +
+		root + "/b (2)\n" +
+		"  loop1 -> loop2 (loop)\n" +
+		"  loop2 -> loop1 (loop)\n" +
+		"Broken links: 3\n"
+	if report := crawlAndReport(); report != expected {
+		t.Errorf("brokenLinksReport() = %q, want %q", report, expected)
+	}
+
+	// The status follows the targets on the next crawl
+	if err := os.Rename(target, filepath.Join(root, "nothing.txt")); err != nil {
+		t.Fatal(err)
+	}
+	expected = root + "/a (1)\n" +
+		"  ok -> ../target.txt\n" +
+		root + "/b (3)\n" +
+		"  later -> ../target.txt\n" +
+		"  loop1 -> loop2 (loop)\n" +
+		"  loop2 -> loop1 (loop)\n" +
+		"Broken links: 4\n"
+	if report := crawlAndReport(); report != expected {
+		t.Errorf("brokenLinksReport() after renaming the target = %q, want %q", report, expected)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultBundleExtensions are the extensions of the macOS bundle directories that -bundles-as-files stores as
+// single entries
+const defaultBundleExtensions = ".app,.bundle,.framework,.plugin,.kext,.photoslibrary,.musiclibrary,.imovielibrary," +
+	".fcpbundle,.logicx,.band,.rtfd,.pages,.numbers,.key"
+
+// parseBundleExtensions splits a comma-separated list of extensions, adding the leading dot where it is missing
+func parseBundleExtensions(list string) []string {
+	var extensions []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
+// isBundle reports whether the directory at path is a bundle, i.e. has one of extensions, ignoring case
+func isBundle(path string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleContents lists the contents of a bundle, which are enough to tell whether it changed without reading
+// any file
+type bundleContents struct {
+	Size             int64     // Total size of the regular files inside
+	ModificationTime time.Time // Latest modification time of the bundle and anything inside it
+	entries          []bundleEntry
+}
+
+// bundleEntry is a regular file or a symlink inside a bundle
+type bundleEntry struct {
+	relPath string // Path relative to the bundle, with '/' as separator
+	symlink bool
+}
+
+// scanBundle walks the bundle at root and lists its files and symlinks, sorted by relative path. Directories are
+// only used for their modification times, which change when files are added or removed.
+func scanBundle(root string) (*bundleContents, error) {
+	contents := &bundleContents{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(contents.ModificationTime) {
+			contents.ModificationTime = info.ModTime()
+		}
+		if path == root || !(info.Mode().IsRegular() || info.Mode()&fs.ModeSymlink != 0) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			contents.Size += info.Size()
+		}
+		entry := bundleEntry{relPath: filepath.ToSlash(rel), symlink: info.Mode()&fs.ModeSymlink != 0}
+		contents.entries = append(contents.entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// WalkDir sorts the entries of each directory, which isn't the same as sorting the relative paths:
+	// "a/b" comes before "a.txt"
+	sort.Slice(contents.entries, func(i, j int) bool {
+		return contents.entries[i].relPath < contents.entries[j].relPath
+	})
+	return contents, nil
+}
+
+// hashBundle returns the aggregate hash of the bundle at root with the given contents: the hash of one line per
+// file, sorted by relative path, made of the relative path, a NUL byte and the hex hash of the file. Symlinks
+// contribute their target instead of a hash. Files are hashed with algorithm, as is the list.
+func hashBundle(root string, contents *bundleContents, algorithm string) (string, error) {
+	aggregate := hashAlgorithms[algorithm]()
+	for _, entry := range contents.entries {
+		path := filepath.Join(root, filepath.FromSlash(entry.relPath))
+		var value string
+		if entry.symlink {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			value = "symlink:" + target
+		} else {
+			hash, _, err := hashFile(path, algorithm)
+			if err != nil {
+				return "", err
+			}
+			value = hash
+		}
+		if _, err := fmt.Fprintf(aggregate, "%s\x00%s\n", entry.relPath, value); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", aggregate.Sum(nil)), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBundleExtensions(t *testing.T) {
+	extensions := parseBundleExtensions(".app, Photoslibrary,,.logicx ")
+	if expected := []string{".app", ".photoslibrary", ".logicx"}; !reflect.DeepEqual(extensions, expected) {
+		t.Errorf("parseBundleExtensions() = %q, want %q", extensions, expected)
+	}
+	if !isBundle("/Applications/Safari.APP", extensions) || isBundle("/Applications/app", extensions) {
+		t.Error("isBundle() doesn't match extensions regardless of case only")
+	}
+}
+
+// writeFiles creates the files at the relative paths of contents below root, in the order given
+func writeFiles(t *testing.T, root string, contents [][2]string) {
+	t.Helper()
+	for _, c := range contents {
+		path := filepath.Join(root, c[0])
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(c[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func bundleHashOf(t *testing.T, root string) string {
+	t.Helper()
+	contents, err := scanBundle(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashBundle(root, contents, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestHashBundle(t *testing.T) {
+	first := filepath.Join(t.TempDir(), "A.app")
+	writeFiles(t, first, [][2]string{{"a/b", "1"}, {"a.txt", "2"}, {"Contents/Info.plist", "3"}})
+	second := filepath.Join(t.TempDir(), "B.app")
+	writeFiles(t, second, [][2]string{{"Contents/Info.plist", "3"}, {"a.txt", "2"}, {"a/b", "1"}})
+
+	// The hash only depends on the relative paths and the contents
+	hash := bundleHashOf(t, first)
+	if other := bundleHashOf(t, second); other != hash {
+		t.Errorf("bundles with the same contents have hashes %s and %s", hash, other)
+	}
+
+	contents, err := scanBundle(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Size != 3 || len(contents.entries) != 3 || contents.entries[1].relPath != "a.txt" {
+		t.Errorf("scanBundle() = %+v, want 3 files of 3 bytes sorted by relative path", contents)
+	}
+
+	writeFiles(t, second, [][2]string{{"a.txt", "changed"}})
+	if other := bundleHashOf(t, second); other == hash {
+		t.Error("changing a file didn't change the hash of its bundle")
+	}
+}
+
+func TestProcessDirectoryBundles(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"Tool.app/Contents/Info.plist", "plist"}, {"Tool.app/Contents/MacOS/tool", "binary"},
+		{"notes.txt", "notes"}})
+	bundle := filepath.Join(root, "Tool.app")
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, BundleExtensions: []string{".app"}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path LIKE ?", bundle+"/%").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d files inside the bundle were stored, want none", count)
+	}
+	var dir, isBundle bool
+	var size int64
+	var hash string
+	err := db.QueryRow("SELECT dir, bundle, size, hash FROM files WHERE path = ?", bundle).
+		Scan(&dir, &isBundle, &size, &hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir || !isBundle || size != 11 || hash != bundleHashOf(t, bundle) {
+		t.Errorf("bundle stored with dir %v, bundle %v, size %d and hash %s", dir, isBundle, size, hash)
+	}
+
+	// An unchanged bundle is skipped, a changed one is hashed again
+	stats := NewProcessStats()
+	if err := processDirectory(root, db, stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := stats.rootCounts()[0]; counts.Hashed != 0 {
+		t.Errorf("the second crawl hashed %d files, want none", counts.Hashed)
+	}
+	tool := filepath.Join(bundle, "Contents/MacOS/tool")
+	writeFiles(t, bundle, [][2]string{{"Contents/MacOS/tool", "new binary"}})
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(tool, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var newHash string
+	if err := db.QueryRow("SELECT hash FROM files WHERE path = ?", bundle).Scan(&newHash); err != nil {
+		t.Fatal(err)
+	}
+	if newHash == hash || newHash != bundleHashOf(t, bundle) {
+		t.Errorf("after a change inside the bundle, its hash is %s, want the new hash %s", newHash, bundleHashOf(t, bundle))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkpointInterval is how often a crawl records its position in the checkpoint file
+const checkpointInterval = 10 * time.Second
+
+// checkpoint is the position of an unfinished crawl, kept in a file next to the database rather than in it, so
+// that it is written even when the database can't be
+type checkpoint struct {
+	Root      string `json:"root"`
+	LastPath  string `json:"last_path"` // Everything up to and including this path has been processed
+	Timestamp string `json:"timestamp"`
+}
+
+// checkpointFile returns the checkpoint file of the database at dbFile
+func checkpointFile(dbFile string) string {
+	return dbFile + ".checkpoint"
+}
+
+// readCheckpoint reads the checkpoint in file, returning nil if there is none
+func readCheckpoint(file string) (*checkpoint, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %w", file, err)
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint in file. The checkpoint is written to a temporary file that is then
+// renamed, so that a crash never leaves a partial checkpoint behind.
+func writeCheckpoint(file string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	temp := file + ".tmp"
+	if err := os.WriteFile(temp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, file)
+}
+
+// removeCheckpoint deletes the checkpoint in file, if there is one
+func removeCheckpoint(file string) error {
+	err := os.Remove(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// confirmResume asks on out whether to resume from cp, and reads the answer from in
+func confirmResume(cp *checkpoint, in io.Reader, out io.Writer) bool {
+	_, _ = fmt.Fprintf(out, "A crawl of %s stopped after %s at %s. Resume from there? [y/N] ",
+		cp.Root, cp.LastPath, cp.Timestamp)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// resolveResumeFrom returns the absolute path of the -resume-from-path path, which must be one of roots or below
+// one of them. Roots are compared as given rather than with their symlinks resolved, like the walk does.
+func resolveResumeFrom(path string, roots []string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return "", err
+		}
+		if isUnderRoots(path, []string{root}) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("-resume-from-path %s is not below any of the roots", path)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointFile(t *testing.T) {
+	file := checkpointFile(filepath.Join(t.TempDir(), "index.sqlite"))
+	if cp, err := readCheckpoint(file); cp != nil || err != nil {
+		t.Fatalf("readCheckpoint() without a file = %v, %v, want nil", cp, err)
+	}
+
+	expected := checkpoint{Root: "/data", LastPath: "/data/z/file.txt", Timestamp: "2024-03-15T10:00:00Z"}
+	if err := writeCheckpoint(file, expected); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := readCheckpoint(file); err != nil || cp == nil || *cp != expected {
+		t.Errorf("readCheckpoint() = %v, %v, want %v", cp, err, expected)
+	}
+
+	if err := removeCheckpoint(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeCheckpoint(file); err != nil {
+		t.Errorf("removeCheckpoint() without a file = %v", err)
+	}
+}
+
+func TestConfirmResume(t *testing.T) {
+	cp := &checkpoint{Root: "/data", LastPath: "/data/z", Timestamp: "2024-03-15T10:00:00Z"}
+	for answer, expected := range map[string]bool{"y\n": true, "Yes\n": true, "\n": false, "no\n": false, "": false} {
+		var out bytes.Buffer
+		if confirmResume(cp, strings.NewReader(answer), &out) != expected {
+			t.Errorf("confirmResume() with answer %q = %v, want %v", answer, !expected, expected)
+		}
+		if !strings.Contains(out.String(), "/data/z") {
+			t.Errorf("confirmResume() asked %q, which doesn't mention the last path", out.String())
+		}
+	}
+}
+
+func TestProcessDirectoryWritesCheckpoints(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every call of the clock advances it past the checkpoint interval
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	opts := &crawlOptions{
+		walkOptions:    walkOptions{MaxDepth: -1},
+		CheckpointFile: checkpointFile(filepath.Join(t.TempDir(), "index.sqlite")),
+		Now: func() time.Time {
+			now = now.Add(checkpointInterval)
+			return now
+		},
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := readCheckpoint(opts.CheckpointFile)
+	if err != nil || cp == nil {
+		t.Fatalf("readCheckpoint() = %v, %v, want a checkpoint", cp, err)
+	}
+	// The checkpoint is written before a path is processed, so it points to the one before the last
+	if cp.Root != root || cp.LastPath != filepath.Join(root, "b") {
+		t.Errorf("checkpoint is %+v, want root %s and last path %s", cp, root, filepath.Join(root, "b"))
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"a/1", "1"}, {"b/2", "2"}, {"b/c/3", "3"}, {"b/c/d/4", "4"}, {"e/5", "5"}})
+	resumeFrom, err := resolveResumeFrom(filepath.Join(root, "b/c"), []string{"/elsewhere", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveResumeFrom(filepath.Dir(root), []string{root}); err == nil {
+		t.Error("resolveResumeFrom() accepted a path above the root")
+	}
+
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, ResumeFrom: resumeFrom}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	rows, err := db.Query("SELECT path FROM files WHERE dir = 0 ORDER BY path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, strings.TrimPrefix(path, root+"/"))
+	}
+	if expected := []string{"b/c/3", "b/c/d/4", "e/5"}; strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("crawled %q, want %q", paths, expected)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// Parameters of the content-defined chunking of large files with -chunk-files-above. Changing any of them moves
+// the chunk boundaries, so they are recorded in the settings of the database with chunkParameters.
+const (
+	chunkMinSize  = 256 << 10 // No boundary is looked for in the first bytes of a chunk
+	chunkAvgSize  = 1 << 20
+	chunkMaxSize  = 4 << 20 // Chunks are cut here if no boundary was found
+	chunkGearSeed = 0x6372617760636463
+)
+
+// chunkParameters describes the chunking, so that chunks from different parameters are never compared
+var chunkParameters = fmt.Sprintf("fastcdc min=%d avg=%d max=%d gear=%x hash=sha256",
+	chunkMinSize, chunkAvgSize, chunkMaxSize, chunkGearSeed)
+
+// The masks of normalized chunking: boundaries are less likely before the average size and more likely after it,
+// which narrows the distribution of the chunk sizes. The average size is a power of 2.
+const (
+	chunkMaskSmall = 1<<22 - 1 // log2(chunkAvgSize) + 2 bits
+	chunkMaskLarge = 1<<18 - 1 // log2(chunkAvgSize) - 2 bits
+)
+
+// chunkGear maps each byte to a pseudo-random number for the rolling hash, generated with splitmix64 from
+// chunkGearSeed so that it is the same in every build
+var chunkGear = func() (gear [256]uint64) {
+	state := uint64(chunkGearSeed)
+	for i := range gear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+	return gear
+}()
+
+// fileChunk is a chunk of a file, as stored in the chunks table
+type fileChunk struct {
+	Offset int64
+	Length int64
+	Hash   string // sha256 of the chunk, hex-encoded
+}
+
+// chunker splits what is written to it into chunks with FastCDC: a gear hash of the recent bytes is tested
+// against a mask at each byte, so that boundaries depend on the contents and move with insertions and deletions.
+// It is written to during the hashing read, see teeHash.
+type chunker struct {
+	fingerprint uint64
+	length      int64 // Bytes in the current chunk
+	offset      int64 // Offset of the current chunk
+	hash        hash.Hash
+	chunks      []fileChunk
+}
+
+func newChunker() *chunker {
+	return &chunker{hash: sha256.New()}
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n, cut := c.boundary(p)
+		c.hash.Write(p[:n])
+		c.length += int64(n)
+		if cut {
+			c.cut()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// boundary returns how many bytes of p belong to the current chunk, and whether the chunk ends there
+func (c *chunker) boundary(p []byte) (int, bool) {
+	start := 0
+	if c.length < chunkMinSize {
+		start = int(min(chunkMinSize-c.length, int64(len(p))))
+	}
+	for i := start; i < len(p); i++ {
+		c.fingerprint = c.fingerprint<<1 + chunkGear[p[i]]
+		length := c.length + int64(i) + 1
+		mask := uint64(chunkMaskLarge)
+		if length < chunkAvgSize {
+			mask = chunkMaskSmall
+		}
+		if c.fingerprint&mask == 0 || length >= chunkMaxSize {
+			return i + 1, true
+		}
+	}
+	return len(p), false
+}
+
+// cut ends the current chunk
+func (c *chunker) cut() {
+	chunk := fileChunk{Offset: c.offset, Length: c.length, Hash: fmt.Sprintf("%x", c.hash.Sum(nil))}
+	c.chunks = append(c.chunks, chunk)
+	c.offset += c.length
+	c.length = 0
+	c.fingerprint = 0
+	c.hash.Reset()
+}
+
+// finish ends the last chunk and returns all of them
+func (c *chunker) finish() []fileChunk {
+	if c.length > 0 {
+		c.cut()
+	}
+	return c.chunks
+}
+
+// initChunking records chunkParameters in the database. Chunks computed with other parameters can't be compared
+// with new ones, so they are deleted, and their files are chunked again as they are crawled.
+func initChunking(db *sql.DB) error {
+	stored, err := getSetting(db, "chunk_parameters")
+	if err != nil || stored == chunkParameters {
+		return err
+	}
+	if stored != "" {
+		log.Printf("Deleting the chunks computed with %s, which are replaced with %s\n", stored, chunkParameters)
+		if _, err := db.Exec("DELETE FROM chunks"); err != nil {
+			return err
+		}
+	}
+	return setSetting(db, "chunk_parameters", chunkParameters)
+}
+
+// writeChunks replaces the stored chunks of path, in a single transaction, or in the transaction db belongs to
+func writeChunks(db execQuerier, path string, chunks []fileChunk) error {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return replaceChunks(db, path, chunks)
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := replaceChunks(tx, path, chunks); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceChunks deletes the stored chunks of path and inserts chunks
+func replaceChunks(db execQuerier, path string, chunks []fileChunk) error {
+	if _, err := db.Exec("DELETE FROM chunks WHERE path = ?", path); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		_, err := db.Exec("INSERT INTO chunks(path, offset, length, hash) VALUES (?, ?, ?, ?)",
+			path, chunk.Offset, chunk.Length, chunk.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedDataReport writes how many of the chunked bytes are in chunks that are stored more than once, which is
+// what deduplication could save, followed by the files with the most bytes in chunks that other files have too
+func sharedDataReport(db *sql.DB, w io.Writer, format string) error {
+	parameters, err := getSetting(db, "chunk_parameters")
+	if err != nil {
+		return err
+	}
+	var files, total, unique int64
+	err = db.QueryRow(`
+	SELECT COUNT(DISTINCT path), COALESCE(SUM(length), 0),
+	       COALESCE((SELECT SUM(length) FROM (SELECT MAX(length) AS length FROM chunks GROUP BY hash)), 0)
+	FROM chunks`).Scan(&files, &total, &unique)
+	if err != nil {
+		return err
+	}
+	if parameters == "" {
+		parameters = "none"
+	}
+	_, err = fmt.Fprintf(w, "Chunking: %s\nFiles: %d, chunked bytes: %d, unique bytes: %d, "+
+		"duplicated bytes: %d (%.1f%%)\n\n", parameters, files, total, unique, total-unique,
+		percentage(total-unique, total))
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`
+	SELECT c.path, SUM(c.length), SUM(CASE WHEN shared.files > 1 THEN c.length ELSE 0 END) AS shared_bytes
+	FROM chunks c JOIN (SELECT hash, COUNT(DISTINCT path) AS files FROM chunks GROUP BY hash) shared USING (hash)
+	GROUP BY c.path HAVING shared_bytes > 0
+	ORDER BY shared_bytes DESC, c.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	table := reportTable{Header: []string{"Shared", "Bytes", "Path"}, Text: "%16s %16s  %s\n"}
+	for rows.Next() {
+		var path string
+		var size, shared int64
+		if err := rows.Scan(&path, &size, &shared); err != nil {
+			return err
+		}
+		table.Rows = append(table.Rows, []string{fmt.Sprint(shared), fmt.Sprint(size), path})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeTable(w, table, format)
+}
+
+// percentage returns part as a percentage of total, or 0 if total is 0
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
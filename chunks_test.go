@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkData splits data into chunks, writing it in parts of the given size
+func chunkData(data []byte, part int) []fileChunk {
+	c := newChunker()
+	for i := 0; i < len(data); i += part {
+		_, _ = c.Write(data[i:min(i+part, len(data))])
+	}
+	return c.finish()
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkData(data, 1<<20)
+	var offset int64
+	for i, chunk := range chunks {
+		if chunk.Offset != offset {
+			t.Fatalf("chunk %d starts at %d, want %d", i, chunk.Offset, offset)
+		}
+		if chunk.Length > chunkMaxSize || (chunk.Length < chunkMinSize && i < len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes", i, chunk.Length)
+		}
+		offset += chunk.Length
+	}
+	if offset != int64(len(data)) || len(chunks) < 6 || len(chunks) > 24 {
+		t.Fatalf("got %d chunks covering %d bytes, want about 12 covering %d", len(chunks), offset, len(data))
+	}
+	if split := chunkData(data, 4096+17); len(split) != len(chunks) || split[len(split)/2] != chunks[len(chunks)/2] {
+		t.Errorf("chunks depend on how the data is written")
+	}
+
+	// An insertion only changes the chunk it is in
+	edited := append(append(append([]byte{}, data[:6<<20]...), "inserted"...), data[6<<20:]...)
+	hashes := make(map[string]bool)
+	for _, chunk := range chunks {
+		hashes[chunk.Hash] = true
+	}
+	var changed int
+	for _, chunk := range chunkData(edited, 1<<20) {
+		if !hashes[chunk.Hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("an insertion changed %d chunks, want at most 2", changed)
+	}
+}
+
+func TestSharedDataReport(t *testing.T) {
+	data := make([]byte, 6<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte{}, data[:3<<20]...), "inserted"...), data[3<<20:]...)
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"disk.img", string(data)},
+		{"disk-2.img", string(edited)},
+		{"small.txt", "small"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files crawled without chunks are hashed again to get them, and then skipped
+	opts.ChunkThreshold = 1 << 20
+	if err := initChunking(db); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int64{2, 0} {
+		stats := NewProcessStats()
+		if err := processDirectory(root, db, stats, opts); err != nil {
+			t.Fatal(err)
+		}
+		if counts := stats.rootCounts()[0]; counts.Hashed != expected {
+			t.Errorf("crawl %d with chunks hashed %d files, want %d", i+1, counts.Hashed, expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := sharedDataReport(db, &buf, textFormat); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	if !strings.Contains(report, "Chunking: "+chunkParameters) || !strings.Contains(report, "Files: 2,") ||
+		!strings.Contains(report, filepath.Join(root, "disk.img")) ||
+		!strings.Contains(report, filepath.Join(root, "disk-2.img")) ||
+		strings.Contains(report, "small.txt") || strings.Contains(report, "duplicated bytes: 0 ") {
+		t.Errorf("sharedDataReport() = %q", report)
+	}
+
+	// A file that shrinks below the threshold loses the chunks of its previous contents
+	shrunk := filepath.Join(root, "disk-2.img")
+	if err := os.WriteFile(shrunk, []byte("shrunk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Hour)
+	if err := os.Chtimes(shrunk, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var stale int
+	if err := db.QueryRow("SELECT COUNT(*) FROM chunks WHERE path = ?", shrunk).Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := sharedDataReport(db, &buf, textFormat); err != nil {
+		t.Fatal(err)
+	}
+	if report := buf.String(); stale != 0 || !strings.Contains(report, "Files: 1,") {
+		t.Errorf("got %d chunks for the shrunk file and report %q, want none and 1 chunked file", stale, report)
+	}
+}
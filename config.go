@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// crawlFlags are the crawl flags that resolveOptions turns into crawlOptions
+type crawlFlags struct {
+	DBFile             string
+	LogFile            string
+	ExclusionFile      string
+	ExcludePatterns    []string // Patterns given with -exclude-pattern
+	MaxDBSize          string
+	DoubleBufferSize   string
+	HashAlgorithmsFile string
+	HeadHashSize       string
+	HashProgressSize   string
+	ChunkThreshold     string
+	BundlesAsFiles     bool
+	BundleExtensions   string
+	NoDefaultExcludes  bool
+}
+
+// resolveOptions sets the options derived from flags and the roots: absolute paths, sizes in bytes, the exclusion
+// patterns including the global ones, and the hash rules. It has no side effects, so that -print-config can use
+// it without crawling.
+func resolveOptions(opts *crawlOptions, flags crawlFlags, roots []string) error {
+	dbFile, err := filepath.Abs(flags.DBFile)
+	if err != nil {
+		return fmt.Errorf("getting absolute path for database file %s: %w", flags.DBFile, err)
+	}
+	logFile, err := filepath.Abs(flags.LogFile)
+	if err != nil {
+		return fmt.Errorf("getting absolute path for log file %s: %w", flags.LogFile, err)
+	}
+
+	opts.ExcludePatterns, err = loadExcludePatterns(flags.ExclusionFile, flags.ExcludePatterns, flags.NoDefaultExcludes)
+	if err != nil {
+		return fmt.Errorf("loading exclusion patterns: %w", err)
+	}
+	// The crawl writes these itself, and they are next to the database when it is inside a root
+	checkpointPath := checkpointFile(dbFile)
+	opts.ExcludePatterns = append(opts.ExcludePatterns, dbFile, logFile, checkpointPath, checkpointPath+".tmp")
+
+	opts.DBFile = dbFile
+	opts.LogFile = logFile
+	if flags.MaxDBSize != "" {
+		opts.MaxDBSize, err = parseSize(flags.MaxDBSize)
+		if err != nil {
+			return fmt.Errorf("parsing maximum database size: %w", err)
+		}
+	}
+
+	bufferSize, err := parseSize(flags.DoubleBufferSize)
+	if err != nil {
+		return fmt.Errorf("parsing double buffer size: %w", err)
+	}
+	opts.DoubleBufferSize = int(bufferSize)
+
+	if flags.HeadHashSize != "" {
+		opts.HeadHashSize, err = parseSize(flags.HeadHashSize)
+		if err != nil {
+			return fmt.Errorf("parsing head hash size: %w", err)
+		}
+		if opts.HeadHashSize <= 0 {
+			return fmt.Errorf("head hash size must be positive, got %s", flags.HeadHashSize)
+		}
+	}
+
+	if flags.HashProgressSize != "" {
+		opts.HashProgressSize, err = parseSize(flags.HashProgressSize)
+		if err != nil {
+			return fmt.Errorf("parsing hash progress size: %w", err)
+		}
+	}
+
+	if flags.ChunkThreshold != "" {
+		opts.ChunkThreshold, err = parseSize(flags.ChunkThreshold)
+		if err != nil {
+			return fmt.Errorf("parsing chunk threshold: %w", err)
+		}
+	}
+
+	if flags.HashAlgorithmsFile != "" {
+		opts.HashRules, err = readHashRules(flags.HashAlgorithmsFile)
+		if err != nil {
+			return fmt.Errorf("reading hash algorithms file: %w", err)
+		}
+	}
+
+	if _, ok := similarityAlgorithms[opts.SimilarityDigest]; opts.SimilarityDigest != "" && !ok {
+		return fmt.Errorf("unknown similarity digest %q", opts.SimilarityDigest)
+	}
+
+	opts.BundleExtensions = nil
+	if flags.BundlesAsFiles {
+		opts.BundleExtensions = parseBundleExtensions(flags.BundleExtensions)
+	}
+
+	if opts.MacOSMetadata {
+		opts.Mdls, err = findMdls()
+		if err != nil {
+			return fmt.Errorf("finding mdls for -macos-metadata: %w", err)
+		}
+	}
+
+	opts.Roots = nil
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return fmt.Errorf("getting absolute path for root %s: %w", root, err)
+		}
+		opts.Roots = append(opts.Roots, root)
+		// Resolved symlink targets have no symlinks in them, so the resolved root is needed to compare them
+		if resolved, err := filepath.EvalSymlinks(root); err == nil && resolved != root {
+			opts.Roots = append(opts.Roots, resolved)
+		}
+	}
+	return nil
+}
+
+// effectiveConfig is the configuration a crawl would run with, as printed by -print-config
+type effectiveConfig struct {
+	Flags            map[string]string `json:"flags"` // All flags, including those left at their defaults
+	DBFile           string            `json:"db_file"`
+	LogFile          string            `json:"log_file"`
+	Roots            []string          `json:"roots"` // Absolute roots, followed by their resolved forms if different
+	ExcludePatterns  []string          `json:"exclude_patterns"`
+	HashRules        []hashRule        `json:"hash_rules"`
+	MaxDBSize        int64             `json:"max_db_size"`
+	DoubleBufferSize int               `json:"double_buffer_size"`
+	HeadHashSize     int64             `json:"head_hash_size,omitempty"`
+	BundleExtensions []string          `json:"bundle_extensions,omitempty"`
+}
+
+// printConfig writes the effective configuration of a crawl with opts, resolved by resolveOptions, as JSON
+func printConfig(flags *flag.FlagSet, opts *crawlOptions, w io.Writer) error {
+	config := effectiveConfig{
+		Flags:            make(map[string]string),
+		DBFile:           opts.DBFile,
+		LogFile:          opts.LogFile,
+		Roots:            opts.Roots,
+		ExcludePatterns:  opts.ExcludePatterns,
+		HashRules:        opts.HashRules,
+		MaxDBSize:        opts.MaxDBSize,
+		DoubleBufferSize: opts.DoubleBufferSize,
+		HeadHashSize:     opts.HeadHashSize,
+		BundleExtensions: opts.BundleExtensions,
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		config.Flags[f.Name] = f.Value.String()
+	})
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveOptions(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	hashAlgorithms := filepath.Join(dir, "hash_algorithms.txt")
+	if err := os.WriteFile(hashAlgorithms, []byte("*.jpg=blake3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts crawlOptions
+	resolveFlags := crawlFlags{
+		DBFile:             filepath.Join(dir, "index.sqlite"),
+		LogFile:            filepath.Join(dir, "errors.log"),
+		MaxDBSize:          "1G",
+		DoubleBufferSize:   "4M",
+		HashAlgorithmsFile: hashAlgorithms,
+	}
+	if err := resolveOptions(&opts, resolveFlags, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	flags.String("max-db-size", "", "")
+	if err := flags.Parse([]string{"-max-db-size", "1G"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := printConfig(flags, &opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	var config effectiveConfig
+	if err := json.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRoots := []string{dir}
+	if resolvedDir != dir {
+		expectedRoots = append(expectedRoots, resolvedDir)
+	}
+	expectedExcludes := append(defaultExcludePatterns(), resolveFlags.DBFile, resolveFlags.LogFile,
+		checkpointFile(resolveFlags.DBFile), checkpointFile(resolveFlags.DBFile)+".tmp")
+	expected := effectiveConfig{
+		Flags:            map[string]string{"max-db-size": "1G"},
+		DBFile:           resolveFlags.DBFile,
+		LogFile:          resolveFlags.LogFile,
+		Roots:            expectedRoots,
+		ExcludePatterns:  expectedExcludes,
+		HashRules:        []hashRule{{Pattern: "*.jpg", Algorithm: "blake3"}},
+		MaxDBSize:        1 << 30,
+		DoubleBufferSize: 4 << 20,
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("printConfig() = %+v, want %+v", config, expected)
+	}
+
+	resolveFlags.MaxDBSize = "lots"
+	if err := resolveOptions(&opts, resolveFlags, nil); err == nil {
+		t.Error("resolveOptions() accepted an invalid size")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash"
+	"unicode/utf8"
+)
+
+// contentSampleSize is how many bytes at the start of a file are examined by classifyContent
+const contentSampleSize = 8 * 1024
+
+// maxControlBytes is the fraction of control bytes above which a sample is binary rather than text
+const maxControlBytes = 0.1
+
+// headerCapture keeps the first bytes written to it, up to its limit
+type headerCapture struct {
+	buf   []byte
+	limit int
+}
+
+func (c *headerCapture) Write(p []byte) (int, error) {
+	if room := c.limit - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// capturingHash is a hash that also passes the start of what it hashes to a headerCapture, so that the headers of
+// a file can be read without reading the file again
+type capturingHash struct {
+	hash.Hash
+	capture *headerCapture
+}
+
+func (h capturingHash) Write(p []byte) (int, error) {
+	_, _ = h.capture.Write(p)
+	return h.Hash.Write(p)
+}
+
+// classifyContent returns the content_kind of a file of the given size that starts with sample: "empty", "text"
+// for valid UTF-8 with few control characters, or "binary". Like file(1), only the start of the file is examined,
+// so a text file with binary data further in is text.
+func classifyContent(sample []byte, size int64) string {
+	if size == 0 {
+		return "empty"
+	}
+	sample = sample[:min(len(sample), contentSampleSize)]
+	// The sample may end in the middle of a character
+	if int64(len(sample)) < size {
+		for i := 1; i < utf8.UTFMax && i <= len(sample); i++ {
+			if utf8.RuneStart(sample[len(sample)-i]) {
+				if !utf8.FullRune(sample[len(sample)-i:]) {
+					sample = sample[:len(sample)-i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(sample) {
+		return "binary"
+	}
+	control := 0
+	for _, b := range sample {
+		switch {
+		case b == 0:
+			return "binary"
+		case b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b, b == 0x7f:
+			control++
+		}
+	}
+	if float64(control) > maxControlBytes*float64(len(sample)) {
+		return "binary"
+	}
+	return "text"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestClassifyContent(t *testing.T) {
+	euro := strings.Repeat("€", contentSampleSize/3+1) // The sample ends in the middle of a character
+	testCases := []struct {
+		name     string
+		sample   string
+		size     int64
+		expected string
+	}{
+		{"empty", "", 0, "empty"},
+		{"ascii", "#!/bin/sh\necho hello\n", 21, "text"},
+		{"utf-8", "Grüße\r\n\tcafé", 15, "text"},
+		{"truncated utf-8", euro[:contentSampleSize], int64(len(euro)), "text"},
+		{"invalid utf-8", "caf\xe9", 4, "binary"},
+		{"nul", "text\x00text", 9, "binary"},
+		{"control bytes", "\x01\x02\x03abcdefg", 10, "binary"},
+		{"escape sequences", "\x1b[31mred\x1b[0m\n", 13, "text"},
+	}
+	for _, tc := range testCases {
+		if kind := classifyContent([]byte(tc.sample), tc.size); kind != tc.expected {
+			t.Errorf("%s: classifyContent() = %s, want %s", tc.name, kind, tc.expected)
+		}
+	}
+}
+
+func TestFindContentKind(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"notes", strings.Repeat("a line of notes\n", 100)},
+		{"script.sh", "#!/bin/sh\n"},
+		{"program", "\x7fELF\x02\x01\x01\x00"},
+		{"empty", ""},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		filter   findFilter
+		expected []string
+	}{
+		{findFilter{ContentKind: "text"}, []string{"notes", "script.sh"}},
+		{findFilter{ContentKind: "text", NoExtension: true}, []string{"notes"}},
+		{findFilter{ContentKind: "text", MinSize: 1024}, []string{"notes"}},
+		{findFilter{ContentKind: "binary"}, []string{"program"}},
+		{findFilter{ContentKind: "empty"}, []string{"empty"}},
+	}
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		if err := findFiles(db, tc.filter, &out); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line != "" {
+				names = append(names, line[strings.LastIndex(line, "/")+1:])
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("findFiles(%+v) = %v, want %v", tc.filter, names, tc.expected)
+		}
+	}
+}
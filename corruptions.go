@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// recordCorruption records in the corruptions table that the verify run with the given ID found actualHash and
+// actualModTime for the file of c. A mismatch already recorded and still open only gets a new
+// last_seen, so that verifying again doesn't add duplicates. Entries are never deleted, only resolved with the
+// corruptions subcommand.
+func recordCorruption(db *sql.DB, c verifyCandidate, actualHash, actualModTime string, runId int64, now time.Time) error {
+	seen := now.UTC().Format(time.RFC3339)
+	_, err := db.Exec(`
+	INSERT INTO corruptions(path, detected_at, last_seen, stored_hash, actual_hash, stored_mtime, actual_mtime,
+	                        crawl_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(path, stored_hash, actual_hash) WHERE resolved_at IS NULL DO UPDATE
+	SET last_seen=excluded.last_seen, actual_mtime=excluded.actual_mtime`,
+		c.StoredPath, seen, seen, c.Hash, actualHash, sql.NullString{String: c.ModTime, Valid: c.ModTime != ""},
+		sql.NullString{String: actualModTime, Valid: actualModTime != ""}, sql.NullInt64{Int64: runId, Valid: runId > 0})
+	return err
+}
+
+// countOpenCorruptions returns the number of corruptions that haven't been resolved
+func countOpenCorruptions(db *sql.DB) (int64, error) {
+	var count int64
+	err := db.QueryRow("SELECT COUNT(*) FROM corruptions WHERE resolved_at IS NULL").Scan(&count)
+	return count, err
+}
+
+// openCorruptionsError is returned by verify while there are open corruptions, so that its exit code alerts
+// monitoring until they are resolved
+type openCorruptionsError struct {
+	Count int64
+}
+
+func (e *openCorruptionsError) Error() string {
+	return fmt.Sprintf("%d open corruptions, see the corruptions subcommand", e.Count)
+}
+
+// runCorruptions implements the corruptions subcommand, which lists the mismatches recorded by verify, or resolves
+// them by ID once they have been dealt with
+func runCorruptions(args []string) error {
+	var dbFile string
+	var all bool
+
+	flags := flag.NewFlagSet("corruptions", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.BoolVar(&all, "all", false, "Also list the resolved corruptions")
+	_ = flags.Parse(args)
+
+	action := "list"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+	if (action != "list" && action != "resolve") || (action == "resolve" && flags.NArg() < 2) {
+		fmt.Println("Usage: program corruptions [options] [list | resolve <id> [<id> ...]]")
+		flags.PrintDefaults()
+		return nil
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if action == "list" {
+		return corruptionsReport(db, all, os.Stdout)
+	}
+	var ids []int64
+	for _, arg := range flags.Args()[1:] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid corruption ID %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	resolved, err := resolveCorruptions(db, ids, time.Now())
+	fmt.Printf("Resolved: %d\n", resolved)
+	return err
+}
+
+// corruptionsReport writes the open corruptions, or all of them, oldest first
+func corruptionsReport(db *sql.DB, all bool, w io.Writer) error {
+	condition := "resolved_at IS NULL"
+	if all {
+		condition = "1"
+	}
+	rows, err := db.Query(`
+	SELECT id, path, detected_at, last_seen, stored_hash, actual_hash, COALESCE(stored_mtime, ''),
+	       COALESCE(actual_mtime, ''), COALESCE(resolved_at, '')
+	FROM corruptions WHERE ` + condition + `
+	ORDER BY detected_at, id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		var id int64
+		var path, detectedAt, lastSeen, storedHash, actualHash, storedModTime, actualModTime, resolvedAt string
+		err := rows.Scan(&id, &path, &detectedAt, &lastSeen, &storedHash, &actualHash, &storedModTime,
+			&actualModTime, &resolvedAt)
+		if err != nil {
+			return err
+		}
+		status := "open"
+		if resolvedAt != "" {
+			status = "resolved " + resolvedAt
+		}
+		_, err = fmt.Fprintf(w, "%d %s\n  detected %s, last seen %s, %s\n  stored %s %s\n  actual %s %s\n",
+			id, path, detectedAt, lastSeen, status, storedHash, storedModTime, actualHash, actualModTime)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Corruptions: %d\n", count)
+	return err
+}
+
+// resolveCorruptions marks the open corruptions with the given IDs as resolved at now, and returns how many were
+func resolveCorruptions(db *sql.DB, ids []int64, now time.Time) (int64, error) {
+	var resolved int64
+	for _, id := range ids {
+		res, err := db.Exec("UPDATE corruptions SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL",
+			now.UTC().Format(time.RFC3339), id)
+		if err != nil {
+			return resolved, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return resolved, err
+		}
+		if n == 0 {
+			return resolved, errors.New("no open corruption with ID " + strconv.FormatInt(id, 10))
+		}
+		resolved += n
+	}
+	return resolved, nil
+}
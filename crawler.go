@@ -1,43 +1,290 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"io"
 	"io/fs"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// commands maps subcommand names to their entry points. Anything else on the command line is treated
+// as a list of directories to crawl.
+var commands = map[string]func(args []string) error{
+	"import":         runImport,
+	"estimate":       runEstimate,
+	"report":         runReport,
+	"verify":         runVerify,
+	"find":           runFind,
+	"broken-links":   runBrokenLinks,
+	"export":         runExport,
+	"query":          runQueryCommand,
+	"roots":          runRoots,
+	"note":           runNote,
+	"rewrite-prefix": runRewritePrefix,
+	"convert-hashes": runConvertHashes,
+	"similar-images": runSimilarImages,
+	"similar":        runSimilar,
+	"find-unindexed": runFindUnindexed,
+	"stats-by-type":  runStatsByType,
+	"corruptions":    runCorruptions,
+	"recent":         runRecent,
+	"errors":         runErrors,
+	"dupes":          runDupes,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Printf("Error running %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Process command line arguments
 	var dbFile string
 	var exclusionFile string
+	var excludePatterns patternList
+	var noDefaultExcludes bool
 	var logFileName string
-	var printInterval int
+	printInterval := intervalValue(time.Second)
 	var printErrors bool
-	var retryErrors bool
-	var extraLogging bool
+	var hashAlgorithmsFile string
+	var progressFile string
+	var progressJSONFile string
+	var hashStorageFlag string
+	var maxDBSize string
+	var rotateDB bool
+	var fastHash bool
+	var doubleBufferSize string
+	var onlyErrors bool
+	var printConfigFlag bool
+	var maxDBErrors int
+	var bundlesAsFiles bool
+	var bundleExtensions string
+	var watch bool
+	var reconcileInterval time.Duration
+	var resume bool
+	var resumeFrom string
+	var headHashSize string
+	var hashProgressSize string
+	var chunkThreshold string
+	var referenceDB string
+	var referenceMatch string
+	var linkFarmAware bool
+	var linkFarmFromDB bool
+	var transactionalScan bool
+	var warnAmbiguousPatterns bool
+	var reportFormat string
+	var opts crawlOptions
 
 	flag.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
-	flag.StringVar(&exclusionFile, "exclude", "", "Path to the exclusion file")
+	flag.StringVar(&exclusionFile, "exclude", "", excludeUsage)
+	flag.Var(&excludePatterns, "exclude-pattern", excludePatternUsage)
+	flag.BoolVar(&noDefaultExcludes, "no-default-excludes", false, noDefaultExcludesUsage)
+	flag.BoolVar(&warnAmbiguousPatterns, "warn-ambiguous-patterns", false,
+		"Before crawling, explain how the exclusion patterns without a leading slash match, e.g. that logs "+
+			"excludes every file or directory named logs at any depth, not only the one right below a root")
 	flag.StringVar(&logFileName, "log", "errors.log", "Path to the errors log file")
 	flag.BoolVar(&printErrors, "print-errors", false, "Print errors to stdout in addition to the log file")
-	flag.IntVar(&printInterval, "interval", 1, "Time interval for printing statistics in seconds")
-	flag.BoolVar(&retryErrors, "retry", false, "Retry files that previously caused errors")
-	flag.BoolVar(&extraLogging, "extra-logging", false, "Log extra information such as file read and hash generation speed")
+	flag.Var(&printInterval, "interval", intervalUsage)
+	flag.BoolVar(&opts.RetryErrors, "retry", false, "Retry files that previously caused errors")
+	flag.BoolVar(&onlyErrors, "only-errors", false,
+		"Instead of walking the directories, only process again the paths that previously caused errors, "+
+			"and delete those that no longer exist")
+	flag.BoolVar(&opts.ExtraLogging, "extra-logging", false, "Log extra information such as file read and hash generation speed")
+	flag.StringVar(&hashAlgorithmsFile, "hash-algorithms", "",
+		"Path to a file mapping patterns to hash algorithms, e.g. *.jpg=blake3 (default sha256 for all files). "+
+			"Duplicates can only be found among files hashed with the same algorithm")
+	flag.BoolVar(&opts.SkipUnchangedDirs, "skip-unchanged-dirs", false,
+		"Skip the files of directories whose modification time hasn't changed since the last crawl. "+
+			"Files modified in place don't change their directory's modification time and are missed")
+	flag.Int64Var(&opts.SinceRun, "since-run", 0,
+		"Skip the directories whose tree has the same names as when this crawl run, or a later one, listed it, and "+
+			"whose files were all hashed without an error, with one listing per directory instead of checking each "+
+			"file. Files modified in place keep their names and are missed (default 0, disabled)")
+	flag.StringVar(&progressFile, "progress-file", "",
+		"Path to a file or FIFO to append progress events to as JSON lines")
+	flag.StringVar(&progressJSONFile, "output-progress-json", "",
+		"Path to a file to append the statistics to as a line of JSON every -interval")
+	flag.StringVar(&hashStorageFlag, "hash-storage", "",
+		"How to store hashes in a new database: hex (readable) or blob (raw bytes, half the size). "+
+			"Existing databases keep their storage (default hex for a new database)")
+	flag.StringVar(&maxDBSize, "max-db-size", "",
+		"Stop the crawl when the database grows larger than this size, e.g. 10G (default unlimited)")
+	flag.BoolVar(&rotateDB, "rotate-db", false,
+		"Instead of stopping at -max-db-size, continue in a numbered successor database, e.g. index.001.sqlite")
+	flag.BoolVar(&fastHash, "fast-hash", false,
+		"Use github.com/minio/sha256-simd for sha256 on x86-64; hashes are identical to the standard library")
+	flag.StringVar(&doubleBufferSize, "double-buffer-size", "4M",
+		"Buffer size for reading large files in one goroutine while hashing in another, when reading is slow "+
+			"enough for this to help (0 to disable)")
+	flag.StringVar(&headHashSize, "head-hash", "",
+		"Instead of full hashes, only hash the first bytes of each file, e.g. 64K, into head_hash. This is a single "+
+			"forward read, for quickly bucketing files. A later crawl without it computes the full hashes")
+	flag.BoolVar(&opts.ACLs, "acls", false,
+		"Store POSIX ACLs on Linux and extended ACLs on macOS, for files that have more than the mode bits")
+	flag.BoolVar(&bundlesAsFiles, "bundles-as-files", runtime.GOOS == "darwin",
+		"Store directories with the extensions of -bundle-extensions, such as macOS applications, as single "+
+			"entries with their total size and a hash of their contents, without the files inside them")
+	flag.StringVar(&bundleExtensions, "bundle-extensions", defaultBundleExtensions,
+		"Comma-separated extensions of the directories stored as single entries with -bundles-as-files")
+	flag.BoolVar(&opts.MacOSMetadata, "macos-metadata", false,
+		"Store the Finder comment and the Spotlight content type of files, read with mdls. Only supported on macOS, "+
+			"and slow, since mdls runs for each file")
+	flag.BoolVar(&opts.MediaMetadata, "media-metadata", false,
+		"Store the duration, dimensions and codec of MP4, MOV, MKV, MP3 and FLAC files in the media_info table, "+
+			"parsed from their headers when they are hashed")
+	flag.BoolVar(&opts.EXIF, "exif", false,
+		"Store the EXIF capture time, camera model and whether there is a GPS position of JPEG, HEIC, TIFF and raw "+
+			"photos in the photo_info table, read from the start of the files while they are hashed")
+	flag.BoolVar(&opts.PHash, "phash", false,
+		"Store a perceptual hash of JPEG and PNG images, recognized by their contents, for finding resized and "+
+			"re-encoded copies with similar-images. Decodes each image, which is slow. HEIC isn't supported")
+	flag.StringVar(&opts.SimilarityDigest, "similarity-digest", "",
+		"Also compute a similarity digest of hashed files, for finding files that are mostly the same with similar. "+
+			"ctph is the only algorithm, a context-triggered piecewise hash in the style of ssdeep. Files stored "+
+			"without a digest are hashed again")
+	flag.BoolVar(&opts.StrictSymlinks, "strict-symlinks", false,
+		"Also store the size and modification time of what each chain of symlinks ends at, in target_size and "+
+			"target_mtime, without following the links in the crawl. Broken links are marked by their target_type")
+	flag.StringVar(&opts.Label, "relative", "",
+		"Store paths relative to the root, under this label instead of where the root is mounted, e.g. backup "+
+			"stores /Volumes/Backup/a.jpg as backup:/a.jpg. Needs a single root. A database can't mix absolute and "+
+			"relative paths")
+	flag.StringVar(&resumeFrom, "resume-from-path", "",
+		"Skip everything before this path in the walk of the root that contains it, and crawl from there, e.g. to "+
+			"process a subtree again. The other roots are crawled in full. Can't be combined with -resume")
+	flag.BoolVar(&resume, "resume", false,
+		"Resume the crawl of a root from the checkpoint left next to the database by an unfinished crawl, "+
+			"without asking")
+	flag.DurationVar(&opts.SlowFileThreshold, "slow-file-threshold", 0,
+		"Log the size and speed of files that take longer than this to read and hash, e.g. 30s, and count them in the "+
+			"summary. Slow files are still hashed (default 0, disabled)")
+	flag.StringVar(&hashProgressSize, "hash-progress-for-large-files", "1G",
+		"Show how much of files of at least this size has been hashed, as a percentage after the last processed "+
+			"file (0 to disable)")
+	flag.StringVar(&reportFormat, "report-format", textFormat,
+		"Format of the summary printed at the end of the crawl: text, or markdown for a GitHub-flavored table")
+	flag.StringVar(&chunkThreshold, "chunk-files-above", "",
+		"Also split files of at least this size, e.g. 64M, into content-defined chunks of about 1M while they are "+
+			"hashed, and store the chunk hashes in the chunks table, for the shared-data report. Unchanged files "+
+			"without chunks are hashed again (default disabled)")
+	flag.StringVar(&referenceDB, "exclude-from-db", "",
+		"Path to a reference database, e.g. a master index. Files already indexed there are recorded as excluded "+
+			"instead of being stored, see -exclude-from-db-match. Its paths and hashes are held in memory")
+	flag.StringVar(&referenceMatch, "exclude-from-db-match", "hash",
+		"How files are matched against -exclude-from-db: path (the same stored path, without reading the file), "+
+			"hash (the same contents, wherever they are; files are still hashed), or both (either one)")
+	flag.BoolVar(&linkFarmAware, "hash-link-farm-aware", false,
+		"Hash each file with several hard links once per crawl, and store its hash on every path that links to it, "+
+			"for backups made of hard-linked snapshots such as rsnapshot or Time Machine. The hashes are kept in "+
+			"memory, keyed by device and inode")
+	flag.BoolVar(&linkFarmFromDB, "link-farm-from-db", false,
+		"With -hash-link-farm-aware, also reuse the hashes stored by earlier crawls for the same device and inode, "+
+			"size and modification time, so that a new snapshot isn't hashed again. Only safe while device IDs are "+
+			"stable, which they may not be for network and removable volumes")
+	flag.IntVar(&opts.WarnLongNames, "warn-long-names", 200,
+		"Log a warning for file names longer than this many bytes and set their long_name column, since most file "+
+			"systems limit names to 255 bytes, or 255 UTF-16 code units on Windows (0 to disable)")
+	flag.StringVar(&opts.TracePath, "trace-path", "",
+		"Log every step of processing this file or directory, such as the exclusion check, the stored and current "+
+			"modification times and the results of hashing and storing it, to debug why it isn't indexed as expected")
+	flag.IntVar(&maxDBErrors, "max-db-errors", 1,
+		"Stop the crawl after this many consecutive failed database writes. A successful write resets the count, "+
+			"so that transient failures are skipped, while a full disk still stops the crawl")
+	flag.BoolVar(&watch, "watch", false,
+		"After the crawl, keep the index up to date until interrupted: changes reported by the file system are "+
+			"crawled as they happen (Linux only), and the roots are crawled again every -reconcile-interval")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", time.Hour,
+		"With -watch, how often to crawl the roots again to catch changes the file system didn't report")
+	flag.BoolVar(&transactionalScan, "transactional-scan", false,
+		"Crawl in a single transaction, so that other processes reading the database see the previous index until "+
+			"the crawl commits, instead of a partial one. The write lock is held for the whole crawl, large crawls "+
+			"can block readers too, and an interrupted crawl loses everything, so this is only practical for short "+
+			"crawls. Can't be combined with -rotate-db")
+	flag.BoolVar(&printConfigFlag, "print-config", false,
+		"Print the effective configuration as JSON, including the global exclusion patterns, and exit without crawling")
+	opts.addFlags(flag.CommandLine)
+	addDatabaseFlags(flag.CommandLine)
 	flag.Parse()
 
+	resolveFlags := crawlFlags{
+		DBFile:             dbFile,
+		LogFile:            logFileName,
+		ExclusionFile:      exclusionFile,
+		ExcludePatterns:    excludePatterns,
+		MaxDBSize:          maxDBSize,
+		DoubleBufferSize:   doubleBufferSize,
+		HashAlgorithmsFile: hashAlgorithmsFile,
+		HeadHashSize:       headHashSize,
+		HashProgressSize:   hashProgressSize,
+		ChunkThreshold:     chunkThreshold,
+		BundlesAsFiles:     bundlesAsFiles,
+		BundleExtensions:   bundleExtensions,
+		NoDefaultExcludes:  noDefaultExcludes,
+	}
+	if printConfigFlag {
+		err := resolveOptions(&opts, resolveFlags, flag.Args())
+		if err == nil {
+			err = printConfig(flag.CommandLine, &opts, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(flag.Args()) < 1 {
 		fmt.Println("Usage: program [options] <directory1> [<directory2> ...]")
+		fmt.Println("       program import [options] <file.ndjson>")
+		fmt.Println("       program estimate [options] <directory1> [<directory2> ...]")
+		fmt.Println("       program report [options]")
+		fmt.Println("       program verify [options]")
+		fmt.Println("       program find [options]")
+		fmt.Println("       program broken-links [options]")
+		fmt.Println("       program export [options]")
+		fmt.Println("       program query [options]")
+		fmt.Println("       program roots [options]")
+		fmt.Println("       program note [options]")
+		fmt.Println("       program rewrite-prefix [options] <old prefix> <new prefix>")
+		fmt.Println("       program convert-hashes [options]")
+		fmt.Println("       program similar-images [options]")
+		fmt.Println("       program similar [options]")
+		fmt.Println("       program find-unindexed [options] <root>")
+		fmt.Println("       program stats-by-type [options]")
+		fmt.Println("       program corruptions [options] [list | resolve <id> [<id> ...]]")
+		fmt.Println("       program recent [options]")
+		fmt.Println("       program errors [options]")
+		fmt.Println("       program dupes [options]")
 		flag.PrintDefaults()
 		return
 	}
 
+	if opts.TracePath != "" {
+		tracePath, err := filepath.Abs(opts.TracePath)
+		if err != nil {
+			fmt.Println("Error getting absolute path for -trace-path:", opts.TracePath, err)
+			os.Exit(1)
+		}
+		opts.TracePath = tracePath
+	}
+
 	// Initialize logging
 	logFileName, err := filepath.Abs(logFileName)
 	if err != nil {
@@ -65,17 +312,31 @@ func main() {
 		log.SetOutput(logFile)
 	}
 
-	// Start a goroutine for printing status, unless printInterval is negative
+	if progressFile != "" {
+		progress = newProgressWriter(progressFile)
+		defer progress.Close(5 * time.Second)
+	}
+
+	// Start a goroutine for printing status, unless printInterval is 0 or negative
 	stats := NewProcessStats()
-	if printInterval > 0 {
-		go func() {
-			ticker := time.NewTicker(time.Second * time.Duration(printInterval))
-			startTime := time.Now()
-			stats.Print(startTime)
-			for range ticker.C {
-				stats.Print(startTime)
+	if progressJSONFile != "" {
+		file, err := os.OpenFile(progressJSONFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Println("Error opening progress JSON file:", err)
+			os.Exit(1)
+		}
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				log.Println("Error closing progress JSON file:", err)
 			}
-		}()
+		}(file)
+		stats.ProgressJSON = file
+	}
+	stats.ShowDBMetrics = opts.ExtraLogging
+	startTime := stats.Now()
+	if printInterval > 0 {
+		stats.PrintEvery(time.Duration(printInterval))
 	}
 
 	// Initialize database
@@ -84,71 +345,608 @@ func main() {
 		log.Println("Error getting absolute path for database file:", dbFile, err)
 		os.Exit(1)
 	}
-	db, err := sql.Open("sqlite3", dbFile)
+	db, err := openDatabase(dbFile)
 	if err != nil {
-		log.Println("Error opening database:", err)
+		log.Println(err)
 		os.Exit(1)
 	}
-	defer func(db *sql.DB) {
-		err := db.Close()
+	defer func() { closeDatabase(db) }()
+	// A conflicting -hash-storage would otherwise only show in the log, so it is reported on stdout too
+	err = initHashStorage(db, hashStorageFlag)
+	if err != nil {
+		fmt.Println("Error initializing hash storage:", err)
+		log.Println("Error initializing hash storage:", err)
+		os.Exit(1)
+	}
+	// Mixing absolute and relative paths would make the database inconsistent, so this is reported on stdout too
+	if opts.Label != "" && len(flag.Args()) != 1 {
+		err = errors.New("-relative needs exactly one root")
+	} else if opts.Label != "" {
+		err = checkLabel(opts.Label)
+	}
+	if err == nil {
+		err = initPathMode(db, opts.Label)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		log.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// Exclusion patterns, sizes, hash rules and roots
+	if err := resolveOptions(&opts, resolveFlags, flag.Args()); err != nil {
+		log.Println("Error:", err)
+		os.Exit(1)
+	}
+	if warnAmbiguousPatterns {
+		for _, warning := range ambiguousPatternWarnings(opts.ExcludePatterns) {
+			fmt.Println("Warning:", warning)
+			log.Println("Warning:", warning)
+		}
+	}
+	if opts.MacOSMetadata && opts.Mdls == "" {
+		log.Println("Ignoring -macos-metadata, which is only supported on macOS")
+	}
+	if resumeFrom != "" {
+		if resume || onlyErrors {
+			log.Println("Error: -resume-from-path can't be combined with -resume or -only-errors")
+			os.Exit(1)
+		}
+		if resumeFrom, err = resolveResumeFrom(resumeFrom, flag.Args()); err != nil {
+			log.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+	if transactionalScan && rotateDB {
+		log.Println("Error: -transactional-scan can't be combined with -rotate-db")
+		os.Exit(1)
+	}
+	if linkFarmFromDB && !linkFarmAware {
+		log.Println("Error: -link-farm-from-db needs -hash-link-farm-aware")
+		os.Exit(1)
+	}
+	if linkFarmAware && (opts.SimilarityDigest != "" || opts.ChunkThreshold > 0) {
+		// The hash of another link comes without the digest and the chunks, which only hashing computes
+		log.Println("Error: -hash-link-farm-aware can't be combined with -similarity-digest or -chunk-files-above")
+		os.Exit(1)
+	}
+	if maxDBErrors < 1 {
+		log.Println("Error: -max-db-errors must be at least 1")
+		os.Exit(1)
+	}
+	opts.DBErrors = &dbErrorCounter{Limit: maxDBErrors}
+	if opts.SlowFileThreshold < 0 {
+		log.Println("Error: -slow-file-threshold must not be negative")
+		os.Exit(1)
+	}
+	if watch && reconcileInterval <= 0 {
+		log.Println("Error: -reconcile-interval must be positive")
+		os.Exit(1)
+	}
+	if err := checkReportFormat(reportFormat); err != nil {
+		log.Println("Error:", err)
+		os.Exit(1)
+	}
+	if fastHash {
+		useFastSHA256()
+	}
+	if opts.SinceRun != 0 {
+		if err := checkCrawlRun(db, opts.SinceRun); err != nil {
+			log.Println("Error: -since-run:", err)
+			os.Exit(1)
+		}
+	}
+	if opts.ChunkThreshold > 0 {
+		if err := initChunking(db); err != nil {
+			log.Println("Error recording the chunking parameters:", err)
+			os.Exit(1)
+		}
+	}
+	if linkFarmAware {
+		opts.LinkFarm = newLinkFarmCache(linkFarmFromDB)
+	}
+	if referenceDB != "" {
+		opts.Reference, err = loadReferenceIndex(referenceDB, referenceMatch)
 		if err != nil {
-			log.Println("Error closing database:", err)
+			log.Println("Error loading -exclude-from-db:", err)
+			os.Exit(1)
 		}
-	}(db)
-	err = createSchema(db)
+	}
+
+	if opts.ExtraLogging {
+		opts.Throughput = &throughputHistogram{}
+	}
+
+	process := processDirectory
+	if onlyErrors {
+		process = retryErroredPaths
+	}
+
+	// Crawls record their position next to the database, so that an unfinished one can be resumed
+	checkpointPath := checkpointFile(opts.DBFile)
+	previous, err := readCheckpoint(checkpointPath)
 	if err != nil {
-		log.Println("Error creating schema:", err)
-		os.Exit(1)
+		log.Println("Error reading checkpoint:", err)
+	}
+	if !onlyErrors && !transactionalScan {
+		// A checkpoint of a transactional crawl could point past files that were rolled back
+		opts.CheckpointFile = checkpointPath
 	}
 
-	// Initialize exclusion patterns slice
-	var excludePatterns []string
-	if exclusionFile != "" {
-		excludePatterns = readExcludePatterns(exclusionFile)
+	crawlParams := newCrawlParameters(flag.CommandLine, flag.Args())
+	runId, err := startRun(db, "crawl", crawlParams)
+	if err != nil {
+		log.Println("Error recording the crawl:", err)
+		os.Exit(1)
 	}
+	opts.RunId = runId
 
-	excludePatterns = append(excludePatterns, dbFile)
-	excludePatterns = append(excludePatterns, logFileName)
+	// The crawl writes to scan, which is the database, or its transaction with -transactional-scan
+	var scan crawlDB = db
+	var scanTx *scanTransaction
+	if transactionalScan {
+		if scanTx, err = beginScanTransaction(db); err != nil {
+			log.Println("Error beginning the transaction of the crawl:", err)
+			os.Exit(1)
+		}
+		scan = scanTx
+	}
 
 	// Process each directory
+	stopped := false
 	for _, root := range flag.Args() {
-		err := processDirectory(root, db, stats, excludePatterns, retryErrors, extraLogging)
+		progress.Send(progressEvent{Type: "root-start", Root: root})
+		absRoot, err := filepath.Abs(root)
+		var recorded bool
+		if err == nil {
+			// Decided before the root is recorded, and kept for the whole crawl of the root
+			recorded, err = rootRecorded(scan, storedPath(opts.Label, absRoot, absRoot))
+		}
+		if err == nil {
+			opts.InitialCrawl = !recorded
+			err = recordRoot(scan, storedPath(opts.Label, absRoot, absRoot), absRoot, runId, opts.now())
+		}
+		if err != nil {
+			log.Println("Error recording root:", root, err)
+			os.Exit(1)
+		}
+		if resumeFrom != "" && isUnderRoots(resumeFrom, []string{absRoot}) {
+			log.Println("Crawling", root, "from", resumeFrom)
+			opts.ResumeFrom = resumeFrom
+		} else if previous != nil && previous.Root == absRoot && !onlyErrors {
+			if resume || (isTerminal(os.Stdin) && confirmResume(previous, os.Stdin, os.Stdout)) {
+				log.Println("Resuming", root, "after", previous.LastPath)
+				opts.ResumeAfter = previous.LastPath
+			} else if !isTerminal(os.Stdin) {
+				fmt.Println("Crawling", root, "from the start; use -resume to continue after", previous.LastPath)
+			}
+		}
+		err = process(root, scan, stats, &opts)
+		var full *databaseFullError
+		for rotateDB && errors.As(err, &full) {
+			if err := finishRun(db, runId, stats.rootCounts()); err != nil {
+				log.Println("Error recording the end of the crawl:", err)
+			}
+			db, opts.DBFile, err = rotateDatabase(db, opts.DBFile, dbFile, opts.MaxDBSize)
+			if err != nil {
+				log.Println("Error rotating database:", err)
+				os.Exit(1)
+			}
+			// The successor database stores hashes like the full one, whatever the flag defaulted to
+			err = initHashStorage(db, hashStorage)
+			if err == nil {
+				err = initPathMode(db, opts.Label)
+			}
+			if err != nil {
+				log.Println("Error initializing the database:", err)
+				os.Exit(1)
+			}
+			// The successor database covers the rest of the root, so it gets its own run and root records
+			if runId, err = startRun(db, "crawl", crawlParams); err == nil {
+				opts.RunId = runId
+				err = recordRoot(db, storedPath(opts.Label, absRoot, absRoot), absRoot, runId, opts.now())
+			}
+			if err != nil {
+				log.Println("Error recording the crawl:", err)
+				os.Exit(1)
+			}
+			opts.ExcludePatterns = append(opts.ExcludePatterns, opts.DBFile)
+			opts.ResumeAfter = full.LastPath
+			opts.ResumeFrom = ""
+			scan = db
+			err = process(root, scan, stats, &opts)
+		}
+		opts.ResumeAfter = ""
+		opts.ResumeFrom = ""
+		opts.InitialCrawl = false
+		var dbErrors *tooManyDBErrorsError
+		if errors.As(err, &full) || errors.As(err, &dbErrors) {
+			fmt.Printf("Stopping: %v\n", err)
+			log.Println("Stopping:", err)
+			progress.Send(progressEvent{Type: "error", Root: root, Error: err.Error()})
+			stopped = true
+			break
+		}
 		if err != nil {
 			fmt.Printf("Error processing directory %s: %v\n", root, err)
+			progress.Send(progressEvent{Type: "error", Root: root, Error: err.Error()})
+		} else {
+			if err := removeCheckpoint(checkpointPath); err != nil {
+				log.Println("Error removing checkpoint:", err)
+			}
+			if err := updateTreeHashes(scan, storedPath(opts.Label, absRoot, absRoot)); err != nil {
+				log.Println("Error computing the tree hashes of", root, err)
+			}
+			if err := recordFolderSizes(scan, runId, storedPath(opts.Label, absRoot, absRoot)); err != nil {
+				log.Println("Error recording the folder sizes of", root, err)
+			}
+		}
+		progress.Send(progressEvent{Type: "root-finish", Root: root})
+	}
+
+	if scanTx != nil && stopped {
+		fmt.Println("Rolling back the crawl, the index is left as it was before it")
+		log.Println("Rolling back the crawl")
+		if err := scanTx.Rollback(); err != nil {
+			log.Println("Error rolling back the crawl:", err)
+		}
+	} else if scanTx != nil {
+		if err := scanTx.Commit(); err != nil {
+			fmt.Println("Error committing the crawl:", err)
+			log.Println("Error committing the crawl:", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := finishRun(db, runId, stats.rootCounts()); err != nil {
+		log.Println("Error recording the end of the crawl:", err)
+	}
+
+	rootSummary := stats.rootSummary(reportFormat)
+	fmt.Print(rootSummary)
+	log.Print(rootSummary)
+	log.Println(snapshotDBMetrics())
+	logConnectionStats(db)
+
+	if opts.DBErrors.Total > 0 {
+		fmt.Printf("Database write errors: %d\n", opts.DBErrors.Total)
+		log.Printf("Database write errors: %d\n", opts.DBErrors.Total)
+	}
+
+	if opts.SlowFileThreshold > 0 {
+		var slowFiles int64
+		for _, counts := range stats.rootCounts() {
+			slowFiles += counts.SlowFiles
+		}
+		fmt.Printf("Files slower than %v: %d\n", opts.SlowFileThreshold, slowFiles)
+		log.Printf("Files slower than %v: %d\n", opts.SlowFileThreshold, slowFiles)
+	}
+
+	if opts.LinkFarm != nil {
+		var linked int64
+		for _, counts := range stats.rootCounts() {
+			linked += counts.Linked
+		}
+		fmt.Printf("Hashes reused from hard links: %d\n", linked)
+		log.Printf("Hashes reused from hard links: %d\n", linked)
+	}
+
+	if opts.Throughput != nil {
+		throughput := opts.Throughput.Summary()
+		fmt.Print(throughput)
+		log.Print(throughput)
+	}
+
+	summary := stats.progressEvent("summary", startTime)
+	summary.Dropped = progress.Dropped()
+	summary.Roots = stats.rootCounts()
+	summary.DBErrors = opts.DBErrors.Total
+	metrics := snapshotDBMetrics()
+	summary.DBMetrics = &metrics
+	progress.Send(summary)
+
+	if watch && !stopped {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Println("Watching for changes, press Ctrl-C to stop")
+		opts.CheckpointFile = ""
+		if err := runWatch(ctx, db, stats, &opts, flag.Args(), reconcileInterval); err != nil {
+			fmt.Println("Stopped watching:", err)
+			log.Println("Stopped watching:", err)
 		}
 	}
 }
 
+// openDatabase opens the SQLite database at dbFile and makes sure the schema is up-to-date
+func openDatabase(dbFile string) (*sql.DB, error) {
+	key, err := loadDBKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDatabaseHeader(dbFile, key != nil); err != nil {
+		return nil, err
+	}
+	dsn, err := databaseDSN(dbFile, key)
+	if err != nil {
+		return nil, err
+	}
+	dsn = withBusyTimeout(dsn, dbTimeout)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	err = createSchema(db)
+	var newer *newerSchemaError
+	if errors.As(err, &newer) {
+		closeDatabase(db)
+		return nil, fmt.Errorf("error opening database %s: %w", dbFile, err)
+	} else if err != nil && key != nil {
+		closeDatabase(db)
+		return nil, fmt.Errorf("error creating schema, the database key may be wrong: %w", err)
+	} else if err != nil {
+		closeDatabase(db)
+		return nil, fmt.Errorf("error creating schema: %w", err)
+	}
+	err = loadHashStorage(db)
+	if err == nil {
+		err = loadPathMode(db)
+	}
+	if err != nil {
+		closeDatabase(db)
+		return nil, fmt.Errorf("error loading settings: %w", err)
+	}
+	return db, nil
+}
+
+// withBusyTimeout adds the busy timeout of SQLite to dsn. The driver sets it with PRAGMA busy_timeout on each
+// connection it opens, so that statements retry while another connection holds a lock instead of failing at once
+// with SQLITE_BUSY.
+func withBusyTimeout(dsn string, timeout time.Duration) string {
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%s_busy_timeout=%d", dsn, separator, timeout.Milliseconds())
+}
+
+// openExistingDatabase is like openDatabase, but fails if dbFile doesn't exist. It is used by commands that
+// only read the index.
+func openExistingDatabase(dbFile string) (*sql.DB, error) {
+	dbFile, err := filepath.Abs(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, err
+	}
+	return openDatabase(dbFile)
+}
+
+func closeDatabase(db *sql.DB) {
+	err := db.Close()
+	if err != nil {
+		log.Println("Error closing database:", err)
+	}
+}
+
+// crawlOptions holds the settings of a crawl
+type crawlOptions struct {
+	walkOptions
+	HashRules    []hashRule
+	RetryErrors  bool
+	ExtraLogging bool
+	// SkipUnchangedDirs skips the files of directories whose modification time hasn't changed since they were
+	// processed. Files modified in place don't change the modification time of their directory, so changes to them
+	// are missed.
+	SkipUnchangedDirs bool
+	// SinceRun skips the directories whose signature, see folderSignature, is the one recorded in this run or a
+	// later one, and whose files are all hashed. Like SkipUnchangedDirs, it misses files modified in place.
+	SinceRun          int64
+	RunId             int64                // ID of the run of the crawl, which records the folder signatures
+	DBFile            string               // Path of the database, used to check its size
+	LogFile           string               // Path of the log file, which is excluded from the crawl
+	MaxDBSize         int64                // Stop the crawl with databaseFullError when the database grows larger, 0 for unlimited
+	ResumeAfter       string               // Skip everything up to and including this path
+	ResumeFrom        string               // Skip everything before this path
+	DoubleBufferSize  int                  // Buffer size for overlapping reads with hashing of large files, 0 to disable
+	Roots             []string             // Absolute paths of all roots of the crawl, for detecting external symlinks
+	ACLs              bool                 // Store the ACLs of files that have non-trivial ones
+	BundleExtensions  []string             // Extensions of the directories stored as single entries, see isBundle
+	MacOSMetadata     bool                 // Store the Finder comments and content types of files on macOS
+	MediaMetadata     bool                 // Store the duration, dimensions and codec of audio and video files
+	EXIF              bool                 // Store the capture time, camera model and GPS presence of photos
+	StrictSymlinks    bool                 // Store the size and modification time of the targets of symlinks
+	PHash             bool                 // Store the perceptual hashes of JPEG and PNG images, see dHash
+	SimilarityDigest  string               // Key of similarityAlgorithms for the digests of hashed files, "" for none
+	Mdls              string               // Path of mdls with MacOSMetadata, "" if it is unavailable
+	Throughput        *throughputHistogram // Collects the read speeds measured with ExtraLogging, if not nil
+	Label             string               // Store paths relative to the root under this label, "" for absolute paths
+	CheckpointFile    string               // Where to record the position of the crawl regularly, "" for nowhere
+	HeadHashSize      int64                // Only hash this many bytes at the start of files, into HeadHash, 0 for full hashes
+	DBErrors          *dbErrorCounter      // Counts failed database writes across roots, nil to stop at the first one
+	SlowFileThreshold time.Duration        // Log the files that take longer than this to read and hash, 0 to disable
+	Now               func() time.Time     // Clock used for timing, time.Now if nil
+	InitialCrawl      bool                 // Whether this is the first crawl of the root, see firstSeenTime
+	TracePath         string               // Absolute path whose processing is logged step by step, "" for none
+	WarnLongNames     int                  // Flag and log the names longer than this many bytes, 0 to disable
+	HashProgressSize  int64                // Show the hashing progress of files at least this large, 0 to disable
+	ChunkThreshold    int64                // Store the content-defined chunks of files at least this large, 0 to disable
+	Reference         *referenceIndex      // Files already indexed in -exclude-from-db, which are excluded, or nil
+	LinkFarm          *linkFarmCache       // Hashes of hard-linked files with -hash-link-farm-aware, or nil
+}
+
+func (opts *crawlOptions) now() time.Time {
+	if opts.Now == nil {
+		return time.Now()
+	}
+	return opts.Now()
+}
+
+// trace logs a step of processing path if it is TracePath, for finding out why a single file isn't indexed as
+// expected without the volume of ExtraLogging
+func (opts *crawlOptions) trace(path string, v ...any) {
+	if opts.TracePath != "" && path == opts.TracePath {
+		log.Println(append([]any{"TRACE", path + ":"}, v...)...)
+	}
+}
+
 // processDirectory walks the directory tree and processes each file
-func processDirectory(root string, db *sql.DB, stats *ProcessStats, excludePatterns []string, retryErrors bool, extraLogging bool) error {
-	root, err := filepath.Abs(root)
+func processDirectory(root string, db crawlDB, stats *ProcessStats, opts *crawlOptions) error {
+	walk, err := opts.newRoot(root)
 	if err != nil {
-		log.Println("Error getting absolute path for root:", root, err)
+		log.Println("Error initializing root:", root, err)
 		return err
 	}
+	walk.Label = opts.Label
+	return processTree(walk, walk.Path, db, stats, opts)
+}
+
+// processTree walks the tree at start, which is the root of walk or a path below it, and processes each file
+func processTree(walk *walkRoot, start string, db crawlDB, stats *ProcessStats, opts *crawlOptions) error {
+	// Paths that previously caused errors are skipped
+	var erroredPaths map[string]bool
+	var err error
+	if !opts.RetryErrors {
+		erroredPaths, err = loadErroredPaths(db, walk.storedPath(start))
+		if err != nil {
+			log.Println("Error loading errored paths for root:", start, err)
+			return err
+		}
+	}
+
+	firstSeen := firstSeenTime(opts.InitialCrawl, opts.now())
+
+	dirModTimes := make(map[string]string) // Modification times of the visited directories
+	unchangedDirs := make(map[string]bool) // Directories whose files are skipped
+	cache := &directoryEntries{limit: maxCachedEntries}
+	sinceRun := newSinceRunCheck(db, opts)
+	dbErrors := opts.DBErrors
+	if dbErrors == nil {
+		dbErrors = &dbErrorCounter{Limit: 1}
+	}
+	resumeAfter := opts.ResumeAfter
+	resumeFrom := opts.ResumeFrom
+	previousPath := ""
+	visited := 0
+	counts := stats.root(walk.Path)
+	startTime := opts.now()
+	lastCheckpoint := startTime
+	defer func() { counts.ElapsedSeconds += opts.now().Sub(startTime).Seconds() }()
+
+	err = filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		var f *FileInfo
+		defer func() {
+			if f != nil && f.Error.Valid {
+				atomic.AddInt64(&counts.Errors, 1)
+			}
+		}()
+
+		if resumeFrom != "" {
+			switch walkOrder(path, resumeFrom) {
+			case ancestorOfTarget:
+				return nil
+			case beforeTarget:
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			default:
+				resumeFrom = ""
+			}
+		}
+		if resumeAfter != "" {
+			switch walkOrder(path, resumeAfter) {
+			case ancestorOfTarget:
+				return nil
+			case beforeTarget:
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			case atTarget:
+				resumeAfter = ""
+				return nil
+			case afterTarget:
+				resumeAfter = ""
+			}
+		}
+
+		if err := dbErrors.check(); err != nil {
+			return err
+		}
+		visited++
+		if opts.MaxDBSize > 0 && visited%1000 == 0 {
+			size, err := databaseSize(opts.DBFile)
+			if err != nil {
+				log.Println("Error getting database size:", err)
+			} else if size >= opts.MaxDBSize && previousPath != "" {
+				return &databaseFullError{LastPath: previousPath}
+			}
+		}
+		if opts.CheckpointFile != "" && previousPath != "" && opts.now().Sub(lastCheckpoint) >= checkpointInterval {
+			lastCheckpoint = opts.now()
+			cp := checkpoint{Root: walk.Path, LastPath: previousPath, Timestamp: lastCheckpoint.Format(time.RFC3339)}
+			if err := writeCheckpoint(opts.CheckpointFile, cp); err != nil {
+				log.Println("Error writing checkpoint:", err)
+			}
+		}
+		previousPath = path
+		f = NewFileInfo(path, walk.storedPath(path), d)
+		f.dbErrors = dbErrors
+		f.FirstSeen = firstSeen
+		f.runId = opts.RunId
+		f.now = opts.now
+		cache.leave(f.Path.String)
 
-	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		f := NewFileInfo(path, d)
+		// Skip files that previously caused errors. This comes first, so that nothing below replaces their
+		// row, and with it the stored error, unless they are retried. WalkDir reports an unreadable directory
+		// a second time with the error, which would otherwise overwrite the original one.
+		if erroredPaths[f.Path.String] {
+			opts.trace(path, "skipped, it caused an error in a previous crawl and -retry isn't set")
+			counts.Skipped++
+			return nil
+		}
 
 		if err != nil {
+			opts.trace(path, "error walking:", err)
 			f.WriteError("walking file:", err, db)
 			return nil
 		}
 
-		// Skip files that previously caused errors
-		if !retryErrors {
-			var storedError string
-			err = db.QueryRow(
-				"SELECT error FROM files WHERE path=? AND error IS NOT NULL",
-				path).Scan(&storedError)
-			if err == nil {
-				return nil
-			}
+		if unchangedDirs[filepath.Dir(path)] && !d.IsDir() {
+			opts.trace(path, "skipped, its directory is unchanged")
+			counts.Skipped++
+			return nil
 		}
 
-		if f.UpdateFolderId(db) != nil || f.UpdateInfo(db) != nil {
+		if err := f.UpdateFolderId(db); err != nil {
+			opts.trace(path, "UpdateFolderId failed:", err)
+			return nil
+		}
+		if err := f.UpdateInfo(db); err != nil {
+			opts.trace(path, "UpdateInfo failed:", err)
 			return nil
 		}
+		f.CheckNameLength(opts.WarnLongNames)
+		opts.trace(path, "UpdateInfo: size", f.Size, "modification time", f.ModificationTime.String, "mode",
+			f.ModeString.String, "symlink", f.Symlink.String)
+
+		if parentModTime, ok := dirModTimes[filepath.Dir(path)]; ok {
+			f.ParentModTime = sql.NullString{String: parentModTime, Valid: true}
+		}
+		if f.Dir {
+			dirModTimes[path] = f.ModificationTime.String
+		}
+		f.Depth = sql.NullInt64{Int64: int64(walk.depth(path)), Valid: true}
+		if opts.ACLs && !f.Symlink.Valid {
+			f.UpdateACL()
+		}
+		if opts.Mdls != "" && !f.Symlink.Valid {
+			f.UpdateSpotlightMetadata(opts.Mdls)
+		}
+		if f.Symlink.Valid {
+			f.UpdateSymlinkChain(opts.Roots, opts.StrictSymlinks)
+		}
 
 		// skip the FIFO
 		if f.isFifo {
@@ -156,34 +954,223 @@ func processDirectory(root string, db *sql.DB, stats *ProcessStats, excludePatte
 			return nil
 		}
 
-		if match, pattern := isExcluded(path, excludePatterns); match {
+		match, pattern := opts.isExcluded(path, f.attributes())
+		opts.trace(path, "exclusion check: excluded", match, "pattern", pattern)
+		if match {
 			f.ExclusionPattern = sql.NullString{String: pattern, Valid: true}
-			f.WriteToDatabase(db)
+			opts.trace(path, "WriteToDatabase:", f.WriteToDatabase(db))
+			counts.Excluded++
+			return nil
+		}
+		if !f.Dir {
+			if ext := opts.excludedExtension(path); ext != "" {
+				f.ExclusionPattern = sql.NullString{String: "ext:" + ext, Valid: true}
+				opts.trace(path, "excluded by extension", ext, "WriteToDatabase:", f.WriteToDatabase(db))
+				counts.Excluded++
+				return nil
+			}
+			if reason := opts.excludedOwner(f.UID, f.GID); reason != "" {
+				f.ExclusionPattern = sql.NullString{String: reason, Valid: true}
+				opts.trace(path, "excluded by owner", f.UID.Int64, "WriteToDatabase:", f.WriteToDatabase(db))
+				counts.Excluded++
+				return nil
+			}
+		}
+
+		if !f.Dir && opts.Reference.hasPath(f.Path.String) {
+			f.ExclusionPattern = sql.NullString{String: "ref-db:path", Valid: true}
+			opts.trace(path, "in -exclude-from-db, WriteToDatabase:", f.WriteToDatabase(db))
+			counts.Excluded++
 			return nil
 		}
 
+		// Directories that exclude themselves with a marker file are recorded, but not descended into
+		if f.Dir && path != walk.Path {
+			if marker := opts.excludingMarker(path); marker != "" {
+				f.ExclusionPattern = sql.NullString{String: marker, Valid: true}
+				opts.trace(path, "excluded by marker", marker, "WriteToDatabase:", f.WriteToDatabase(db))
+				counts.Excluded++
+				return filepath.SkipDir
+			}
+		}
+
+		// A bundle is stored as a single entry, with its contents taking the place of a file's. It is hashed again
+		// when anything inside it is newer than the stored entry.
+		next := error(nil) // What to return once f is processed
+		var contents *bundleContents
+		if f.Dir && path != walk.Path && isBundle(path, opts.BundleExtensions) {
+			contents, err = f.UpdateBundle(db)
+			if err != nil {
+				return filepath.SkipDir
+			}
+			next = filepath.SkipDir
+		}
+
 		if f.Dir || f.Symlink.String != "" {
-			f.WriteToDatabase(db)
+			opts.trace(path, "WriteToDatabase:", f.WriteToDatabase(db))
+			if f.Dir && !walk.descend(path, f.device) {
+				opts.trace(path, "not descending into it")
+				return filepath.SkipDir
+			}
+			if f.Dir {
+				entries, err := cache.enter(db, f.Path.String)
+				if err != nil {
+					log.Println("Error loading directory entries:", path, err)
+				} else if unchanged, skipped := sinceRun.unchanged(path, f.Path.String, entries); unchanged {
+					opts.trace(path, "skipped, the signatures of its tree are unchanged since run", opts.SinceRun)
+					counts.Skipped += skipped
+					return filepath.SkipDir
+				} else if opts.SkipUnchangedDirs {
+					unchanged, hasSubdirs := directoryUnchanged(entries, f.ModificationTime.String)
+					if unchanged && !hasSubdirs {
+						counts.Skipped += int64(len(entries))
+						return filepath.SkipDir
+					} else if unchanged {
+						unchangedDirs[path] = true
+					}
+				}
+			}
 			return nil
 		}
 
 		// Update statistics
 		stats.Update(path, f.Size)
+		if opts.HashProgressSize > 0 && f.Size >= opts.HashProgressSize {
+			f.hashProgress = stats
+		}
 
 		// Check if file already exists in database
-		var storedModTime string
-		err = db.QueryRow("SELECT modification_time FROM files WHERE path=?", path).Scan(&storedModTime)
-		if extraLogging {
-			log.Println("Path: ", f.Path.String, "stored mod time: ", storedModTime, "new mod time: ", f.ModificationTime.String)
+		stored, found, loaded := cache.lookup(f.Path.String)
+		if !loaded {
+			stored, found, err = loadStoredEntry(db, f.Path.String)
+			if err != nil {
+				log.Println("Error loading stored entry:", path, err)
+			}
 		}
-		if err == nil && storedModTime == f.ModificationTime.String {
-			return nil
+		if opts.ExtraLogging {
+			log.Println("Path: ", f.Path.String, "stored mod time: ", stored.ModificationTime, "new mod time: ", f.ModificationTime.String)
+		}
+		opts.trace(path, "stored: found", found, "failed", stored.Failed, "modification time", stored.ModificationTime,
+			"current modification time", f.ModificationTime.String)
+		if found && !stored.Failed && stored.ModificationTime == f.ModificationTime.String &&
+			stored.hashedFor(opts.HeadHashSize) &&
+			(opts.HeadHashSize > 0 || f.Bundle ||
+				(stored.digestedFor(opts.SimilarityDigest) && stored.chunkedFor(opts.ChunkThreshold, f.Size))) {
+			if stored.ParentModTime != f.ParentModTime || stored.Mode != f.Mode ||
+				stored.ExternalSymlink != f.ExternalSymlink || (opts.ACLs && stored.ACL != f.ACL) ||
+				stored.Depth != f.Depth || stored.TargetType != f.TargetType || stored.LongName != f.LongName ||
+				stored.UID != f.UID || stored.GID != f.GID || stored.DevID != f.DevID || stored.Inode != f.Inode ||
+				(opts.Mdls != "" && (stored.MacOSComment != f.MacOSComment || stored.ContentType != f.ContentType)) {
+				f.UpdateMetadata(db)
+			}
+			if opts.MediaMetadata && isMediaFile(f.Type.String) {
+				if has, err := hasMediaInfo(db, f.Path.String); err == nil && !has {
+					f.UpdateMediaInfo(nil)
+					f.WriteMediaInfo(db)
+				}
+			}
+			if opts.PHash && f.Category.String == "image" {
+				if needed, err := needsPHash(db, f.Path.String); err == nil && needed {
+					f.UpdatePHash(nil)
+					f.WritePHash(db)
+				}
+			}
+			if opts.EXIF && isPhotoFile(f.Type.String) {
+				if has, err := hasPhotoInfo(db, f.Path.String); err == nil && !has {
+					f.UpdatePhotoInfo(nil)
+					f.WritePhotoInfo(db)
+				}
+			}
+			opts.trace(path, "skipped, unchanged since it was hashed")
+			counts.Skipped++
+			return next
 		}
 
-		if f.UpdateHash(db, extraLogging) != nil {
-			return nil
+		hashedBytes := f.Size
+		var hashStart time.Time
+		if opts.SlowFileThreshold > 0 {
+			hashStart = opts.now()
 		}
-		f.WriteToDatabase(db)
-		return nil
+		if f.Bundle {
+			err := f.UpdateBundleHash(db, opts, contents)
+			opts.trace(path, "UpdateBundleHash:", f.Hash.String, err)
+			if err != nil {
+				return next
+			}
+		} else if opts.HeadHashSize > 0 {
+			err := f.UpdateHeadHash(db, opts)
+			opts.trace(path, "UpdateHeadHash:", f.HeadHash.String, err)
+			if err != nil {
+				return nil
+			}
+			hashedBytes = min(f.Size, opts.HeadHashSize)
+		} else {
+			if opts.LinkFarm.apply(db, f, hashAlgorithmFor(f.Path.String, opts.HashRules)) {
+				opts.trace(path, "hash of another link to the same file:", f.Hash.String)
+				counts.Linked++
+				hashedBytes = 0
+			} else {
+				err := f.UpdateHash(db, opts)
+				opts.trace(path, "UpdateHash:", f.Hash.String, err)
+				if err != nil {
+					return nil
+				}
+				opts.LinkFarm.add(f)
+			}
+			// A file whose contents are in the reference database keeps its hash, so that it isn't hashed again
+			// while it is unchanged
+			if opts.Reference.hasHash(f.HashAlgorithm.String, f.Hash.String) {
+				f.ExclusionPattern = sql.NullString{String: "ref-db:hash", Valid: true}
+				opts.trace(path, "in -exclude-from-db, WriteToDatabase:", f.WriteToDatabase(db))
+				counts.Excluded++
+				return next
+			}
+		}
+		if opts.SlowFileThreshold > 0 {
+			if elapsed := opts.now().Sub(hashStart); elapsed > opts.SlowFileThreshold {
+				logSlowFile(f.Path.String, hashedBytes, elapsed)
+				counts.SlowFiles++
+			}
+		}
+		opts.trace(path, "WriteToDatabase:", f.WriteToDatabase(db))
+		f.WriteMediaInfo(db)
+		f.WritePhotoInfo(db)
+		f.WriteChunks(db)
+		counts.Hashed++
+		counts.Bytes += hashedBytes
+		return next
 	})
+	if err == nil {
+		err = dbErrors.check()
+	}
+	return err
+}
+
+// loadErroredPaths returns the set of paths under root that have a stored error
+func loadErroredPaths(db crawlDB, root string) (map[string]bool, error) {
+	paths, err := listErroredPaths(db, root)
+	if err != nil {
+		return nil, err
+	}
+	erroredPaths := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		erroredPaths[path.Path] = true
+	}
+	return erroredPaths, nil
+}
+
+// underRootCondition selects the paths equal to or below a root, using the index on path. Its arguments
+// are returned by underRootArgs.
+const underRootCondition = "(path = ? OR (path >= ? AND path < ?))"
+
+// finalTargetUnderCondition is underRootCondition for the final targets of symlinks
+const finalTargetUnderCondition = "(final_target = ? OR (final_target >= ? AND final_target < ?))"
+
+func underRootArgs(root string) []any {
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	// "0" is the character following "/"
+	return []any{root, prefix, prefix[:len(prefix)-1] + "0"}
 }
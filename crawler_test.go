@@ -1,7 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestFilepathMatch(t *testing.T) {
@@ -22,6 +33,10 @@ func TestFilepathMatch(t *testing.T) {
 		{"/a/*/b/*", "/a/x/b/d", true},             // Test matching a relative multi-folder pattern
 		{"/a/*/b/*", "/a/b/c/d", false},            // Test not matching any pattern with a subfolder
 		{"/logs/*.txt", "/a/logs/file.txt", false}, // Test not matching any pattern with a subfolder
+		{"*.tar.gz", "/a/b.tar.gz", true},          // Test matching an extension with a dot
+		{"*.txt", "/a/.txt", true},                 // Test matching an empty name before the extension
+		{"*.tx?", "/a/b.txt", true},                // Test matching an extension with a wildcard
+		{"*.txt", "/a/b.txt/c", false},             // Test not matching a directory above the file
 
 		// Patterns ending with a slash should  match both a directory and files under the directory
 		{".git/", "/a/.git/b", true},
@@ -58,8 +73,492 @@ func TestIsExcluded(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		if matched, _ := isExcluded(tc.path, excludePatterns); matched != tc.expected {
+		if matched, _ := isExcluded(tc.path, nil, excludePatterns); matched != tc.expected {
 			t.Errorf("isExcluded(%q, %q) = %v, want %v", tc.path, excludePatterns, matched, tc.expected)
 		}
 	}
 }
+
+func TestIsExcludedNegation(t *testing.T) {
+	excludePatterns := []string{"*.log", "/tmp/", "!/tmp/keep/", "!important.log", "/tmp/keep/*.tmp"}
+
+	testCases := []struct {
+		path     string
+		expected bool
+		pattern  string
+	}{
+		{"/a/debug.log", true, "*.log"},
+		{"/a/important.log", false, ""},                 // Re-included by a later negation
+		{"/tmp/file", true, "/tmp/"},                    // Not affected by the negations
+		{"/tmp/keep/file", false, ""},                   // Re-included directory contents
+		{"/tmp/keep/file.tmp", true, "/tmp/keep/*.tmp"}, // Excluded again after the negation
+		{"/tmp/keep/important.log", false, ""},
+	}
+
+	for _, tc := range testCases {
+		if matched, pattern := isExcluded(tc.path, nil, excludePatterns); matched != tc.expected || pattern != tc.pattern {
+			t.Errorf("isExcluded(%q) = %v, %q, want %v, %q", tc.path, matched, pattern, tc.expected, tc.pattern)
+		}
+	}
+}
+
+func TestParsePatternLine(t *testing.T) {
+	testCases := []struct {
+		line       string
+		pattern    string
+		qualifiers []patternQualifier
+	}{
+		{"*.iso", "*.iso", nil},
+		{"*.iso size>4G", "*.iso", []patternQualifier{{Op: ">", Value: 4 << 30}}},
+		{"tmp/**  age>=365d", "tmp/**", []patternQualifier{{Age: true, Op: ">=", Value: int64(365 * 24 * time.Hour)}}},
+		{"*.log size<1K age>30d", "*.log",
+			[]patternQualifier{{Op: "<", Value: 1024}, {Age: true, Op: ">", Value: int64(30 * 24 * time.Hour)}}},
+		{"My Documents/", "My Documents/", nil},
+		{"!keep.iso size<=1M", "!keep.iso", []patternQualifier{{Op: "<=", Value: 1 << 20}}},
+		{"sizes.txt", "sizes.txt", nil},
+	}
+	for _, tc := range testCases {
+		pattern, qualifiers, err := parsePatternLine(tc.line)
+		if err != nil || pattern != tc.pattern || !reflect.DeepEqual(qualifiers, tc.qualifiers) {
+			t.Errorf("parsePatternLine(%q) = %q, %+v, %v, want %q, %+v",
+				tc.line, pattern, qualifiers, err, tc.pattern, tc.qualifiers)
+		}
+	}
+
+	for _, line := range []string{"*.iso size>4X", "*.iso size=4G", "*.iso age>soon", "size>4G", "size>1 age>1d"} {
+		if _, _, err := parsePatternLine(line); err == nil {
+			t.Errorf("parsePatternLine(%q) succeeded, want an error", line)
+		}
+	}
+}
+
+func TestAmbiguousPatternWarnings(t *testing.T) {
+	warnings := ambiguousPatternWarnings([]string{
+		"*.tmp", "/var/log", "logs", "!cache/", "build/out age>30d", "*.iso size>4G",
+	})
+	expected := []string{`"logs" has no slash`, `"!cache/" has no slash`, `"build/out age>30d" doesn't start`}
+	if len(warnings) != len(expected) {
+		t.Fatalf("ambiguousPatternWarnings() = %q, want %d warnings", warnings, len(expected))
+	}
+	for i, warning := range warnings {
+		if !strings.Contains(warning, expected[i]) {
+			t.Errorf("warning %d = %q, want it to contain %q", i, warning, expected[i])
+		}
+	}
+	if !strings.Contains(warnings[0], "/path/to/root/logs") || !strings.Contains(warnings[2], "a/build/out") {
+		t.Errorf("ambiguousPatternWarnings() = %q, want examples of how the patterns match", warnings)
+	}
+}
+
+func TestIsExcludedQualifiers(t *testing.T) {
+	patterns := []string{"*.iso size>4G", "tmp/* age>365d", "!tmp/keep.* size<1K"}
+	old := time.Now().Add(-2 * 365 * 24 * time.Hour)
+	testCases := []struct {
+		path     string
+		file     *fileAttributes
+		expected string
+	}{
+		{"/a/big.iso", &fileAttributes{Size: 5 << 30, ModTime: time.Now()}, "*.iso size>4G"},
+		{"/a/small.iso", &fileAttributes{Size: 1 << 30, ModTime: time.Now()}, ""},
+		{"/a/unknown.iso", nil, ""},
+		{"/a/tmp/old.txt", &fileAttributes{Size: 10, ModTime: old}, "tmp/* age>365d"},
+		{"/a/tmp/new.txt", &fileAttributes{Size: 10, ModTime: time.Now()}, ""},
+		{"/a/tmp/keep.txt", &fileAttributes{Size: 10, ModTime: old}, ""},
+		{"/a/tmp/keep.bin", &fileAttributes{Size: 1 << 20, ModTime: old}, "tmp/* age>365d"},
+	}
+
+	m := NewExclusionMatcher(patterns)
+	for _, tc := range testCases {
+		if excluded, pattern := isExcluded(tc.path, tc.file, patterns); excluded != (tc.expected != "") ||
+			pattern != tc.expected {
+			t.Errorf("isExcluded(%q) = %v, %q, want %q", tc.path, excluded, pattern, tc.expected)
+		}
+		if excluded, pattern := m.IsExcluded(tc.path, tc.file); excluded != (tc.expected != "") ||
+			pattern != tc.expected {
+			t.Errorf("IsExcluded(%q) = %v, %q, want %q", tc.path, excluded, pattern, tc.expected)
+		}
+	}
+}
+
+func TestReadExcludePatternsInvalidQualifier(t *testing.T) {
+	exclusionFile := filepath.Join(t.TempDir(), "exclude.txt")
+	if err := os.WriteFile(exclusionFile, []byte("*.tmp\n# Comment\n*.iso size>4X\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := readExcludePatterns(exclusionFile)
+	if err == nil || !strings.Contains(err.Error(), "exclude.txt:3:") || patterns != nil {
+		t.Errorf("readExcludePatterns() = %q, %v, want an error for line 3", patterns, err)
+	}
+}
+
+func TestLoadGlobalExcludePatterns(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	if patterns, err := loadGlobalExcludePatterns(); patterns != nil || err != nil {
+		t.Errorf("loadGlobalExcludePatterns() without a config file = %q, %v, want nil", patterns, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(configHome, "crawler"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(configHome, "crawler", "exclude"), []byte("# Global\n.git/\n*.tmp\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclusionFile := filepath.Join(t.TempDir(), "exclude.txt")
+	if err := os.WriteFile(exclusionFile, []byte("!keep.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{".git/", "*.tmp", "!keep.tmp"}
+	if patterns, err := loadExcludePatterns(exclusionFile, nil, true); err != nil || !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("loadExcludePatterns() = %q, %v, want %q", patterns, err, expected)
+	}
+
+	// The defaults of the platform come first, so that any other pattern can re-include what they exclude
+	withDefaults := append(defaultExcludePatterns(), expected...)
+	if patterns, err := loadExcludePatterns(exclusionFile, nil, false); err != nil ||
+		!reflect.DeepEqual(patterns, withDefaults) {
+		t.Errorf("loadExcludePatterns() with the defaults = %q, %v, want %q", patterns, err, withDefaults)
+	}
+
+	// Patterns given with -exclude-pattern come last, so they can re-include paths too
+	var extra patternList
+	for _, value := range []string{"*.iso size>4G", "!important.tmp"} {
+		if err := extra.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := extra.Set("*.iso size>4X"); err == nil {
+		t.Error("Set() accepted an invalid qualifier")
+	}
+	expected = append(expected, "*.iso size>4G", "!important.tmp")
+	if patterns, err := loadExcludePatterns(exclusionFile, extra, true); err != nil || !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("loadExcludePatterns() with -exclude-pattern = %q, %v, want %q", patterns, err, expected)
+	}
+}
+
+func TestLoadErroredPaths(t *testing.T) {
+	db := newTestDatabase(t)
+	for path, storedError := range map[string]any{
+		"/a":       "walking file",
+		"/a/b":     nil,
+		"/a/b/c":   "opening file",
+		"/a/bc":    "opening file",
+		"/a0":      "opening file",
+		"/other/c": "opening file",
+	} {
+		if _, err := db.Exec("INSERT INTO files(path, error) VALUES (?, ?)", path, storedError); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		root     string
+		expected map[string]bool
+	}{
+		{"/a", map[string]bool{"/a": true, "/a/b/c": true, "/a/bc": true}},
+		{"/a/b", map[string]bool{"/a/b/c": true}},
+		{"/", map[string]bool{"/a": true, "/a/b/c": true, "/a/bc": true, "/a0": true, "/other/c": true}},
+	}
+
+	for _, tc := range testCases {
+		erroredPaths, err := loadErroredPaths(db, tc.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(erroredPaths, tc.expected) {
+			t.Errorf("loadErroredPaths(%q) = %v, want %v", tc.root, erroredPaths, tc.expected)
+		}
+	}
+}
+
+func TestProcessDirectory(t *testing.T) {
+	root := t.TempDir()
+	binary := string([]byte{0x00, 0xff, 0x10, 0x80, 0x7f})
+	writeFiles(t, root, [][2]string{
+		{"a.txt", "hello"},
+		{"sub/b.jpg", "not really a photo"},
+		{"empty", ""},
+		{"data.bin", binary},
+		{"debug.log", "excluded"},
+	})
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1, ExcludePatterns: []string{"*.log"}}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name, hash, symlink, exclusion string
+		size                           int64
+		dir                            bool
+	}
+	rows, err := db.Query(`SELECT path, COALESCE(name, ''), COALESCE(hash, ''), COALESCE(symlink, ''),
+	       COALESCE(exclusion_pattern, ''), COALESCE(size, 0), dir FROM files`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	entries := make(map[string]entry)
+	for rows.Next() {
+		var path string
+		var e entry
+		if err := rows.Scan(&path, &e.name, &e.hash, &e.symlink, &e.exclusion, &e.size, &e.dir); err != nil {
+			t.Fatal(err)
+		}
+		entries[path] = e
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	sha := func(content string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(content))) }
+	expected := map[string]entry{
+		"a.txt":     {name: "a.txt", hash: sha("hello"), size: 5},
+		"sub/b.jpg": {name: "b.jpg", hash: sha("not really a photo"), size: 18},
+		"empty":     {name: "empty", hash: sha("")},
+		"data.bin":  {name: "data.bin", hash: sha(binary), size: 5},
+		"debug.log": {name: "debug.log", exclusion: "*.log", size: 8},
+	}
+	for rel, want := range expected {
+		got, ok := entries[filepath.Join(root, rel)]
+		if !ok {
+			t.Errorf("%s is missing from the database", rel)
+			continue
+		}
+		if got != want {
+			t.Errorf("got %+v for %s, want %+v", got, rel, want)
+		}
+	}
+	if link := entries[filepath.Join(root, "link")]; link.symlink != "a.txt" || link.hash != "" {
+		t.Errorf("got %+v for the symlink, want its target and no hash", link)
+	}
+	if sub := entries[filepath.Join(root, "sub")]; !sub.dir || sub.name != "sub" {
+		t.Errorf("got %+v for the subdirectory, want a directory", sub)
+	}
+	if root := entries[root]; !root.dir {
+		t.Errorf("got %+v for the root, want a directory", root)
+	}
+	if len(entries) != len(expected)+3 {
+		t.Errorf("got %d entries, want %d", len(entries), len(expected)+3)
+	}
+}
+
+func TestProcessDirectoryKeepsStoredErrors(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(sub, "file.txt")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const storedError = "walking file:: open sub: permission denied"
+	for _, path := range []string{sub, file} {
+		if _, err := db.Exec("INSERT INTO files(path, error) VALUES (?, ?)", path, storedError); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storedErrors := func() map[string]string {
+		rows, err := db.Query("SELECT path, error FROM files WHERE error IS NOT NULL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		result := make(map[string]string)
+		for rows.Next() {
+			var path, message string
+			if err := rows.Scan(&path, &message); err != nil {
+				t.Fatal(err)
+			}
+			result[path] = message
+		}
+		return result
+	}
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{sub: storedError, file: storedError}
+	if got := storedErrors(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("after a normal crawl, got errors %v, want %v", got, expected)
+	}
+
+	opts.RetryErrors = true
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedErrors(); len(got) != 0 {
+		t.Errorf("after a crawl with retry, got errors %v, want none", got)
+	}
+}
+
+func TestProcessDirectoryHeadHash(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	for name, content := range map[string]string{"a": "same start, then a", "b": "same start, then b", "c": "same"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes := func() map[string][2]string {
+		rows, err := db.Query("SELECT name, COALESCE(hash, ''), COALESCE(head_hash, '') FROM files WHERE dir = 0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		result := make(map[string][2]string)
+		for rows.Next() {
+			var name string
+			var h [2]string
+			if err := rows.Scan(&name, &h[0], &h[1]); err != nil {
+				t.Fatal(err)
+			}
+			result[name] = h
+		}
+		return result
+	}
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, HeadHashSize: 10}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	got := hashes()
+	if got["a"][0] != "" || got["a"][1] == "" || got["a"][1] != got["b"][1] || got["a"][1] == got["c"][1] {
+		t.Errorf("after a head hash crawl, got hashes %q, want equal head hashes only for a and b", got)
+	}
+
+	// A full crawl computes the missing hashes, and a later head hash crawl keeps them
+	for _, headHashSize := range []int64{0, 10} {
+		opts.HeadHashSize = headHashSize
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		got = hashes()
+		if got["a"][0] == "" || got["a"][0] == got["b"][0] {
+			t.Errorf("after a crawl with head hash size %d, got hashes %q, want different full hashes",
+				headHashSize, got)
+		}
+	}
+}
+
+func TestProcessDirectoryExcludedExtensions(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"disk.ISO", "image"},
+		{"images.iso/file.txt", "data"},
+		{"download.part", "partial"},
+		{"notes.txt", "notes"},
+	})
+
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := opts.ExcludeExtensions.Set("iso,part"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"disk.ISO": "ext:iso", "download.part": "ext:part", "notes.txt": "", "images.iso": "", "images.iso/file.txt": "",
+	}
+	for path, pattern := range expected {
+		var got sql.NullString
+		err := db.QueryRow("SELECT exclusion_pattern FROM files WHERE path = ?", filepath.Join(root, path)).Scan(&got)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if got.String != pattern {
+			t.Errorf("%s has exclusion pattern %q, want %q", path, got.String, pattern)
+		}
+	}
+}
+
+func TestProcessDirectorySlowFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"a.txt", "a"}, {"b.txt", "b"}})
+
+	// Every reading of the clock advances it by a second, so every file takes longer than the threshold
+	clock := time.Now()
+	opts := &crawlOptions{
+		walkOptions:       walkOptions{MaxDepth: -1},
+		SlowFileThreshold: 500 * time.Millisecond,
+		Now: func() time.Time {
+			clock = clock.Add(time.Second)
+			return clock
+		},
+	}
+	stats := NewProcessStats()
+	if err := processDirectory(root, newTestDatabase(t), stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := stats.rootCounts(); len(counts) != 1 || counts[0].SlowFiles != 2 || counts[0].Hashed != 2 {
+		t.Errorf("got counts %+v, want 2 slow files, still hashed", counts)
+	}
+
+	// A threshold that isn't reached counts nothing
+	opts.SlowFileThreshold = time.Hour
+	stats = NewProcessStats()
+	if err := processDirectory(root, newTestDatabase(t), stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := stats.rootCounts(); len(counts) != 1 || counts[0].SlowFiles != 0 {
+		t.Errorf("got counts %+v, want no slow files", counts)
+	}
+}
+
+func TestProcessDirectoryErrorTime(t *testing.T) {
+	root := t.TempDir()
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, Now: func() time.Time { return at }}
+	db := newTestDatabase(t)
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var errorAt sql.NullString
+	err := db.QueryRow("SELECT error_at FROM files WHERE path = ?", filepath.Join(root, "fifo")).Scan(&errorAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errorAt.String != "2024-03-01T08:30:00Z" {
+		t.Errorf("error_at = %v, want the time of the crawl clock", errorAt)
+	}
+}
+
+func TestProcessDirectoryTracePath(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"traced.txt", "traced"}, {"other.txt", "other"}})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	traced := filepath.Join(root, "traced.txt")
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, TracePath: traced}
+	db := newTestDatabase(t)
+	for i := 0; i < 2; i++ {
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, step := range []string{"UpdateInfo: size 6", "exclusion check: excluded false", "UpdateHash:",
+		"WriteToDatabase: <nil>", "skipped, unchanged since it was hashed"} {
+		if !strings.Contains(logged.String(), "TRACE "+traced+": "+step) {
+			t.Errorf("log doesn't trace %q:\n%s", step, logged.String())
+		}
+	}
+	if strings.Contains(logged.String(), "other.txt") {
+		t.Errorf("log traces other.txt:\n%s", logged.String())
+	}
+}
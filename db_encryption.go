@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// dbKeyEnv is the environment variable holding the database key when -db-key-file isn't given
+const dbKeyEnv = "CRAWLER_DB_KEY"
+
+// dbKeyFile is the file holding the key of an encrypted database, set by -db-key-file. The key itself is never
+// given on the command line, where other users could see it.
+var dbKeyFile string
+
+// dbTimeout is how long a statement waits for a lock held by another connection or process before failing with
+// "database is locked", set by -db-timeout
+var dbTimeout = 30 * time.Second
+
+// addDatabaseFlags registers -db-key-file and -db-timeout, which every command opening a database accepts
+func addDatabaseFlags(flags *flag.FlagSet) {
+	flags.StringVar(&dbKeyFile, "db-key-file", "",
+		"File with the key of an encrypted database, as 64 hex characters, e.g. from openssl rand -hex 32 "+
+			"(default $"+dbKeyEnv+"). Needs a build with -tags sqlcipher")
+	flags.DurationVar(&dbTimeout, "db-timeout", dbTimeout,
+		"How long to wait for a lock held by another process using the database, such as a crawl or a query, "+
+			"before failing; 0 fails at once")
+}
+
+// loadDBKey returns the 32-byte database key from -db-key-file or the environment, or nil if there is none
+func loadDBKey() ([]byte, error) {
+	encoded := os.Getenv(dbKeyEnv)
+	source := "$" + dbKeyEnv
+	if dbKeyFile != "" {
+		data, err := os.ReadFile(dbKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading database key: %w", err)
+		}
+		encoded, source = string(data), dbKeyFile
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the database key in %s must be 64 hex characters", source)
+	}
+	return key, nil
+}
+
+// sqliteHeader starts every plain SQLite database. Encrypted databases look like random bytes instead.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// checkDatabaseHeader returns a clear error if the database at dbFile exists but is encrypted while no key is
+// given, or the other way round, rather than leaving SQLite to fail with "file is not a database"
+func checkDatabaseHeader(dbFile string, encrypted bool) error {
+	file, err := os.Open(dbFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(file, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil // A new, empty database
+	} else if err != nil {
+		return err
+	}
+	plain := bytes.Equal(header, sqliteHeader)
+	if !plain && !encrypted {
+		return fmt.Errorf("%s is encrypted or not a database; give its key with -db-key-file or $%s", dbFile, dbKeyEnv)
+	}
+	if plain && encrypted {
+		return fmt.Errorf("%s is not encrypted, but a database key was given", dbFile)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDBKey(t *testing.T) {
+	t.Cleanup(func() { dbKeyFile = "" })
+	hexKey := strings.Repeat("0f", 32)
+
+	t.Setenv(dbKeyEnv, "")
+	if key, err := loadDBKey(); key != nil || err != nil {
+		t.Errorf("loadDBKey() without a key = %x, %v, want nil", key, err)
+	}
+
+	t.Setenv(dbKeyEnv, hexKey)
+	if key, err := loadDBKey(); err != nil || !bytes.Equal(key, bytes.Repeat([]byte{0x0f}, 32)) {
+		t.Errorf("loadDBKey() from the environment = %x, %v, want %s", key, err, hexKey)
+	}
+
+	// The key file takes precedence over the environment
+	dbKeyFile = filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(dbKeyFile, []byte("not hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDBKey(); err == nil {
+		t.Error("loadDBKey() accepted an invalid key")
+	}
+}
+
+func TestCheckDatabaseHeader(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.sqlite")
+	db, err := openDatabase(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeDatabase(db)
+	encrypted := filepath.Join(dir, "encrypted.sqlite")
+	if err := os.WriteFile(encrypted, bytes.Repeat([]byte{0xa5}, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.sqlite")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		file      string
+		encrypted bool
+		valid     bool
+	}{
+		{plain, false, true},
+		{plain, true, false},
+		{encrypted, false, false},
+		{encrypted, true, true},
+		{empty, false, true},
+		{filepath.Join(dir, "missing.sqlite"), true, true},
+	}
+	for _, tc := range testCases {
+		if err := checkDatabaseHeader(tc.file, tc.encrypted); (err == nil) != tc.valid {
+			t.Errorf("checkDatabaseHeader(%s, %v) = %v, want valid %v", filepath.Base(tc.file), tc.encrypted, err, tc.valid)
+		}
+	}
+
+	if _, err := openDatabase(encrypted); err == nil || !strings.Contains(err.Error(), "-db-key-file") {
+		t.Errorf("openDatabase() of an encrypted database without a key = %v, want an error mentioning -db-key-file", err)
+	}
+}
+
+func TestDBTimeout(t *testing.T) {
+	t.Cleanup(func() { dbTimeout = 30 * time.Second })
+	dbFile := filepath.Join(t.TempDir(), "index.sqlite")
+	open := func(timeout time.Duration) *sql.DB {
+		t.Helper()
+		dbTimeout = timeout
+		db, err := openDatabase(dbFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { closeDatabase(db) })
+		return db
+	}
+	crawl := open(time.Second)
+	var timeout int
+	if err := crawl.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 1000 {
+		t.Errorf("busy_timeout = %d, %v, want 1000", timeout, err)
+	}
+
+	// A write waits for the lock of another process, until it is released or the timeout passes
+	tx, err := beginScanTransaction(crawl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impatient, patient := open(0), open(5*time.Second)
+	if _, err := impatient.Exec("INSERT INTO settings(key, value) VALUES ('a', '1')"); err == nil {
+		t.Error("a write without a timeout didn't fail while the database was locked")
+	}
+	time.AfterFunc(200*time.Millisecond, func() { _ = tx.Commit() })
+	if _, err := patient.Exec("INSERT INTO settings(key, value) VALUES ('b', '2')"); err != nil {
+		t.Errorf("a write with a timeout failed: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "fmt"
+
+// dbErrorCounter counts the failed database writes of a crawl, so that it can continue past a transient failure
+// but stops on a systemic one, such as a full disk
+type dbErrorCounter struct {
+	Limit       int   // Number of consecutive failures that stop the crawl
+	Total       int64 // Number of failures during the whole crawl
+	consecutive int
+	last        error
+}
+
+// record counts the outcome of a database write. A successful write, with a nil err, resets the number of
+// consecutive failures. It does nothing on a nil counter.
+func (c *dbErrorCounter) record(err error) {
+	if c == nil {
+		return
+	}
+	if err == nil {
+		c.consecutive = 0
+		return
+	}
+	c.Total++
+	c.consecutive++
+	c.last = err
+}
+
+// check returns a tooManyDBErrorsError once the limit of consecutive failures is reached
+func (c *dbErrorCounter) check() error {
+	if c == nil || c.consecutive < c.Limit {
+		return nil
+	}
+	return &tooManyDBErrorsError{Count: c.consecutive, Last: c.last}
+}
+
+// tooManyDBErrorsError stops a crawl after too many consecutive failed database writes
+type tooManyDBErrorsError struct {
+	Count int
+	Last  error
+}
+
+func (e *tooManyDBErrorsError) Error() string {
+	if e.Count == 1 {
+		return fmt.Sprintf("database write failed: %v", e.Last)
+	}
+	return fmt.Sprintf("%d consecutive database writes failed, the last one with: %v", e.Count, e.Last)
+}
+
+func (e *tooManyDBErrorsError) Unwrap() error {
+	return e.Last
+}
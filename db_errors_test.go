@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessDirectoryDBErrors(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "bad1", "bad2", "c", "d"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		limit    int
+		stopped  bool
+		stored   int // Files stored below root, excluding root itself
+		failures int64
+	}{
+		{3, false, 3, 2},
+		{2, true, 1, 2}, // Stops after bad2, before c
+		{1, true, 1, 1},
+	}
+	for _, tc := range testCases {
+		db := newTestDatabase(t)
+		// Writes of the files starting with "bad" fail, as they would on a full disk
+		_, err := db.Exec(`
+		CREATE TRIGGER fail_bad BEFORE INSERT ON files WHEN NEW.name LIKE 'bad%'
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, DBErrors: &dbErrorCounter{Limit: tc.limit}}
+		err = processDirectory(root, db, NewProcessStats(), opts)
+		var dbErrors *tooManyDBErrorsError
+		if errors.As(err, &dbErrors) != tc.stopped {
+			t.Errorf("with limit %d, processDirectory() = %v, want stopped %v", tc.limit, err, tc.stopped)
+		}
+		if opts.DBErrors.Total != tc.failures {
+			t.Errorf("with limit %d, counted %d failures, want %d", tc.limit, opts.DBErrors.Total, tc.failures)
+		}
+
+		var stored int
+		if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path != ?", root).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored != tc.stored {
+			t.Errorf("with limit %d, %d files were stored, want %d", tc.limit, stored, tc.stored)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// dbMetrics counts the database work of the crawl, for tuning and for diagnosing slow crawls with -extra-logging.
+// There is no separate cache of folder IDs: the folders table is the cache, so a hit is a getFolderID call whose
+// folder already exists, and a miss one that has to create it or one of its ancestors.
+var dbMetrics struct {
+	folderCacheHits   atomic.Int64
+	folderCacheMisses atomic.Int64
+	dbQueryCount      atomic.Int64 // Lookups of folders and stored entries
+	dbInsertCount     atomic.Int64 // Rows of files and folders written
+}
+
+// dbMetricsSnapshot is the JSON form of dbMetrics, in the summary of -progress-file
+type dbMetricsSnapshot struct {
+	FolderCacheHits   int64 `json:"folder_cache_hits"`
+	FolderCacheMisses int64 `json:"folder_cache_misses"`
+	Queries           int64 `json:"queries"`
+	Inserts           int64 `json:"inserts"`
+}
+
+// snapshotDBMetrics returns the current values of dbMetrics
+func snapshotDBMetrics() dbMetricsSnapshot {
+	return dbMetricsSnapshot{
+		FolderCacheHits:   dbMetrics.folderCacheHits.Load(),
+		FolderCacheMisses: dbMetrics.folderCacheMisses.Load(),
+		Queries:           dbMetrics.dbQueryCount.Load(),
+		Inserts:           dbMetrics.dbInsertCount.Load(),
+	}
+}
+
+// String formats the metrics for the status line
+func (m dbMetricsSnapshot) String() string {
+	hitRate := 0.0
+	if lookups := m.FolderCacheHits + m.FolderCacheMisses; lookups > 0 {
+		hitRate = 100 * float64(m.FolderCacheHits) / float64(lookups)
+	}
+	return fmt.Sprintf("Folder cache: %.1f%% hits, DB queries: %d, inserts: %d", hitRate, m.Queries, m.Inserts)
+}
+
+// logConnectionStats logs the state of the connection pool of db, whose waits show whether the goroutines of the
+// crawl are starved of connections
+func logConnectionStats(db *sql.DB) {
+	s := db.Stats()
+	log.Printf("Database connections: %d open, %d in use, %d idle, %d waits for %v\n",
+		s.OpenConnections, s.InUse, s.Idle, s.WaitCount, s.WaitDuration)
+}
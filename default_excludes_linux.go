@@ -0,0 +1,9 @@
+//go:build linux
+
+package main
+
+// defaultExcludePatterns returns the paths that are never crawled unless -no-default-excludes is given: the
+// virtual file systems of the kernel and the devices, whose files have no stable contents and may block when read
+func defaultExcludePatterns() []string {
+	return []string{"/proc", "/sys", "/dev"}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// defaultExcludePatterns returns no paths, since there are no known virtual file systems to avoid outside Unix
+func defaultExcludePatterns() []string {
+	return nil
+}
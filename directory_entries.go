@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// storedEntry is the stored state of a path, used to detect changes
+type storedEntry struct {
+	ModificationTime string
+	ParentModTime    sql.NullString
+	Size             int64
+	Dir              bool
+	Mode             sql.NullInt64
+	ExternalSymlink  sql.NullBool
+	ACL              sql.NullString
+	Depth            sql.NullInt64
+	TargetType       sql.NullString
+	MacOSComment     sql.NullString
+	ContentType      sql.NullString
+	Hashed           bool          // Whether the full hash is stored
+	HeadHashSize     sql.NullInt64 // Number of bytes covered by the stored head hash, if any
+	Failed           bool          // Whether an error is stored, in which case the file is processed again
+	LongName         bool
+	FuzzyAlgorithm   sql.NullString // Algorithm of the stored similarity digest, if any
+	UID              sql.NullInt64
+	GID              sql.NullInt64
+	DevID            sql.NullInt64
+	Inode            sql.NullInt64
+	Chunked          bool // Whether chunks are stored
+	Symlink          bool
+	Excluded         bool
+	Bundle           bool
+}
+
+// hashedFor reports whether the entry has the hash a crawl with the given head hash size would compute. A full hash
+// is good enough for a head hash crawl, but a head hash doesn't replace a full one.
+func (e storedEntry) hashedFor(headHashSize int64) bool {
+	return e.Hashed || (headHashSize > 0 && e.HeadHashSize.Valid && e.HeadHashSize.Int64 == headHashSize)
+}
+
+// digestedFor reports whether the entry has the similarity digest of the given algorithm, which is always the case
+// for crawls without one
+func (e storedEntry) digestedFor(algorithm string) bool {
+	return algorithm == "" || e.FuzzyAlgorithm.String == algorithm
+}
+
+// chunkedFor reports whether the entry has the chunks a crawl with the given -chunk-files-above would compute, for
+// a file of the given size
+func (e storedEntry) chunkedFor(threshold, size int64) bool {
+	return threshold <= 0 || size < threshold || e.Chunked
+}
+
+// completeFor reports whether nothing is left to do for the entry in a crawl with the given head hash size: it has
+// no error, and it is hashed unless it is a directory, a symlink or excluded
+func (e storedEntry) completeFor(headHashSize int64) bool {
+	return !e.Failed && (e.Dir || e.Symlink || e.Excluded || e.hashedFor(headHashSize))
+}
+
+// storedEntryColumns are the columns scanned by scanStoredEntry
+const storedEntryColumns = "COALESCE(modification_time, ''), parent_mtime, COALESCE(size, 0), COALESCE(dir, 0), mode, external_symlink, acl, depth, target_type, macos_comment, content_type, hash IS NOT NULL, head_hash_size, error IS NOT NULL, COALESCE(long_name, 0), fuzzy_algorithm, uid, gid, dev_id, inode, EXISTS (SELECT 1 FROM chunks WHERE chunks.path = files.path), COALESCE(symlink, '') != '', exclusion_pattern IS NOT NULL, COALESCE(bundle, 0)"
+
+func scanStoredEntry(scan func(dest ...any) error, path *string, entry *storedEntry) error {
+	return scan(path, &entry.ModificationTime, &entry.ParentModTime, &entry.Size, &entry.Dir, &entry.Mode,
+		&entry.ExternalSymlink, &entry.ACL, &entry.Depth, &entry.TargetType, &entry.MacOSComment,
+		&entry.ContentType, &entry.Hashed, &entry.HeadHashSize, &entry.Failed, &entry.LongName,
+		&entry.FuzzyAlgorithm, &entry.UID, &entry.GID, &entry.DevID, &entry.Inode, &entry.Chunked, &entry.Symlink,
+		&entry.Excluded, &entry.Bundle)
+}
+
+// maxCachedEntries bounds the number of stored entries a crawl keeps in memory, about 200 bytes each
+const maxCachedEntries = 1 << 20
+
+// directoryEntries caches the stored entries of the directories between the root and the current path, so that
+// each directory needs a single query rather than one per child. A directory's entries are discarded as soon as
+// the walk leaves it. Directories whose entries would take the cache over its limit are not cached, and their
+// children are looked up one by one.
+type directoryEntries struct {
+	dirs    []string
+	entries []map[string]storedEntry // nil for directories that are not cached
+	limit   int                      // Maximum number of entries held, 0 for no limit
+	size    int
+}
+
+// enter loads the stored entries of the directory at path
+func (c *directoryEntries) enter(db crawlDB, path string) (map[string]storedEntry, error) {
+	entries, err := loadDirectoryEntries(db, path)
+	if err != nil {
+		return nil, err
+	}
+	c.dirs = append(c.dirs, path)
+	if c.limit > 0 && c.size+len(entries) > c.limit {
+		c.entries = append(c.entries, nil)
+	} else {
+		c.entries = append(c.entries, entries)
+		c.size += len(entries)
+	}
+	return entries, nil
+}
+
+// loadDirectoryEntries queries the stored entries of the children of the directory at path, by path
+func loadDirectoryEntries(db crawlDB, path string) (map[string]storedEntry, error) {
+	folderId, err := getFolderID(db, path)
+	if err != nil {
+		return nil, err
+	}
+	dbMetrics.dbQueryCount.Add(1)
+	rows, err := db.Query("SELECT path, "+storedEntryColumns+" FROM files WHERE folder_id = ?", folderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]storedEntry)
+	for rows.Next() {
+		var childPath string
+		var entry storedEntry
+		if err := scanStoredEntry(rows.Scan, &childPath, &entry); err != nil {
+			return nil, err
+		}
+		entries[childPath] = entry
+	}
+	return entries, rows.Err()
+}
+
+// leave discards the entries of the directories that don't contain path
+func (c *directoryEntries) leave(path string) {
+	parent := filepath.Dir(path)
+	for n := len(c.dirs); n > 0; n = len(c.dirs) {
+		dir := c.dirs[n-1]
+		if dir == parent || dir == "/" || strings.HasPrefix(parent, dir+"/") {
+			return
+		}
+		c.size -= len(c.entries[n-1])
+		c.dirs = c.dirs[:n-1]
+		c.entries = c.entries[:n-1]
+	}
+}
+
+// lookup returns the stored entry for path, whether it exists, and whether the entries of its directory are loaded
+func (c *directoryEntries) lookup(path string) (entry storedEntry, found bool, loaded bool) {
+	n := len(c.dirs)
+	if n == 0 || c.dirs[n-1] != filepath.Dir(path) || c.entries[n-1] == nil {
+		return storedEntry{}, false, false
+	}
+	entry, found = c.entries[n-1][path]
+	return entry, found, true
+}
+
+// loadStoredEntry queries the stored entry for a single path
+func loadStoredEntry(db execQuerier, path string) (storedEntry, bool, error) {
+	var entry storedEntry
+	dbMetrics.dbQueryCount.Add(1)
+	err := scanStoredEntry(db.QueryRow("SELECT path, "+storedEntryColumns+" FROM files WHERE path=?", path).Scan,
+		&path, &entry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	}
+	return entry, err == nil, err
+}
+
+// directoryUnchanged reports whether all stored entries of a directory were processed while the directory
+// had the given modification time, and whether any of them is a directory
+func directoryUnchanged(entries map[string]storedEntry, modificationTime string) (unchanged bool, hasSubdirs bool) {
+	for _, entry := range entries {
+		if entry.ParentModTime.String != modificationTime || !entry.ParentModTime.Valid {
+			return false, false
+		}
+		hasSubdirs = hasSubdirs || entry.Dir
+	}
+	return len(entries) > 0, hasSubdirs
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDirectoryEntries(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, dir := range []string{"/a", "/a/b", "/a/c"} {
+		folderId, err := getFolderID(db, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO files(path, modification_time, folder_id) VALUES (?, ?, ?)",
+			dir+"/file", "2023-01-01T00:00:00Z", folderId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := &directoryEntries{}
+	for _, dir := range []string{"/a", "/a/b"} {
+		cache.leave(dir)
+		if _, err := cache.enter(db, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.leave("/a/b/file")
+	if entry, found, loaded := cache.lookup("/a/b/file"); !found || !loaded || entry.ModificationTime == "" {
+		t.Errorf("lookup(/a/b/file) = %+v, %v, %v, want a loaded entry", entry, found, loaded)
+	}
+	if _, found, loaded := cache.lookup("/a/b/missing"); found || !loaded {
+		t.Errorf("lookup(/a/b/missing) = %v, %v, want not found in loaded entries", found, loaded)
+	}
+
+	// Leaving /a/b for a sibling keeps the entries of /a
+	cache.leave("/a/file")
+	if _, found, loaded := cache.lookup("/a/file"); !found || !loaded {
+		t.Errorf("lookup(/a/file) = %v, %v, want a loaded entry", found, loaded)
+	}
+	cache.leave("/a/c/file")
+	if _, _, loaded := cache.lookup("/a/c/file"); loaded {
+		t.Error("lookup(/a/c/file) is loaded, but /a/c was never entered")
+	}
+	if len(cache.dirs) != 1 {
+		t.Errorf("cache holds %q, want only /a", cache.dirs)
+	}
+}
+
+func TestDirectoryEntriesLimit(t *testing.T) {
+	db := newTestDatabase(t)
+	for dir, files := range map[string]int{"/a": 2, "/a/b": 2, "/a/c": 1} {
+		folderId, err := getFolderID(db, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < files; i++ {
+			_, err = db.Exec("INSERT INTO files(path, modification_time, folder_id) VALUES (?, ?, ?)",
+				fmt.Sprintf("%s/file%d", dir, i), "2023-01-01T00:00:00Z", folderId)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cache := &directoryEntries{limit: 3}
+	for _, dir := range []string{"/a", "/a/b"} {
+		cache.leave(dir)
+		entries, err := cache.enter(db, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("enter(%s) returned %d entries, want 2", dir, len(entries))
+		}
+	}
+	if _, _, loaded := cache.lookup("/a/b/file0"); loaded {
+		t.Error("lookup(/a/b/file0) is loaded, but /a/b is over the limit")
+	}
+
+	// Leaving /a/b frees room for /a/c
+	cache.leave("/a/c")
+	if _, err := cache.enter(db, "/a/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, loaded := cache.lookup("/a/c/file0"); !found || !loaded {
+		t.Errorf("lookup(/a/c/file0) = %v, %v, want a loaded entry", found, loaded)
+	}
+	if cache.size != 3 {
+		t.Errorf("cache holds %d entries, want 3", cache.size)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"hash"
+	"io"
+	"time"
+)
+
+// probeDuration is how long hashReader reads and hashes sequentially to decide whether double buffering pays off
+const probeDuration = 100 * time.Millisecond
+
+// chunk is a buffer filled by the reading goroutine of hashReader
+type chunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// hashReader writes everything from r to h using buffers of bufferSize. It starts by reading and hashing
+// sequentially, timing both. If after probeDuration reading takes at least a quarter of the time, i.e. hashing isn't
+// the only bottleneck as it usually is on SSDs, the rest is read by a goroutine into one buffer while the other is
+// being hashed.
+func hashReader(h hash.Hash, r io.Reader, bufferSize int, now func() time.Time) (int64, error) {
+	var total int64
+	var readTime, hashTime time.Duration
+	buf := make([]byte, bufferSize)
+
+	for readTime+hashTime < probeDuration {
+		start := now()
+		n, err := io.ReadFull(r, buf)
+		read := now()
+		h.Write(buf[:n])
+		readTime += read.Sub(start)
+		hashTime += now().Sub(read)
+		total += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+
+	if 4*readTime < readTime+hashTime {
+		n, err := io.CopyBuffer(h, r, buf)
+		return total + n, err
+	}
+
+	free := make(chan []byte, 2)
+	full := make(chan chunk, 2)
+	free <- buf
+	free <- make([]byte, bufferSize)
+	defer close(free)
+
+	go func() {
+		defer close(full)
+		for buf := range free {
+			n, err := io.ReadFull(r, buf)
+			full <- chunk{buf: buf, n: n, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range full {
+		h.Write(c.buf[:c.n])
+		total += int64(c.n)
+		if errors.Is(c.err, io.EOF) || errors.Is(c.err, io.ErrUnexpectedEOF) {
+			return total, nil
+		} else if c.err != nil {
+			return total, c.err
+		}
+		free <- c.buf
+	}
+	return total, nil
+}
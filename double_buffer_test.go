@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// slowReader delays every read, so that reading dominates the time
+type slowReader struct {
+	r io.Reader
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return s.r.Read(p)
+}
+
+func TestHashReader(t *testing.T) {
+	data := make([]byte, 3<<20+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+	expected := sha256.Sum256(data)
+
+	for name, r := range map[string]func() io.Reader{
+		"fast": func() io.Reader { return bytes.NewReader(data) },
+		"slow": func() io.Reader { return slowReader{bytes.NewReader(data)} },
+	} {
+		h := sha256.New()
+		n, err := hashReader(h, r(), 64<<10, time.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) || !bytes.Equal(h.Sum(nil), expected[:]) {
+			t.Errorf("%s reader: hashReader() hashed %d bytes with a different hash", name, n)
+		}
+	}
+}
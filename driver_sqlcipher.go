@@ -0,0 +1,23 @@
+//go:build sqlcipher
+
+// Building with -tags sqlcipher replaces go-sqlite3 by go-sqlcipher, which registers itself under the same driver
+// name and embeds SQLCipher. It is not in go.mod, since default builds don't use it; add it with
+// go get github.com/mutecomm/go-sqlcipher/v4 before building with the tag.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	_ "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+// databaseDSN returns the data source name for opening the database at dbFile, encrypted with key if it isn't nil.
+// Passing the key in the DSN makes the driver set it on every connection of the pool.
+func databaseDSN(dbFile string, key []byte) (string, error) {
+	if key == nil {
+		return dbFile, nil
+	}
+	return fmt.Sprintf("%s?_pragma_key=x'%s'&_pragma_cipher_page_size=4096", dbFile, hex.EncodeToString(key)), nil
+}
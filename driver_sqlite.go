@@ -0,0 +1,18 @@
+//go:build !sqlcipher
+
+package main
+
+import (
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// databaseDSN returns the data source name for opening the database at dbFile with key, which must be nil since
+// this build has no encryption support
+func databaseDSN(dbFile string, key []byte) (string, error) {
+	if key != nil {
+		return "", errors.New("a database key was given, but encryption needs a build with -tags sqlcipher")
+	}
+	return dbFile, nil
+}
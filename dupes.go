@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes of the duplicates listed by dupes, relative to the roots recorded in the database
+const (
+	anyRoots    = ""       // All the groups of files with the same hash
+	acrossRoots = "across" // Only the groups with files under more than one root, such as a volume and its backup
+	withinRoot  = "within" // Only the files with the same hash under the same root, a group per root
+)
+
+// duplicateGroup is a group of files with the same hash
+type duplicateGroup struct {
+	Hash  string // Hash algorithm and hex hash, e.g. sha256:9f86d0...
+	Size  int64
+	Files []duplicateFile
+	Roots int // Number of roots the files are under
+}
+
+// duplicateFile is a file of a duplicateGroup
+type duplicateFile struct {
+	Path             string // Stored path
+	Encoding         string
+	ModificationTime string
+}
+
+// runDupes implements the dupes subcommand, which lists the groups of files with the same contents
+func runDupes(args []string) error {
+	var dbFile string
+	var acrossRootsOnly, withinRootOnly bool
+	var emitScript, keep string
+
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.BoolVar(&acrossRootsOnly, "across-roots-only", false,
+		"Only list the groups with files under more than one root, such as the copies of files on a backup volume")
+	flags.BoolVar(&withinRootOnly, "within-root", false,
+		"Only list the files with the same hash under the same root, split into a group per root")
+	flags.StringVar(&emitScript, "emit-script", "",
+		"Instead of listing the groups, write a bash script removing all their files but one with rm, or moving them "+
+			"to the trash with trash, to review before running it")
+	flags.StringVar(&keep, "keep", "first",
+		"File of each group kept by -emit-script: "+strings.Join(keepPolicies, ", ")+
+			"; first and shortest go by path, oldest and newest by modification time")
+	_ = flags.Parse(args)
+
+	if emitScript != "" && emitScript != "rm" && emitScript != "trash" {
+		return fmt.Errorf("unknown -emit-script command %q, want rm or trash", emitScript)
+	}
+	if !slices.Contains(keepPolicies, keep) {
+		return fmt.Errorf("unknown -keep policy %q, want one of %s", keep, strings.Join(keepPolicies, ", "))
+	}
+
+	scope := anyRoots
+	switch {
+	case acrossRootsOnly && withinRootOnly:
+		return errors.New("-across-roots-only and -within-root can't be combined")
+	case acrossRootsOnly:
+		scope = acrossRoots
+	case withinRootOnly:
+		scope = withinRoot
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	groups, err := findDuplicateGroups(db, scope)
+	if err != nil {
+		return err
+	}
+	if emitScript == "" {
+		return writeDuplicateGroups(os.Stdout, groups)
+	}
+	absDBFile, err := filepath.Abs(dbFile)
+	if err != nil {
+		return err
+	}
+	header, err := loadScriptHeader(db, absDBFile, time.Now())
+	if err != nil {
+		return err
+	}
+	locations, err := loadRootLocations(db)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeRemovalScript(w, groups, emitScript, keep, header, locations); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// findDuplicateGroups returns the groups of non-empty files with the same hash in scope, those wasting the most
+// bytes first. Each file belongs to the recorded root that contains it most closely; files under no recorded root,
+// e.g. imported ones, count as being under the same unknown root. Files hashed with different algorithms are never
+// in the same group.
+func findDuplicateGroups(db *sql.DB, scope string) ([]duplicateGroup, error) {
+	roots, err := knownRoots(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+	SELECT COALESCE(hash_algorithm, ?) || ':' || `+hashHexColumn+`, size, path, COALESCE(path_encoding, 'utf8'),
+	       COALESCE(modification_time, '')
+	FROM files
+	WHERE hash IS NOT NULL AND error IS NULL AND COALESCE(dir, 0) = 0 AND size > 0 AND hash IN (
+		SELECT hash FROM files
+		WHERE hash IS NOT NULL AND error IS NULL AND COALESCE(dir, 0) = 0 AND size > 0
+		GROUP BY hash HAVING COUNT(*) > 1
+	)
+	ORDER BY path`, defaultHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct {
+		hash string
+		root string // Only set within roots
+	}
+	groups := make(map[key]*duplicateGroup)
+	groupRoots := make(map[key]map[string]bool)
+	var keys []key
+	for rows.Next() {
+		var hash string
+		var size int64
+		var f duplicateFile
+		if err := rows.Scan(&hash, &size, &f.Path, &f.Encoding, &f.ModificationTime); err != nil {
+			return nil, err
+		}
+		root := rootOf(f.Path, roots)
+		k := key{hash: hash}
+		if scope == withinRoot {
+			k.root = root
+		}
+		g, ok := groups[k]
+		if !ok {
+			g = &duplicateGroup{Hash: hash, Size: size}
+			groups[k] = g
+			groupRoots[k] = make(map[string]bool)
+			keys = append(keys, k)
+		}
+		g.Files = append(g.Files, f)
+		groupRoots[k][root] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var found []duplicateGroup
+	for _, k := range keys {
+		g := groups[k]
+		g.Roots = len(groupRoots[k])
+		if len(g.Files) < 2 || (scope == acrossRoots && g.Roots < 2) {
+			continue
+		}
+		found = append(found, *g)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		wasted := func(g duplicateGroup) int64 { return g.Size * int64(len(g.Files)-1) }
+		return wasted(found[i]) > wasted(found[j])
+	})
+	return found, nil
+}
+
+// writeDuplicateGroups writes each group with its size and number of roots, followed by its files
+func writeDuplicateGroups(w io.Writer, groups []duplicateGroup) error {
+	for _, g := range groups {
+		if _, err := fmt.Fprintf(w, "%d bytes, %d files, %d roots, %s\n", g.Size, len(g.Files), g.Roots, g.Hash); err != nil {
+			return err
+		}
+		for _, f := range g.Files {
+			if _, err := fmt.Fprintf(w, "  %s\n", f.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Policies choosing the file of each duplicate group kept by the script of dupes -emit-script
+var keepPolicies = []string{"first", "shortest", "oldest", "newest"}
+
+// keptFile returns the index of the file of g that policy keeps: the first by path, the one with the shortest
+// path, or the one modified first or last. Ties go to the first file by path.
+func keptFile(g duplicateGroup, policy string) int {
+	kept := 0
+	for i, f := range g.Files[1:] {
+		i++
+		k := g.Files[kept]
+		switch policy {
+		case "shortest":
+			if len(f.Path) < len(k.Path) {
+				kept = i
+			}
+		case "oldest", "newest":
+			t, err := time.Parse(time.RFC3339, f.ModificationTime)
+			if err != nil {
+				continue
+			}
+			kt, err := time.Parse(time.RFC3339, k.ModificationTime)
+			if err != nil || (policy == "oldest" && t.Before(kt)) || (policy == "newest" && t.After(kt)) {
+				kept = i
+			}
+		}
+	}
+	return kept
+}
+
+// scriptHeader is the state of the database a removal script reflects
+type scriptHeader struct {
+	Database    string
+	CrawlId     int64 // Last crawl, 0 if there was none
+	CrawledAt   string
+	GeneratedAt time.Time
+}
+
+// loadScriptHeader returns the header of a script generated now from the database at dbFile
+func loadScriptHeader(db *sql.DB, dbFile string, now time.Time) (scriptHeader, error) {
+	header := scriptHeader{Database: dbFile, GeneratedAt: now}
+	var startedAt sql.NullString
+	err := db.QueryRow("SELECT id, started_at FROM runs WHERE command = 'crawl' ORDER BY id DESC LIMIT 1").
+		Scan(&header.CrawlId, &startedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return header, err
+	}
+	header.CrawledAt = startedAt.String
+	return header, nil
+}
+
+// writeRemovalScript writes a bash script removing the redundant copies of each group with command, rm or trash,
+// keeping one file per group according to policy. The crawler never deletes anything itself: the script is meant to
+// be reviewed, and edited, before it is run. Each group is preceded by comments with its hash, size and kept file,
+// and paths are quoted like printf %q does, so that any name is passed as a single argument.
+func writeRemovalScript(w io.Writer, groups []duplicateGroup, command, policy string, header scriptHeader,
+	locations rootLocations) error {
+	crawl := "none"
+	if header.CrawlId != 0 {
+		crawl = fmt.Sprintf("%d, started at %s", header.CrawlId, header.CrawledAt)
+	}
+	_, err := fmt.Fprintf(w, "#!/bin/bash\n# Generated by dupes -emit-script %s -keep %s, review before running\n"+
+		"# Database: %s\n# Last crawl: %s\n# Generated at: %s\nset -u\n",
+		command, policy, commentText(header.Database), crawl, header.GeneratedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		kept := keptFile(g, policy)
+		osPath := func(f duplicateFile) string { return locations.osPath(decodePath(f.Path, f.Encoding)) }
+		_, err := fmt.Fprintf(w, "\n# %s, %d bytes, %d files\n# Keeping %s\n", g.Hash, g.Size, len(g.Files),
+			commentText(osPath(g.Files[kept])))
+		if err != nil {
+			return err
+		}
+		for i, f := range g.Files {
+			if i == kept {
+				continue
+			}
+			path := osPath(f)
+			if strings.HasPrefix(path, "-") {
+				path = "./" + path
+			}
+			if _, err := fmt.Fprintf(w, "%s %s\n", command, shellQuote(path)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commentText makes s fit on a comment line of a script, by quoting it if it has a newline or other control
+// characters
+func commentText(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 || !utf8.ValidString(s) {
+		return shellQuote(s)
+	}
+	return s
+}
+
+// shellQuote quotes s for bash like printf %q: in single quotes, or in $'...' with escapes if it has control
+// characters or bytes that are not valid UTF-8
+func shellQuote(s string) string {
+	special := func(r rune) bool { return r < 0x20 || r == 0x7f || r == utf8.RuneError }
+	if strings.IndexFunc(s, special) < 0 {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\\' || r == '\'':
+			b.WriteString(`\` + string(r))
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteString("'")
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindDuplicateGroups(t *testing.T) {
+	primary, backup := t.TempDir(), t.TempDir()
+	writeFiles(t, primary, [][2]string{
+		{"backed-up.txt", "backed up"},
+		{"report.txt", "report, copied twice"},
+		{"old/report.txt", "report, copied twice"},
+		{"empty-1", ""},
+		{"empty-2", ""},
+	})
+	writeFiles(t, backup, [][2]string{
+		{"backed-up.txt", "backed up"},
+		{"report.txt", "report, copied twice"},
+		{"unique.txt", "unique"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	for _, root := range []string{primary, backup} {
+		if err := recordRoot(db, root, root, 1, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The group of reports has the most wasted bytes, and is split by root within roots. The temporary directory
+	// of primary sorts before that of backup.
+	reports := []string{filepath.Join(primary, "old/report.txt"), filepath.Join(primary, "report.txt"),
+		filepath.Join(backup, "report.txt")}
+	backedUp := []string{filepath.Join(primary, "backed-up.txt"), filepath.Join(backup, "backed-up.txt")}
+	for _, tc := range []struct {
+		scope    string
+		expected [][]string
+		roots    []int
+	}{
+		{anyRoots, [][]string{reports, backedUp}, []int{2, 2}},
+		{acrossRoots, [][]string{reports, backedUp}, []int{2, 2}},
+		{withinRoot, [][]string{{filepath.Join(primary, "old/report.txt"), filepath.Join(primary, "report.txt")}}, []int{1}},
+	} {
+		groups, err := findDuplicateGroups(db, tc.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths [][]string
+		var roots []int
+		for _, g := range groups {
+			var groupPaths []string
+			for _, f := range g.Files {
+				groupPaths = append(groupPaths, f.Path)
+			}
+			paths = append(paths, groupPaths)
+			roots = append(roots, g.Roots)
+		}
+		if !reflect.DeepEqual(paths, tc.expected) || !reflect.DeepEqual(roots, tc.roots) {
+			t.Errorf("findDuplicateGroups(%q) = %v with roots %v, want %v with %v", tc.scope, paths, roots,
+				tc.expected, tc.roots)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tc := range []struct{ s, expected string }{
+		{"/data/a b.txt", "'/data/a b.txt'"},
+		{"/data/it's", `'/data/it'\''s'`},
+		{"/data/-rf", "'/data/-rf'"},
+		{"/data/new\nline", `$'/data/new\nline'`},
+		{"/data/tab\tand 'quote' \\", `$'/data/tab\tand \'quote\' \\'`},
+		{"/data/latin-1 \xe9t\xe9", `$'/data/latin-1 \xe9t\xe9'`},
+		{"/data/café\x01", `$'/data/café\x01'`},
+	} {
+		if quoted := shellQuote(tc.s); quoted != tc.expected {
+			t.Errorf("shellQuote(%q) = %s, want %s", tc.s, quoted, tc.expected)
+		}
+	}
+}
+
+func TestWriteRemovalScript(t *testing.T) {
+	root := t.TempDir()
+	names := []string{"keep.txt", "it's a copy.txt", "new\nline.txt", "-dash.txt", "$(touch pwned).txt"}
+	var files [][2]string
+	for _, name := range names {
+		files = append(files, [2]string{"copies/" + name, "the same contents"})
+	}
+	writeFiles(t, root, append(files, [2]string{"unique.txt", "unique"}))
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := findDuplicateGroups(db, anyRoots)
+	if err != nil || len(groups) != 1 {
+		t.Fatalf("findDuplicateGroups() = %v, %v, want one group", groups, err)
+	}
+
+	var buf bytes.Buffer
+	header := scriptHeader{Database: "/data/index.sqlite", CrawlId: 7, CrawledAt: "2024-06-01T12:00:00Z",
+		GeneratedAt: time.Date(2024, 6, 2, 8, 0, 0, 0, time.UTC)}
+	if err := writeRemovalScript(&buf, groups, "rm", "shortest", header, nil); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	if !strings.HasPrefix(script, "#!/bin/bash\n") || !strings.Contains(script, "# Database: /data/index.sqlite\n") ||
+		!strings.Contains(script, "# Last crawl: 7, started at 2024-06-01T12:00:00Z\n") ||
+		!strings.Contains(script, "# Generated at: 2024-06-02T08:00:00Z\n") ||
+		!strings.Contains(script, "# Keeping "+filepath.Join(root, "copies/keep.txt")+"\n") ||
+		strings.Count(script, "\nrm ") != len(names)-1 {
+		t.Errorf("writeRemovalScript() = %q", script)
+	}
+
+	// Running the script removes every copy but the kept one, and nothing else
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	cmd := exec.Command(bash, "-c", script)
+	cmd.Dir = root
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running the script failed: %v\n%s", err, out)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "copies"))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "keep.txt" {
+		t.Errorf("after running the script, copies has %v, %v, want keep.txt", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "pwned")); err == nil {
+		t.Error("a file name was run as a command")
+	}
+}
+
+func TestKeptFile(t *testing.T) {
+	g := duplicateGroup{Files: []duplicateFile{
+		{Path: "/a/long/path", ModificationTime: "2024-03-01T00:00:00Z"},
+		{Path: "/b/old", ModificationTime: "2024-01-01T00:00:00+01:00"},
+		{Path: "/c/new", ModificationTime: "2024-05-01T00:00:00Z"},
+		{Path: "/d/unknown"},
+	}}
+	for policy, expected := range map[string]string{
+		"first": "/a/long/path", "shortest": "/b/old", "oldest": "/b/old", "newest": "/c/new",
+	} {
+		if kept := g.Files[keptFile(g, policy)].Path; kept != expected {
+			t.Errorf("keptFile(%s) = %s, want %s", policy, kept, expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// estimate holds the counts gathered by the estimate command
+type estimate struct {
+	Files    int64
+	Bytes    int64
+	Excluded int64
+	Errors   int64
+}
+
+// runEstimate implements the estimate subcommand, which walks the trees like a crawl would, but only
+// calls stat and never touches the database
+func runEstimate(args []string) error {
+	var exclusionFile string
+	var excludePatterns patternList
+	var noDefaultExcludes bool
+	printInterval := intervalValue(time.Second)
+	var hashSpeed float64
+	var opts walkOptions
+
+	flags := flag.NewFlagSet("estimate", flag.ExitOnError)
+	flags.StringVar(&exclusionFile, "exclude", "", excludeUsage)
+	flags.Var(&excludePatterns, "exclude-pattern", excludePatternUsage)
+	flags.BoolVar(&noDefaultExcludes, "no-default-excludes", false, noDefaultExcludesUsage)
+	flags.Var(&printInterval, "interval", intervalUsage)
+	flags.Float64Var(&hashSpeed, "speed", 100, "Assumed hashing speed in MB/s for the time estimate")
+	opts.addFlags(flags)
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Usage: program estimate [options] <directory1> [<directory2> ...]")
+		flags.PrintDefaults()
+		return nil
+	}
+	if hashSpeed <= 0 {
+		return fmt.Errorf("speed must be positive, got %v", hashSpeed)
+	}
+
+	patterns, err := loadExcludePatterns(exclusionFile, excludePatterns, noDefaultExcludes)
+	if err != nil {
+		return err
+	}
+	opts.ExcludePatterns = patterns
+
+	stats := NewProcessStats()
+	if printInterval > 0 {
+		stats.PrintEvery(time.Duration(printInterval))
+	}
+
+	var total estimate
+	for _, root := range flags.Args() {
+		e, err := estimateDirectory(root, &opts, stats)
+		if err != nil {
+			fmt.Printf("Error estimating directory %s: %v\n", root, err)
+		}
+		total.Files += e.Files
+		total.Bytes += e.Bytes
+		total.Excluded += e.Excluded
+		total.Errors += e.Errors
+	}
+
+	duration := time.Duration(float64(total.Bytes) / (hashSpeed * 1e6) * float64(time.Second))
+	fmt.Printf("Files: %d, MB: %.2f, excluded: %d, errors: %d\n",
+		total.Files, float64(total.Bytes)/1e6, total.Excluded, total.Errors)
+	fmt.Printf("Estimated hashing time at %.0f MB/s: %v\n", hashSpeed, duration.Round(time.Second))
+	return nil
+}
+
+// estimateDirectory counts the files and bytes under root that a crawl with the same options would hash.
+// It mirrors the decisions made by processDirectory, except for those that depend on the database.
+func estimateDirectory(root string, opts *walkOptions, stats *ProcessStats) (estimate, error) {
+	var e estimate
+	walk, err := opts.newRoot(root)
+	if err != nil {
+		return e, err
+	}
+
+	err = filepath.WalkDir(walk.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			e.Errors++
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Mode()&os.ModeNamedPipe != 0 {
+			e.Errors++
+			return nil
+		}
+
+		if match, _ := opts.isExcluded(path, &fileAttributes{Size: info.Size(), ModTime: info.ModTime()}); match {
+			e.Excluded++
+			return nil
+		}
+		if !d.IsDir() && opts.excludedExtension(path) != "" {
+			e.Excluded++
+			return nil
+		}
+		if uid, gid := getOwner(info); !d.IsDir() && opts.excludedOwner(uid, gid) != "" {
+			e.Excluded++
+			return nil
+		}
+
+		if d.IsDir() {
+			if path != walk.Path && opts.excludingMarker(path) != "" {
+				e.Excluded++
+				return filepath.SkipDir
+			}
+			if !walk.descend(path, getDeviceID(info)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		e.Files++
+		e.Bytes += info.Size()
+		stats.Update(path, info.Size())
+		return nil
+	})
+	return e, err
+}
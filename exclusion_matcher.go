@@ -0,0 +1,237 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExclusionMatcher is a compiled list of exclusion patterns. IsExcluded gives the same results as isExcluded
+// with the same patterns, but avoids trying every pattern on every path, which matters with hundreds of them.
+type ExclusionMatcher struct {
+	patterns  []string
+	positives *patternSet
+	negations *patternSet
+}
+
+// patternSet indexes patterns by their shape, so that only the patterns that can match a path are tried
+type patternSet struct {
+	patterns   []string             // All patterns of the matcher without their qualifiers, indexed by the ints below
+	qualifiers [][]patternQualifier // Qualifiers of the patterns, which must match too
+	reverse    bool                 // Whether later patterns are preferred
+
+	names    map[string][]int // Patterns without '/' or wildcards, matching the base name exactly
+	suffixes map[string][]int // Patterns like "*.ext", keyed by ".ext"
+	globs    []globPattern    // Other patterns without '/', in order
+	anchored map[string][]int // Patterns starting with '/' and a literal component, keyed by that component
+	floating map[string][]int // Other patterns with '/' and a literal first component, keyed by that component
+	other    []int            // Everything else, tried one by one
+}
+
+// NewExclusionMatcher compiles patterns, which use the syntax of the exclusion file
+func NewExclusionMatcher(patterns []string) *ExclusionMatcher {
+	bare := make([]string, len(patterns))
+	qualifiers := make([][]patternQualifier, len(patterns))
+	for i, line := range patterns {
+		bare[i], qualifiers[i] = splitPatternLine(line)
+	}
+	m := &ExclusionMatcher{
+		patterns:  patterns,
+		positives: newPatternSet(bare, qualifiers, false),
+		negations: newPatternSet(bare, qualifiers, true),
+	}
+	for i, pattern := range bare {
+		if strings.HasPrefix(pattern, "!") {
+			m.negations.add(i, pattern[1:])
+		} else {
+			m.positives.add(i, pattern)
+		}
+	}
+	return m
+}
+
+// Patterns returns the patterns the matcher was compiled from
+func (m *ExclusionMatcher) Patterns() []string {
+	return m.patterns
+}
+
+// IsExcluded reports whether path is excluded, and by which pattern including its qualifiers. Like isExcluded, a
+// path is excluded by the first pattern that matches it after the last matching negation, and patterns with
+// qualifiers only match if file, nil if unknown, satisfies them.
+func (m *ExclusionMatcher) IsExcluded(filePath string, file *fileAttributes) (bool, string) {
+	p := newMatchPath(filePath)
+	p.file = file
+	lastNegation := m.negations.match(p, -1)
+	first := m.positives.match(p, lastNegation)
+	if first < 0 {
+		return false, ""
+	}
+	return true, m.patterns[first]
+}
+
+func newPatternSet(patterns []string, qualifiers [][]patternQualifier, reverse bool) *patternSet {
+	return &patternSet{
+		patterns:   patterns,
+		qualifiers: qualifiers,
+		reverse:    reverse,
+		names:      make(map[string][]int),
+		suffixes:   make(map[string][]int),
+		anchored:   make(map[string][]int),
+		floating:   make(map[string][]int),
+	}
+}
+
+// hasMeta reports whether s contains characters with a special meaning for path.Match
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// add indexes pattern i, whose text is pattern without any negation
+func (s *patternSet) add(i int, pattern string) {
+	trimmed := strings.TrimSuffix(pattern, "/")
+	switch {
+	case pattern == "":
+		s.other = append(s.other, i)
+	case !strings.Contains(pattern, "/"):
+		if !hasMeta(pattern) {
+			s.names[pattern] = append(s.names[pattern], i)
+		} else if ext := pattern[1:]; pattern[0] == '*' && strings.HasPrefix(ext, ".") && !hasMeta(ext) {
+			s.suffixes[ext] = append(s.suffixes[ext], i)
+		} else if !strings.ContainsAny(pattern, `[\`) {
+			s.globs = append(s.globs, globPattern{pattern: pattern, literal: longestLiteral(pattern), index: i})
+		} else {
+			s.other = append(s.other, i)
+		}
+	case strings.HasPrefix(trimmed, "/"):
+		if first := strings.Split(trimmed[1:], "/")[0]; first != "" && !hasMeta(first) {
+			s.anchored[first] = append(s.anchored[first], i)
+		} else {
+			s.other = append(s.other, i)
+		}
+	default:
+		if first := strings.Split(trimmed, "/")[0]; first != "" && !hasMeta(first) {
+			s.floating[first] = append(s.floating[first], i)
+		} else {
+			s.other = append(s.other, i)
+		}
+	}
+}
+
+// globPattern is a pattern with wildcards and without '/', which only matches names containing its longest
+// literal part. Checking that first is much cheaper than path.Match.
+type globPattern struct {
+	pattern string
+	literal string
+	index   int
+}
+
+// longestLiteral returns the longest part of pattern without wildcards
+func longestLiteral(pattern string) string {
+	longest := ""
+	for _, part := range strings.FieldsFunc(pattern, func(r rune) bool { return r == '*' || r == '?' }) {
+		if len(part) > len(longest) {
+			longest = part
+		}
+	}
+	return longest
+}
+
+// matchPath is a path split up the way the pattern sets need it
+type matchPath struct {
+	path       string
+	base       string
+	components []string
+	file       *fileAttributes // For the qualifiers of patterns, nil if unknown
+}
+
+func newMatchPath(filePath string) matchPath {
+	components := strings.Split(filePath, "/")
+	if components[0] == "" {
+		components = components[1:]
+	}
+	return matchPath{path: filePath, base: filepath.Base(filePath), components: components}
+}
+
+// match returns the preferred pattern matching p among those after index after, or -1. The preferred pattern
+// is the first one, or the last one for a reverse set.
+func (s *patternSet) match(p matchPath, after int) int {
+	best := -1
+	// consider makes pattern i the best match if it is preferred to the current one, and, if verify is set,
+	// matches p. It returns whether it did.
+	consider := func(i int, verify bool) bool {
+		if i <= after || (best >= 0 && (i > best) != s.reverse) {
+			return false
+		}
+		pattern := s.patterns[i]
+		if s.reverse {
+			pattern = pattern[1:]
+		}
+		if verify && !filepathMatch(pattern, p.path) {
+			return false
+		}
+		if !qualifiersMatch(s.qualifiers[i], p.file) {
+			return false
+		}
+		best = i
+		return true
+	}
+
+	for _, i := range s.names[p.base] {
+		consider(i, false)
+	}
+	for dot := strings.IndexByte(p.base, '.'); dot >= 0; {
+		for _, i := range s.suffixes[p.base[dot:]] {
+			consider(i, false)
+		}
+		next := strings.IndexByte(p.base[dot+1:], '.')
+		if next < 0 {
+			break
+		}
+		dot += next + 1
+	}
+	if len(s.anchored) > 0 && len(p.components) > 0 {
+		for _, i := range s.anchored[p.components[0]] {
+			consider(i, true)
+		}
+	}
+	if len(s.floating) > 0 {
+		for k, component := range p.components {
+			if indexOf(p.components[:k], component) >= 0 {
+				continue // Already tried
+			}
+			for _, i := range s.floating[component] {
+				consider(i, true)
+			}
+		}
+	}
+	for _, i := range s.other {
+		consider(i, true)
+	}
+	s.matchGlobs(p, consider)
+	return best
+}
+
+// matchGlobs considers the patterns in globs, stopping at the first match in the order of preference
+func (s *patternSet) matchGlobs(p matchPath, consider func(i int, verify bool) bool) {
+	for k := range s.globs {
+		if s.reverse {
+			k = len(s.globs) - 1 - k
+		}
+		g := s.globs[k]
+		if !strings.Contains(p.base, g.literal) {
+			continue
+		}
+		if match, _ := path.Match(g.pattern, p.base); match && consider(g.index, false) {
+			return
+		}
+	}
+}
+
+func indexOf(s []string, x string) int {
+	for i, y := range s {
+		if y == x {
+			return i
+		}
+	}
+	return -1
+}
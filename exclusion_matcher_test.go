@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Pieces from which random patterns and paths are built, chosen to collide often
+var (
+	testComponents = []string{"a", "b", "logs", "tmp", ".git", "node_modules", "x.txt", "y.log", "z.tar.gz", "caf\xe9"}
+	testPatterns   = []string{"*.txt", "*.log", "*.gz", "*.tar.gz", "x.*", "?.txt", "*~", "y.log", "tmp", ".git/",
+		"/tmp/*", "/tmp/", "logs/*.txt", "a/b", "/a/*/b/*", "*/b", "[xy].txt", `\x.txt`, "node_modules/", "a/", ""}
+)
+
+func randomPath(rng *rand.Rand) string {
+	path := ""
+	for i := rng.Intn(5); i >= 0; i-- {
+		path += "/" + testComponents[rng.Intn(len(testComponents))]
+	}
+	if rng.Intn(10) == 0 {
+		path = path[1:] // Relative paths are matched too
+	}
+	return path
+}
+
+func randomPatterns(rng *rand.Rand, n int) []string {
+	patterns := make([]string, n)
+	for i := range patterns {
+		patterns[i] = testPatterns[rng.Intn(len(testPatterns))]
+		if rng.Intn(4) == 0 {
+			patterns[i] = "!" + patterns[i]
+		}
+	}
+	return patterns
+}
+
+func TestExclusionMatcher(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		patterns := randomPatterns(rng, 1+rng.Intn(12))
+		m := NewExclusionMatcher(patterns)
+		for i := 0; i < 200; i++ {
+			path := randomPath(rng)
+			expected, expectedPattern := isExcluded(path, nil, patterns)
+			if excluded, pattern := m.IsExcluded(path, nil); excluded != expected || pattern != expectedPattern {
+				t.Fatalf("IsExcluded(%q) with %q = %v, %q, want %v, %q",
+					path, patterns, excluded, pattern, expected, expectedPattern)
+			}
+		}
+	}
+}
+
+// benchmarkPatterns returns n patterns in the style of a large exclusion file
+func benchmarkPatterns(n int) []string {
+	patterns := make([]string, n)
+	for i := range patterns {
+		switch i % 5 {
+		case 0:
+			patterns[i] = fmt.Sprintf("*.ext%d", i)
+		case 1:
+			patterns[i] = fmt.Sprintf("cache%d", i)
+		case 2:
+			patterns[i] = fmt.Sprintf("/volume/project%d/build/", i)
+		case 3:
+			patterns[i] = fmt.Sprintf("project%d/*.tmp", i)
+		default:
+			patterns[i] = fmt.Sprintf("*backup%d*", i)
+		}
+	}
+	return patterns
+}
+
+var benchmarkPaths = []string{
+	"/volume/project17/src/main.go",
+	"/volume/project42/build/output.bin",
+	"/home/user/Documents/report.ext500",
+	"/home/user/cache3/data",
+	"/srv/files/archive.backup999.zip",
+}
+
+func BenchmarkIsExcluded(b *testing.B) {
+	patterns := benchmarkPatterns(1000)
+	for i := 0; i < b.N; i++ {
+		isExcluded(benchmarkPaths[i%len(benchmarkPaths)], nil, patterns)
+	}
+}
+
+func BenchmarkIsExcludedNoPatterns(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		isExcluded(benchmarkPaths[i%len(benchmarkPaths)], nil, nil)
+	}
+}
+
+func BenchmarkIsExcludedExtensions(b *testing.B) {
+	patterns := []string{"*.tmp", "*.log", "*.bak", "*.ext500"}
+	for i := 0; i < b.N; i++ {
+		isExcluded(benchmarkPaths[i%len(benchmarkPaths)], nil, patterns)
+	}
+}
+
+func BenchmarkExclusionMatcher(b *testing.B) {
+	m := NewExclusionMatcher(benchmarkPatterns(1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IsExcluded(benchmarkPaths[i%len(benchmarkPaths)], nil)
+	}
+}
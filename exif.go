@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// exifHeaderSize is how many bytes at the start of a photo are kept for reading its EXIF metadata. EXIF comes
+// first in JPEG files, and close to the start in TIFF based raw files and HEIC files.
+const exifHeaderSize = 256 * 1024
+
+// photoInfo is the EXIF metadata stored with -exif. Values that are absent or can't be read are empty.
+type photoInfo struct {
+	CaptureTime string // DateTimeOriginal as 2006-01-02T15:04:05, followed by OffsetTimeOriginal if set
+	CameraModel string
+	GPS         sql.NullBool // Whether the photo has a GPS position, NULL without EXIF metadata
+}
+
+// exifExtensions are the lowercase extensions of the files whose EXIF metadata is read, with the container it is in
+var exifExtensions = map[string]string{
+	".jpg": "jpeg", ".jpeg": "jpeg",
+	".heic": "heic", ".heif": "heic",
+	".tif": "tiff", ".tiff": "tiff", ".dng": "tiff", ".cr2": "tiff", ".nef": "tiff", ".arw": "tiff", ".orf": "tiff",
+	".rw2": "tiff", ".pef": "tiff", ".srw": "tiff",
+}
+
+// isPhotoFile reports whether files with the extension ext, as returned by filepath.Ext, have EXIF metadata
+func isPhotoFile(ext string) bool {
+	_, ok := exifExtensions[strings.ToLower(ext)]
+	return ok
+}
+
+// readPhotoInfo reads the EXIF metadata from header, the start of a file with the extension ext. Anything that
+// can't be read is left empty, since many photos have no EXIF metadata at all.
+func readPhotoInfo(header []byte, ext string) photoInfo {
+	var tiff []byte
+	switch exifExtensions[strings.ToLower(ext)] {
+	case "jpeg":
+		tiff = jpegExif(header)
+	case "heic":
+		tiff = heicExif(header)
+	case "tiff":
+		tiff = header
+	}
+	if tiff == nil {
+		return photoInfo{}
+	}
+	return parseExif(tiff)
+}
+
+// jpegExif returns the TIFF structure in the APP1 segment of a JPEG file, or nil
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for off := 2; off+4 <= len(data); {
+		if data[off] != 0xff {
+			return nil
+		}
+		marker := data[off+1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			off += 2 // Markers without a length
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 { // Start of the image data, or its end
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[off+2:]))
+		end := off + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if segment := data[off+4 : end]; marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		off = end
+	}
+	return nil
+}
+
+// heicExif returns the TIFF structure of the Exif item of a HEIC file, or nil
+func heicExif(data []byte) []byte {
+	r := bytes.NewReader(data)
+	size := int64(len(data))
+	boxes, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return nil
+	}
+	meta, ok := findMP4Box(boxes, "meta")
+	if !ok {
+		return nil
+	}
+	// meta is a full box, with a version and flags before its children
+	children, err := mp4Boxes(r, meta.Start+4, meta.End)
+	if err != nil {
+		return nil
+	}
+	iinf, ok := findMP4Box(children, "iinf")
+	if !ok {
+		return nil
+	}
+	iloc, ok := findMP4Box(children, "iloc")
+	if !ok {
+		return nil
+	}
+	id, ok := heicExifItem(data[iinf.Start:iinf.End])
+	if !ok {
+		return nil
+	}
+	offset, length, ok := heicItemLocation(data[iloc.Start:iloc.End], id)
+	if !ok || offset < 0 || offset > size || length > size-offset || length < 4 {
+		return nil
+	}
+	item := data[offset : offset+length]
+	// The item starts with the offset of the TIFF header, which follows an optional Exif\0\0
+	tiffOffset := 4 + int64(binary.BigEndian.Uint32(item))
+	if tiffOffset >= length {
+		return nil
+	}
+	return item[tiffOffset:]
+}
+
+// heicExifItem returns the ID of the item of type Exif in the contents of an iinf box
+func heicExifItem(iinf []byte) (uint32, bool) {
+	if len(iinf) < 6 {
+		return 0, false
+	}
+	start := int64(6) // Version, flags and a 16-bit entry count
+	if iinf[0] > 0 {
+		start = 8
+	}
+	r := bytes.NewReader(iinf)
+	entries, err := mp4Boxes(r, start, int64(len(iinf)))
+	if err != nil {
+		return 0, false
+	}
+	for _, infe := range entries {
+		entry := iinf[infe.Start:infe.End]
+		if infe.Type != "infe" || len(entry) < 4 || entry[0] < 2 {
+			continue
+		}
+		// Version 2 has a 16-bit item ID, version 3 a 32-bit one, followed by a protection index and the type
+		var id uint32
+		var itemType []byte
+		if entry[0] == 2 && len(entry) >= 12 {
+			id, itemType = uint32(binary.BigEndian.Uint16(entry[4:])), entry[8:12]
+		} else if entry[0] == 3 && len(entry) >= 14 {
+			id, itemType = binary.BigEndian.Uint32(entry[4:]), entry[10:14]
+		}
+		if string(itemType) == "Exif" {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// heicItemLocation returns the offset and length of the first extent of item id in the contents of an iloc box
+func heicItemLocation(iloc []byte, id uint32) (int64, int64, bool) {
+	if len(iloc) < 8 {
+		return 0, 0, false
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0x0f)
+	baseOffsetSize, indexSize := int(iloc[5]>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0x0f)
+	}
+	pos := 6
+	// read returns the next n bytes as a big-endian number, with ok cleared once the data runs out
+	ok := true
+	read := func(n int) int64 {
+		if !ok || pos+n > len(iloc) || n > 8 {
+			ok = false
+			return 0
+		}
+		var value int64
+		for _, b := range iloc[pos : pos+n] {
+			value = value<<8 | int64(b)
+		}
+		pos += n
+		return value
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := read(idSize)
+	for i := int64(0); i < count && ok; i++ {
+		itemId := read(idSize)
+		if version == 1 || version == 2 {
+			read(2) // Construction method
+		}
+		read(2) // Data reference index
+		baseOffset := read(baseOffsetSize)
+		extents := read(2)
+		for e := int64(0); e < extents && ok; e++ {
+			read(indexSize)
+			offset := read(offsetSize)
+			length := read(lengthSize)
+			if ok && e == 0 && uint32(itemId) == id {
+				return baseOffset + offset, length, offset >= 0 && length >= 0
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// EXIF tags
+const (
+	exifTagModel              = 0x0110
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTagGPSLatitude        = 0x0002
+)
+
+// exifEntry is an entry of an image file directory
+type exifEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte // The 4 bytes holding the value, or its offset if it doesn't fit
+}
+
+// exifDirectory returns the entries of the image file directory at off, by tag
+func exifDirectory(tiff []byte, order binary.ByteOrder, off uint32) map[uint16]exifEntry {
+	if int64(off)+2 > int64(len(tiff)) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[off:]))
+	entries := make(map[uint16]exifEntry, count)
+	for i := 0; i < count; i++ {
+		start := int(off) + 2 + 12*i
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		entries[order.Uint16(entry)] = exifEntry{
+			Type:  order.Uint16(entry[2:]),
+			Count: order.Uint32(entry[4:]),
+			Value: entry[8:12],
+		}
+	}
+	return entries
+}
+
+// exifString returns the ASCII value of entry, or "" if it isn't one
+func exifString(tiff []byte, order binary.ByteOrder, entry exifEntry) string {
+	const asciiType = 2
+	if entry.Type != asciiType || entry.Count == 0 {
+		return ""
+	}
+	value := entry.Value
+	if entry.Count > 4 {
+		off := int64(order.Uint32(entry.Value))
+		if off+int64(entry.Count) > int64(len(tiff)) {
+			return ""
+		}
+		value = tiff[off : off+int64(entry.Count)]
+	}
+	value = value[:min(int(entry.Count), len(value))]
+	return strings.TrimSpace(string(bytes.TrimRight(value, "\x00")))
+}
+
+// exifTimeOffset matches the values of OffsetTimeOriginal
+var exifTimeOffset = regexp.MustCompile(`^[+-]\d\d:\d\d$`)
+
+// parseExif reads the capture time, camera model and GPS presence from a TIFF structure
+func parseExif(tiff []byte) photoInfo {
+	var info photoInfo
+	if len(tiff) < 8 {
+		return info
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+	ifd0 := exifDirectory(tiff, order, order.Uint32(tiff[4:]))
+	info.CameraModel = exifString(tiff, order, ifd0[exifTagModel])
+
+	if pointer, ok := ifd0[exifTagExifIFD]; ok {
+		exif := exifDirectory(tiff, order, order.Uint32(pointer.Value))
+		captured := exifString(tiff, order, exif[exifTagDateTimeOriginal])
+		if t, err := time.Parse("2006:01:02 15:04:05", captured); err == nil {
+			info.CaptureTime = t.Format("2006-01-02T15:04:05")
+			if offset := exifString(tiff, order, exif[exifTagOffsetTimeOriginal]); exifTimeOffset.MatchString(offset) {
+				info.CaptureTime += offset
+			}
+		}
+	}
+	info.GPS.Valid = ifd0 != nil
+	if pointer, ok := ifd0[exifTagGPSIFD]; ok {
+		_, info.GPS.Bool = exifDirectory(tiff, order, order.Uint32(pointer.Value))[exifTagGPSLatitude]
+	}
+	return info
+}
+
+// readPhotoHeader reads the start of the file at path for readPhotoInfo, for files that are not hashed
+func readPhotoHeader(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, exifHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return header[:n], err
+}
+
+// writePhotoInfo stores the EXIF metadata of path, with NULL for the values that are empty
+func writePhotoInfo(db execQuerier, path string, info photoInfo) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO photo_info(path, capture_time, camera_model, gps) VALUES (?, ?, ?, ?)`,
+		path, sql.NullString{String: info.CaptureTime, Valid: info.CaptureTime != ""},
+		sql.NullString{String: info.CameraModel, Valid: info.CameraModel != ""}, info.GPS)
+	return err
+}
+
+// hasPhotoInfo reports whether a row for path is in the photo_info table, even one without metadata
+func hasPhotoInfo(db execQuerier, path string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM photo_info WHERE path = ?", path).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+// tiffField is an entry of an image file directory built by testTIFF
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	value []byte
+}
+
+func tiffASCII(tag uint16, s string) tiffField { return tiffField{tag, 2, append([]byte(s), 0)} }
+func tiffLong(tag uint16, v uint32) tiffField {
+	return tiffField{tag, 4, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+// putTIFFDirectory writes an image file directory with fields at off in the little-endian TIFF structure tiff,
+// followed by the values that don't fit in their entries
+func putTIFFDirectory(tiff []byte, off int, fields ...tiffField) {
+	binary.LittleEndian.PutUint16(tiff[off:], uint16(len(fields)))
+	data := off + 2 + 12*len(fields) + 4
+	for i, field := range fields {
+		entry := tiff[off+2+12*i:]
+		binary.LittleEndian.PutUint16(entry, field.tag)
+		binary.LittleEndian.PutUint16(entry[2:], field.typ)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(field.value)))
+		if len(field.value) <= 4 {
+			copy(entry[8:12], field.value)
+			continue
+		}
+		binary.LittleEndian.PutUint32(entry[8:], uint32(data))
+		data += copy(tiff[data:], field.value)
+	}
+}
+
+// testTIFF builds a TIFF structure with a camera model, a capture time with its offset and a GPS position
+func testTIFF() []byte {
+	tiff := make([]byte, 400)
+	copy(tiff, "II\x2a\x00\x08\x00\x00\x00")
+	putTIFFDirectory(tiff, 8, tiffASCII(exifTagModel, "Canon EOS 5D"),
+		tiffLong(exifTagExifIFD, 200), tiffLong(exifTagGPSIFD, 300))
+	putTIFFDirectory(tiff, 200, tiffASCII(exifTagDateTimeOriginal, "2016:05:01 14:30:00"),
+		tiffASCII(exifTagOffsetTimeOriginal, "+02:00"))
+	putTIFFDirectory(tiff, 300, tiffField{exifTagGPSLatitude, 5, make([]byte, 24)})
+	return tiff
+}
+
+// testJPEG builds the start of a JPEG file with the EXIF metadata of testTIFF after a JFIF segment
+func testJPEG() []byte {
+	app1 := append([]byte("Exif\x00\x00"), testTIFF()...)
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0x00}
+	jpeg = append(jpeg, 0xff, 0xe1)
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(2+len(app1)))
+	return append(append(jpeg, app1...), 0xff, 0xda, 0x00, 0x02)
+}
+
+// testHEIC builds a HEIC file with an image item and an Exif item holding the EXIF metadata of testTIFF
+func testHEIC() []byte {
+	infe := func(id uint16, itemType string) []byte {
+		body := append([]byte{2, 0, 0, 0}, binary.BigEndian.AppendUint16(nil, id)...)
+		return mp4Atom("infe", append(append(body, 0, 0), itemType...))
+	}
+	iinf := mp4Atom("iinf", []byte{0, 0, 0, 0, 0, 2}, infe(1, "hvc1"), infe(2, "Exif"))
+	exifItem := append([]byte{0, 0, 0, 6}, append([]byte("Exif\x00\x00"), testTIFF()...)...)
+
+	// The Exif item follows the ftyp and meta boxes, so the location depends on the size of meta
+	iloc := func(offset uint32) []byte {
+		body := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 2}
+		body = append(body, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0) // Item 1, with an empty extent
+		body = append(body, 0, 2, 0, 0, 0, 1)
+		body = binary.BigEndian.AppendUint32(body, offset)
+		return mp4Atom("iloc", binary.BigEndian.AppendUint32(body, uint32(len(exifItem))))
+	}
+	ftyp := mp4Atom("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	meta := mp4Atom("meta", make([]byte, 4), iinf, iloc(0))
+	meta = mp4Atom("meta", make([]byte, 4), iinf, iloc(uint32(len(ftyp)+len(meta)+8)))
+	return bytes.Join([][]byte{ftyp, meta, mp4Atom("mdat", exifItem)}, nil)
+}
+
+func TestReadPhotoInfo(t *testing.T) {
+	expected := photoInfo{
+		CaptureTime: "2016-05-01T14:30:00+02:00",
+		CameraModel: "Canon EOS 5D",
+		GPS:         sql.NullBool{Bool: true, Valid: true},
+	}
+	testCases := []struct {
+		name string
+		ext  string
+		data []byte
+	}{
+		{"jpeg", ".JPG", testJPEG()},
+		{"heic", ".heic", testHEIC()},
+		{"raw", ".dng", testTIFF()},
+	}
+	for _, tc := range testCases {
+		if info := readPhotoInfo(tc.data, tc.ext); info != expected {
+			t.Errorf("%s: got %+v, want %+v", tc.name, info, expected)
+		}
+	}
+
+	// Corrupt and truncated files have no metadata instead of panicking
+	for _, tc := range testCases {
+		for _, data := range [][]byte{tc.data[:len(tc.data)/3], bytes.Repeat([]byte{0xff}, 64), nil} {
+			_ = readPhotoInfo(data, tc.ext)
+		}
+	}
+	if info := readPhotoInfo([]byte("not a photo"), ".jpg"); info != (photoInfo{}) {
+		t.Errorf("readPhotoInfo() of a text file = %+v, want nothing", info)
+	}
+}
+
+func TestProcessDirectoryEXIF(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"photo.jpg", string(testJPEG())},
+		{"scan.jpg", "no exif"},
+		{"notes.txt", "notes"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, EXIF: true}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var captured, model sql.NullString
+	var gps sql.NullBool
+	err := db.QueryRow("SELECT capture_time, camera_model, gps FROM photo_info WHERE path = ?",
+		filepath.Join(root, "photo.jpg")).Scan(&captured, &model, &gps)
+	if err != nil || captured.String != "2016-05-01T14:30:00+02:00" || model.String != "Canon EOS 5D" || !gps.Bool {
+		t.Errorf("got %v, %v, %v, %v for photo.jpg", captured, model, gps, err)
+	}
+	err = db.QueryRow("SELECT capture_time, gps FROM photo_info WHERE path = ?",
+		filepath.Join(root, "scan.jpg")).Scan(&captured, &gps)
+	if err != nil || captured.Valid || gps.Valid {
+		t.Errorf("got %v, %v, %v for scan.jpg, want NULLs", captured, gps, err)
+	}
+
+	for _, tc := range []struct {
+		captured string
+		expected string
+	}{
+		{"2016", filepath.Join(root, "photo.jpg")},
+		{"2016-05", filepath.Join(root, "photo.jpg")},
+		{"2016-05-02", ""},
+		{"2015", ""},
+	} {
+		var out bytes.Buffer
+		if err := findFiles(db, findFilter{Captured: tc.captured}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(out.Bytes(), []byte(tc.expected)) || (tc.expected == "") != (out.Len() == 0) {
+			t.Errorf("find -captured %s = %q, want %q", tc.captured, out.String(), tc.expected)
+		}
+	}
+
+	// Unchanged photos that were crawled without -exif get it on the next crawl
+	if _, err := db.Exec("DELETE FROM photo_info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM photo_info").Scan(&count); err != nil || count != 2 {
+		t.Errorf("after a second crawl, got %d photo_info rows, %v, want 2", count, err)
+	}
+}
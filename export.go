@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runExport implements the export subcommand, which writes the indexed metadata in other formats
+func runExport(args []string) error {
+	var dbFile string
+	var exportType string
+	var output string
+	var flatten bool
+	var checksumFile string
+	var algorithm string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&exportType, "type", "", "Export type: tar-manifest, ndjson or tsv")
+	flags.StringVar(&output, "output", "", "Output file (default standard output)")
+	flags.BoolVar(&flatten, "flatten-export", true,
+		"In ndjson and tsv exports, replace the folder_id of each file, which is only meaningful inside the database, by "+
+			"the path of its folder")
+	flags.StringVar(&checksumFile, "checksum-file", "",
+		"Write the hashes of the files in the format of sha256sum and similar tools to this file, instead of an "+
+			"export of -type; in a directory, the file is named after -hash-algo, e.g. SHA256SUMS")
+	flags.StringVar(&algorithm, "hash-algo", defaultHashAlgorithm,
+		"Hash algorithm of the files written with -checksum-file: md5, sha1, sha256, sha512 or blake3")
+	_ = flags.Parse(args)
+
+	if checksumFile != "" {
+		if exportType != "" || output != "" {
+			return errors.New("-checksum-file can't be combined with -type or -output")
+		}
+		if _, ok := hashAlgorithms[algorithm]; !ok {
+			return fmt.Errorf("unknown hash algorithm %q", algorithm)
+		}
+		output = checksumFile
+		if info, err := os.Stat(checksumFile); err == nil && info.IsDir() {
+			output = filepath.Join(checksumFile, checksumFileName(algorithm))
+		}
+		exportType = "checksums"
+	}
+
+	var export func(db *sql.DB, w io.Writer) error
+	switch exportType {
+	case "checksums":
+		export = func(db *sql.DB, w io.Writer) error { return exportChecksumFile(db, w, algorithm) }
+	case "tar-manifest":
+		export = exportTarManifest
+	case "ndjson":
+		export = func(db *sql.DB, w io.Writer) error { return exportNDJSON(db, w, flatten) }
+	case "tsv":
+		export = func(db *sql.DB, w io.Writer) error { return exportTSV(db, w, flatten) }
+	default:
+		flags.PrintDefaults()
+		return fmt.Errorf("unknown export type %q", exportType)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if output == "" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := export(db, w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := export(db, w); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// exportTarManifest writes a pax tar archive with an empty entry for each file, directory and symlink that was
+// indexed without errors. The headers carry the stored metadata: the original size, which can't go in the size
+// field of an entry without data, is in a CRAWLER.size record, and sha256 hashes are in SCHILY.xattr.user.sha256.
+// Entries belong to the stored owner, with its user and group names where they resolve on this system, or to uid
+// and gid 0 where no owner is stored.
+func exportTarManifest(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT path, COALESCE(dir, 0), COALESCE(symlink, ''), COALESCE(size, 0), COALESCE(modification_time, ''),
+	       COALESCE(mode, -1), COALESCE(` + hashHexColumn + `, ''), COALESCE(hash_algorithm, 'sha256'),
+	       COALESCE(uid, -1), COALESCE(gid, -1)
+	FROM files
+	WHERE exclusion_pattern IS NULL AND error IS NULL
+	ORDER BY path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tar.NewWriter(w)
+	userNames, groupNames := ownerNames(userName), ownerNames(groupName)
+	for rows.Next() {
+		var path, symlink, modificationTime, hash, algorithm string
+		var dir bool
+		var size, mode, uid, gid int64
+		err := rows.Scan(&path, &dir, &symlink, &size, &modificationTime, &mode, &hash, &algorithm, &uid, &gid)
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Name:       strings.TrimPrefix(path, "/"),
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{},
+		}
+		switch {
+		case dir:
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case symlink != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = symlink
+			header.Mode = 0777
+		default:
+			header.PAXRecords["CRAWLER.size"] = fmt.Sprint(size)
+			if hash != "" && algorithm == "sha256" {
+				header.PAXRecords["SCHILY.xattr.user.sha256"] = hash
+			}
+		}
+		if header.Name == "" || header.Name == "/" {
+			continue // The root directory has no name in a tar archive
+		}
+		if mode >= 0 {
+			header.Mode = mode
+		}
+		if t, err := time.Parse(time.RFC3339, modificationTime); err == nil {
+			header.ModTime = t
+		}
+		if uid >= 0 {
+			header.Uid, header.Uname = int(uid), userNames(uid)
+		}
+		if gid >= 0 {
+			header.Gid, header.Gname = int(gid), groupNames(gid)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ownerNames returns a function giving the name of a user or group ID with lookup, or "" if it doesn't resolve.
+// Each ID is only looked up once.
+func ownerNames(lookup func(id string) (string, error)) func(id int64) string {
+	names := make(map[int64]string)
+	return func(id int64) string {
+		name, ok := names[id]
+		if !ok {
+			name, _ = lookup(strconv.FormatInt(id, 10))
+			names[id] = name
+		}
+		return name
+	}
+}
+
+// exportChecksumFile writes the files hashed with algorithm in the format of sha256sum and the similar tools of
+// the other algorithms, such as md5sum and b3sum, so that they can be checked with --check: the hex hash, two
+// spaces and the path on the file system, one file per line. Like those tools, paths with a backslash or a newline
+// are escaped, and their line starts with a backslash. Files with errors, bundles and folders are left out.
+func exportChecksumFile(db *sql.DB, w io.Writer, algorithm string) error {
+	locations, err := loadRootLocations(db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+	SELECT path, COALESCE(path_encoding, 'utf8'), `+hashHexColumn+`
+	FROM files
+	WHERE hash IS NOT NULL AND error IS NULL AND COALESCE(hash_algorithm, ?) = ?
+	      AND COALESCE(dir, 0) = 0 AND COALESCE(bundle, 0) = 0
+	ORDER BY path`, defaultHashAlgorithm, algorithm)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, encoding, hash string
+		if err := rows.Scan(&path, &encoding, &hash); err != nil {
+			return err
+		}
+		path = locations.osPath(decodePath(path, encoding))
+		prefix := ""
+		if strings.ContainsAny(path, "\\\n") {
+			prefix, path = "\\", checksumEscaper.Replace(path)
+		}
+		if _, err := fmt.Fprintf(w, "%s%s  %s\n", prefix, hash, path); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// checksumEscaper escapes the paths of a checksum file like sha256sum does
+var checksumEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+// checksumFileName returns the conventional name of a checksum file of algorithm, e.g. SHA256SUMS
+func checksumFileName(algorithm string) string {
+	return strings.ToUpper(algorithm) + "SUMS"
+}
+
+// exportNDJSON writes each row of the files table as a line of JSON, in the format read by import. Hashes are
+// written as hex, however they are stored. With flatten, the folder of each file is written as its path instead
+// of its folder_id, so that the export can be used without the folders table.
+func exportNDJSON(db *sql.DB, w io.Writer, flatten bool) error {
+	encoder := json.NewEncoder(w)
+	return forEachFileRecord(db, flatten, func(r *fileRecord) error {
+		return encoder.Encode(r)
+	})
+}
+
+// exportTSV writes the files table as tab-separated values with a header line. The columns are the fields of the
+// ndjson export, in the same order, with the same choice between folder and folder_id. Missing values are empty.
+// Tabs, newlines and backslashes in values are escaped as \t, \n, \r and \\, so that every line is one row.
+func exportTSV(db *sql.DB, w io.Writer, flatten bool) error {
+	columns := fileRecordColumns(flatten)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+	}
+	if _, err := io.WriteString(w, strings.Join(names, "\t")+"\n"); err != nil {
+		return err
+	}
+
+	values := make([]string, len(columns))
+	return forEachFileRecord(db, flatten, func(r *fileRecord) error {
+		record := reflect.ValueOf(r).Elem()
+		for i, column := range columns {
+			values[i] = tsvEscaper.Replace(formatRecordValue(record.Field(column.field)))
+		}
+		_, err := io.WriteString(w, strings.Join(values, "\t")+"\n")
+		return err
+	})
+}
+
+// tsvEscaper escapes the characters that can't appear literally in a TSV value
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// recordColumn is a field of fileRecord exported as a column
+type recordColumn struct {
+	name  string // Name of the JSON field
+	field int    // Index of the field in fileRecord
+}
+
+// fileRecordColumns returns the columns of the exports: the fields of fileRecord in order, named after their JSON
+// fields, with folder instead of folder_id if flatten is set, and the other way around otherwise
+func fileRecordColumns(flatten bool) []recordColumn {
+	var columns []recordColumn
+	recordType := reflect.TypeOf(fileRecord{})
+	for i := 0; i < recordType.NumField(); i++ {
+		name, _, _ := strings.Cut(recordType.Field(i).Tag.Get("json"), ",")
+		if (flatten && name == "folder_id") || (!flatten && name == "folder") {
+			continue
+		}
+		columns = append(columns, recordColumn{name: name, field: i})
+	}
+	return columns
+}
+
+// formatRecordValue formats a field of fileRecord for a text export, with nil pointers as empty strings
+func formatRecordValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// forEachFileRecord calls fn with each row of the files table, ordered by path. Hashes are hex, however they are
+// stored. With flatten, records have the path of their folder instead of its folder_id.
+func forEachFileRecord(db *sql.DB, flatten bool, fn func(r *fileRecord) error) error {
+	rows, err := db.Query(`
+	SELECT files.path, name, type, creation_time, modification_time, ` + hashHexColumn + `, hash_algorithm,
+	       COALESCE(size, 0), COALESCE(dir, 0), symlink, exclusion_pattern, error, folder_id, folders.path,
+	       parent_mtime, mode, mode_string, external_symlink, acl, depth, target_type, path_encoding, final_target,
+	       chain_length, head_hash, head_hash_size, macos_comment, content_type,
+	       COALESCE(bundle, 0), target_size, target_mtime, content_kind, magic, detected_type, phash, fuzzy_hash,
+	       fuzzy_algorithm, COALESCE(has_suid, 0), COALESCE(has_sgid, 0), COALESCE(has_sticky, 0), uid, gid, dev_id,
+	       inode, first_seen, last_verified, notes
+	FROM files LEFT JOIN folders ON files.folder_id = folders.id
+	ORDER BY files.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r fileRecord
+		err := rows.Scan(&r.Path, &r.Name, &r.Type, &r.CreationTime, &r.ModificationTime, &r.Hash, &r.HashAlgorithm,
+			&r.Size, &r.Dir, &r.Symlink, &r.ExclusionPattern, &r.Error, &r.FolderId, &r.Folder, &r.ParentModTime,
+			&r.Mode, &r.ModeString, &r.ExternalSymlink, &r.ACL, &r.Depth, &r.TargetType, &r.PathEncoding,
+			&r.FinalTarget, &r.ChainLength, &r.HeadHash, &r.HeadHashSize, &r.MacOSComment, &r.ContentType,
+			&r.Bundle, &r.TargetSize, &r.TargetModTime, &r.ContentKind, &r.Magic,
+			&r.DetectedType, &r.PHash, &r.FuzzyHash, &r.FuzzyAlgorithm,
+			&r.HasSUID, &r.HasSGID, &r.HasSticky, &r.UID, &r.GID, &r.DevID, &r.Inode, &r.FirstSeen, &r.LastVerified,
+			&r.Notes)
+		if err != nil {
+			return err
+		}
+		if flatten {
+			r.FolderId = nil
+		} else {
+			r.Folder = nil
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportTarManifest(t *testing.T) {
+	db := newTestDatabase(t)
+	hash := strings.Repeat("ab", 32)
+	for _, row := range []struct {
+		path, symlink, hash, algorithm string
+		dir                            bool
+		size, mode                     int64
+		uid, gid                       any
+	}{
+		{path: "/data", dir: true, mode: 0750},
+		{path: "/data/a.txt", size: 1234, mode: 04755, hash: hash, algorithm: "sha256", uid: 1234, gid: 4321},
+		{path: "/data/b.txt", size: 10, mode: 0600, hash: strings.Repeat("cd", 32), algorithm: "blake3"},
+		{path: "/data/link", symlink: "a.txt", mode: 0777},
+	} {
+		_, err := db.Exec(`
+		INSERT INTO files(path, dir, symlink, size, mode, hash, hash_algorithm, modification_time, uid, gid)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), '2023-06-01T12:00:00Z', ?, ?)`,
+			row.path, row.dir, row.symlink, row.size, row.mode, row.hash, row.algorithm, row.uid, row.gid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO files(path, error) VALUES ('/data/failed', 'opening file')"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportTarManifest(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var headers []*tar.Header
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+	if len(headers) != 4 {
+		t.Fatalf("got %d entries, want 4", len(headers))
+	}
+
+	modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	dir, file, other, link := headers[0], headers[1], headers[2], headers[3]
+	if dir.Name != "data/" || dir.Typeflag != tar.TypeDir || dir.Mode != 0750 || !dir.ModTime.Equal(modTime) {
+		t.Errorf("got directory entry %+v", dir)
+	}
+	if file.Name != "data/a.txt" || file.Size != 0 || file.Mode != 04755 ||
+		file.PAXRecords["CRAWLER.size"] != "1234" || file.PAXRecords["SCHILY.xattr.user.sha256"] != hash {
+		t.Errorf("got file entry %+v", file)
+	}
+	// Owners are kept, with the names that resolve
+	userName := ""
+	if u, err := user.LookupId("1234"); err == nil {
+		userName = u.Username
+	}
+	groupName := ""
+	if g, err := user.LookupGroupId("4321"); err == nil {
+		groupName = g.Name
+	}
+	if file.Uid != 1234 || file.Uname != userName || file.Gid != 4321 || file.Gname != groupName {
+		t.Errorf("got owner %d (%s) and group %d (%s), want 1234 (%s) and 4321 (%s)", file.Uid, file.Uname,
+			file.Gid, file.Gname, userName, groupName)
+	}
+	if dir.Uid != 0 || dir.Gid != 0 || dir.Uname != "" {
+		t.Errorf("got owner %d (%s) and group %d for a directory without one, want 0", dir.Uid, dir.Uname, dir.Gid)
+	}
+	if _, ok := other.PAXRecords["SCHILY.xattr.user.sha256"]; ok {
+		t.Errorf("got a sha256 record for a blake3 hash: %+v", other)
+	}
+	if link.Typeflag != tar.TypeSymlink || link.Linkname != "a.txt" {
+		t.Errorf("got symlink entry %+v", link)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, path := range []string{"/data", "/data/a.txt"} {
+		f := &FileInfo{
+			Path:         sql.NullString{String: path, Valid: true},
+			Hash:         sql.NullString{String: strings.Repeat("ab", 32), Valid: path == "/data/a.txt"},
+			Dir:          path == "/data",
+			PathEncoding: utf8Encoding,
+			DevID:        sql.NullInt64{Int64: 42, Valid: true},
+			Inode:        sql.NullInt64{Int64: 7, Valid: true},
+			FirstSeen:    sql.NullString{String: "2024-01-02T03:04:05Z", Valid: true},
+		}
+		if err := f.UpdateFolderId(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.upsert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec("UPDATE files SET notes = 'keep\tthis', last_verified = '2024-02-03T04:05:06Z' WHERE path = ?",
+		"/data/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flatten := range []bool{true, false} {
+		var buf bytes.Buffer
+		if err := exportNDJSON(db, &buf, flatten); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, want 2: %s", len(lines), buf.String())
+		}
+		var record fileRecord
+		if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Path != "/data/a.txt" || record.Hash == nil || *record.Hash != strings.Repeat("ab", 32) {
+			t.Errorf("got record %s", lines[1])
+		}
+		if flatten && (record.FolderId != nil || record.Folder == nil || *record.Folder != "/data") {
+			t.Errorf("flattened record %s doesn't have folder /data instead of folder_id", lines[1])
+		} else if !flatten && (record.FolderId == nil || record.Folder != nil) {
+			t.Errorf("record %s doesn't have a folder_id only", lines[1])
+		}
+	}
+
+	// The export can be imported into another database
+	var buf bytes.Buffer
+	if err := exportNDJSON(db, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestDatabase(t)
+	result, err := importRecords(imported, &buf, 10, NewProcessStats())
+	if err != nil || result.Inserted != 2 || result.Rejected != 0 {
+		t.Errorf("importing the export = %+v, %v, want 2 inserted", result, err)
+	}
+
+	// Including the columns a crawl can't rebuild
+	query := "SELECT notes, last_verified, first_seen, dev_id, inode FROM files WHERE path = '/data/a.txt'"
+	var expected, got [5]sql.NullString
+	for _, c := range []struct {
+		db     *sql.DB
+		values *[5]sql.NullString
+	}{{db, &expected}, {imported, &got}} {
+		v := c.values
+		if err := c.db.QueryRow(query).Scan(&v[0], &v[1], &v[2], &v[3], &v[4]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got != expected || !got[0].Valid || !got[4].Valid {
+		t.Errorf("imported notes, last_verified, first_seen, dev_id and inode = %v, want %v", got, expected)
+	}
+}
+
+func TestExportTSV(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, path := range []string{"/data", "/data/a\tb\nc.txt"} {
+		f := &FileInfo{
+			Path:         sql.NullString{String: path, Valid: true},
+			Dir:          path == "/data",
+			PathEncoding: utf8Encoding,
+		}
+		if err := f.UpdateFolderId(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.upsert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := exportTSV(db, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 rows: %q", len(lines), buf.String())
+	}
+	header := strings.Split(lines[0], "\t")
+	if header[0] != "path" || slices.Contains(header, "folder_id") || !slices.Contains(header, "folder") {
+		t.Errorf("got header %q", lines[0])
+	}
+	row := strings.Split(lines[2], "\t")
+	if len(row) != len(header) {
+		t.Fatalf("got %d values, want %d: %q", len(row), len(header), lines[2])
+	}
+	if row[0] != `/data/a\tb\nc.txt` {
+		t.Errorf("got path %q, want it escaped", row[0])
+	}
+	if folder := row[slices.Index(header, "folder")]; folder != "/data" {
+		t.Errorf("got folder %q, want /data", folder)
+	}
+	if hash := row[slices.Index(header, "hash")]; hash != "" {
+		t.Errorf("got hash %q, want an empty value", hash)
+	}
+}
+
+func TestExportChecksumFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"a.txt", "a"},
+		{"with  two spaces.txt", "spaces"},
+		{"back\\slash.txt", "backslash"},
+		{"sub/b.txt", "b"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("UPDATE files SET hash_algorithm = 'blake3' WHERE path = ?", filepath.Join(root, "sub/b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportChecksumFile(db, &buf, "sha256"); err != nil {
+		t.Fatal(err)
+	}
+	escaped := strings.ReplaceAll(filepath.Join(root, "back\\slash.txt"), "\\", "\\\\")
+	expected := fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte("a")), filepath.Join(root, "a.txt")) +
+		fmt.Sprintf("\\%x  %s\n", sha256.Sum256([]byte("backslash")), escaped) +
+		fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte("spaces")), filepath.Join(root, "with  two spaces.txt"))
+	if buf.String() != expected {
+		t.Errorf("exportChecksumFile() = %q, want %q", buf.String(), expected)
+	}
+
+	// The file checks with sha256sum itself
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum not found")
+	}
+	sums := filepath.Join(t.TempDir(), checksumFileName("sha256"))
+	if err := os.WriteFile(sums, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sha256sum", "--check", sums).CombinedOutput(); err != nil {
+		t.Errorf("sha256sum --check failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build amd64
+
+package main
+
+import (
+	"hash"
+
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+// fastSHA256 uses SHA extensions or AVX-512 when the CPU supports them
+var fastSHA256 func() hash.Hash = sha256simd.New
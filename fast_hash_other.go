@@ -0,0 +1,8 @@
+//go:build !amd64
+
+package main
+
+import "crypto/sha256"
+
+// fastSHA256 falls back to the standard library outside of x86-64
+var fastSHA256 = sha256.New
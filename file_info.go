@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bufio"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -10,11 +10,23 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 func createSchema(db *sql.DB) error {
-	_, err := db.Exec(`
+	version, err := getDBVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return &newerSchemaError{Version: version}
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	_, err = db.Exec(`
 	CREATE TABLE IF NOT EXISTS files (
 		path TEXT PRIMARY KEY,
 		name TEXT,
@@ -31,6 +43,7 @@ func createSchema(db *sql.DB) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS hash_idx ON files(hash);
+	CREATE INDEX IF NOT EXISTS folder_idx ON files(folder_id);
 
 	CREATE TABLE IF NOT EXISTS folders (
 		id INTEGER PRIMARY KEY,	    		
@@ -38,96 +51,512 @@ func createSchema(db *sql.DB) error {
 	    parent_id INTEGER DEFAULT NULL
 	);
 
+	CREATE TABLE IF NOT EXISTS runs (
+		id INTEGER PRIMARY KEY,
+		command TEXT,
+		started_at TEXT,
+		finished_at TEXT DEFAULT NULL,
+		parameters TEXT,
+		results TEXT DEFAULT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS roots (
+		path TEXT PRIMARY KEY,
+		first_crawled TEXT,
+		last_crawled TEXT,
+		last_run_id INTEGER REFERENCES runs(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS media_info (
+		path TEXT PRIMARY KEY,
+		duration REAL,
+		width INTEGER,
+		height INTEGER,
+		codec TEXT,
+		error TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS photo_info (
+		path TEXT PRIMARY KEY,
+		capture_time TEXT,
+		camera_model TEXT,
+		gps INTEGER
+	);
+
+	CREATE TABLE IF NOT EXISTS chunks (
+		path TEXT,
+		offset INTEGER,
+		length INTEGER,
+		hash TEXT,
+		PRIMARY KEY (path, offset)
+	);
+
+	CREATE TABLE IF NOT EXISTS corruptions (
+		id INTEGER PRIMARY KEY,
+		path TEXT,
+		detected_at TEXT,
+		last_seen TEXT,
+		stored_hash TEXT,
+		actual_hash TEXT,
+		stored_mtime TEXT,
+		actual_mtime TEXT,
+		crawl_id INTEGER,
+		resolved_at TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS run_folder_sizes (
+		run_id INTEGER REFERENCES runs(id),
+		root TEXT,
+		path TEXT,
+		files INTEGER,
+		bytes INTEGER,
+		PRIMARY KEY (run_id, path)
+	);
+
+
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	for _, column := range []struct{ name, definition string }{
+		{"hash_algorithm", "TEXT DEFAULT NULL"},
+		{"parent_mtime", "TEXT DEFAULT NULL"},
+		{"mode", "INTEGER DEFAULT NULL"},
+		{"mode_string", "TEXT DEFAULT NULL"},
+		{"external_symlink", "INTEGER DEFAULT NULL"},
+		{"acl", "TEXT DEFAULT NULL"},
+		{"depth", "INTEGER DEFAULT NULL"},
+		{"target_type", "TEXT DEFAULT NULL"},
+		{"path_encoding", "TEXT DEFAULT 'utf8'"},
+		{"final_target", "TEXT DEFAULT NULL"},
+		{"chain_length", "INTEGER DEFAULT NULL"},
+		{"notes", "TEXT DEFAULT NULL"},
+		{"head_hash", "TEXT DEFAULT NULL"},
+		{"head_hash_size", "INTEGER DEFAULT NULL"},
+		{"macos_comment", "TEXT DEFAULT NULL"},
+		{"content_type", "TEXT DEFAULT NULL"},
+		{"bundle", "INTEGER DEFAULT 0"},
+		{"category", "TEXT DEFAULT NULL"},
+		{"target_size", "INTEGER DEFAULT NULL"},
+		{"target_mtime", "TEXT DEFAULT NULL"},
+		{"content_kind", "TEXT DEFAULT NULL"},
+		{"magic", "TEXT DEFAULT NULL"},
+		{"detected_type", "TEXT DEFAULT NULL"},
+		{"long_name", "INTEGER DEFAULT 0"},
+		{"phash", "TEXT DEFAULT NULL"},
+		{"fuzzy_hash", "TEXT DEFAULT NULL"},
+		{"fuzzy_algorithm", "TEXT DEFAULT NULL"},
+		{"has_suid", "INTEGER DEFAULT 0"},
+		{"has_sgid", "INTEGER DEFAULT 0"},
+		{"has_sticky", "INTEGER DEFAULT 0"},
+		{"uid", "INTEGER DEFAULT NULL"},
+		{"gid", "INTEGER DEFAULT NULL"},
+		{"last_verified", "TEXT DEFAULT NULL"},
+		{"dev_id", "INTEGER DEFAULT NULL"},
+		{"inode", "INTEGER DEFAULT NULL"},
+		{"first_seen", "TEXT DEFAULT NULL"},
+		{"error_at", "TEXT DEFAULT NULL"},
+		{"error_run_id", "INTEGER DEFAULT NULL"},
+	} {
+		if err := ensureColumn(db, "files", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if err := backfillCategories(db); err != nil {
+		return err
+	}
+	if err := backfillSpecialPermissions(db); err != nil {
+		return err
+	}
+
+	if err := ensureColumn(db, "roots", "location", "TEXT DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "folders", "tree_hash", "TEXT DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "folders", "tree_size", "INTEGER DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "folders", "signature", "TEXT DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "folders", "signature_run_id", "INTEGER DEFAULT NULL"); err != nil {
+		return err
+	}
 
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS depth_idx ON files(depth);
+	CREATE INDEX IF NOT EXISTS head_hash_idx ON files(head_hash);
+	CREATE INDEX IF NOT EXISTS capture_time_idx ON photo_info(capture_time);
+	CREATE INDEX IF NOT EXISTS suid_idx ON files(has_suid);
+	CREATE INDEX IF NOT EXISTS sgid_idx ON files(has_sgid);
+	CREATE INDEX IF NOT EXISTS chunks_hash_idx ON chunks(hash);
+	CREATE INDEX IF NOT EXISTS tree_hash_idx ON folders(tree_hash);
+	CREATE INDEX IF NOT EXISTS last_verified_idx ON files(last_verified);
+	CREATE UNIQUE INDEX IF NOT EXISTS corruptions_open_idx ON corruptions(path, stored_hash, actual_hash)
+		WHERE resolved_at IS NULL;
+	CREATE INDEX IF NOT EXISTS inode_idx ON files(dev_id, inode);
+	CREATE INDEX IF NOT EXISTS run_folder_sizes_root_idx ON run_folder_sizes(root, run_id);
 	`)
+	if err != nil {
+		return err
+	}
+	return setDBVersion(db, schemaVersion)
+}
+
+// schemaVersion is the version of the schema created by createSchema, which is stored in the user_version of
+// the database. It must be incremented with every change to createSchema, since databases that already have
+// this version are left as they are.
+const schemaVersion = 20
+
+// newerSchemaError is returned for a database created by a newer version of the crawler, which may have columns
+// that this version doesn't know how to fill
+type newerSchemaError struct {
+	Version int // Schema version of the database
+}
+
+func (e *newerSchemaError) Error() string {
+	return fmt.Sprintf("the database has schema version %d, but this version of the crawler only supports up to "+
+		"version %d; use a newer version of the crawler", e.Version, schemaVersion)
+}
+
+// getDBVersion returns the schema version of the database, 0 for new databases and those created before
+// versions were stored
+func getDBVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// setDBVersion stores the schema version of the database
+func setDBVersion(db *sql.DB, v int) error {
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", v))
+	return err
+}
+
+// fileCategories maps lowercase extensions to the category of the files that have them. Files with other
+// extensions are in the other category.
+var fileCategories = map[string]string{
+	".go": "code", ".py": "code", ".rs": "code",
+	".pdf": "document", ".docx": "document", ".xlsx": "document",
+	".mp4": "video", ".mkv": "video", ".avi": "video",
+	".mp3": "audio", ".flac": "audio", ".aac": "audio",
+	".jpg": "image", ".png": "image", ".gif": "image",
+	".zip": "archive", ".tar": "archive", ".gz": "archive",
+}
+
+// categorizeFile returns the category of files with the extension ext, as returned by filepath.Ext
+func categorizeFile(ext string) string {
+	if category, ok := fileCategories[strings.ToLower(ext)]; ok {
+		return category
+	}
+	return "other"
+}
+
+// backfillCategories sets the category of the files stored before categories were, from their type
+func backfillCategories(db *sql.DB) error {
+	var cases strings.Builder
+	var args []any
+	for ext, category := range fileCategories {
+		cases.WriteString(" WHEN ? THEN ?")
+		args = append(args, ext, category)
+	}
+	_, err := db.Exec(`UPDATE files SET category = CASE lower(type)`+cases.String()+` ELSE 'other' END
+	WHERE category IS NULL AND dir = 0`, args...)
+	return err
+}
+
+// backfillSpecialPermissions sets has_suid, has_sgid and has_sticky from the modes stored before they existed
+func backfillSpecialPermissions(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE files SET has_suid = (mode & 2048 != 0), has_sgid = (mode & 1024 != 0),
+	                   has_sticky = (mode & 512 != 0)
+	WHERE mode & 3584 != 0 AND has_suid = 0 AND has_sgid = 0 AND has_sticky = 0`)
+	return err
+}
+
+// ensureColumn adds column to table, unless it is already there
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
+// execQuerier is implemented by both *sql.DB and *sql.Tx, so that the same helpers can be used
+// inside and outside of transactions
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// crawlDB is what a crawl reads and writes: the database, or the connection holding the transaction around the
+// whole crawl with -transactional-scan, see scanTransaction
+type crawlDB interface {
+	execQuerier
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// FileInfo is the state of a single path while it is processed, and its row in the files table.
+//
+// A FileInfo is not safe for concurrent use and has no locking of its own: it is owned by one goroutine at a time,
+// which is the one walking the path. Work can be handed to another goroutine, e.g. hashing by a worker, as long as
+// ownership goes with it and the walker doesn't touch the FileInfo until the worker is done. All the Update
+// methods write fields, so WriteToDatabase must only be called once they have returned.
 type FileInfo struct {
 	d                fs.DirEntry
+	osPath           string // Path on the file system, which differs from Path if that is percent-encoded
 	Path             sql.NullString
 	Name             sql.NullString
 	Type             sql.NullString
 	CreationTime     sql.NullString
 	ModificationTime sql.NullString
 	Hash             sql.NullString
+	HashAlgorithm    sql.NullString
 	Size             int64
 	Dir              bool
 	Symlink          sql.NullString
 	ExclusionPattern sql.NullString
 	Error            sql.NullString
 	FolderId         int64
+	ParentModTime    sql.NullString // Modification time of the parent directory when the file was processed
+	Mode             sql.NullInt64  // Permission bits, including setuid, setgid and sticky, as in chmod
+	HasSUID          bool           // Whether the setuid bit is set, also part of Mode
+	HasSGID          bool           // Whether the setgid bit is set, also part of Mode
+	HasSticky        bool           // Whether the sticky bit is set, also part of Mode
+	UID              sql.NullInt64  // User ID of the owner, NULL where the file system doesn't have one
+	GID              sql.NullInt64  // Group ID of the owner, like UID
+	DevID            sql.NullInt64  // Device of the file, which with Inode identifies hard links to the same file
+	Inode            sql.NullInt64  // Inode number of the file, NULL where the file system doesn't have one
+	FirstSeen        sql.NullString // When the row was inserted, only stored then, see firstSeenTime
+	ErrorAt          sql.NullString // When Error was recorded, NULL without an error
+	ErrorRunId       sql.NullInt64  // ID of the crawl run that recorded Error, NULL without an error or a run
+	ModeString       sql.NullString // Symbolic mode as formatted by fs.FileMode.String
+	ExternalSymlink  sql.NullBool   // Whether a symlink points outside all roots of the crawl, NULL for other files
+	ACL              sql.NullString // Text form of a non-trivial ACL, only captured with -acls
+	Depth            sql.NullInt64  // Number of directory levels below the root of the crawl, 0 for the root itself
+	TargetType       sql.NullString // What a chain of symlinks ends at, see symlinkChain, NULL for other files
+	FinalTarget      sql.NullString // Where a chain of symlinks ends, NULL for other files
+	ChainLength      sql.NullInt64  // Number of symlinks followed to reach FinalTarget, NULL for other files
+	TargetSize       sql.NullInt64  // Size of FinalTarget, only captured with -strict-symlinks for existing targets
+	TargetModTime    sql.NullString // Modification time of FinalTarget, like TargetSize
+	ContentKind      sql.NullString // text, binary or empty, see classifyContent, NULL for files that weren't hashed
+	Magic            sql.NullString // First magicSize bytes, hex-encoded, NULL for files that weren't hashed
+	DetectedType     sql.NullString // Type recognized from Magic, see magicSignatures, NULL if it isn't recognized
+	LongName         bool           // Whether the name is longer than -warn-long-names bytes, see CheckNameLength
+	PHash            sql.NullString // Perceptual hash of an image, see dHash, only computed with -phash
+	FuzzyHash        sql.NullString // Similarity digest of the contents, only computed with -similarity-digest
+	FuzzyAlgorithm   sql.NullString // Key of similarityAlgorithms that computed FuzzyHash
+	HeadHash         sql.NullString // Hash of the first HeadHashSize bytes, computed instead of Hash
+	HeadHashSize     sql.NullInt64  // Number of bytes hashed into HeadHash, NULL without a head hash
+	MacOSComment     sql.NullString // Finder comment, only captured with -macos-metadata
+	ContentType      sql.NullString // Spotlight content type, e.g. public.jpeg, only captured with -macos-metadata
+	Bundle           bool           // Whether f is a bundle directory stored as a single entry, see hashBundle
+	Category         sql.NullString // Kind of file according to its extension, see categorizeFile, NULL for directories
+	PathEncoding     string         // utf8, or percent-encoded if the file system path is not valid UTF-8
 	isFifo           bool
+	device           uint64
+	links            uint64           // Number of hard links to the file, 0 if unknown
+	runId            int64            // ID of the crawl run processing f, 0 if there is none
+	now              func() time.Time // Clock of the crawl processing f, time.Now if nil
+	dbErrors         *dbErrorCounter  // Counts the failed writes of f, if not nil
+	hashProgress     *ProcessStats    // Receives the progress of hashing f, if not nil
+	media            *mediaResult     // Media metadata read by UpdateMediaInfo, nil if it wasn't
+	photo            *photoInfo       // EXIF metadata read by UpdatePhotoInfo, nil if it wasn't
+	chunks           []fileChunk      // Chunks found by UpdateHash with -chunk-files-above, nil if it didn't look
 }
 
-func NewFileInfo(path string, d fs.DirEntry) *FileInfo {
+// NewFileInfo returns the FileInfo of the file at osPath, which is stored under path
+func NewFileInfo(osPath, path string, d fs.DirEntry) *FileInfo {
 	info := &FileInfo{}
 	info.d = d
-	info.Path = sql.NullString{String: path, Valid: true}
-	info.Name = sql.NullString{String: d.Name(), Valid: true}
-	info.Type = sql.NullString{String: filepath.Ext(path), Valid: true}
+	info.osPath = osPath
+	encodedPath, encoding := encodePath(path)
+	if encoding != utf8Encoding {
+		log.Println("Path is not valid UTF-8, storing it percent-encoded:", encodedPath)
+	}
+	name, _ := encodePath(d.Name())
+	info.Path = sql.NullString{String: encodedPath, Valid: true}
+	info.Name = sql.NullString{String: name, Valid: true}
+	info.Type = sql.NullString{String: filepath.Ext(encodedPath), Valid: true}
+	info.PathEncoding = encoding
 	info.Dir = d.IsDir()
+	if !info.Dir {
+		info.Category = sql.NullString{String: categorizeFile(info.Type.String), Valid: true}
+	}
 	return info
 }
 
-func (f *FileInfo) WriteToDatabase(db *sql.DB) {
+// WriteToDatabase stores f. Failures are logged and counted, and the crawl decides whether to continue. It must
+// be called by the goroutine that owns f, after all updates to it are complete.
+func (f *FileInfo) WriteToDatabase(db execQuerier) error {
+	err := f.upsert(db)
+	if err != nil {
+		log.Println("Error inserting into database:", f.Path.String, err)
+	}
+	f.dbErrors.record(err)
+	return err
+}
+
+// upsert inserts or updates the row for f. Columns that aren't part of FileInfo, such as notes, are kept, except
+// for last_verified, which is cleared when the hash changes, since verify hasn't confirmed the new one. first_seen
+// is only set by the insert.
+func (f *FileInfo) upsert(db execQuerier) error {
+	dbMetrics.dbInsertCount.Add(1)
 	_, err := db.Exec(`
-	INSERT OR REPLACE INTO files(path, name, type, creation_time, modification_time, hash, size, dir, symlink, 
-	                             exclusion_pattern, error, folder_id)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, f.Path, f.Name, f.Type, f.CreationTime, f.ModificationTime, f.Hash, f.Size, f.Dir, f.Symlink,
-		f.ExclusionPattern, f.Error, f.FolderId)
+	INSERT INTO files(path, name, type, creation_time, modification_time, hash, hash_algorithm, size, 
+	                  dir, symlink, exclusion_pattern, error, folder_id, parent_mtime, mode, mode_string,
+	                  external_symlink, acl, depth, target_type, path_encoding, final_target, chain_length,
+	                  head_hash, head_hash_size, macos_comment, content_type, bundle, category, target_size,
+	                  target_mtime, content_kind, magic, detected_type, long_name, phash, fuzzy_hash,
+	                  fuzzy_algorithm, has_suid, has_sgid, has_sticky, uid, gid, dev_id, inode, first_seen, error_at,
+	                  error_run_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+	        ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(path) DO UPDATE
+	SET name=excluded.name, type=excluded.type, creation_time=excluded.creation_time,
+	    modification_time=excluded.modification_time, hash=excluded.hash, hash_algorithm=excluded.hash_algorithm,
+	    size=excluded.size, dir=excluded.dir, symlink=excluded.symlink,
+	    exclusion_pattern=excluded.exclusion_pattern, error=excluded.error, folder_id=excluded.folder_id,
+	    parent_mtime=excluded.parent_mtime, mode=excluded.mode, mode_string=excluded.mode_string,
+	    external_symlink=excluded.external_symlink, acl=excluded.acl, depth=excluded.depth,
+	    target_type=excluded.target_type, path_encoding=excluded.path_encoding,
+	    final_target=excluded.final_target, chain_length=excluded.chain_length, head_hash=excluded.head_hash,
+	    head_hash_size=excluded.head_hash_size, macos_comment=excluded.macos_comment,
+	    content_type=excluded.content_type, bundle=excluded.bundle, category=excluded.category,
+	    target_size=excluded.target_size, target_mtime=excluded.target_mtime, content_kind=excluded.content_kind,
+	    magic=excluded.magic, detected_type=excluded.detected_type, long_name=excluded.long_name,
+	    phash=excluded.phash, fuzzy_hash=excluded.fuzzy_hash, fuzzy_algorithm=excluded.fuzzy_algorithm,
+	    has_suid=excluded.has_suid, has_sgid=excluded.has_sgid, has_sticky=excluded.has_sticky, uid=excluded.uid,
+	    gid=excluded.gid, dev_id=excluded.dev_id, inode=excluded.inode, error_at=excluded.error_at,
+	    error_run_id=excluded.error_run_id,
+	    last_verified=CASE WHEN files.hash IS excluded.hash AND files.hash_algorithm IS excluded.hash_algorithm
+	                       THEN files.last_verified END
+	`, f.Path, f.Name, f.Type, f.CreationTime, f.ModificationTime, hashValue(f.Hash), f.HashAlgorithm, f.Size, f.Dir,
+		f.Symlink, f.ExclusionPattern, f.Error, f.FolderId, f.ParentModTime, f.Mode, f.ModeString,
+		f.ExternalSymlink, f.ACL, f.Depth, f.TargetType, f.PathEncoding, f.FinalTarget, f.ChainLength, f.HeadHash,
+		f.HeadHashSize, f.MacOSComment, f.ContentType, f.Bundle, f.Category, f.TargetSize, f.TargetModTime,
+		f.ContentKind, f.Magic, f.DetectedType, f.LongName, f.PHash, f.FuzzyHash, f.FuzzyAlgorithm, f.HasSUID,
+		f.HasSGID, f.HasSticky, f.UID, f.GID, f.DevID, f.Inode, f.FirstSeen, f.ErrorAt, f.ErrorRunId)
+	return err
+}
+
+// UpdateMetadata stores the metadata that can change without changing the modification time of a file:
+// the parent directory modification time, the mode, the ACL, the Spotlight metadata and the symlink target type,
+// as well as the depth and whether a symlink is external, which depend on the roots, the long name flag, which
+// depends on -warn-long-names, and the device and inode, which change when a file is copied with its
+// modification time
+func (f *FileInfo) UpdateMetadata(db execQuerier) error {
+	_, err := db.Exec(`
+	UPDATE files SET parent_mtime=?, mode=?, mode_string=?, external_symlink=?, acl=?, depth=?, target_type=?,
+	                 macos_comment=?, content_type=?, long_name=?, has_suid=?, has_sgid=?, has_sticky=?, uid=?,
+	                 gid=?, dev_id=?, inode=?
+	WHERE path=?`,
+		f.ParentModTime, f.Mode, f.ModeString, f.ExternalSymlink, f.ACL, f.Depth, f.TargetType, f.MacOSComment,
+		f.ContentType, f.LongName, f.HasSUID, f.HasSGID, f.HasSticky, f.UID, f.GID, f.DevID, f.Inode, f.Path)
 	if err != nil {
-		log.Fatalln("Error inserting into database:", err)
+		log.Println("Error updating database:", f.Path.String, err)
 	}
+	f.dbErrors.record(err)
+	return err
 }
 
-func (f *FileInfo) WriteError(msg string, err error, db *sql.DB) {
+func (f *FileInfo) WriteError(msg string, err error, db execQuerier) {
 	f.Error = sql.NullString{String: fmt.Sprintf("%s: %s", msg, err), Valid: true}
+	now := time.Now
+	if f.now != nil {
+		now = f.now
+	}
+	f.ErrorAt = sql.NullString{String: now().UTC().Format(time.RFC3339), Valid: true}
+	f.ErrorRunId = sql.NullInt64{Int64: f.runId, Valid: f.runId > 0}
+	progress.Send(progressEvent{Type: "error", Path: f.Path.String, Error: f.Error.String})
 	f.WriteToDatabase(db)
 }
 
-func (f *FileInfo) UpdateFolderId(db *sql.DB) error {
+func (f *FileInfo) UpdateFolderId(db execQuerier) error {
 	var err error
-	f.FolderId, err = getFolderID(db, filepath.Dir(f.Path.String))
+	f.FolderId, err = getFolderID(db, parentDir(f.Path.String))
 	if err != nil {
 		f.WriteError("getting folder ID", err, db)
 	}
 	return err
 }
 
-// getFolderID returns the ID of the folder with the given path, or creates a new folder and returns its ID
-func getFolderID(db *sql.DB, path string) (int64, error) {
-	var id int64
-	err := db.QueryRow("SELECT id FROM folders WHERE path=?", path).Scan(&id)
-	if err == nil {
-		return id, nil
+// getFolderID returns the ID of the folder with the given path, creating it and its missing ancestors. Missing
+// folders are created from the shallowest to the deepest in a single transaction, or in the transaction db
+// belongs to. This is a loop rather than recursion, so that arbitrarily deep trees don't overflow the stack.
+func getFolderID(db execQuerier, path string) (int64, error) {
+	// The path and its ancestors that don't exist yet, deepest first
+	var missing []string
+	var parentId sql.NullInt64
+	for {
+		var id int64
+		dbMetrics.dbQueryCount.Add(1)
+		err := db.QueryRow("SELECT id FROM folders WHERE path=?", path).Scan(&id)
+		if err == nil && len(missing) == 0 {
+			dbMetrics.folderCacheHits.Add(1)
+			return id, nil
+		} else if err == nil {
+			parentId = sql.NullInt64{Int64: id, Valid: true}
+			break
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		missing = append(missing, path)
+		if parentDir(path) == path {
+			break
+		}
+		path = parentDir(path)
 	}
+	dbMetrics.folderCacheMisses.Add(1)
 
-	if !errors.Is(err, sql.ErrNoRows) {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return insertFolders(db, missing, parentId)
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
 		return 0, err
 	}
+	id, err := insertFolders(tx, missing, parentId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
 
-	if path == "/" {
-		res, err := db.Exec("INSERT INTO folders(path) VALUES (?)", path)
-		if err != nil {
-			return 0, err
-		}
-		return res.LastInsertId()
-	} else {
-		parentId, err := getFolderID(db, filepath.Dir(path))
+// insertFolders creates the folders at paths, which are ordered from the deepest to the shallowest, each the
+// parent of the one before it. The shallowest folder gets parentId. It returns the ID of the deepest folder.
+// Another goroutine may create the same folders after getFolderID looked them up, in which case theirs are kept.
+func insertFolders(db execQuerier, paths []string, parentId sql.NullInt64) (int64, error) {
+	var id int64
+	for i := len(paths) - 1; i >= 0; i-- {
+		_, err := db.Exec("INSERT INTO folders(path, parent_id) VALUES (?, ?) ON CONFLICT(path) DO NOTHING",
+			paths[i], parentId)
 		if err != nil {
 			return 0, err
 		}
-		res, err := db.Exec("INSERT INTO folders(path, parent_id) VALUES (?, ?)", path, parentId)
-		if err != nil {
+		dbMetrics.dbInsertCount.Add(1)
+		if err := db.QueryRow("SELECT id FROM folders WHERE path=?", paths[i]).Scan(&id); err != nil {
 			return 0, err
 		}
-		return res.LastInsertId()
+		parentId = sql.NullInt64{Int64: id, Valid: true}
 	}
+	return id, nil
 }
 
-func (f *FileInfo) UpdateInfo(db *sql.DB) error {
+func (f *FileInfo) UpdateInfo(db execQuerier) error {
 	info, err := f.d.Info()
 	if err != nil {
 		f.WriteError("getting file info", err, db)
@@ -136,12 +565,25 @@ func (f *FileInfo) UpdateInfo(db *sql.DB) error {
 		f.ModificationTime = sql.NullString{String: info.ModTime().Format(time.RFC3339), Valid: true}
 		f.Size = info.Size()
 		f.isFifo = info.Mode()&os.ModeNamedPipe != 0
+		f.device = getDeviceID(info)
+		f.Mode = sql.NullInt64{Int64: int64(posixMode(info.Mode())), Valid: true}
+		f.ModeString = sql.NullString{String: info.Mode().String(), Valid: true}
+		f.HasSUID = info.Mode()&os.ModeSetuid != 0
+		f.HasSGID = info.Mode()&os.ModeSetgid != 0
+		f.HasSticky = info.Mode()&os.ModeSticky != 0
+		f.UID, f.GID = getOwner(info)
+		if inode, links := getInode(info); inode != 0 {
+			f.DevID = sql.NullInt64{Int64: int64(f.device), Valid: true}
+			f.Inode = sql.NullInt64{Int64: int64(inode), Valid: true}
+			f.links = links
+		}
 		if info.Mode()&os.ModeSymlink != 0 {
 			var symlink string
-			symlink, err = os.Readlink(f.Path.String)
+			symlink, err = os.Readlink(f.osPath)
 			if err != nil {
 				f.WriteError("reading symlink", err, db)
 			} else {
+				symlink, _ = encodePath(symlink)
 				f.Symlink = sql.NullString{String: symlink, Valid: true}
 			}
 		}
@@ -149,8 +591,189 @@ func (f *FileInfo) UpdateInfo(db *sql.DB) error {
 	return err
 }
 
-func (f *FileInfo) UpdateHash(db *sql.DB, extraLogging bool) error {
-	file, err := os.Open(f.Path.String)
+// attributes returns the attributes of f tested by the qualifiers of exclusion patterns, once UpdateInfo has set them
+func (f *FileInfo) attributes() *fileAttributes {
+	modTime, err := time.Parse(time.RFC3339, f.ModificationTime.String)
+	if err != nil {
+		return nil
+	}
+	return &fileAttributes{Size: f.Size, ModTime: modTime}
+}
+
+// UpdateACL reads the ACL of the file. Errors are logged, but don't mark the file as failed.
+func (f *FileInfo) UpdateACL() {
+	acl, err := readACL(f.osPath)
+	if err != nil {
+		log.Println("Error reading ACL:", f.Path.String, err)
+		return
+	}
+	f.ACL = sql.NullString{String: acl, Valid: acl != ""}
+}
+
+// UpdateSpotlightMetadata reads the Finder comment and content type of the file with the mdls command at mdls.
+// Errors are logged, but don't mark the file as failed.
+func (f *FileInfo) UpdateSpotlightMetadata(mdls string) {
+	metadata, err := readSpotlightMetadata(mdls, f.osPath)
+	if err != nil {
+		log.Println("Error reading Spotlight metadata:", f.Path.String, err)
+		return
+	}
+	f.MacOSComment = sql.NullString{String: metadata.Comment, Valid: metadata.Comment != ""}
+	f.ContentType = sql.NullString{String: metadata.ContentType, Valid: metadata.ContentType != ""}
+}
+
+// UpdateMediaInfo parses the container headers of f, an audio or video file, from file, which is already open for
+// hashing, or from the file at osPath if file is nil. Errors are kept for WriteMediaInfo, but don't mark the file as
+// failed.
+func (f *FileInfo) UpdateMediaInfo(file io.ReaderAt) {
+	if file == nil {
+		opened, err := os.Open(f.osPath)
+		if err != nil {
+			f.media = &mediaResult{Err: err}
+			return
+		}
+		defer opened.Close()
+		file = opened
+	}
+	info, err := readMediaInfo(file, f.Size, f.Type.String)
+	f.media = &mediaResult{Info: info, Err: err}
+}
+
+// WriteChunks stores the chunks found by UpdateHash in the chunks table. It is called whenever f is hashed again,
+// so if UpdateHash found none, e.g. because the file shrank below -chunk-files-above, the chunks of its previous
+// contents are deleted.
+func (f *FileInfo) WriteChunks(db execQuerier) {
+	if f.chunks == nil {
+		// The delete succeeding says nothing about the row of f, so only a failure is counted
+		if _, err := db.Exec("DELETE FROM chunks WHERE path = ?", f.Path.String); err != nil {
+			log.Println("Error deleting chunks:", f.Path.String, err)
+			f.dbErrors.record(err)
+		}
+		return
+	}
+	err := writeChunks(db, f.Path.String, f.chunks)
+	if err != nil {
+		log.Println("Error storing chunks:", f.Path.String, err)
+	}
+	f.dbErrors.record(err)
+}
+
+// WriteMediaInfo stores the media metadata read by UpdateMediaInfo, if any, in the media_info table
+func (f *FileInfo) WriteMediaInfo(db execQuerier) {
+	if f.media == nil {
+		return
+	}
+	if f.media.Err != nil {
+		log.Println("Error reading media metadata:", f.Path.String, f.media.Err)
+	}
+	err := writeMediaInfo(db, f.Path.String, f.media.Info, f.media.Err)
+	if err != nil {
+		log.Println("Error storing media metadata:", f.Path.String, err)
+	}
+	f.dbErrors.record(err)
+}
+
+// UpdatePHash computes the perceptual hash of f, a JPEG or PNG image, from file, which is already open for hashing,
+// or from the file at osPath if file is nil. Images that can't be decoded are logged and keep a NULL hash, without
+// marking the file as failed.
+func (f *FileInfo) UpdatePHash(file io.ReaderAt) {
+	if file == nil {
+		opened, err := os.Open(f.osPath)
+		if err != nil {
+			log.Println("Error computing perceptual hash:", f.Path.String, err)
+			return
+		}
+		defer opened.Close()
+		file = opened
+	}
+	hash, err := readPHash(bufio.NewReader(io.NewSectionReader(file, 0, f.Size)))
+	if err != nil {
+		log.Println("Error computing perceptual hash:", f.Path.String, err)
+		return
+	}
+	f.PHash = sql.NullString{String: hash, Valid: true}
+}
+
+// WritePHash stores the perceptual hash computed by UpdatePHash for a file that isn't written again
+func (f *FileInfo) WritePHash(db execQuerier) {
+	if !f.PHash.Valid {
+		return
+	}
+	_, err := db.Exec("UPDATE files SET phash=? WHERE path=?", f.PHash, f.Path)
+	if err != nil {
+		log.Println("Error storing perceptual hash:", f.Path.String, err)
+	}
+	f.dbErrors.record(err)
+}
+
+// UpdatePhotoInfo reads the EXIF metadata of f, a photo, from header, the start of the file captured while it was
+// hashed, or from the file at osPath if header is nil. Values that are missing or can't be read are left empty.
+func (f *FileInfo) UpdatePhotoInfo(header []byte) {
+	if header == nil {
+		var err error
+		if header, err = readPhotoHeader(f.osPath); err != nil {
+			log.Println("Error reading EXIF metadata:", f.Path.String, err)
+			return
+		}
+	}
+	info := readPhotoInfo(header, f.Type.String)
+	f.photo = &info
+}
+
+// WritePhotoInfo stores the EXIF metadata read by UpdatePhotoInfo, if any, in the photo_info table
+func (f *FileInfo) WritePhotoInfo(db execQuerier) {
+	if f.photo == nil {
+		return
+	}
+	err := writePhotoInfo(db, f.Path.String, *f.photo)
+	if err != nil {
+		log.Println("Error storing EXIF metadata:", f.Path.String, err)
+	}
+	f.dbErrors.record(err)
+}
+
+// CheckNameLength sets LongName and logs a warning if the name of f is longer than limit bytes, which is close to
+// the 255 bytes most file systems allow, so that copying it elsewhere may fail. A limit of 0 disables the check.
+func (f *FileInfo) CheckNameLength(limit int) {
+	length := len(filepath.Base(f.osPath))
+	f.LongName = limit > 0 && length > limit
+	if f.LongName {
+		log.Printf("Warning: name of %d bytes: %s\n", length, f.Path.String)
+	}
+}
+
+// UpdateSymlinkChain resolves the chain of symlinks starting at f, and checks whether it ends outside roots.
+// With strict, the size and modification time of an existing final target are recorded too, without following the
+// link in the walk. Broken links keep them NULL, with a target type of missing, loop or error.
+func (f *FileInfo) UpdateSymlinkChain(roots []string, strict bool) {
+	chain := resolveSymlinkChain(f.osPath)
+	finalTarget, _ := encodePath(chain.FinalTarget)
+	f.FinalTarget = sql.NullString{String: finalTarget, Valid: true}
+	f.ChainLength = sql.NullInt64{Int64: int64(chain.Length), Valid: true}
+	f.TargetType = sql.NullString{String: chain.TargetType, Valid: true}
+	f.ExternalSymlink = sql.NullBool{Bool: !isUnderRoots(chain.FinalTarget, roots), Valid: true}
+	if !strict {
+		return
+	}
+	switch chain.TargetType {
+	case "missing", "loop", "error":
+		return
+	}
+	info, err := os.Stat(chain.FinalTarget)
+	if err != nil {
+		// The target disappeared after the chain was resolved
+		f.TargetType = sql.NullString{String: "error", Valid: true}
+		return
+	}
+	f.TargetSize = sql.NullInt64{Int64: info.Size(), Valid: true}
+	f.TargetModTime = sql.NullString{String: info.ModTime().Format(time.RFC3339), Valid: true}
+}
+
+// UpdateHash hashes the file contents with the algorithm selected by opts.HashRules. A file that ends before the
+// size reported by stat is an error rather than the hash of part of it, since a truncated read, e.g. on a network
+// file system, would otherwise go unnoticed. Files that grew since stat are hashed as they are.
+func (f *FileInfo) UpdateHash(db execQuerier, opts *crawlOptions) error {
+	file, err := os.Open(f.osPath)
 	if err != nil {
 		f.WriteError("opening file", err, db)
 		return err
@@ -164,16 +787,19 @@ func (f *FileInfo) UpdateHash(db *sql.DB, extraLogging bool) error {
 
 	sizeMb := float64(f.Size) / (1024 * 1024)
 
-	if extraLogging {
-		readStart := time.Now()
+	if opts.ExtraLogging {
+		readStart := opts.now()
 		_, err = io.Copy(io.Discard, file)
 		if err != nil {
 			f.WriteError("reading file", err, db)
 			return err
 		}
-		readDuration := time.Since(readStart)
+		readDuration := opts.now().Sub(readStart)
 		readSpeed := sizeMb / readDuration.Seconds() // MB/s
 		log.Printf("Read speed for %s [%.2f MB]: %.2f MB/s\n", f.Path.String, sizeMb, readSpeed)
+		if opts.Throughput != nil {
+			opts.Throughput.Add(f.Path.String, f.Size, readSpeed)
+		}
 
 		// Reset file pointer to the beginning
 		_, err = file.Seek(0, 0)
@@ -183,18 +809,147 @@ func (f *FileInfo) UpdateHash(db *sql.DB, extraLogging bool) error {
 		}
 	}
 
-	hashStart := time.Now()
-	hash := sha256.New()
-	_, err = io.Copy(hash, file)
+	hashStart := opts.now()
+	algorithm := hashAlgorithmFor(f.Path.String, opts.HashRules)
+	hash := hashAlgorithms[algorithm]()
+	header := &headerCapture{limit: contentSampleSize}
+	photo := opts.EXIF && isPhotoFile(f.Type.String)
+	if photo {
+		header.limit = exifHeaderSize
+	}
+	hash = capturingHash{Hash: hash, capture: header}
+	digest := newSimilarityDigest(opts.SimilarityDigest)
+	if digest != nil {
+		hash = teeHash{Hash: hash, w: digest}
+	}
+	var chunks *chunker
+	if opts.ChunkThreshold > 0 && f.Size >= opts.ChunkThreshold {
+		chunks = newChunker()
+		hash = teeHash{Hash: hash, w: chunks}
+	}
+	var reader io.Reader = file
+	if f.hashProgress != nil {
+		reader = &progressReader{r: file, stats: f.hashProgress, size: f.Size}
+	}
+	var read int64
+	if opts.DoubleBufferSize > 0 && f.Size > 2*int64(opts.DoubleBufferSize) {
+		read, err = hashReader(hash, reader, opts.DoubleBufferSize, opts.now)
+	} else {
+		read, err = io.Copy(hash, reader)
+	}
 	if err != nil {
 		f.WriteError("hashing file", err, db)
 		return err
 	}
+	if read < f.Size {
+		err = fmt.Errorf("read %d bytes, but the size is %d", read, f.Size)
+		f.WriteError("short read", err, db)
+		return err
+	}
+	if opts.MediaMetadata && isMediaFile(f.Type.String) {
+		f.UpdateMediaInfo(file)
+	}
+	if photo {
+		f.UpdatePhotoInfo(header.buf)
+	}
+	f.updateContentInfo(header.buf, read)
+	if opts.PHash && pHashTypes[f.DetectedType.String] {
+		f.UpdatePHash(file)
+	}
 	f.Hash = sql.NullString{String: fmt.Sprintf("%x", hash.Sum(nil)), Valid: true}
-	if extraLogging {
-		hashDuration := time.Since(hashStart)
+	f.HashAlgorithm = sql.NullString{String: algorithm, Valid: true}
+	if chunks != nil {
+		f.chunks = chunks.finish()
+	}
+	if digest != nil {
+		f.FuzzyHash = sql.NullString{String: string(digest.Sum(nil)), Valid: true}
+		f.FuzzyAlgorithm = sql.NullString{String: opts.SimilarityDigest, Valid: true}
+	}
+	if opts.ExtraLogging {
+		hashDuration := opts.now().Sub(hashStart)
 		hashSpeed := sizeMb / hashDuration.Seconds() // MB/s
 		log.Printf("Hash speed for %s [%.2f MB]: %.2f MB/s\n", f.Path.String, sizeMb, hashSpeed)
 	}
 	return nil
 }
+
+// updateContentInfo sets the content kind, magic and detected type of f, of the given size, from header, its start
+func (f *FileInfo) updateContentInfo(header []byte, size int64) {
+	f.ContentKind = sql.NullString{String: classifyContent(header, size), Valid: true}
+	f.Magic = sql.NullString{String: encodeMagic(header), Valid: true}
+	detectedType := detectType(header)
+	f.DetectedType = sql.NullString{String: detectedType, Valid: detectedType != ""}
+}
+
+// UpdateHeadHash sets HeadHash to the hash of the first opts.HeadHashSize bytes of the file, or of the whole file
+// if it is shorter. The file is read once from the start, without seeking.
+func (f *FileInfo) UpdateHeadHash(db execQuerier, opts *crawlOptions) error {
+	size := opts.HeadHashSize
+	file, err := os.Open(f.osPath)
+	if err != nil {
+		f.WriteError("opening file", err, db)
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing file:", err)
+		}
+	}(file)
+
+	algorithm := hashAlgorithmFor(f.Path.String, opts.HashRules)
+	header := &headerCapture{limit: contentSampleSize}
+	hash := capturingHash{Hash: hashAlgorithms[algorithm](), capture: header}
+	if _, err := io.CopyN(hash, file, size); err != nil && !errors.Is(err, io.EOF) {
+		f.WriteError("hashing file", err, db)
+		return err
+	}
+	f.updateContentInfo(header.buf, f.Size)
+	f.HeadHash = sql.NullString{String: fmt.Sprintf("%x", hash.Sum(nil)), Valid: true}
+	f.HeadHashSize = sql.NullInt64{Int64: size, Valid: true}
+	f.HashAlgorithm = sql.NullString{String: algorithm, Valid: true}
+	return nil
+}
+
+// UpdateBundle turns f, a bundle directory, into a single entry with the total size of its files and the latest
+// modification time of anything inside it. It returns the contents for UpdateBundleHash.
+func (f *FileInfo) UpdateBundle(db execQuerier) (*bundleContents, error) {
+	contents, err := scanBundle(f.osPath)
+	if err != nil {
+		f.WriteError("reading bundle", err, db)
+		return nil, err
+	}
+	f.Dir = false
+	f.Bundle = true
+	f.Size = contents.Size
+	f.ModificationTime = sql.NullString{String: contents.ModificationTime.Format(time.RFC3339), Valid: true}
+	return contents, nil
+}
+
+// UpdateBundleHash sets Hash to the aggregate hash of the bundle with the given contents, see hashBundle
+func (f *FileInfo) UpdateBundleHash(db execQuerier, opts *crawlOptions, contents *bundleContents) error {
+	algorithm := hashAlgorithmFor(f.Path.String, opts.HashRules)
+	hash, err := hashBundle(f.osPath, contents, algorithm)
+	if err != nil {
+		f.WriteError("hashing bundle", err, db)
+		return err
+	}
+	f.Hash = sql.NullString{String: hash, Valid: true}
+	f.HashAlgorithm = sql.NullString{String: algorithm, Valid: true}
+	return nil
+}
+
+// posixMode converts the permission bits of mode to their numeric chmod representation
+func posixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
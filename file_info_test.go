@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGetFolderIDDeepPath(t *testing.T) {
+	db := newTestDatabase(t)
+	path := "/" + strings.Repeat("d/", 999) + "d"
+	id, err := getFolderID(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := getFolderID(db, path); err != nil || again != id {
+		t.Errorf("getFolderID() a second time = %d, %v, want %d", again, err, id)
+	}
+
+	// Every folder from the deepest one up has its parent as parent_id
+	var count int
+	err = db.QueryRow(`
+	WITH RECURSIVE chain(id, path, parent_id) AS (
+		SELECT id, path, parent_id FROM folders WHERE id = ?
+		UNION ALL
+		SELECT folders.id, folders.path, folders.parent_id FROM folders JOIN chain ON folders.id = chain.parent_id
+	)
+	SELECT COUNT(*) FROM chain`, id).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1001 {
+		t.Errorf("the chain of parents has %d folders, want 1001 including /", count)
+	}
+
+	// A sibling only creates itself below its existing parent
+	parent := path[:strings.LastIndex(path, "/")]
+	if _, err := getFolderID(db, parent+"/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM folders").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1002 {
+		t.Errorf("there are %d folders, want 1002", count)
+	}
+}
+
+func TestGetFolderIDConcurrent(t *testing.T) {
+	db := newTestDatabase(t)
+	const goroutines, rounds = 8, 20
+	ids := make([][rounds]int64, goroutines)
+	errs := make(chan error, goroutines*rounds)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			// All goroutines create the same new deep paths at the same time, racing on every folder
+			for round := 0; round < rounds; round++ {
+				var err error
+				ids[i][round], err = getFolderID(db, fmt.Sprintf("/r%d/%sd", round, strings.Repeat("d/", 20)))
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	for i := range ids {
+		if ids[i] != ids[0] {
+			t.Errorf("goroutine %d got %v, want %v", i, ids[i], ids[0])
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM folders").Scan(&count); err != nil || count != 1+rounds*22 {
+		t.Errorf("there are %d folders, %v, want %d", count, err, 1+rounds*22)
+	}
+}
+
+func TestCreateSchemaVersions(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "index.sqlite")
+
+	// A database from before versions were stored, with only the initial columns, is migrated
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE files (path TEXT PRIMARY KEY, name TEXT, type TEXT, creation_time TEXT,
+		modification_time TEXT, hash TEXT, size INTEGER, dir INTEGER DEFAULT 0, symlink TEXT DEFAULT '',
+		exclusion_pattern TEXT DEFAULT NULL, error TEXT DEFAULT NULL, folder_id INTEGER DEFAULT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeDatabase(db)
+
+	db, err = openDatabase(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := getDBVersion(db); err != nil || version != schemaVersion {
+		t.Errorf("getDBVersion() = %d, %v, want %d", version, err, schemaVersion)
+	}
+	f := &FileInfo{Path: sql.NullString{String: "/a", Valid: true}, Bundle: true}
+	if err := f.upsert(db); err != nil {
+		t.Errorf("writing to the migrated database: %v", err)
+	}
+
+	// A database from a newer version is refused
+	if err := setDBVersion(db, schemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	closeDatabase(db)
+	_, err = openDatabase(dbFile)
+	var newer *newerSchemaError
+	if !errors.As(err, &newer) || newer.Version != schemaVersion+1 {
+		t.Errorf("opening a newer database returned %v, want a newerSchemaError", err)
+	}
+}
+
+func TestCategorizeFile(t *testing.T) {
+	testCases := []struct {
+		ext      string
+		expected string
+	}{
+		{".go", "code"},
+		{".PDF", "document"},
+		{".mkv", "video"},
+		{".flac", "audio"},
+		{".Jpg", "image"},
+		{".gz", "archive"},
+		{".txt", "other"},
+		{"", "other"},
+	}
+	for _, tc := range testCases {
+		if category := categorizeFile(tc.ext); category != tc.expected {
+			t.Errorf("categorizeFile(%q) = %q, want %q", tc.ext, category, tc.expected)
+		}
+	}
+}
+
+func TestUpdateHashShortRead(t *testing.T) {
+	db := newTestDatabase(t)
+	path := filepath.Join(t.TempDir(), "truncated")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The size is what stat reported before the file was truncated, or what a network file system claims
+	for _, size := range []int64{5, 10} {
+		f := &FileInfo{osPath: path, Path: sql.NullString{String: path, Valid: true}, Size: size}
+		err := f.UpdateHash(db, &crawlOptions{})
+		if size == 5 && (err != nil || !f.Hash.Valid) {
+			t.Errorf("UpdateHash() with the right size = %v, hash %v", err, f.Hash)
+		} else if size == 10 && (err == nil || f.Hash.Valid || !strings.HasPrefix(f.Error.String, "short read")) {
+			t.Errorf("UpdateHash() after a short read = %v, hash %v, error %q, want a short read error",
+				err, f.Hash, f.Error.String)
+		}
+	}
+}
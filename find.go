@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// capturedPattern matches the values of -captured
+var capturedPattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// findFilter selects the files listed by the find command
+type findFilter struct {
+	Root          string
+	WorldWritable bool
+	Setuid        bool
+	Setgid        bool
+	Sticky        bool
+	External      bool
+	TargetOutside string
+	Captured      string // Prefix of the EXIF capture time, e.g. 2016 or 2016-05
+	ContentKind   string // text, binary or empty, see classifyContent
+	MinSize       int64
+	NoExtension   bool
+}
+
+// runFind implements the find subcommand, which lists the stored files matching the given filters
+func runFind(args []string) error {
+	var dbFile string
+	var minSize string
+	var filter findFilter
+
+	flags := flag.NewFlagSet("find", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&filter.Root, "root", "", "Only list paths equal to or below this path")
+	flags.BoolVar(&filter.WorldWritable, "world-writable", false, "Only list world-writable files and directories")
+	flags.BoolVar(&filter.Setuid, "setuid", false, "Only list files with the setuid bit")
+	flags.BoolVar(&filter.Setgid, "setgid", false, "Only list files and directories with the setgid bit")
+	flags.BoolVar(&filter.Sticky, "sticky", false, "Only list files and directories with the sticky bit")
+	flags.BoolVar(&filter.External, "external-symlinks", false, "Only list symlinks pointing outside the crawled roots")
+	flags.StringVar(&filter.TargetOutside, "target-outside", "",
+		"Only list symlinks whose chain of links ends outside this path")
+	flags.StringVar(&filter.Captured, "captured", "",
+		"Only list photos whose EXIF capture time is in this year, month or day, e.g. 2016, 2016-05 or 2016-05-01. "+
+			"Needs a crawl with -exif")
+	flags.StringVar(&filter.ContentKind, "kind", "",
+		"Only list files whose contents were classified as text, binary or empty when they were hashed")
+	flags.StringVar(&minSize, "min-size", "", "Only list files of at least this size, e.g. 1M")
+	flags.BoolVar(&filter.NoExtension, "no-extension", false, "Only list files without an extension")
+	_ = flags.Parse(args)
+	if filter.Captured != "" && !capturedPattern.MatchString(filter.Captured) {
+		return fmt.Errorf("invalid capture date %q, expected YYYY, YYYY-MM or YYYY-MM-DD", filter.Captured)
+	}
+	switch filter.ContentKind {
+	case "", "text", "binary", "empty":
+	default:
+		return fmt.Errorf("invalid kind %q, expected text, binary or empty", filter.ContentKind)
+	}
+	if minSize != "" {
+		var err error
+		if filter.MinSize, err = parseSize(minSize); err != nil {
+			return err
+		}
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	return findFiles(db, filter, os.Stdout)
+}
+
+// findFiles writes the mode, size and path of the files matching filter, one per line, followed by the final
+// target for symlinks. Files stored
+// before modes were recorded have no mode and only match when no mode filter is given.
+func findFiles(db *sql.DB, filter findFilter, w io.Writer) error {
+	conditions := []string{"exclusion_pattern IS NULL"}
+	var args []any
+	if filter.Root != "" {
+		conditions = append(conditions, underRootCondition)
+		args = append(args, underRootArgs(filter.Root)...)
+	}
+	if filter.WorldWritable {
+		// Symlinks always have all permissions, which says nothing about their target
+		conditions = append(conditions, "mode & 2 != 0 AND COALESCE(symlink, '') = ''")
+	}
+	if filter.Setuid {
+		conditions = append(conditions, "mode & 2048 != 0")
+	}
+	if filter.Setgid {
+		conditions = append(conditions, "mode & 1024 != 0")
+	}
+	if filter.Sticky {
+		conditions = append(conditions, "mode & 512 != 0")
+	}
+	if filter.External {
+		conditions = append(conditions, "external_symlink = 1")
+	}
+	if filter.TargetOutside != "" {
+		conditions = append(conditions, "final_target IS NOT NULL AND NOT "+finalTargetUnderCondition)
+		args = append(args, underRootArgs(filter.TargetOutside)...)
+	}
+	if filter.Captured != "" {
+		conditions = append(conditions,
+			"path IN (SELECT path FROM photo_info WHERE capture_time >= ? AND substr(capture_time, 1, ?) = ?)")
+		args = append(args, filter.Captured, len(filter.Captured), filter.Captured)
+	}
+	if filter.ContentKind != "" {
+		conditions = append(conditions, "content_kind = ?")
+		args = append(args, filter.ContentKind)
+	}
+	if filter.MinSize > 0 {
+		conditions = append(conditions, "size >= ?")
+		args = append(args, filter.MinSize)
+	}
+	if filter.NoExtension {
+		conditions = append(conditions, "COALESCE(type, '') = '' AND COALESCE(dir, 0) = 0")
+	}
+
+	rows, err := db.Query(`
+	SELECT path, COALESCE(mode_string, ''), COALESCE(size, 0), COALESCE(final_target, ''), COALESCE(chain_length, 0)
+	FROM files
+	WHERE `+strings.Join(conditions, " AND ")+`
+	ORDER BY path`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, modeString, finalTarget string
+		var size, chainLength int64
+		if err := rows.Scan(&path, &modeString, &size, &finalTarget, &chainLength); err != nil {
+			return err
+		}
+		if finalTarget != "" {
+			path = fmt.Sprintf("%s -> %s (%d links)", path, finalTarget, chainLength)
+		}
+		if _, err := fmt.Fprintf(w, "%-11s %12d %s\n", modeString, size, path); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
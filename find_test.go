@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/fs"
+	"testing"
+)
+
+func TestPosixMode(t *testing.T) {
+	testCases := []struct {
+		mode     fs.FileMode
+		expected uint32
+	}{
+		{0644, 0644},
+		{fs.ModeDir | 0755, 0755},
+		{fs.ModeSetuid | 0755, 04755},
+		{fs.ModeDir | fs.ModeSetgid | fs.ModeSticky | 0777, 03777},
+	}
+	for _, tc := range testCases {
+		if mode := posixMode(tc.mode); mode != tc.expected {
+			t.Errorf("posixMode(%v) = %o, want %o", tc.mode, mode, tc.expected)
+		}
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	db := newTestDatabase(t)
+
+	for _, tc := range []struct {
+		path    string
+		mode    fs.FileMode
+		symlink string
+	}{
+		{"/bin/ls", 0755, ""},
+		{"/bin/su", fs.ModeSetuid | 0755, ""},
+		{"/tmp", fs.ModeDir | fs.ModeSticky | 0777, ""},
+		{"/tmp/link", fs.ModeSymlink | 0777, "/bin/ls"},
+		{"/tmp/open", 0666, ""},
+	} {
+		f := FileInfo{
+			Path:       sql.NullString{String: tc.path, Valid: true},
+			Mode:       sql.NullInt64{Int64: int64(posixMode(tc.mode)), Valid: true},
+			ModeString: sql.NullString{String: tc.mode.String(), Valid: true},
+			Symlink:    sql.NullString{String: tc.symlink, Valid: true},
+		}
+		if tc.symlink != "" {
+			f.FinalTarget = sql.NullString{String: tc.symlink, Valid: true}
+			f.ChainLength = sql.NullInt64{Int64: 1, Valid: true}
+		}
+		if err := f.upsert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		filter   findFilter
+		expected string
+	}{
+		{findFilter{Setuid: true}, "urwxr-xr-x             0 /bin/su\n"},
+		{findFilter{WorldWritable: true}, "dtrwxrwxrwx            0 /tmp\n-rw-rw-rw-             0 /tmp/open\n"},
+		{findFilter{WorldWritable: true, Root: "/tmp/"}, "-rw-rw-rw-             0 /tmp/open\n"},
+		{findFilter{Sticky: true, Setuid: true}, ""},
+		{findFilter{TargetOutside: "/srv"}, "Lrwxrwxrwx             0 /tmp/link -> /bin/ls (1 links)\n"},
+		{findFilter{TargetOutside: "/bin"}, ""},
+	}
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		if err := findFiles(db, tc.filter, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.expected {
+			t.Errorf("findFiles(%+v) = %q, want %q", tc.filter, out.String(), tc.expected)
+		}
+	}
+}
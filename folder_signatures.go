@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// folderSignature returns the signature of the directory at path, the sha256 of the names of its children in the
+// sorted order of ReadDir with whether each is a directory, and the number of children. Listing a directory is
+// much cheaper than the lstat and stored entry of each child, so an unchanged signature lets -since-run skip them.
+// Files modified in place keep their names and go unnoticed.
+func folderSignature(path string) (string, int, error) {
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return "", 0, err
+	}
+	digest := sha256.New()
+	for _, child := range children {
+		kind := "f"
+		if child.IsDir() {
+			kind = "d"
+		}
+		fmt.Fprintf(digest, "%s\x00%s\n", child.Name(), kind)
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil)), len(children), nil
+}
+
+// loadFolderSignature returns the stored signature of the folder at path and the ID of the run that recorded it,
+// which are NULL for folders that have none
+func loadFolderSignature(db execQuerier, path string) (sql.NullString, sql.NullInt64, error) {
+	var signature sql.NullString
+	var runId sql.NullInt64
+	err := db.QueryRow("SELECT signature, signature_run_id FROM folders WHERE path = ?", path).Scan(&signature, &runId)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return signature, runId, err
+}
+
+// recordFolderSignature stores the signature of the folder at path, computed during the run with the given ID, 0
+// for none
+func recordFolderSignature(db execQuerier, path, signature string, runId int64) error {
+	_, err := db.Exec("UPDATE folders SET signature = ?, signature_run_id = ? WHERE path = ?",
+		signature, sql.NullInt64{Int64: runId, Valid: runId > 0}, path)
+	return err
+}
+
+// sinceRunCheck finds the directories that -since-run skips with their whole subtree: those whose signature and
+// those of all their subdirectories were recorded in that run or a later one, are the same now, and whose stored
+// children are all hashed without an error. A directory is checked together with its subdirectories, so those of a
+// directory that has changed are remembered until the walk reaches them, and each directory is listed once.
+type sinceRunCheck struct {
+	db      crawlDB
+	opts    *crawlOptions
+	results map[string]sinceRunResult // Results of the subdirectories checked with their parent, by path
+}
+
+type sinceRunResult struct {
+	unchanged bool
+	entries   int64 // Number of stored entries in the subtree, if it is unchanged
+}
+
+func newSinceRunCheck(db crawlDB, opts *crawlOptions) *sinceRunCheck {
+	return &sinceRunCheck{db: db, opts: opts, results: make(map[string]sinceRunResult)}
+}
+
+// unchanged reports whether the subtree of the directory at path, which is stored at storedPath with the children
+// entries, can be skipped, and how many stored entries it has. The current signatures of the directories it lists
+// are recorded in the run of the crawl.
+func (c *sinceRunCheck) unchanged(path, storedPath string, entries map[string]storedEntry) (bool, int64) {
+	if result, ok := c.results[path]; ok {
+		delete(c.results, path)
+		return result.unchanged, result.entries
+	}
+	signature, children, err := folderSignature(path)
+	if err != nil {
+		log.Println("Error computing the signature of", path, err)
+		return false, 0
+	}
+	stored, runId, err := loadFolderSignature(c.db, storedPath)
+	if err != nil {
+		log.Println("Error loading the signature of", path, err)
+		return false, 0
+	}
+	if err := recordFolderSignature(c.db, storedPath, signature, c.opts.RunId); err != nil {
+		log.Println("Error recording the signature of", path, err)
+	}
+	if c.opts.SinceRun <= 0 || !runId.Valid || runId.Int64 < c.opts.SinceRun || stored.String != signature ||
+		children != len(entries) {
+		return false, 0
+	}
+
+	var subdirs []string
+	for childPath, entry := range entries {
+		if !entry.completeFor(c.opts.HeadHashSize) {
+			return false, 0
+		}
+		if entry.Dir && !entry.Bundle && !entry.Excluded && !entry.Symlink {
+			subdirs = append(subdirs, childPath)
+		}
+	}
+	total := int64(len(entries))
+	for _, storedChild := range subdirs {
+		child := filepath.Join(path, filepath.Base(storedChild))
+		childEntries, err := loadDirectoryEntries(c.db, storedChild)
+		if err != nil {
+			log.Println("Error loading directory entries:", child, err)
+			return false, 0
+		}
+		unchanged, count := c.unchanged(child, storedChild, childEntries)
+		c.results[child] = sinceRunResult{unchanged: unchanged, entries: count}
+		if !unchanged {
+			return false, 0
+		}
+		total += count
+	}
+	// The walk doesn't reach the subdirectories of a skipped directory
+	for _, storedChild := range subdirs {
+		delete(c.results, filepath.Join(path, filepath.Base(storedChild)))
+	}
+	return true, total
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSinceRun(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"a/1.txt", "one"},
+		{"a/sub/2.txt", "two"},
+		{"b/3.txt", "three"},
+	})
+	db := newTestDatabase(t)
+	crawl := func(sinceRun int64) rootStats {
+		t.Helper()
+		runId, err := startRun(db, "crawl", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, RunId: runId, SinceRun: sinceRun}
+		stats := NewProcessStats()
+		if err := processDirectory(root, db, stats, opts); err != nil {
+			t.Fatal(err)
+		}
+		return stats.rootCounts()[0]
+	}
+
+	first := crawl(0)
+	if counts := crawl(1); counts.Hashed != 0 || counts.Skipped != 6 {
+		t.Errorf("a crawl since run 1 hashed %d and skipped %d, want the whole tree of 6 skipped",
+			counts.Hashed, counts.Skipped)
+	}
+	if first.Hashed != 3 {
+		t.Errorf("the first crawl hashed %d files, want 3", first.Hashed)
+	}
+
+	// A new file deep down changes the signature of its directory, and with it the tree of the root, but b is still
+	// skipped, so 3.txt, which is modified in place, isn't hashed again
+	writeFiles(t, root, [][2]string{{"a/sub/new.txt", "new"}, {"b/3.txt", "modified"}})
+	modified := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "b/3.txt"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if counts := crawl(2); counts.Hashed != 1 {
+		t.Errorf("a crawl since run 2 after adding a file hashed %d files, want 1", counts.Hashed)
+	}
+	var found bool
+	err := db.QueryRow("SELECT hash IS NOT NULL FROM files WHERE path = ?", filepath.Join(root, "a/sub/new.txt")).
+		Scan(&found)
+	if err != nil || !found {
+		t.Errorf("a/sub/new.txt isn't hashed: %v", err)
+	}
+
+	// Signatures recorded before -since-run aren't trusted, so each file is checked and 3.txt is hashed again
+	if counts := crawl(10); counts.Hashed != 1 {
+		t.Errorf("a crawl since a later run hashed %d files, want 1", counts.Hashed)
+	}
+}
@@ -1,5 +1,15 @@
 module crawler
 
-go 1.21.1
+go 1.22
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/minio/sha256-simd v1.0.1
+	golang.org/x/text v0.21.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.3 // indirect
+	golang.org/x/sys v0.0.0-20220704084225-05e143d24a9e // indirect
+)
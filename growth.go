@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// folderSize is the number and total size of the files below a folder
+type folderSize struct {
+	Files int64
+	Bytes int64
+}
+
+// recordFolderSizes records the number and total size of the files under root, and under each of its top-level
+// folders, in the run_folder_sizes table for the crawl runId, so that report -growth can compare them with those of
+// another crawl. It is called once the tree is crawled, and reads its files in one pass.
+func recordFolderSizes(db crawlDB, runId int64, root string) error {
+	rows, err := db.Query(`
+	SELECT path, COALESCE(size, 0) FROM files
+	WHERE (COALESCE(dir, 0) = 0 OR COALESCE(bundle, 0) = 1) AND exclusion_pattern IS NULL AND `+underRootCondition,
+		underRootArgs(root)...)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	sizes := make(map[string]*folderSize)
+	add := func(path string, size int64) {
+		s, ok := sizes[path]
+		if !ok {
+			s = &folderSize{}
+			sizes[path] = s
+		}
+		s.Files++
+		s.Bytes += size
+	}
+	for rows.Next() {
+		var path string
+		var size int64
+		if err := rows.Scan(&path, &size); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		add(root, size)
+		if top, _, below := strings.Cut(strings.TrimPrefix(path, prefix), "/"); below {
+			add(prefix+top, size)
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if _, ok := sizes[root]; !ok {
+		sizes[root] = &folderSize{}
+	}
+
+	for path, s := range sizes {
+		_, err := db.Exec(`
+		INSERT OR REPLACE INTO run_folder_sizes(run_id, root, path, files, bytes) VALUES (?, ?, ?, ?, ?)`,
+			runId, root, path, s.Files, s.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFolderSizes returns the folder sizes recorded for root by the crawl runId
+func loadFolderSizes(db *sql.DB, runId int64, root string) (map[string]folderSize, error) {
+	rows, err := db.Query("SELECT path, files, bytes FROM run_folder_sizes WHERE run_id = ? AND root = ?",
+		runId, root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]folderSize)
+	for rows.Next() {
+		var path string
+		var s folderSize
+		if err := rows.Scan(&path, &s.Files, &s.Bytes); err != nil {
+			return nil, err
+		}
+		sizes[path] = s
+	}
+	return sizes, rows.Err()
+}
+
+// growthReport writes, for each root of the last crawl that recorded folder sizes, how the number and size of its
+// files changed since the previous crawl of the same root, followed by its top-level folders that changed, those
+// that grew the most first
+func growthReport(db *sql.DB, w io.Writer, format string) error {
+	var latest sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(run_id) FROM run_folder_sizes").Scan(&latest); err != nil {
+		return err
+	}
+	if !latest.Valid {
+		_, err := fmt.Fprintln(w, "No crawl has recorded folder sizes yet")
+		return err
+	}
+	roots, err := db.Query("SELECT root FROM run_folder_sizes WHERE run_id = ? AND path = root ORDER BY root",
+		latest.Int64)
+	if err != nil {
+		return err
+	}
+	var rootPaths []string
+	for roots.Next() {
+		var root string
+		if err := roots.Scan(&root); err != nil {
+			_ = roots.Close()
+			return err
+		}
+		rootPaths = append(rootPaths, root)
+	}
+	_ = roots.Close()
+	if err := roots.Err(); err != nil {
+		return err
+	}
+
+	for i, root := range rootPaths {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if err := writeRootGrowth(db, w, latest.Int64, root, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRootGrowth writes the growth of root between the crawl runId and the previous crawl that recorded it
+func writeRootGrowth(db *sql.DB, w io.Writer, runId int64, root, format string) error {
+	var previous int64
+	err := db.QueryRow(`
+	SELECT run_id FROM run_folder_sizes WHERE root = ? AND path = root AND run_id < ?
+	ORDER BY run_id DESC LIMIT 1`, root, runId).Scan(&previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err := fmt.Fprintf(w, "%s: crawl %d is the first one with folder sizes\n", root, runId)
+		return err
+	} else if err != nil {
+		return err
+	}
+	current, err := loadFolderSizes(db, runId, root)
+	if err != nil {
+		return err
+	}
+	before, err := loadFolderSizes(db, previous, root)
+	if err != nil {
+		return err
+	}
+
+	total, was := current[root], before[root]
+	_, err = fmt.Fprintf(w, "%s: crawl %d (%s) compared with crawl %d (%s)\nFiles: %d (%+d), bytes: %d (%+d)\n\n",
+		root, runId, runStartedAt(db, runId), previous, runStartedAt(db, previous),
+		total.Files, total.Files-was.Files, total.Bytes, total.Bytes-was.Bytes)
+	if err != nil {
+		return err
+	}
+
+	type growth struct {
+		path         string
+		now          folderSize
+		files, bytes int64
+	}
+	var folders []growth
+	for path, s := range current {
+		if path != root {
+			folders = append(folders, growth{path, s, s.Files - before[path].Files, s.Bytes - before[path].Bytes})
+		}
+	}
+	for path, s := range before {
+		if _, ok := current[path]; !ok && path != root {
+			folders = append(folders, growth{path, folderSize{}, -s.Files, -s.Bytes})
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		if folders[i].bytes != folders[j].bytes {
+			return folders[i].bytes > folders[j].bytes
+		}
+		return folders[i].path < folders[j].path
+	})
+
+	table := reportTable{Header: []string{"Growth", "Bytes", "Files", "Path"}, Text: "%16s %16s %10s  %s\n"}
+	for _, f := range folders {
+		if f.files == 0 && f.bytes == 0 {
+			continue
+		}
+		table.Rows = append(table.Rows, []string{fmt.Sprintf("%+d", f.bytes), fmt.Sprint(f.now.Bytes),
+			fmt.Sprintf("%d (%+d)", f.now.Files, f.files), f.path})
+	}
+	return writeTable(w, table, format)
+}
+
+// runStartedAt returns when the run with the given ID started, or "unknown"
+func runStartedAt(db *sql.DB, id int64) string {
+	var startedAt sql.NullString
+	if err := db.QueryRow("SELECT started_at FROM runs WHERE id = ?", id).Scan(&startedAt); err != nil ||
+		!startedAt.Valid {
+		return "unknown"
+	}
+	return startedAt.String
+}
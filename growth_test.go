@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGrowthReport(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"photos/a.jpg", "aaaa"}, {"docs/a.txt", "aa"}, {"top.txt", "t"}})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	crawl := func() {
+		t.Helper()
+		runId, err := startRun(db, "crawl", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := recordFolderSizes(db, runId, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	crawl()
+	if err := growthReport(db, &buf, textFormat); err != nil || !strings.Contains(buf.String(), "is the first one") {
+		t.Errorf("growthReport() after one crawl = %q, %v", buf.String(), err)
+	}
+
+	writeFiles(t, root, [][2]string{{"photos/b.jpg", "bbbbbbbb"}, {"videos/c.mp4", "cccccc"}})
+	crawl()
+	buf.Reset()
+	if err := growthReport(db, &buf, textFormat); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	// Unchanged folders are left out
+	if len(lines) != 7 || lines[1] != "Files: 5 (+2), bytes: 21 (+14)" ||
+		!strings.HasPrefix(strings.TrimSpace(lines[4]), "+8 ") ||
+		!strings.HasSuffix(lines[4], filepath.Join(root, "photos")) ||
+		!strings.HasPrefix(strings.TrimSpace(lines[5]), "+6 ") ||
+		!strings.HasSuffix(lines[5], filepath.Join(root, "videos")) {
+		t.Errorf("growthReport() = %q", buf.String())
+	}
+}
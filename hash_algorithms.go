@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+const defaultHashAlgorithm = "sha256"
+
+// hashAlgorithms maps the supported algorithm names to their constructors
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// useFastSHA256 switches sha256 to an implementation that produces the same hashes, but uses SIMD instructions
+// where available
+func useFastSHA256() {
+	hashAlgorithms["sha256"] = fastSHA256
+}
+
+// hashRule selects the hash algorithm for paths matching Pattern
+type hashRule struct {
+	Pattern   string `json:"pattern"`
+	Algorithm string `json:"algorithm"`
+}
+
+// readHashRules reads a mapping file with one `pattern=algorithm` rule per line, e.g. `*.jpg=blake3`.
+// Patterns use the same syntax as the exclusion file, and the first matching rule wins.
+//
+// Note that files hashed with different algorithms never have equal hashes, so duplicates can only be found
+// among files that were hashed with the same algorithm.
+func readHashRules(filename string) ([]hashRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing hash algorithms file:", err)
+		}
+	}(file)
+
+	var rules []hashRule
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		// Ignore comments and empty lines
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected pattern=algorithm, got %q", lineNumber, line)
+		}
+		rule := hashRule{Pattern: strings.TrimSpace(line[:i]), Algorithm: strings.TrimSpace(line[i+1:])}
+		if _, ok := hashAlgorithms[rule.Algorithm]; !ok {
+			return nil, fmt.Errorf("line %d: unknown hash algorithm %q", lineNumber, rule.Algorithm)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// hashAlgorithmFor returns the algorithm of the first rule matching path, or the default algorithm
+func hashAlgorithmFor(path string, rules []hashRule) string {
+	for _, rule := range rules {
+		if filepathMatch(rule.Pattern, path) {
+			return rule.Algorithm
+		}
+	}
+	return defaultHashAlgorithm
+}
+
+// hashFile returns the hex hash of the file at path, and the number of bytes hashed
+func hashFile(path, algorithm string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing file:", err)
+		}
+	}(file)
+
+	hash := hashAlgorithms[algorithm]()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return "", n, err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), n, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"testing"
+)
+
+func TestHashAlgorithmFor(t *testing.T) {
+	rules := []hashRule{{"*.jpg", "blake3"}, {"/docs/", "sha512"}, {"*.pdf", "sha256"}}
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/photos/a.jpg", "blake3"},
+		{"/docs/a.jpg", "blake3"},   // First matching rule wins
+		{"/docs/a.txt", "sha512"},   // Directory pattern
+		{"/other/a.pdf", "sha256"},  // Extension pattern
+		{"/other/a.txt", "sha256"},  // Default algorithm
+		{"/other/a.jpeg", "sha256"}, // Default algorithm
+	}
+
+	for _, tc := range testCases {
+		if algorithm := hashAlgorithmFor(tc.path, rules); algorithm != tc.expected {
+			t.Errorf("hashAlgorithmFor(%q) = %q, want %q", tc.path, algorithm, tc.expected)
+		}
+	}
+}
+
+func TestFastSHA256(t *testing.T) {
+	data := bytes.Repeat([]byte("crawler"), 100000)
+	expected := sha256.Sum256(data)
+	h := fastSHA256()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Error("fastSHA256 differs from crypto/sha256")
+	}
+}
+
+func benchmarkHash(b *testing.B, newHash func() hash.Hash) {
+	data := make([]byte, 64<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		h := newHash()
+		h.Write(data)
+		h.Sum(nil)
+	}
+}
+
+func BenchmarkSHA256(b *testing.B) {
+	benchmarkHash(b, sha256.New)
+}
+
+func BenchmarkFastSHA256(b *testing.B) {
+	benchmarkHash(b, fastSHA256)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// runConvertHashes implements the convert-hashes subcommand, which converts the hex hashes of a database to blobs
+func runConvertHashes(args []string) error {
+	var dbFile string
+	var batchSize int
+
+	flags := flag.NewFlagSet("convert-hashes", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.IntVar(&batchSize, "batch", 10000, "Number of hashes to convert per transaction")
+	_ = flags.Parse(args)
+
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	result, err := convertHashesToBlob(db, batchSize)
+	fmt.Printf("Converted: %d, invalid: %d\n", result.Converted, result.Invalid)
+	if err == nil && result.Converted > 0 {
+		fmt.Println("Run VACUUM on the database to reclaim the space of the hex hashes")
+	}
+	return err
+}
+
+// hashConversion counts the outcome of convertHashesToBlob
+type hashConversion struct {
+	Converted int64
+	Invalid   int64 // Hashes that are not valid hex, which are left as they are
+}
+
+// convertHashesToBlob rewrites the hex hashes stored as TEXT as the raw digest bytes, batchSize rows per
+// transaction, and switches the database to blob storage.
+//
+// The conversion can be interrupted and run again: the storage is switched first, so that new hashes are stored as
+// blobs, and every run converts the hashes that are still TEXT. In between, readers see both kinds through
+// hashHexColumn. hash_idx is dropped during the conversion and rebuilt at the end, which is much faster than
+// updating it row by row. Until it is rebuilt, the schema version is reset, so that if the conversion is interrupted,
+// createSchema recreates the index the next time the database is opened.
+func convertHashesToBlob(db *sql.DB, batchSize int) (hashConversion, error) {
+	var result hashConversion
+	if err := setSetting(db, "hash_storage", "blob"); err != nil {
+		return result, err
+	}
+	hashStorage = "blob"
+	if err := setDBVersion(db, 0); err != nil {
+		return result, err
+	}
+	if _, err := db.Exec("DROP INDEX IF EXISTS hash_idx"); err != nil {
+		return result, err
+	}
+
+	var lastRowId int64
+	for {
+		converted, invalid, last, err := convertHashBatch(db, lastRowId, batchSize)
+		result.Converted += converted
+		result.Invalid += invalid
+		if err != nil {
+			return result, err
+		}
+		if last == lastRowId {
+			break
+		}
+		lastRowId = last
+		log.Println("Converted hashes:", result.Converted)
+	}
+
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS hash_idx ON files(hash)"); err != nil {
+		return result, err
+	}
+	return result, setDBVersion(db, schemaVersion)
+}
+
+// convertHashBatch converts the TEXT hashes of up to batchSize rows after afterRowId in a single transaction, and
+// returns the counts and the last row it looked at, which is afterRowId if there are none left
+func convertHashBatch(db *sql.DB, afterRowId int64, batchSize int) (converted, invalid, lastRowId int64, err error) {
+	lastRowId = afterRowId
+	type row struct {
+		id   int64
+		hash string
+	}
+	var batch []row
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, lastRowId, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`
+	SELECT rowid, hash FROM files WHERE rowid > ? AND typeof(hash) = 'text' ORDER BY rowid LIMIT ?`,
+		afterRowId, batchSize)
+	if err != nil {
+		return 0, 0, afterRowId, err
+	}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.hash); err != nil {
+			_ = rows.Close()
+			return 0, 0, afterRowId, err
+		}
+		batch = append(batch, r)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, afterRowId, err
+	}
+
+	for _, r := range batch {
+		digest, decodeErr := hex.DecodeString(r.hash)
+		if decodeErr != nil {
+			log.Println("Leaving invalid hash as it is:", r.hash, decodeErr)
+			invalid++
+			continue
+		}
+		if _, err := tx.Exec("UPDATE files SET hash = ? WHERE rowid = ?", digest, r.id); err != nil {
+			return 0, 0, afterRowId, err
+		}
+		converted++
+	}
+	if len(batch) > 0 {
+		lastRowId = batch[len(batch)-1].id
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, afterRowId, err
+	}
+	return converted, invalid, lastRowId, nil
+}
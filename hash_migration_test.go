@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestConvertHashesToBlob(t *testing.T) {
+	db := newTestDatabase(t)
+	t.Cleanup(func() { hashStorage = "hex" })
+	if err := initHashStorage(db, "hex"); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := map[string]string{
+		"/a/1": strings.Repeat("01", 32),
+		"/a/2": strings.Repeat("02", 32),
+		"/a/3": strings.Repeat("03", 32),
+		"/a/4": "not hex",
+		"/a/5": "",
+	}
+	for path, hash := range hashes {
+		f := &FileInfo{
+			Path: sql.NullString{String: path, Valid: true},
+			Hash: sql.NullString{String: hash, Valid: hash != ""},
+		}
+		if err := f.upsert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := convertHashesToBlob(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (hashConversion{Converted: 3, Invalid: 1}) {
+		t.Errorf("convertHashesToBlob() = %+v, want 3 converted and 1 invalid", result)
+	}
+
+	for path, hash := range hashes {
+		var storedType string
+		var stored sql.NullString
+		err := db.QueryRow("SELECT typeof(hash), "+hashHexColumn+" FROM files WHERE path = ?", path).
+			Scan(&storedType, &stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedType := "blob"
+		if hash == "" {
+			expectedType = "null"
+		} else if hash == "not hex" {
+			expectedType = "text"
+		}
+		if storedType != expectedType || stored.String != hash {
+			t.Errorf("%s has %s hash %q, want %s hash %q", path, storedType, stored.String, expectedType, hash)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'hash_idx'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("hash_idx was not rebuilt")
+	}
+	if err := initHashStorage(db, "blob"); err != nil {
+		t.Errorf("initHashStorage(blob) after the conversion = %v", err)
+	}
+
+	// Running it again finds nothing left to convert
+	if result, err := convertHashesToBlob(db, 2); err != nil || result.Converted != 0 {
+		t.Errorf("convertHashesToBlob() a second time = %+v, %v, want nothing converted", result, err)
+	}
+}
+
+func TestCrawlAfterConvertHashes(t *testing.T) {
+	db := newTestDatabase(t)
+	t.Cleanup(func() { hashStorage = "hex" })
+	if err := initHashStorage(db, "hex"); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"a", "first"}})
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convertHashesToBlob(db, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later crawl without -hash-storage keeps the converted storage
+	hashStorage = "hex"
+	if err := initHashStorage(db, ""); err != nil {
+		t.Fatalf("initHashStorage() after convert-hashes = %v", err)
+	}
+	writeFiles(t, root, [][2]string{{"b", "second"}})
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := getSetting(db, "hash_storage")
+	if err != nil || storage != "blob" {
+		t.Errorf("hash_storage after the crawl = %q, %v, want blob", storage, err)
+	}
+	var notBlob int
+	err = db.QueryRow("SELECT COUNT(*) FROM files WHERE hash IS NOT NULL AND typeof(hash) != 'blob'").Scan(&notBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashed int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE hash IS NOT NULL").Scan(&hashed); err != nil {
+		t.Fatal(err)
+	}
+	if notBlob != 0 || hashed != 2 {
+		t.Errorf("got %d hashes, %d of them not blobs, want 2 blob hashes", hashed, notBlob)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileRecord is a single line of an NDJSON export, i.e. one row of the files table. folder_id and folder are
+// accepted but ignored, since the folders are rebuilt from the paths.
+type fileRecord struct {
+	Path             string  `json:"path"`
+	Name             *string `json:"name"`
+	Type             *string `json:"type"`
+	CreationTime     *string `json:"creation_time"`
+	ModificationTime *string `json:"modification_time"`
+	Hash             *string `json:"hash"`
+	HashAlgorithm    *string `json:"hash_algorithm"`
+	Size             int64   `json:"size"`
+	Dir              bool    `json:"dir"`
+	Symlink          *string `json:"symlink"`
+	ExclusionPattern *string `json:"exclusion_pattern"`
+	Error            *string `json:"error"`
+	FolderId         *int64  `json:"folder_id,omitempty"`
+	Folder           *string `json:"folder,omitempty"` // Path of the folder, which replaces folder_id in exports
+	ParentModTime    *string `json:"parent_mtime"`
+	Mode             *int64  `json:"mode"`
+	ModeString       *string `json:"mode_string"`
+	ExternalSymlink  *bool   `json:"external_symlink"`
+	ACL              *string `json:"acl"`
+	Depth            *int64  `json:"depth"`
+	TargetType       *string `json:"target_type"`
+	PathEncoding     *string `json:"path_encoding"`
+	FinalTarget      *string `json:"final_target"`
+	ChainLength      *int64  `json:"chain_length"`
+	HeadHash         *string `json:"head_hash"`
+	HeadHashSize     *int64  `json:"head_hash_size"`
+	MacOSComment     *string `json:"macos_comment"`
+	ContentType      *string `json:"content_type"`
+	Bundle           bool    `json:"bundle,omitempty"`
+	TargetSize       *int64  `json:"target_size,omitempty"`
+	TargetModTime    *string `json:"target_mtime,omitempty"`
+	ContentKind      *string `json:"content_kind,omitempty"`
+	Magic            *string `json:"magic,omitempty"`
+	DetectedType     *string `json:"detected_type,omitempty"`
+	PHash            *string `json:"phash,omitempty"`
+	FuzzyHash        *string `json:"fuzzy_hash,omitempty"`
+	FuzzyAlgorithm   *string `json:"fuzzy_algorithm,omitempty"`
+	HasSUID          bool    `json:"has_suid,omitempty"`
+	HasSGID          bool    `json:"has_sgid,omitempty"`
+	HasSticky        bool    `json:"has_sticky,omitempty"`
+	UID              *int64  `json:"uid,omitempty"`
+	GID              *int64  `json:"gid,omitempty"`
+	DevID            *int64  `json:"dev_id,omitempty"`
+	Inode            *int64  `json:"inode,omitempty"`
+	FirstSeen        *string `json:"first_seen,omitempty"`
+	LastVerified     *string `json:"last_verified,omitempty"`
+	Notes            *string `json:"notes"`
+}
+
+// importStats counts the outcome of an import
+type importStats struct {
+	Inserted int64
+	Updated  int64
+	Rejected int64
+}
+
+// runImport implements the import subcommand
+func runImport(args []string) error {
+	var dbFile string
+	var batchSize int
+	printInterval := intervalValue(time.Second)
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.IntVar(&batchSize, "batch", 1000, "Number of records to insert per transaction")
+	flags.Var(&printInterval, "interval", intervalUsage)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: program import [options] <file.ndjson>")
+		flags.PrintDefaults()
+		return nil
+	}
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing import file:", err)
+		}
+	}(file)
+
+	dbFile, err = filepath.Abs(dbFile)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	stats := NewProcessStats()
+	if printInterval > 0 {
+		stats.PrintEvery(time.Duration(printInterval))
+	}
+
+	result, err := importRecords(db, file, batchSize, stats)
+	fmt.Printf("Inserted: %d, updated: %d, rejected: %d\n", result.Inserted, result.Updated, result.Rejected)
+	return err
+}
+
+// importRecords reads NDJSON records from r and upserts them into the files table, batchSize records
+// per transaction. Malformed records are logged with their line number and skipped.
+func importRecords(db *sql.DB, r io.Reader, batchSize int, stats *ProcessStats) (importStats, error) {
+	var result importStats
+	reader := bufio.NewReader(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	inBatch := 0
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			_ = tx.Rollback()
+			return result, readErr
+		}
+
+		if len(strings.TrimSpace(string(line))) > 0 {
+			f, record, err := parseFileRecord(line)
+			if err != nil {
+				log.Printf("Rejected line %d: %v\n", lineNumber, err)
+				result.Rejected++
+			} else {
+				inserted, err := importFileInfo(tx, f, record)
+				if err != nil {
+					_ = tx.Rollback()
+					return result, fmt.Errorf("line %d: %w", lineNumber, err)
+				}
+				if inserted {
+					result.Inserted++
+				} else {
+					result.Updated++
+				}
+				stats.Update(f.Path.String, f.Size)
+				inBatch++
+			}
+		}
+
+		if inBatch >= batchSize {
+			if err := tx.Commit(); err != nil {
+				return result, err
+			}
+			if tx, err = db.Begin(); err != nil {
+				return result, err
+			}
+			inBatch = 0
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// importFileInfo rebuilds the folder of f and writes f to the database, with the notes and verification time of
+// record, which aren't part of FileInfo, returning true if the row is new. Those a record doesn't have are kept.
+func importFileInfo(tx *sql.Tx, f *FileInfo, record *fileRecord) (bool, error) {
+	var exists int
+	err := tx.QueryRow("SELECT 1 FROM files WHERE path=?", f.Path.String).Scan(&exists)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	f.FolderId, err = getFolderID(tx, parentDir(f.Path.String))
+	if err != nil {
+		return false, err
+	}
+	if err := f.upsert(tx); err != nil {
+		return false, err
+	}
+	if record.Notes != nil || record.LastVerified != nil {
+		_, err := tx.Exec("UPDATE files SET notes = COALESCE(?, notes), last_verified = COALESCE(?, last_verified) "+
+			"WHERE path = ?", record.Notes, record.LastVerified, f.Path.String)
+		if err != nil {
+			return false, err
+		}
+	}
+	return exists == 0, nil
+}
+
+// parseFileRecord decodes and validates a single NDJSON line
+func parseFileRecord(line []byte) (*FileInfo, *fileRecord, error) {
+	var record fileRecord
+	decoder := json.NewDecoder(strings.NewReader(string(line)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&record); err != nil {
+		return nil, nil, err
+	}
+
+	if record.Path == "" {
+		return nil, nil, errors.New("missing path")
+	}
+	if err := checkStoredPath(record.Path); err != nil {
+		return nil, nil, err
+	}
+	if record.Size < 0 {
+		return nil, nil, fmt.Errorf("negative size %d", record.Size)
+	}
+	for _, t := range []*string{record.CreationTime, record.ModificationTime, record.ParentModTime, record.FirstSeen,
+		record.LastVerified} {
+		if t == nil {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, *t); err != nil {
+			return nil, nil, fmt.Errorf("invalid time %q", *t)
+		}
+	}
+	if record.PathEncoding != nil && *record.PathEncoding != utf8Encoding && *record.PathEncoding != percentEncoding {
+		return nil, nil, fmt.Errorf("unknown path encoding %q", *record.PathEncoding)
+	}
+	if record.Mode != nil && (*record.Mode < 0 || *record.Mode > 0o7777) {
+		return nil, nil, fmt.Errorf("invalid mode %o", *record.Mode)
+	}
+	if record.HashAlgorithm != nil {
+		if _, ok := hashAlgorithms[*record.HashAlgorithm]; !ok {
+			return nil, nil, fmt.Errorf("unknown hash algorithm %q", *record.HashAlgorithm)
+		}
+	}
+	if record.Hash != nil {
+		algorithm := defaultHashAlgorithm
+		if record.HashAlgorithm != nil {
+			algorithm = *record.HashAlgorithm
+		}
+		size := hashAlgorithms[algorithm]().Size()
+		if _, err := hex.DecodeString(*record.Hash); err != nil || len(*record.Hash) != 2*size {
+			return nil, nil, fmt.Errorf("invalid %s hash %q", algorithm, *record.Hash)
+		}
+	}
+
+	f := &FileInfo{
+		Path:             sql.NullString{String: record.Path, Valid: true},
+		Name:             sql.NullString{String: filepath.Base(record.Path), Valid: true},
+		Type:             sql.NullString{String: filepath.Ext(record.Path), Valid: true},
+		CreationTime:     toNullString(record.CreationTime),
+		ModificationTime: toNullString(record.ModificationTime),
+		Hash:             toNullString(record.Hash),
+		HashAlgorithm:    toNullString(record.HashAlgorithm),
+		Size:             record.Size,
+		Dir:              record.Dir,
+		Symlink:          toNullString(record.Symlink),
+		ExclusionPattern: toNullString(record.ExclusionPattern),
+		Error:            toNullString(record.Error),
+		ParentModTime:    toNullString(record.ParentModTime),
+		ModeString:       toNullString(record.ModeString),
+		ACL:              toNullString(record.ACL),
+		TargetType:       toNullString(record.TargetType),
+		FinalTarget:      toNullString(record.FinalTarget),
+		HeadHash:         toNullString(record.HeadHash),
+		MacOSComment:     toNullString(record.MacOSComment),
+		ContentType:      toNullString(record.ContentType),
+		TargetModTime:    toNullString(record.TargetModTime),
+		ContentKind:      toNullString(record.ContentKind),
+		Magic:            toNullString(record.Magic),
+		DetectedType:     toNullString(record.DetectedType),
+		PHash:            toNullString(record.PHash),
+		FuzzyHash:        toNullString(record.FuzzyHash),
+		FuzzyAlgorithm:   toNullString(record.FuzzyAlgorithm),
+		FirstSeen:        toNullString(record.FirstSeen),
+		Bundle:           record.Bundle,
+		HasSUID:          record.HasSUID,
+		HasSGID:          record.HasSGID,
+		HasSticky:        record.HasSticky,
+		PathEncoding:     utf8Encoding,
+	}
+	if record.PathEncoding != nil {
+		f.PathEncoding = *record.PathEncoding
+	}
+	if record.ExternalSymlink != nil {
+		f.ExternalSymlink = sql.NullBool{Bool: *record.ExternalSymlink, Valid: true}
+	}
+	if record.HeadHashSize != nil {
+		f.HeadHashSize = sql.NullInt64{Int64: *record.HeadHashSize, Valid: true}
+	}
+	if record.TargetSize != nil {
+		f.TargetSize = sql.NullInt64{Int64: *record.TargetSize, Valid: true}
+	}
+	if record.ChainLength != nil {
+		f.ChainLength = sql.NullInt64{Int64: *record.ChainLength, Valid: true}
+	}
+	if record.Depth != nil {
+		f.Depth = sql.NullInt64{Int64: *record.Depth, Valid: true}
+	}
+	if record.Mode != nil {
+		f.Mode = sql.NullInt64{Int64: *record.Mode, Valid: true}
+	}
+	if record.UID != nil {
+		f.UID = sql.NullInt64{Int64: *record.UID, Valid: true}
+	}
+	if record.GID != nil {
+		f.GID = sql.NullInt64{Int64: *record.GID, Valid: true}
+	}
+	if record.DevID != nil {
+		f.DevID = sql.NullInt64{Int64: *record.DevID, Valid: true}
+	}
+	if record.Inode != nil {
+		f.Inode = sql.NullInt64{Int64: *record.Inode, Valid: true}
+	}
+	if record.Name != nil {
+		f.Name = toNullString(record.Name)
+	}
+	if record.Type != nil {
+		f.Type = toNullString(record.Type)
+	}
+	if !f.Dir {
+		f.Category = sql.NullString{String: categorizeFile(f.Type.String), Valid: true}
+	}
+	return f, &record, nil
+}
+
+func toNullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportRecords(t *testing.T) {
+	db := newTestDatabase(t)
+
+	hash := strings.Repeat("ab", 32)
+	input := strings.Join([]string{
+		`{"path": "/a/b/file.txt", "size": 10, "hash": "` + hash + `", "modification_time": "2023-01-02T03:04:05Z"}`,
+		`{"path": "/a/b", "dir": true}`,
+		`not json`,
+		`{"path": "relative/path"}`,
+		`{"path": "/a/c.txt", "hash": "xyz"}`,
+		``,
+		`{"path": "/a/b/file.txt", "size": 11, "unknown": 1}`,
+		`{"path": "/a/b/file.txt", "size": 12}`,
+	}, "\n")
+
+	result, err := importRecords(db, strings.NewReader(input), 2, NewProcessStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := importStats{Inserted: 2, Updated: 1, Rejected: 4}
+	if result != expected {
+		t.Errorf("importRecords() = %+v, want %+v", result, expected)
+	}
+
+	var size int64
+	var folderPath string
+	err = db.QueryRow(`
+	SELECT size, folders.path FROM files JOIN folders ON files.folder_id = folders.id WHERE files.path = ?`,
+		"/a/b/file.txt").Scan(&size, &folderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 12 || folderPath != "/a/b" {
+		t.Errorf("got size %d and folder %q, want 12 and %q", size, folderPath, "/a/b")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+)
+
+// inodeKey identifies a file independently of the paths that link to it
+type inodeKey struct {
+	Device int64
+	Inode  int64
+}
+
+// linkedHash is the hash of a file shared by its hard links, with what UpdateHash reads from the contents along
+// with it
+type linkedHash struct {
+	Size             int64
+	ModificationTime string
+	Algorithm        string
+	Hash             string
+	ContentKind      sql.NullString
+	Magic            sql.NullString
+	DetectedType     sql.NullString
+}
+
+// linkFarmCache holds the hashes of the files with several hard links during a crawl with -hash-link-farm-aware,
+// so that each file is hashed once however many paths link to it, as in the snapshots of rsnapshot or Time Machine.
+// With FromDB, files missing from the cache are looked up in the database, so that the links in a new snapshot
+// reuse the hashes of the previous ones. It is safe for concurrent use, although two walks reaching the same file at
+// the same time may both hash it.
+type linkFarmCache struct {
+	FromDB bool
+	mu     sync.Mutex
+	hashes map[inodeKey]linkedHash
+}
+
+func newLinkFarmCache(fromDB bool) *linkFarmCache {
+	return &linkFarmCache{FromDB: fromDB, hashes: make(map[inodeKey]linkedHash)}
+}
+
+// apply sets the hash of f, with the given algorithm, from another link to the same file, and reports whether there
+// was one. Only files with several links are looked up, and the size and modification time must be the ones of f,
+// in case the file changed since it was hashed. A nil cache never applies.
+func (c *linkFarmCache) apply(db execQuerier, f *FileInfo, algorithm string) bool {
+	if c == nil || f.links < 2 || !f.Inode.Valid {
+		return false
+	}
+	key := inodeKey{Device: f.DevID.Int64, Inode: f.Inode.Int64}
+	c.mu.Lock()
+	h, ok := c.hashes[key]
+	c.mu.Unlock()
+	if !ok || h.Size != f.Size || h.ModificationTime != f.ModificationTime.String || h.Algorithm != algorithm {
+		if !c.FromDB {
+			return false
+		}
+		var err error
+		h, err = loadLinkedHash(db, key, f.Size, f.ModificationTime.String, algorithm)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		} else if err != nil {
+			log.Println("Error looking up the hash of a hard link:", f.Path.String, err)
+			return false
+		}
+		c.mu.Lock()
+		c.hashes[key] = h
+		c.mu.Unlock()
+	}
+	f.Hash = sql.NullString{String: h.Hash, Valid: true}
+	f.HashAlgorithm = sql.NullString{String: h.Algorithm, Valid: true}
+	f.ContentKind, f.Magic, f.DetectedType = h.ContentKind, h.Magic, h.DetectedType
+	return true
+}
+
+// add records the hash of f, which has just been hashed, for the other links to it
+func (c *linkFarmCache) add(f *FileInfo) {
+	if c == nil || f.links < 2 || !f.Inode.Valid || !f.Hash.Valid {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes[inodeKey{Device: f.DevID.Int64, Inode: f.Inode.Int64}] = linkedHash{
+		Size:             f.Size,
+		ModificationTime: f.ModificationTime.String,
+		Algorithm:        f.HashAlgorithm.String,
+		Hash:             f.Hash.String,
+		ContentKind:      f.ContentKind,
+		Magic:            f.Magic,
+		DetectedType:     f.DetectedType,
+	}
+}
+
+// loadLinkedHash returns the hash stored for a path to the file with the given key, size and modification time,
+// hashed with algorithm, or sql.ErrNoRows if there is none
+func loadLinkedHash(db execQuerier, key inodeKey, size int64, modTime, algorithm string) (linkedHash, error) {
+	h := linkedHash{Size: size, ModificationTime: modTime, Algorithm: algorithm}
+	dbMetrics.dbQueryCount.Add(1)
+	err := db.QueryRow(`
+	SELECT `+hashHexColumn+`, content_kind, magic, detected_type FROM files
+	WHERE dev_id = ? AND inode = ? AND size = ? AND modification_time = ? AND hash_algorithm = ?
+	      AND hash IS NOT NULL AND error IS NULL AND COALESCE(bundle, 0) = 0
+	LIMIT 1`, key.Device, key.Inode, size, modTime, algorithm).Scan(&h.Hash, &h.ContentKind, &h.Magic, &h.DetectedType)
+	return h, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkFarmCache(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"snapshot.1/photo.jpg", "photo"},
+		{"snapshot.1/notes.txt", "notes"},
+	})
+	link := func(snapshot string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(root, snapshot), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := os.Link(filepath.Join(root, "snapshot.1/photo.jpg"), filepath.Join(root, snapshot, "photo.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link("snapshot.2")
+
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, LinkFarm: newLinkFarmCache(false)}
+	stats := NewProcessStats()
+	if err := processDirectory(root, db, stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := stats.rootCounts()[0]; counts.Hashed != 3 || counts.Linked != 1 || counts.Bytes != 10 {
+		t.Errorf("crawl hashed %d files and %d bytes, with %d from links, want 3 files and 10 bytes, with 1 from "+
+			"links", counts.Hashed, counts.Bytes, counts.Linked)
+	}
+
+	// A new snapshot reuses the stored hash with -link-farm-from-db
+	link("snapshot.3")
+	opts.LinkFarm = newLinkFarmCache(true)
+	stats = NewProcessStats()
+	if err := processDirectory(root, db, stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := stats.rootCounts()[0]; counts.Hashed != 1 || counts.Linked != 1 {
+		t.Errorf("crawl of a new snapshot hashed %d files, with %d from links, want 1 from links", counts.Hashed,
+			counts.Linked)
+	}
+
+	var hashes, inodes int
+	err := db.QueryRow(`SELECT COUNT(DISTINCT hash), COUNT(DISTINCT inode) FROM files WHERE name = 'photo.jpg'`).
+		Scan(&hashes, &inodes)
+	if err != nil || hashes != 1 || inodes != 1 {
+		t.Errorf("the links have %d hashes and %d inodes, %v, want 1", hashes, inodes, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// magicSize is how many bytes at the start of a file are stored, hex-encoded, in the magic column
+const magicSize = 16
+
+// magicSignature identifies a file type by the bytes at an offset from the start of the file
+type magicSignature struct {
+	Type   string
+	Offset int
+	Magic  string
+}
+
+// magicSignatures are the well-known signatures stored as detected_type. A type can have several signatures.
+var magicSignatures = []magicSignature{
+	{"png", 0, "\x89PNG\r\n\x1a\n"},
+	{"jpeg", 0, "\xff\xd8\xff"},
+	{"pdf", 0, "%PDF-"},
+	{"zip", 0, "PK\x03\x04"},
+	{"zip", 0, "PK\x05\x06"}, // Empty archive
+	{"elf", 0, "\x7fELF"},
+	{"macho", 0, "\xfe\xed\xfa\xce"},
+	{"macho", 0, "\xfe\xed\xfa\xcf"},
+	{"macho", 0, "\xce\xfa\xed\xfe"},
+	{"macho", 0, "\xcf\xfa\xed\xfe"},
+	{"sqlite", 0, "SQLite format 3\x00"},
+	{"gzip", 0, "\x1f\x8b"},
+	{"heic", 4, "ftypheic"},
+	{"heic", 4, "ftypheix"},
+	{"heic", 4, "ftypmif1"},
+}
+
+// detectedTypeExtensions are the lowercase extensions that files of a detected type are expected to have. Types
+// that are commonly stored under any name, such as executables and databases, are missing and never mismatch.
+var detectedTypeExtensions = map[string][]string{
+	"png":  {".png"},
+	"jpeg": {".jpg", ".jpeg", ".jpe", ".jfif"},
+	"pdf":  {".pdf", ".ai"},
+	"zip": {".zip", ".jar", ".war", ".apk", ".ipa", ".epub", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp",
+		".whl", ".xpi", ".kmz", ".sketch"},
+	"gzip": {".gz", ".tgz", ".svgz"},
+	"heic": {".heic", ".heif", ".hif"},
+}
+
+// encodeMagic returns the first magicSize bytes of header, hex-encoded
+func encodeMagic(header []byte) string {
+	return hex.EncodeToString(header[:min(len(header), magicSize)])
+}
+
+// detectType returns the type of the first of magicSignatures that header starts with, or "" if none does
+func detectType(header []byte) string {
+	for _, signature := range magicSignatures {
+		end := signature.Offset + len(signature.Magic)
+		if end <= len(header) && string(header[signature.Offset:end]) == signature.Magic {
+			return signature.Type
+		}
+	}
+	return ""
+}
+
+// extensionMatchesType reports whether ext, as returned by filepath.Ext, is expected for files of the detected type
+func extensionMatchesType(ext, detectedType string) bool {
+	extensions, ok := detectedTypeExtensions[detectedType]
+	if !ok {
+		return true
+	}
+	for _, e := range extensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeMismatchReport writes the files whose detected type disagrees with their extension, such as HEIC photos
+// named .jpg, with the detected type first
+func typeMismatchReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT path, COALESCE(type, ''), detected_type FROM files
+	WHERE detected_type IS NOT NULL AND exclusion_pattern IS NULL
+	ORDER BY path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, ext, detectedType string
+		if err := rows.Scan(&path, &ext, &detectedType); err != nil {
+			return err
+		}
+		if extensionMatchesType(ext, detectedType) {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%-8s %s\n", detectedType, path); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// runStatsByType implements the stats-by-type subcommand, which summarizes the index by the types detected from
+// the contents of files rather than by their extensions
+func runStatsByType(args []string) error {
+	var dbFile string
+	var root string
+	var byRoot bool
+	var format string
+
+	flags := flag.NewFlagSet("stats-by-type", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&root, "root", "", "Only count the files equal to or below this path")
+	flags.BoolVar(&byRoot, "by-root", false, "Count the files of each crawled root separately")
+	flags.StringVar(&format, "format", textFormat,
+		"Output: text, markdown for a GitHub-flavored table, or json for an object per row")
+	_ = flags.Parse(args)
+
+	if format != "json" {
+		if err := checkReportFormat(format); err != nil {
+			return err
+		}
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	roots := []string{root}
+	if byRoot {
+		if roots, err = knownRoots(db); err != nil {
+			return err
+		}
+	}
+	stats, err := typeStats(db, roots)
+	if err != nil {
+		return err
+	}
+	return writeTypeStats(os.Stdout, stats, byRoot, format)
+}
+
+// Buckets of typeStats for files without a detected type: those whose first bytes are stored but match none of
+// magicSignatures, and those indexed before detection existed, or never hashed
+const (
+	unrecognizedType = "unrecognized"
+	unknownType      = "unknown"
+)
+
+// typeStat is the number and total size of the files of a detected type below a root
+type typeStat struct {
+	Root  string
+	Type  string
+	Files int64
+	Bytes int64
+}
+
+// typeStats counts the files below each of roots by detected type, largest first. An empty root counts all files.
+// Directories, symlinks and excluded files are left out.
+func typeStats(db *sql.DB, roots []string) ([]typeStat, error) {
+	var stats []typeStat
+	for _, root := range roots {
+		condition := "dir = 0 AND COALESCE(symlink, '') = '' AND exclusion_pattern IS NULL"
+		var args []any
+		if root != "" {
+			condition += " AND " + underRootCondition
+			args = underRootArgs(root)
+		}
+		rows, err := db.Query(`
+		SELECT COALESCE(detected_type, CASE WHEN magic IS NULL THEN '`+unknownType+`' ELSE '`+unrecognizedType+`' END)
+		       AS bucket, COUNT(*), COALESCE(SUM(size), 0) AS bytes
+		FROM files WHERE `+condition+`
+		GROUP BY bucket ORDER BY bytes DESC, bucket`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			stat := typeStat{Root: root}
+			if err := rows.Scan(&stat.Type, &stat.Files, &stat.Bytes); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			stats = append(stats, stat)
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// writeTypeStats writes stats in format, with the root of each row if byRoot is set. The json format writes an
+// object per row, like query -sql.
+func writeTypeStats(w io.Writer, stats []typeStat, byRoot bool, format string) error {
+	columns := []string{"type", "files", "bytes"}
+	table := reportTable{Header: []string{"Type", "Files", "Bytes"}, Text: "%-14s %10s %16s\n"}
+	if byRoot {
+		columns = append([]string{"root"}, columns...)
+		table = reportTable{Header: []string{"Root", "Type", "Files", "Bytes"}, Text: "%-30s %-14s %10s %16s\n"}
+	}
+	for _, stat := range stats {
+		values := []any{stat.Type, stat.Files, stat.Bytes}
+		if byRoot {
+			values = append([]any{stat.Root}, values...)
+		}
+		if format == "json" {
+			if err := writeJSONRow(w, columns, values); err != nil {
+				return err
+			}
+			continue
+		}
+		row := make([]string, len(values))
+		for i, value := range values {
+			row[i] = fmt.Sprint(value)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	if format == "json" {
+		return nil
+	}
+	return writeTable(w, table, format)
+}
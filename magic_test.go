@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectType(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "png"},
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "jpeg"},
+		{"%PDF-1.7\n", "pdf"},
+		{"PK\x03\x04\x14\x00", "zip"},
+		{"\x7fELF\x02\x01\x01", "elf"},
+		{"\xcf\xfa\xed\xfe\x0c\x00\x00\x01", "macho"},
+		{"SQLite format 3\x00\x10\x00", "sqlite"},
+		{"\x1f\x8b\x08\x00", "gzip"},
+		{"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00", "heic"},
+		{"\x00\x00\x00\x18ftypisom", ""},
+		{"hello", ""},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if detected := detectType([]byte(tc.header)); detected != tc.expected {
+			t.Errorf("detectType(%q) = %q, want %q", tc.header, detected, tc.expected)
+		}
+	}
+	if magic := encodeMagic([]byte("%PDF-1.7\nmore than sixteen bytes")); magic != "255044462d312e370a6d6f7265207468" {
+		t.Errorf("encodeMagic() = %s", magic)
+	}
+}
+
+func TestTypeMismatchReport(t *testing.T) {
+	root := t.TempDir()
+	heic := "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"
+	writeFiles(t, root, [][2]string{
+		{"IMG_0001.jpg", heic},
+		{"IMG_0002.HEIC", heic},
+		{"photo.JPG", "\xff\xd8\xff\xe0"},
+		{"ls", "\x7fELF\x02\x01\x01"},
+		{"notes.txt", "notes"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := typeMismatchReport(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "heic     " + root + "/IMG_0001.jpg\n"; buf.String() != expected {
+		t.Errorf("typeMismatchReport() = %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestTypeStats(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"a.jpg", "\xff\xd8\xff\xe0 jpeg"},
+		{"photos/b", "\xff\xd8\xff\xe0 jpeg without an extension"},
+		{"photos/notes.txt", "notes"},
+		{"old.pdf", "%PDF-1.4 indexed before detection"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE files SET magic = NULL, detected_type = NULL WHERE path = ?",
+		filepath.Join(root, "old.pdf")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := typeStats(db, []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []typeStat{{"", "jpeg", 2, 39}, {"", "unknown", 1, 33}, {"", "unrecognized", 1, 5}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("typeStats() = %+v, want %+v", stats, expected)
+	}
+
+	photos := filepath.Join(root, "photos")
+	if stats, err = typeStats(db, []string{photos}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeTypeStats(&buf, stats, true, "json"); err != nil {
+		t.Fatal(err)
+	}
+	jsonPhotos, _ := json.Marshal(photos)
+	expectedJSON := `{"root":` + string(jsonPhotos) + `,"type":"jpeg","files":1,"bytes":30}` + "\n" +
+		`{"root":` + string(jsonPhotos) + `,"type":"unrecognized","files":1,"bytes":5}` + "\n"
+	if buf.String() != expectedJSON {
+		t.Errorf("writeTypeStats() = %q, want %q", buf.String(), expectedJSON)
+	}
+}
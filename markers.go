@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Files that exclude the directory containing them from crawls, unless -ignore-markers is given
+const (
+	noCrawlMarker  = ".nocrawl"
+	cacheDirMarker = "CACHEDIR.TAG"
+)
+
+// cacheDirSignature starts every valid CACHEDIR.TAG, see https://bford.info/cachedir/
+var cacheDirSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// excludingMarker returns the name of the marker file that excludes the directory at dir, or "" if there is none
+// or markers are ignored. A .nocrawl file of any content is a marker, a CACHEDIR.TAG only with the standard
+// signature.
+func (opts *walkOptions) excludingMarker(dir string) string {
+	if opts.IgnoreMarkers {
+		return ""
+	}
+	if _, err := os.Lstat(filepath.Join(dir, noCrawlMarker)); err == nil {
+		return noCrawlMarker
+	}
+	if hasCacheDirSignature(filepath.Join(dir, cacheDirMarker)) {
+		return cacheDirMarker
+	}
+	return ""
+}
+
+// hasCacheDirSignature reports whether the file at path starts with the CACHEDIR.TAG signature
+func hasCacheDirSignature(path string) bool {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	} else if err != nil {
+		log.Println("Error opening cache directory tag:", path, err)
+		return false
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing file:", err)
+		}
+	}(file)
+
+	header := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, cacheDirSignature)
+}
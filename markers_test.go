@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessDirectoryMarkers(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"private/.nocrawl", ""},
+		{"private/secret.txt", "secret"},
+		{"cache/CACHEDIR.TAG", "Signature: 8a477f597d28d172789f06886806bc55\n# This file is a cache directory tag.\n"},
+		{"cache/blob", "cached"},
+		{"wrong/CACHEDIR.TAG", "Signature: 0000000000000000000000000000000\n"},
+		{"wrong/data.txt", "data"},
+		{"short/CACHEDIR.TAG", "Signature: 8a477f"},
+		{"short/data.txt", "data"},
+	})
+
+	testCases := []struct {
+		ignoreMarkers bool
+		expected      map[string]string // Exclusion patterns by path, "" for indexed paths, "missing" for paths not stored
+	}{
+		{false, map[string]string{
+			"private": ".nocrawl", "private/secret.txt": "missing", "cache": "CACHEDIR.TAG", "cache/blob": "missing",
+			"wrong/data.txt": "", "short/data.txt": "",
+		}},
+		{true, map[string]string{
+			"private": "", "private/secret.txt": "", "cache": "", "cache/blob": "", "wrong/data.txt": "",
+			"short/data.txt": "",
+		}},
+	}
+	for _, tc := range testCases {
+		db := newTestDatabase(t)
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1, IgnoreMarkers: tc.ignoreMarkers}}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		for path, expected := range tc.expected {
+			var pattern sql.NullString
+			err := db.QueryRow("SELECT exclusion_pattern FROM files WHERE path = ?", filepath.Join(root, path)).
+				Scan(&pattern)
+			got := pattern.String
+			if err == sql.ErrNoRows {
+				got = "missing"
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != expected {
+				t.Errorf("with ignoreMarkers %v, %s is %q, want %q", tc.ignoreMarkers, path, got, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// mediaInfo is what -media-metadata stores about an audio or video file, parsed from the headers of its container
+// without decoding it. Values that the container doesn't give are zero.
+type mediaInfo struct {
+	Duration float64 // Seconds
+	Width    int64   // Pixels, for video
+	Height   int64
+	Codec    string // As named by the container, e.g. avc1 in MP4 or V_MPEG4/ISO/AVC in Matroska
+}
+
+// mediaResult is the outcome of reading the media metadata of a file
+type mediaResult struct {
+	Info mediaInfo
+	Err  error // Why the headers couldn't be parsed, stored instead of Info
+}
+
+// mediaParsers parse the headers of the containers with these extensions. r holds the whole file, of size bytes.
+var mediaParsers = map[string]func(r io.ReaderAt, size int64) (mediaInfo, error){
+	".mp4":  parseMP4,
+	".m4v":  parseMP4,
+	".m4a":  parseMP4,
+	".mov":  parseMP4,
+	".mkv":  parseMatroska,
+	".webm": parseMatroska,
+	".mp3":  parseMP3,
+	".flac": parseFLAC,
+}
+
+// isMediaFile reports whether files with the extension ext, as returned by filepath.Ext, have media metadata
+func isMediaFile(ext string) bool {
+	_, ok := mediaParsers[strings.ToLower(ext)]
+	return ok
+}
+
+// readMediaInfo parses the headers of a file with the extension ext
+func readMediaInfo(r io.ReaderAt, size int64, ext string) (mediaInfo, error) {
+	parse, ok := mediaParsers[strings.ToLower(ext)]
+	if !ok {
+		return mediaInfo{}, fmt.Errorf("unsupported media type %q", ext)
+	}
+	return parse(r, size)
+}
+
+// writeMediaInfo stores the media metadata of path, or the error that prevented reading it
+func writeMediaInfo(db execQuerier, path string, info mediaInfo, err error) error {
+	var message sql.NullString
+	if err != nil {
+		info = mediaInfo{}
+		message = sql.NullString{String: err.Error(), Valid: true}
+	}
+	_, err = db.Exec(`
+	INSERT OR REPLACE INTO media_info(path, duration, width, height, codec, error) VALUES (?, ?, ?, ?, ?, ?)`,
+		path, sql.NullFloat64{Float64: info.Duration, Valid: info.Duration > 0},
+		sql.NullInt64{Int64: info.Width, Valid: info.Width > 0},
+		sql.NullInt64{Int64: info.Height, Valid: info.Height > 0},
+		sql.NullString{String: info.Codec, Valid: info.Codec != ""}, message)
+	return err
+}
+
+// hasMediaInfo reports whether media metadata, or an error reading it, is stored for path
+func hasMediaInfo(db execQuerier, path string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM media_info WHERE path = ?", path).Scan(&count)
+	return count > 0, err
+}
+
+var errTruncatedMedia = errors.New("truncated header")
+
+// readAt reads n bytes at off, failing if they are not all within size
+func readAt(r io.ReaderAt, size, off int64, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+int64(n) > size {
+		return nil, errTruncatedMedia
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil && !(errors.Is(err, io.EOF) && off+int64(n) == size) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// maxMediaBoxes bounds the number of boxes or elements parsed, so that a corrupt file can't take forever
+const maxMediaBoxes = 10000
+
+// mp4Box is a box of an ISO base media file, i.e. MP4 or QuickTime
+type mp4Box struct {
+	Type  string
+	Start int64 // Offset of the contents, after the header
+	End   int64
+}
+
+// mp4Boxes returns the boxes between start and end
+func mp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for off := start; off+8 <= end; {
+		if len(boxes) >= maxMediaBoxes {
+			return nil, errors.New("too many boxes")
+		}
+		header, err := readAt(r, end, off, 8)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		box := mp4Box{Type: string(header[4:8]), Start: off + 8}
+		switch size {
+		case 0: // The box extends to the end
+			size = end - off
+		case 1: // 64-bit size after the type
+			large, err := readAt(r, end, off+8, 8)
+			if err != nil {
+				return nil, err
+			}
+			if size = int64(binary.BigEndian.Uint64(large)); size < 0 {
+				return nil, fmt.Errorf("invalid size of box %q", box.Type)
+			}
+			box.Start += 8
+		}
+		if size < box.Start-off || off+size > end {
+			return nil, fmt.Errorf("invalid size of box %q", box.Type)
+		}
+		box.End = off + size
+		boxes = append(boxes, box)
+		off = box.End
+	}
+	return boxes, nil
+}
+
+// findMP4Box returns the first box of type boxType among boxes
+func findMP4Box(boxes []mp4Box, boxType string) (mp4Box, bool) {
+	for _, box := range boxes {
+		if box.Type == boxType {
+			return box, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// mp4Path returns the box reached by following the types in path down from the children of parent
+func mp4Path(r io.ReaderAt, parent mp4Box, path ...string) (mp4Box, bool, error) {
+	box := parent
+	for _, boxType := range path {
+		children, err := mp4Boxes(r, box.Start, box.End)
+		if err != nil {
+			return box, false, err
+		}
+		var ok bool
+		if box, ok = findMP4Box(children, boxType); !ok {
+			return box, false, nil
+		}
+	}
+	return box, true, nil
+}
+
+// parseMP4 reads the duration from the movie header, and the dimensions and codec from the first video track,
+// or the codec of the first audio track if there is no video
+func parseMP4(r io.ReaderAt, size int64) (mediaInfo, error) {
+	var info mediaInfo
+	boxes, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return info, err
+	}
+	moov, ok := findMP4Box(boxes, "moov")
+	if !ok {
+		return info, errors.New("no moov box")
+	}
+	children, err := mp4Boxes(r, moov.Start, moov.End)
+	if err != nil {
+		return info, err
+	}
+
+	if mvhd, ok := findMP4Box(children, "mvhd"); ok {
+		header, err := readAt(r, mvhd.End, mvhd.Start, 32)
+		if err != nil {
+			return info, err
+		}
+		// Version 1 has 64-bit times and duration, version 0 32-bit ones
+		timescale := uint64(binary.BigEndian.Uint32(header[12:]))
+		duration := uint64(binary.BigEndian.Uint32(header[16:]))
+		if header[0] == 1 {
+			timescale, duration = uint64(binary.BigEndian.Uint32(header[20:])), binary.BigEndian.Uint64(header[24:])
+		}
+		if timescale > 0 && duration != math.MaxUint64 && duration != math.MaxUint32 {
+			info.Duration = float64(duration) / float64(timescale)
+		}
+	}
+
+	audioCodec := ""
+	for _, trak := range children {
+		if trak.Type != "trak" {
+			continue
+		}
+		hdlr, ok, err := mp4Path(r, trak, "mdia", "hdlr")
+		if err != nil || !ok {
+			continue
+		}
+		handler, err := readAt(r, hdlr.End, hdlr.Start+8, 4)
+		if err != nil {
+			continue
+		}
+		codec := ""
+		if stsd, ok, err := mp4Path(r, trak, "mdia", "minf", "stbl", "stsd"); err == nil && ok {
+			// Version, flags and entry count, followed by the size and format of the first entry
+			if entry, err := readAt(r, stsd.End, stsd.Start+8, 8); err == nil {
+				codec = strings.TrimRight(string(entry[4:8]), " \x00")
+			}
+		}
+		switch string(handler) {
+		case "vide":
+			tkhd, ok, err := mp4Path(r, trak, "tkhd")
+			if err != nil || !ok {
+				continue
+			}
+			version, err := readAt(r, tkhd.End, tkhd.Start, 1)
+			if err != nil {
+				continue
+			}
+			offset := int64(76) // Width and height are 16.16 fixed point numbers after the matrix
+			if version[0] == 1 {
+				offset = 88
+			}
+			dimensions, err := readAt(r, tkhd.End, tkhd.Start+offset, 8)
+			if err != nil {
+				continue
+			}
+			info.Width = int64(binary.BigEndian.Uint32(dimensions) >> 16)
+			info.Height = int64(binary.BigEndian.Uint32(dimensions[4:]) >> 16)
+			info.Codec = codec
+			return info, nil
+		case "soun":
+			if audioCodec == "" {
+				audioCodec = codec
+			}
+		}
+	}
+	info.Codec = audioCodec
+	return info, nil
+}
+
+// Matroska element IDs, including their length markers
+const (
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvTrackType     = 0x83
+	mkvCodecID       = 0x86
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvCluster       = 0x1F43B675
+	mkvEBML          = 0x1A45DFA3
+)
+
+// mkvElement is an element of a Matroska file
+type mkvElement struct {
+	ID    uint64
+	Start int64 // Offset of the data, after the ID and size
+	End   int64
+}
+
+// readVint reads an EBML variable-length integer at off, keeping the length marker for IDs. It returns the value,
+// its length and whether all its value bits are set, which means an unknown size.
+func readVint(r io.ReaderAt, end, off int64, keepMarker bool) (uint64, int, bool, error) {
+	first, err := readAt(r, end, off, 1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	length := 1
+	for mask := byte(0x80); first[0]&mask == 0; mask >>= 1 {
+		if length++; length > 8 {
+			return 0, 0, false, errors.New("invalid variable-length integer")
+		}
+	}
+	data, err := readAt(r, end, off, length)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	valueBits := uint64(1)<<(7*length) - 1
+	if keepMarker {
+		return value, length, false, nil
+	}
+	return value & valueBits, length, value&valueBits == valueBits, nil
+}
+
+// mkvElements returns the elements between start and end. An element of unknown size, which is only allowed for
+// the segment and clusters, extends to end.
+func mkvElements(r io.ReaderAt, start, end int64) ([]mkvElement, error) {
+	var elements []mkvElement
+	for off := start; off < end; {
+		if len(elements) >= maxMediaBoxes {
+			return nil, errors.New("too many elements")
+		}
+		id, idLength, _, err := readVint(r, end, off, true)
+		if err != nil {
+			return nil, err
+		}
+		size, sizeLength, unknown, err := readVint(r, end, off+int64(idLength), false)
+		if err != nil {
+			return nil, err
+		}
+		element := mkvElement{ID: id, Start: off + int64(idLength+sizeLength)}
+		if unknown || size > uint64(end-element.Start) {
+			if !unknown {
+				return nil, fmt.Errorf("invalid size of element %x", id)
+			}
+			element.End = end
+		} else {
+			element.End = element.Start + int64(size)
+		}
+		elements = append(elements, element)
+		if id == mkvCluster {
+			break // The metadata comes before the media data
+		}
+		off = element.End
+	}
+	return elements, nil
+}
+
+// mkvUint reads the unsigned integer in element
+func mkvUint(r io.ReaderAt, e mkvElement) (uint64, error) {
+	if e.End-e.Start > 8 {
+		return 0, errors.New("integer too long")
+	}
+	data, err := readAt(r, e.End, e.Start, int(e.End-e.Start))
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, err
+}
+
+// parseMatroska reads the duration from the segment information, and the dimensions and codec from the first
+// video track, or the codec of the first audio track if there is no video
+func parseMatroska(r io.ReaderAt, size int64) (mediaInfo, error) {
+	var info mediaInfo
+	if magic, err := readAt(r, size, 0, 4); err != nil || binary.BigEndian.Uint32(magic) != mkvEBML {
+		return info, errors.New("no EBML header")
+	}
+	top, err := mkvElements(r, 0, size)
+	if err != nil {
+		return info, err
+	}
+	var segment *mkvElement
+	for i := range top {
+		if top[i].ID == mkvSegment {
+			segment = &top[i]
+			break
+		}
+	}
+	if segment == nil {
+		return info, errors.New("no segment")
+	}
+	children, err := mkvElements(r, segment.Start, segment.End)
+	if err != nil {
+		return info, err
+	}
+
+	audioCodec := ""
+	for _, child := range children {
+		switch child.ID {
+		case mkvInfo:
+			elements, err := mkvElements(r, child.Start, child.End)
+			if err != nil {
+				return info, err
+			}
+			timecodeScale, duration := uint64(1000000), 0.0
+			for _, e := range elements {
+				switch e.ID {
+				case mkvTimecodeScale:
+					if timecodeScale, err = mkvUint(r, e); err != nil {
+						return info, err
+					}
+				case mkvDuration:
+					data, err := readAt(r, e.End, e.Start, int(e.End-e.Start))
+					if err != nil {
+						return info, err
+					}
+					switch len(data) {
+					case 4:
+						duration = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+					case 8:
+						duration = math.Float64frombits(binary.BigEndian.Uint64(data))
+					}
+				}
+			}
+			info.Duration = duration * float64(timecodeScale) / 1e9
+		case mkvTracks:
+			entries, err := mkvElements(r, child.Start, child.End)
+			if err != nil {
+				return info, err
+			}
+			for _, entry := range entries {
+				if entry.ID != mkvTrackEntry {
+					continue
+				}
+				track, err := parseMatroskaTrack(r, entry)
+				if err != nil {
+					return info, err
+				}
+				if track.video && info.Codec == "" {
+					info.Width, info.Height, info.Codec = track.width, track.height, track.codec
+				} else if track.audio && audioCodec == "" {
+					audioCodec = track.codec
+				}
+			}
+		}
+	}
+	if info.Codec == "" {
+		info.Codec = audioCodec
+	}
+	return info, nil
+}
+
+// mkvTrack is what parseMatroska needs from a track entry
+type mkvTrack struct {
+	video, audio  bool
+	codec         string
+	width, height int64
+}
+
+func parseMatroskaTrack(r io.ReaderAt, entry mkvElement) (mkvTrack, error) {
+	var track mkvTrack
+	elements, err := mkvElements(r, entry.Start, entry.End)
+	if err != nil {
+		return track, err
+	}
+	for _, e := range elements {
+		switch e.ID {
+		case mkvTrackType:
+			trackType, err := mkvUint(r, e)
+			if err != nil {
+				return track, err
+			}
+			track.video, track.audio = trackType == 1, trackType == 2
+		case mkvCodecID:
+			data, err := readAt(r, e.End, e.Start, int(e.End-e.Start))
+			if err != nil {
+				return track, err
+			}
+			track.codec = string(bytes.TrimRight(data, "\x00"))
+		case mkvVideo:
+			video, err := mkvElements(r, e.Start, e.End)
+			if err != nil {
+				return track, err
+			}
+			for _, v := range video {
+				value, err := mkvUint(r, v)
+				if err != nil {
+					return track, err
+				}
+				switch v.ID {
+				case mkvPixelWidth:
+					track.width = int64(value)
+				case mkvPixelHeight:
+					track.height = int64(value)
+				}
+			}
+		}
+	}
+	return track, nil
+}
+
+// parseFLAC reads the duration from the STREAMINFO block, which must come first
+func parseFLAC(r io.ReaderAt, size int64) (mediaInfo, error) {
+	info := mediaInfo{Codec: "flac"}
+	header, err := readAt(r, size, 0, 8+34)
+	if err != nil {
+		return info, err
+	}
+	if string(header[:4]) != "fLaC" {
+		return info, errors.New("no fLaC marker")
+	}
+	if header[4]&0x7f != 0 {
+		return info, errors.New("no STREAMINFO block")
+	}
+	streamInfo := header[8:]
+	// 20 bits of sample rate, 3 of channels, 5 of bits per sample and 36 of total samples
+	packed := binary.BigEndian.Uint64(streamInfo[10:18])
+	sampleRate := packed >> 44
+	samples := packed & (1<<36 - 1)
+	if sampleRate > 0 {
+		info.Duration = float64(samples) / float64(sampleRate)
+	}
+	return info, nil
+}
+
+// MPEG audio layer III bit rates in kbit/s for MPEG 1 and MPEG 2, and sample rates in Hz for MPEG 1, by their
+// index in the frame header
+var (
+	mp3BitRates = [2][16]int64{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = [3]int64{44100, 48000, 32000}
+)
+
+const (
+	mp3MaxSyncScan  = 64 * 1024 // How far past the ID3 tag to look for the first frame
+	mp3XingFrames   = 1         // Flag of the Xing header for the presence of the number of frames
+	mp3MPEG1Version = 3         // Version bits of MPEG 1 in the frame header
+)
+
+// parseMP3 reads the duration from the Xing or VBRI header of the first frame of variable bit rate files, or
+// computes it from the size and bit rate of constant bit rate files
+func parseMP3(r io.ReaderAt, size int64) (mediaInfo, error) {
+	info := mediaInfo{Codec: "mp3"}
+
+	// An ID3v2 tag at the start has a 10 byte header and a syncsafe size, and may be followed by a footer
+	start := int64(0)
+	if id3, err := readAt(r, size, 0, 10); err == nil && string(id3[:3]) == "ID3" {
+		start = 10 + (int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9]))
+		if id3[5]&0x10 != 0 {
+			start += 10
+		}
+	}
+
+	scan, err := readAt(r, size, start, int(min(mp3MaxSyncScan, size-start)))
+	if err != nil {
+		return info, err
+	}
+	frame := -1
+	for i := 0; i+4 <= len(scan); i++ {
+		if scan[i] == 0xff && scan[i+1]&0xe0 == 0xe0 && scan[i+1]&0x06 == 0x02 && scan[i+2]>>4 != 0x0f &&
+			scan[i+2]>>4 != 0 && scan[i+2]&0x0c != 0x0c && scan[i+1]&0x18 != 0x08 {
+			frame = i
+			break
+		}
+	}
+	if frame < 0 {
+		return info, errors.New("no MPEG audio layer III frame")
+	}
+	header := scan[frame:]
+	version := header[1] >> 3 & 3 // 3 for MPEG 1, 2 for MPEG 2, 0 for MPEG 2.5
+	mono := header[3]>>6 == 3
+	sampleRate := mp3SampleRates[header[2]>>2&3]
+	samplesPerFrame := int64(1152)
+	bitRate := mp3BitRates[0][header[2]>>4] * 1000
+	if version != mp3MPEG1Version {
+		sampleRate /= 2
+		if version == 0 {
+			sampleRate /= 2
+		}
+		samplesPerFrame = 576
+		bitRate = mp3BitRates[1][header[2]>>4] * 1000
+	}
+
+	// The Xing or Info header follows the side information, whose size depends on the version and channels
+	sideInfo := 32
+	switch {
+	case version == mp3MPEG1Version && mono:
+		sideInfo = 17
+	case version != mp3MPEG1Version && !mono:
+		sideInfo = 17
+	case version != mp3MPEG1Version && mono:
+		sideInfo = 9
+	}
+	if xing := 4 + sideInfo; frame+xing+12 <= len(scan) {
+		tag := string(header[xing : xing+4])
+		flags := binary.BigEndian.Uint32(header[xing+4:])
+		if (tag == "Xing" || tag == "Info") && flags&mp3XingFrames != 0 {
+			frames := int64(binary.BigEndian.Uint32(header[xing+8:]))
+			info.Duration = float64(frames*samplesPerFrame) / float64(sampleRate)
+			return info, nil
+		}
+	}
+	if vbri := 4 + 32; frame+vbri+18 <= len(scan) && string(header[vbri:vbri+4]) == "VBRI" {
+		frames := int64(binary.BigEndian.Uint32(header[vbri+14:]))
+		info.Duration = float64(frames*samplesPerFrame) / float64(sampleRate)
+		return info, nil
+	}
+	info.Duration = float64(size-start-int64(frame)) * 8 / float64(bitRate)
+	return info, nil
+}
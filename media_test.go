@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Atom builds an MP4 box of type boxType containing the concatenated contents
+func mp4Atom(boxType string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, boxType...), body...)
+}
+
+// testMP4 builds the boxes of an MP4 file with a 1920x1080 avc1 video track, an mp4a audio track and a duration
+// of 12.5 seconds, with the movie box after the media data like many encoders write it
+func testMP4() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // Timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 12500) // Duration
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1920<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 1080<<16)
+
+	track := func(handler, format string, tkhd []byte) []byte {
+		hdlr := append(make([]byte, 8), handler...)
+		hdlr = append(hdlr, make([]byte, 12)...)
+		stsd := binary.BigEndian.AppendUint32(make([]byte, 4), 1)
+		stsd = append(stsd, mp4Atom(format, make([]byte, 16))...)
+		return mp4Atom("trak", mp4Atom("tkhd", tkhd),
+			mp4Atom("mdia", mp4Atom("hdlr", hdlr), mp4Atom("minf", mp4Atom("stbl", mp4Atom("stsd", stsd)))))
+	}
+	return bytes.Join([][]byte{
+		mp4Atom("ftyp", []byte("isom\x00\x00\x02\x00")),
+		mp4Atom("mdat", make([]byte, 1000)),
+		mp4Atom("moov", mp4Atom("mvhd", mvhd), track("soun", "mp4a", make([]byte, 84)), track("vide", "avc1", tkhd)),
+	}, nil)
+}
+
+// mkvElementBytes builds a Matroska element with an ID including its marker and a one-byte size
+func mkvElementBytes(id uint64, contents ...[]byte) []byte {
+	var idBytes []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(idBytes) > 0 {
+			idBytes = append(idBytes, b)
+		}
+	}
+	body := bytes.Join(contents, nil)
+	return append(append(idBytes, 0x80|byte(len(body))), body...)
+}
+
+// testMatroska builds a Matroska file with a 1280x720 VP9 video track and a duration of 90 seconds
+func testMatroska() []byte {
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(90000)) // In units of the default 1 ms
+	video := mkvElementBytes(mkvTrackEntry,
+		mkvElementBytes(mkvTrackType, []byte{1}),
+		mkvElementBytes(mkvCodecID, []byte("V_VP9")),
+		mkvElementBytes(mkvVideo, mkvElementBytes(mkvPixelWidth, []byte{0x05, 0x00}),
+			mkvElementBytes(mkvPixelHeight, []byte{0x02, 0xd0})))
+	audio := mkvElementBytes(mkvTrackEntry,
+		mkvElementBytes(mkvTrackType, []byte{2}),
+		mkvElementBytes(mkvCodecID, []byte("A_OPUS")))
+	segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // Unknown size
+		bytes.Join([][]byte{
+			mkvElementBytes(mkvInfo, mkvElementBytes(mkvDuration, duration)),
+			mkvElementBytes(mkvTracks, audio, video),
+			mkvElementBytes(mkvCluster, make([]byte, 20)),
+		}, nil)...)
+	return append(mkvElementBytes(mkvEBML, mkvElementBytes(0x4282, []byte("matroska"))), segment...)
+}
+
+// testFLAC builds the start of a FLAC file with 441000 samples at 44.1 kHz
+func testFLAC() []byte {
+	streamInfo := make([]byte, 34)
+	binary.BigEndian.PutUint64(streamInfo[10:], 44100<<44|1<<41|15<<36|441000)
+	return append(append([]byte("fLaC"), 0x80, 0, 0, 34), streamInfo...)
+}
+
+// testMP3 builds an MP3 file with an ID3 tag and 100 frames of 128 kbit/s at 44.1 kHz, with a Xing header if
+// xing is set
+func testMP3(xing bool) []byte {
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0a"), make([]byte, 10)...)
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+	if xing {
+		copy(frame[36:], "Xing")
+		binary.BigEndian.PutUint32(frame[40:], 1)
+		binary.BigEndian.PutUint32(frame[44:], 100)
+	}
+	return append(id3, bytes.Repeat(frame, 100)...)
+}
+
+func TestReadMediaInfo(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ext      string
+		data     []byte
+		expected mediaInfo
+	}{
+		{"mp4", ".MP4", testMP4(), mediaInfo{Duration: 12.5, Width: 1920, Height: 1080, Codec: "avc1"}},
+		{"matroska", ".mkv", testMatroska(), mediaInfo{Duration: 90, Width: 1280, Height: 720, Codec: "V_VP9"}},
+		{"flac", ".flac", testFLAC(), mediaInfo{Duration: 10, Codec: "flac"}},
+		{"mp3 xing", ".mp3", testMP3(true), mediaInfo{Duration: 100 * 1152 / 44100.0, Codec: "mp3"}},
+		{"mp3 cbr", ".mp3", testMP3(false), mediaInfo{Duration: 41700 * 8 / 128000.0, Codec: "mp3"}},
+	}
+	for _, tc := range testCases {
+		info, err := readMediaInfo(bytes.NewReader(tc.data), int64(len(tc.data)), tc.ext)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if math.Abs(info.Duration-tc.expected.Duration) > 1e-9 {
+			t.Errorf("%s: duration %v, want %v", tc.name, info.Duration, tc.expected.Duration)
+		}
+		info.Duration = tc.expected.Duration
+		if info != tc.expected {
+			t.Errorf("%s: got %+v, want %+v", tc.name, info, tc.expected)
+		}
+	}
+
+	// Corrupt and truncated files are errors, not panics
+	for _, tc := range testCases {
+		for _, data := range [][]byte{tc.data[:len(tc.data)/3], bytes.Repeat([]byte{0xff}, 64), nil} {
+			_, _ = readMediaInfo(bytes.NewReader(data), int64(len(data)), tc.ext)
+		}
+	}
+	if _, err := readMediaInfo(bytes.NewReader([]byte("not a movie")), 11, ".mp4"); err == nil {
+		t.Error("readMediaInfo() of a text file succeeded, want an error")
+	}
+}
+
+func TestProcessDirectoryMediaMetadata(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"movie.mp4", string(testMP4())},
+		{"broken.mkv", "not a movie"},
+		{"notes.txt", "notes"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, MediaMetadata: true}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var width, height sql.NullInt64
+	var codec, mediaError sql.NullString
+	err := db.QueryRow("SELECT width, height, codec FROM media_info WHERE path = ?",
+		filepath.Join(root, "movie.mp4")).Scan(&width, &height, &codec)
+	if err != nil || width.Int64 != 1920 || height.Int64 != 1080 || codec.String != "avc1" {
+		t.Errorf("got %v, %v, %v, %v for movie.mp4", width, height, codec, err)
+	}
+
+	// A file that can't be parsed is still hashed, with the error stored next to it
+	var hash sql.NullString
+	err = db.QueryRow(`SELECT files.hash, media_info.error FROM files JOIN media_info USING (path) WHERE path = ?`,
+		filepath.Join(root, "broken.mkv")).Scan(&hash, &mediaError)
+	if err != nil || !hash.Valid || !mediaError.Valid {
+		t.Errorf("got hash %v and error %v, %v for broken.mkv, want both", hash, mediaError, err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM media_info").Scan(&count); err != nil || count != 2 {
+		t.Errorf("got %d media_info rows, %v, want 2", count, err)
+	}
+
+	// Unchanged files that were crawled without -media-metadata get it on the next crawl
+	if _, err := db.Exec("DELETE FROM media_info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM media_info").Scan(&count); err != nil || count != 2 {
+		t.Errorf("after a second crawl, got %d media_info rows, %v, want 2", count, err)
+	}
+}
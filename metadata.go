@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// spotlightMetadata is the Spotlight metadata of a file that is stored with -macos-metadata
+type spotlightMetadata struct {
+	Comment     string // Finder comment, kMDItemFinderComment
+	ContentType string // Uniform type identifier, e.g. public.jpeg, kMDItemContentType
+}
+
+// readSpotlightMetadata reads the Spotlight metadata of path with the mdls command at mdls. Attributes that are
+// not set are returned empty.
+func readSpotlightMetadata(mdls, path string) (spotlightMetadata, error) {
+	var metadata spotlightMetadata
+	var err error
+	if metadata.Comment, err = readSpotlightAttribute(mdls, "kMDItemFinderComment", path); err != nil {
+		return metadata, err
+	}
+	metadata.ContentType, err = readSpotlightAttribute(mdls, "kMDItemContentType", path)
+	return metadata, err
+}
+
+// readSpotlightAttribute runs mdls for a single attribute. With several -name options, mdls -raw separates the
+// values by NUL bytes, but their order is not documented, so each attribute is read separately.
+func readSpotlightAttribute(mdls, name, path string) (string, error) {
+	out, err := exec.Command(mdls, "-raw", "-name", name, path).Output()
+	if err != nil {
+		return "", err
+	}
+	return parseMdlsValue(string(out)), nil
+}
+
+// parseMdlsValue converts the output of mdls -raw for a single attribute into its value, which is empty if the
+// attribute is not set
+func parseMdlsValue(out string) string {
+	out = strings.TrimRight(out, "\x00\n")
+	if out == "(null)" {
+		return ""
+	}
+	return out
+}
@@ -0,0 +1,10 @@
+//go:build darwin
+
+package main
+
+import "os/exec"
+
+// findMdls returns the path of the mdls command, which reads Spotlight metadata
+func findMdls() (string, error) {
+	return exec.LookPath("mdls")
+}
@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package main
+
+// findMdls returns an empty path, since there is no Spotlight metadata outside macOS
+func findMdls() (string, error) {
+	return "", nil
+}
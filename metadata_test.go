@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeMdls writes a script that stands in for mdls -raw -name <attribute> <path>, printing the value of attributes
+// the way mdls does, and "(null)" for the others
+func fakeMdls(t *testing.T, values map[string]string) string {
+	t.Helper()
+	script := "#!/bin/sh\ncase \"$3\" in\n"
+	for name, value := range values {
+		script += fmt.Sprintf("%s) printf '%%s' '%s' ;;\n", name, value)
+	}
+	script += "*) printf '(null)' ;;\nesac\n"
+	mdls := filepath.Join(t.TempDir(), "mdls")
+	if err := os.WriteFile(mdls, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return mdls
+}
+
+func TestReadSpotlightMetadata(t *testing.T) {
+	mdls := fakeMdls(t, map[string]string{"kMDItemFinderComment": "Scanned in 2019", "kMDItemContentType": "public.jpeg"})
+	metadata, err := readSpotlightMetadata(mdls, "/data/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := spotlightMetadata{Comment: "Scanned in 2019", ContentType: "public.jpeg"}
+	if metadata != expected {
+		t.Errorf("readSpotlightMetadata() = %+v, want %+v", metadata, expected)
+	}
+
+	metadata, err = readSpotlightMetadata(fakeMdls(t, nil), "/data/photo.jpg")
+	if err != nil || metadata != (spotlightMetadata{}) {
+		t.Errorf("readSpotlightMetadata() without attributes = %+v, %v, want no metadata", metadata, err)
+	}
+
+	if _, err := readSpotlightMetadata(filepath.Join(t.TempDir(), "missing"), "/data/photo.jpg"); err == nil {
+		t.Error("readSpotlightMetadata() with a missing mdls succeeded")
+	}
+}
+
+func TestProcessDirectorySpotlightMetadata(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &crawlOptions{
+		walkOptions: walkOptions{MaxDepth: -1},
+		Mdls:        fakeMdls(t, map[string]string{"kMDItemFinderComment": "First", "kMDItemContentType": "public.plain-text"}),
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	// Finder comments change without changing the modification time, and are updated for unchanged files
+	opts.Mdls = fakeMdls(t, map[string]string{"kMDItemFinderComment": "Second", "kMDItemContentType": "public.plain-text"})
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var comment, contentType sql.NullString
+	err := db.QueryRow("SELECT macos_comment, content_type FROM files WHERE path = ?", filepath.Join(root, "a.txt")).
+		Scan(&comment, &contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.String != "Second" || contentType.String != "public.plain-text" {
+		t.Errorf("stored comment and content type are %v and %v, want Second and public.plain-text",
+			comment, contentType)
+	}
+}
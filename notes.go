@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runNote implements the note subcommand, which attaches free-text notes to indexed files. Notes are kept when
+// the files are crawled again.
+func runNote(args []string) error {
+	var dbFile string
+	var path string
+	var note string
+	var noteFile string
+
+	flags := flag.NewFlagSet("note", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&path, "path", "", "Path of the file to annotate")
+	flags.StringVar(&note, "note", "", "Text of the note, empty to remove the note of -path")
+	flags.StringVar(&noteFile, "note-file", "", "Path to a TSV file of paths and notes to set, one per line")
+	_ = flags.Parse(args)
+
+	if (path == "") == (noteFile == "") {
+		flags.PrintDefaults()
+		return errors.New("exactly one of -path and -note-file is required")
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if path != "" {
+		return setNote(db, path, note)
+	}
+
+	file, err := os.Open(noteFile)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing note file:", err)
+		}
+	}(file)
+
+	set, err := importNotes(db, file)
+	fmt.Printf("Notes set: %d\n", set)
+	return err
+}
+
+// setNote stores note for the file at path, or removes its note if note is empty. The file must be indexed.
+func setNote(db execQuerier, path, note string) error {
+	if pathMode == absolutePaths {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+	var value sql.NullString
+	if note != "" {
+		value = sql.NullString{String: note, Valid: true}
+	}
+	res, err := db.Exec("UPDATE files SET notes=? WHERE path=?", value, path)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%s is not in the index", path)
+	}
+	return nil
+}
+
+// importNotes sets the notes read from r, a TSV file of paths and notes, in a single transaction. It stops at the
+// first line that can't be applied, and returns the number of notes set.
+func importNotes(db *sql.DB, r io.Reader) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	set := 0
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		path, note, ok := strings.Cut(line, "\t")
+		if !ok {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("line %d: expected a path and a note separated by a tab", lineNumber)
+		}
+		if err := setNote(tx, path, note); err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		set++
+	}
+	if err := scanner.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return set, tx.Commit()
+}
+
+// notesReport writes the files that have a note, with their notes
+func notesReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query("SELECT path, notes FROM files WHERE notes IS NOT NULL ORDER BY path")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, note string
+		if err := rows.Scan(&path, &note); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", path, note); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotes(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	if err := setNote(db, a, "reviewed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setNote(db, filepath.Join(root, "missing.txt"), "note"); err == nil {
+		t.Error("setNote() succeeded for a file that is not in the index")
+	}
+	set, err := importNotes(db, strings.NewReader(b+"\tfirst\tsecond\n\n"))
+	if err != nil || set != 1 {
+		t.Fatalf("importNotes() = %d, %v, want 1 note set", set, err)
+	}
+	if _, err := importNotes(db, strings.NewReader(a+"\n")); err == nil {
+		t.Error("importNotes() succeeded for a line without a note")
+	}
+
+	// Changing a file and crawling again keeps its note
+	if err := os.WriteFile(b, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Hour)
+	if err := os.Chtimes(b, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := notesReport(db, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := a + "\treviewed\n" + b + "\tfirst\tsecond\n"
+	if out.String() != expected {
+		t.Errorf("notesReport() = %q, want %q", out.String(), expected)
+	}
+}
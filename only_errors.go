@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+// retryErroredPaths processes again the paths under root that have a stored error, instead of walking the whole
+// tree. Errored directories are walked, since their contents may never have been processed. Rows of paths that
+// no longer exist are deleted, as long as they are under a recorded root.
+func retryErroredPaths(root string, db crawlDB, stats *ProcessStats, opts *crawlOptions) error {
+	walk, err := opts.newRoot(root)
+	if err != nil {
+		log.Println("Error initializing root:", root, err)
+		return err
+	}
+	walk.Label = opts.Label
+	paths, err := listErroredPaths(db, walk.storedPath(walk.Path))
+	if err != nil {
+		log.Println("Error loading errored paths for root:", walk.Path, err)
+		return err
+	}
+
+	retryOpts := *opts
+	retryOpts.RetryErrors = true
+	lastDir := ""
+	for _, path := range paths {
+		// Paths below an errored directory were processed with it
+		if lastDir != "" && strings.HasPrefix(path.Path, lastDir+"/") {
+			continue
+		}
+
+		osPath := decodePath(path.Path, path.Encoding)
+		if walk.Label != "" {
+			osPath = rootLocations{walk.Label: walk.Path}.osPath(osPath)
+		}
+		info, err := os.Lstat(osPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := requireKnownRoot(db, path.Path); err != nil {
+				log.Println("Error deleting missing path:", err)
+				continue
+			}
+			if _, err := db.Exec("DELETE FROM files WHERE "+underRootCondition, underRootArgs(path.Path)...); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			log.Println("Error retrying path:", path.Path, err)
+			continue
+		}
+		if info.IsDir() {
+			lastDir = path.Path
+		}
+
+		if err := processTree(walk, osPath, db, stats, &retryOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// erroredPath is a stored path with an error, and its encoding
+type erroredPath struct {
+	Path     string
+	Encoding string
+}
+
+// listErroredPaths returns the paths under root that have a stored error, in order
+func listErroredPaths(db crawlDB, root string) ([]erroredPath, error) {
+	rows, err := db.Query(`
+	SELECT path, COALESCE(path_encoding, 'utf8') FROM files
+	WHERE error IS NOT NULL AND `+underRootCondition+`
+	ORDER BY path`, underRootArgs(root)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []erroredPath
+	for rows.Next() {
+		var path erroredPath
+		if err := rows.Scan(&path.Path, &path.Encoding); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
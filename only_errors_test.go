@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryErroredPaths(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	fixed := filepath.Join(root, "fixed.txt")
+	if err := os.WriteFile(fixed, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	untouched := filepath.Join(root, "untouched.txt")
+	if err := os.WriteFile(untouched, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modificationTime := info.ModTime().Format(time.RFC3339)
+
+	// The error of fixed.txt was stored after its metadata, so its modification time is unchanged
+	for path, storedError := range map[string]any{
+		fixed:                            "opening file: input/output error",
+		filepath.Join(root, "gone.txt"):  "opening file: input/output error",
+		filepath.Join(root, "gone/a.go"): "opening file: input/output error",
+		untouched:                        nil,
+	} {
+		_, err := db.Exec("INSERT INTO files(path, modification_time, error) VALUES (?, ?, ?)",
+			path, modificationTime, storedError)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := retryErroredPaths(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	// Missing paths are only deleted under a recorded root
+	var gone int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path LIKE '%gone%'").Scan(&gone); err != nil {
+		t.Fatal(err)
+	}
+	if gone != 2 {
+		t.Errorf("got %d rows of missing paths under an unrecorded root, want 2", gone)
+	}
+	if err := recordRoot(db, root, root, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := retryErroredPaths(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var hash, storedError sql.NullString
+	if err := db.QueryRow("SELECT hash, error FROM files WHERE path = ?", fixed).Scan(&hash, &storedError); err != nil {
+		t.Fatal(err)
+	}
+	if storedError.Valid || !hash.Valid {
+		t.Errorf("got hash %v and error %v for the retried file, want a hash and no error", hash, storedError)
+	}
+
+	var paths []string
+	rows, err := db.Query("SELECT path FROM files ORDER BY path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) != 2 || paths[0] != fixed || paths[1] != untouched {
+		t.Errorf("got paths %v, want only %s and %s", paths, fixed, untouched)
+	}
+}
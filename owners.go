@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ownerList is a list of owners, each a user or a group prefixed with a colon, like in chown, by name or ID. It is
+// a flag.Value accepting comma-separated lists, and resolves names to IDs as the flags are parsed, so that a
+// mistyped name fails at startup rather than excluding nothing.
+type ownerList struct {
+	entries []string
+	uids    map[int64]bool
+	gids    map[int64]bool
+}
+
+func (l *ownerList) String() string {
+	return strings.Join(l.entries, ",")
+}
+
+// Set adds the owners of a comma-separated list, e.g. alice,1001,:staff
+func (l *ownerList) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		group, isGroup := strings.CutPrefix(entry, ":")
+		var id int64
+		var err error
+		if isGroup {
+			id, err = lookupOwnerID(group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+		} else {
+			id, err = lookupOwnerID(entry, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+		}
+		if err != nil {
+			return err
+		}
+		if l.uids == nil {
+			l.uids, l.gids = make(map[int64]bool), make(map[int64]bool)
+		}
+		if isGroup {
+			l.gids[id] = true
+		} else {
+			l.uids[id] = true
+		}
+		l.entries = append(l.entries, entry)
+	}
+	return nil
+}
+
+// lookupOwnerID returns the ID of a user or group given by name or ID, looking names up with lookup
+func lookupOwnerID(name string, lookup func(name string) (string, error)) (int64, error) {
+	if name == "" || strings.Contains(name, ":") {
+		return 0, fmt.Errorf("invalid owner %q, want a user or :group, by name or ID", name)
+	}
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown owner %q: %w", name, err)
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// userName returns the name of the user with the given ID on this system
+func userName(id string) (string, error) {
+	u, err := user.LookupId(id)
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+// groupName returns the name of the group with the given ID on this system
+func groupName(id string) (string, error) {
+	g, err := user.LookupGroupId(id)
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
+
+// matches reports whether a file owned by uid and gid belongs to one of the owners of the list
+func (l *ownerList) matches(uid, gid sql.NullInt64) bool {
+	return (uid.Valid && l.uids[uid.Int64]) || (gid.Valid && l.gids[gid.Int64])
+}
+
+// excludedOwner returns why a file owned by uid and gid is excluded by -only-owner or -exclude-owner, or "" if it
+// isn't. Files whose owner is unknown, such as those on file systems without owners, are never excluded.
+// Directories are walked whoever owns them, so that the files of an owner are found in the directories of others,
+// and the filters only apply to the other entries.
+func (opts *walkOptions) excludedOwner(uid, gid sql.NullInt64) string {
+	if !uid.Valid && !gid.Valid {
+		return ""
+	}
+	if len(opts.OnlyOwners.entries) > 0 && !opts.OnlyOwners.matches(uid, gid) {
+		return "only-owner"
+	}
+	if opts.ExcludeOwners.matches(uid, gid) {
+		return "exclude-owner"
+	}
+	return ""
+}
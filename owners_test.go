@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnerList(t *testing.T) {
+	var l ownerList
+	if err := l.Set("1001,:20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("root"); err != nil {
+		t.Skip("no root user:", err)
+	}
+	id := func(n int64) sql.NullInt64 { return sql.NullInt64{Int64: n, Valid: true} }
+	for _, tc := range []struct {
+		uid, gid sql.NullInt64
+		expected bool
+	}{
+		{id(1001), id(100), true},
+		{id(0), id(100), true}, // root
+		{id(1002), id(20), true},
+		{id(1002), id(100), false},
+		{sql.NullInt64{}, sql.NullInt64{}, false},
+	} {
+		if matches := l.matches(tc.uid, tc.gid); matches != tc.expected {
+			t.Errorf("matches(%v, %v) = %v, want %v", tc.uid, tc.gid, matches, tc.expected)
+		}
+	}
+	for _, value := range []string{"", "alice:staff", ":", "no-such-user-here"} {
+		if err := new(ownerList).Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCrawlByOwner(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"mine.txt", "mine"}, {"theirs/theirs.txt", "theirs"}, {"theirs/mine.txt", "mine"}})
+	// The directory of the other user is still crawled for the files of the first one
+	for _, name := range []string{"theirs", "theirs/theirs.txt"} {
+		if err := os.Lchown(filepath.Join(root, name), 4242, 4242); err != nil {
+			t.Skip("can't change owners:", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		flag, value string
+		excluded    map[string]string
+	}{
+		{"only-owner", "4243,:4242", map[string]string{"mine.txt": "only-owner", "theirs/mine.txt": "only-owner"}},
+		{"only-owner", "4242", map[string]string{"mine.txt": "only-owner", "theirs/mine.txt": "only-owner"}},
+		{"exclude-owner", ":4242", map[string]string{"theirs/theirs.txt": "exclude-owner"}},
+	} {
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+		list := &opts.OnlyOwners
+		if tc.flag == "exclude-owner" {
+			list = &opts.ExcludeOwners
+		}
+		if err := list.Set(tc.value); err != nil {
+			t.Fatal(err)
+		}
+		db := newTestDatabase(t)
+		stats := NewProcessStats()
+		if err := processDirectory(root, db, stats, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"mine.txt", "theirs/theirs.txt", "theirs/mine.txt"} {
+			var pattern sql.NullString
+			var hash sql.NullString
+			err := db.QueryRow("SELECT exclusion_pattern, hash FROM files WHERE path = ?",
+				filepath.Join(root, name)).Scan(&pattern, &hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pattern.String != tc.excluded[name] || hash.Valid == (tc.excluded[name] != "") {
+				t.Errorf("-%s %s: %s has exclusion %q and hash %v, want exclusion %q", tc.flag, tc.value, name,
+					pattern.String, hash.Valid, tc.excluded[name])
+			}
+		}
+		if counts := stats.rootCounts()[0]; counts.Excluded != int64(len(tc.excluded)) {
+			t.Errorf("-%s %s excluded %d files, want %d", tc.flag, tc.value, counts.Excluded, len(tc.excluded))
+		}
+	}
+}
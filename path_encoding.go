@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Values of the path_encoding column
+const (
+	utf8Encoding    = "utf8"
+	percentEncoding = "percent-encoded"
+)
+
+// encodePath makes a path that is not valid UTF-8 storable as SQLite TEXT by percent-encoding the invalid bytes,
+// as well as any '%', so that decodePath can restore it exactly. Valid paths are returned unchanged.
+func encodePath(path string) (string, string) {
+	if utf8.ValidString(path) {
+		return path, utf8Encoding
+	}
+	var b strings.Builder
+	for len(path) > 0 {
+		r, size := utf8.DecodeRuneInString(path)
+		if r == '%' || (r == utf8.RuneError && size == 1) {
+			b.WriteString(url.PathEscape(path[:size]))
+		} else {
+			b.WriteString(path[:size])
+		}
+		path = path[size:]
+	}
+	return b.String(), percentEncoding
+}
+
+// decodePath returns the file system path of a stored path with the given encoding
+func decodePath(path, encoding string) string {
+	if encoding != percentEncoding {
+		return path
+	}
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		log.Println("Error decoding path:", path, err)
+		return path
+	}
+	return decoded
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodePath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+		encoding string
+	}{
+		{"/photos/été 100%.jpg", "/photos/été 100%.jpg", utf8Encoding},
+		{"/photos/\xe9t\xe9.jpg", "/photos/%E9t%E9.jpg", percentEncoding},
+		{"/photos/100%/\xff.jpg", "/photos/100%25/%FF.jpg", percentEncoding},
+	}
+	for _, tc := range testCases {
+		encoded, encoding := encodePath(tc.path)
+		if encoded != tc.expected || encoding != tc.encoding {
+			t.Errorf("encodePath(%q) = %q, %q, want %q, %q", tc.path, encoded, encoding, tc.expected, tc.encoding)
+		}
+		if decoded := decodePath(encoded, encoding); decoded != tc.path {
+			t.Errorf("decodePath(%q, %q) = %q, want %q", encoded, encoding, decoded, tc.path)
+		}
+	}
+}
+
+func TestCrawlNonUTF8Path(t *testing.T) {
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	name := "caf\xe9.txt"
+	if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0644); err != nil {
+		t.Skip("file system doesn't accept non-UTF-8 names:", err)
+	}
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var storedName, encoding string
+	var hash, storedError sql.NullString
+	err := db.QueryRow("SELECT name, path_encoding, hash, error FROM files WHERE path = ?",
+		filepath.Join(root, "caf%E9.txt")).Scan(&storedName, &encoding, &hash, &storedError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedName != "caf%E9.txt" || encoding != percentEncoding || !hash.Valid || storedError.Valid {
+		t.Errorf("got name %q, encoding %q, hash %v and error %v", storedName, encoding, hash, storedError)
+	}
+}
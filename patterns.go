@@ -2,19 +2,50 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// readExcludePatterns reads the exclude file and returns a slice of patterns
-func readExcludePatterns(filename string) []string {
+const excludeUsage = "Path to the exclusion file. Patterns from $XDG_CONFIG_HOME/crawler/exclude " +
+	"(~/.config/crawler/exclude by default) are always applied first, after the defaults of the platform, " +
+	"so this file can re-include paths they exclude with !pattern. A pattern can be followed by size and age " +
+	"qualifiers, e.g. *.iso size>4G or tmp/** age>365d"
+
+const excludePatternUsage = "An exclusion pattern, with the same syntax as the lines of the exclusion file, applied " +
+	"after those of -exclude. Can be given several times, e.g. -exclude-pattern '*.tmp' -exclude-pattern node_modules/"
+
+// patternList is a flag.Value collecting the exclusion patterns of a repeatable flag. Each pattern is checked
+// like a line of the exclusion file. Patterns are not split on commas, which may be part of them.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *patternList) Set(value string) error {
+	line := strings.TrimSpace(value)
+	if line == "" {
+		return fmt.Errorf("empty exclusion pattern")
+	}
+	if _, _, err := parsePatternLine(line); err != nil {
+		return err
+	}
+	*l = append(*l, line)
+	return nil
+}
+
+// readExcludePatterns reads the exclude file and returns a slice of patterns. Lines with invalid qualifiers are
+// an error, while a file that can't be read only logs a warning.
+func readExcludePatterns(filename string) ([]string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		log.Println("Warning: Could not open exclude file,", err)
-		return nil
+		return nil, nil
 	}
 	defer func(file *os.File) {
 		err := file.Close()
@@ -25,31 +56,219 @@ func readExcludePatterns(filename string) []string {
 
 	var patterns []string
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
 		line := strings.TrimSpace(scanner.Text())
 		// Ignore comments and empty lines
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
+		if _, _, err := parsePatternLine(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
 		patterns = append(patterns, line)
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Println("Warning: Error reading exclude file,", err)
-		return nil
+		return nil, nil
+	}
+	return patterns, nil
+}
+
+const noDefaultExcludesUsage = "Also crawl the paths excluded by default on this platform, such as /proc, /sys and " +
+	"/dev on Linux. They can also be re-included one by one with !pattern"
+
+// loadExcludePatterns returns the default exclusion patterns of the platform, unless noDefaults, followed by the
+// global exclusion patterns, the patterns from exclusionFile, if given, and then extra, the patterns given with
+// -exclude-pattern. Each can re-include paths excluded by the ones before it.
+func loadExcludePatterns(exclusionFile string, extra []string, noDefaults bool) ([]string, error) {
+	var patterns []string
+	if !noDefaults {
+		patterns = defaultExcludePatterns()
+	}
+	global, err := loadGlobalExcludePatterns()
+	if err != nil {
+		return nil, err
+	}
+	patterns = append(patterns, global...)
+	if exclusionFile != "" {
+		filePatterns, err := readExcludePatterns(exclusionFile)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, filePatterns...)
+	}
+	return append(patterns, extra...), nil
+}
+
+// loadGlobalExcludePatterns reads the patterns from $XDG_CONFIG_HOME/crawler/exclude (~/.config/crawler/exclude
+// by default), if that file exists
+func loadGlobalExcludePatterns() ([]string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+
+	filename := filepath.Join(configHome, "crawler", "exclude")
+	if _, err := os.Stat(filename); err != nil {
+		return nil, nil
+	}
+	return readExcludePatterns(filename)
+}
+
+// fileAttributes are the attributes of a file that the qualifiers of exclusion patterns test
+type fileAttributes struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// patternQualifier is a condition on the size or the age of a file that follows a pattern in the exclusion file,
+// e.g. size>4G or age>365d
+type patternQualifier struct {
+	Age   bool   // Whether the qualifier tests the age of the file rather than its size
+	Op    string // <, <=, > or >=
+	Value int64  // Size in bytes, or age as a time.Duration
+}
+
+// matches reports whether file satisfies q, measuring its age from now
+func (q patternQualifier) matches(file *fileAttributes, now time.Time) bool {
+	value := file.Size
+	if q.Age {
+		value = int64(now.Sub(file.ModTime))
+	}
+	switch q.Op {
+	case "<":
+		return value < q.Value
+	case "<=":
+		return value <= q.Value
+	case ">":
+		return value > q.Value
+	default:
+		return value >= q.Value
+	}
+}
+
+// qualifiersMatch reports whether file satisfies all qualifiers. Without attributes, a pattern with qualifiers
+// never matches, so that nothing is excluded by a condition that can't be checked.
+func qualifiersMatch(qualifiers []patternQualifier, file *fileAttributes) bool {
+	if len(qualifiers) == 0 {
+		return true
+	}
+	if file == nil {
+		return false
+	}
+	now := time.Now()
+	for _, q := range qualifiers {
+		if !q.matches(file, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// isQualifier reports whether a word of a pattern line is meant as a qualifier: size or age followed by a
+// comparison
+func isQualifier(word string) bool {
+	for _, attribute := range []string{"size", "age"} {
+		rest, ok := strings.CutPrefix(word, attribute)
+		if ok && rest != "" && strings.ContainsRune("<>=", rune(rest[0])) {
+			return true
+		}
 	}
-	return patterns
+	return false
 }
 
-// isExcluded checks if the path matches any of the exclusion patterns, and returns true if it does along with the matching pattern
-func isExcluded(path string, excludePatterns []string) (bool, string) {
-	for _, pattern := range excludePatterns {
-		matched := filepathMatch(pattern, path)
-		if matched {
-			return matched, pattern
+// parseQualifier parses a qualifier such as size>4G or age<=30d
+func parseQualifier(word string) (patternQualifier, error) {
+	var q patternQualifier
+	rest, ok := strings.CutPrefix(word, "size")
+	if !ok {
+		rest = strings.TrimPrefix(word, "age")
+		q.Age = true
+	}
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if value, ok := strings.CutPrefix(rest, op); ok {
+			q.Op = op
+			rest = value
+			break
+		}
+	}
+	if q.Op == "" {
+		return q, fmt.Errorf("invalid qualifier %q, expected <, <=, > or >=", word)
+	}
+	if q.Age {
+		age, err := parseAge(rest)
+		if err != nil {
+			return q, fmt.Errorf("invalid qualifier %q: %w", word, err)
+		}
+		q.Value = int64(age)
+	} else {
+		size, err := parseSize(rest)
+		if err != nil {
+			return q, fmt.Errorf("invalid qualifier %q: %w", word, err)
 		}
+		q.Value = size
 	}
-	return false, ""
+	return q, nil
+}
+
+// parsePatternLine splits a line of the exclusion file into its pattern and the qualifiers that follow it,
+// separated by spaces, e.g. "*.iso size>4G" into "*.iso" and size>4G. Only trailing words that start with size or
+// age and a comparison are qualifiers, so patterns with spaces in them still work.
+func parsePatternLine(line string) (string, []patternQualifier, error) {
+	pattern := line
+	var qualifiers []patternQualifier
+	for {
+		i := strings.LastIndexAny(pattern, " \t")
+		if i < 0 || !isQualifier(pattern[i+1:]) {
+			break
+		}
+		q, err := parseQualifier(pattern[i+1:])
+		if err != nil {
+			return "", nil, err
+		}
+		qualifiers = append([]patternQualifier{q}, qualifiers...)
+		pattern = strings.TrimRight(pattern[:i], " \t")
+	}
+	if isQualifier(pattern) {
+		return "", nil, fmt.Errorf("qualifiers %q without a pattern", line)
+	}
+	return pattern, qualifiers, nil
+}
+
+// splitPatternLine is parsePatternLine for lines that were checked when they were loaded. A line with invalid
+// qualifiers, which can only come from elsewhere, is a pattern as a whole.
+func splitPatternLine(line string) (string, []patternQualifier) {
+	pattern, qualifiers, err := parsePatternLine(line)
+	if err != nil {
+		return line, nil
+	}
+	return pattern, qualifiers
+}
+
+// isExcluded checks if the path matches any of the exclusion patterns, and returns true if it does along with the matching pattern.
+// A pattern starting with ! re-includes paths matched by earlier patterns. Patterns with qualifiers only match
+// if file, which may be nil if its attributes are unknown, satisfies them.
+func isExcluded(path string, file *fileAttributes, excludePatterns []string) (bool, string) {
+	if len(excludePatterns) == 0 {
+		return false, ""
+	}
+	excludedBy := ""
+	for _, line := range excludePatterns {
+		pattern, qualifiers := splitPatternLine(line)
+		if strings.HasPrefix(pattern, "!") {
+			if excludedBy != "" && filepathMatch(pattern[1:], path) && qualifiersMatch(qualifiers, file) {
+				excludedBy = ""
+			}
+		} else if excludedBy == "" && filepathMatch(pattern, path) && qualifiersMatch(qualifiers, file) {
+			excludedBy = line
+		}
+	}
+	return excludedBy != "", excludedBy
 }
 
 func filepathMatch(pattern, filePath string) bool {
@@ -58,7 +277,11 @@ func filepathMatch(pattern, filePath string) bool {
 		return filepathMatch(pattern[:len(pattern)-1], filePath) || filepathMatch(pattern+"*", filePath)
 	}
 
-	// Case 1: Simple pattern, e.g., "*.txt"
+	// Case 1: Simple pattern, e.g., "*.txt". Extension patterns are common enough to skip path.Match.
+	ext, ok := strings.CutPrefix(pattern, "*")
+	if ok && strings.HasPrefix(ext, ".") && !strings.ContainsAny(ext, `/*?[\`) {
+		return strings.HasSuffix(filepath.Base(filePath), ext)
+	}
 	if !strings.Contains(pattern, "/") {
 		match, _ := path.Match(pattern, filepath.Base(filePath))
 		return match
@@ -97,3 +320,29 @@ func fileComponentsMatch(patternComponents, filePathComponents []string) bool {
 	}
 	return true
 }
+
+// ambiguousPatternWarnings explains how the patterns without a leading slash match, for -warn-ambiguous-patterns.
+// They match at any depth, which surprises those who expect logs to only match a logs directory at the top of the
+// root. Extension patterns such as *.tmp are obviously meant to match anywhere and are left out.
+func ambiguousPatternWarnings(patterns []string) []string {
+	var warnings []string
+	for _, line := range patterns {
+		pattern, _ := splitPatternLine(line)
+		pattern = strings.TrimPrefix(pattern, "!")
+		name := strings.TrimSuffix(pattern, "/")
+		ext, isExtension := strings.CutPrefix(name, "*")
+		isExtension = isExtension && strings.HasPrefix(ext, ".") && !strings.ContainsAny(ext, `/*?[\`)
+		switch {
+		case name == "" || strings.HasPrefix(name, "/") || isExtension:
+		case !strings.Contains(name, "/"):
+			warnings = append(warnings, fmt.Sprintf("pattern %q has no slash, so it matches everything named %s at "+
+				"any depth below the roots, not only right below them. Start it with the absolute path of the "+
+				"root, e.g. /path/to/root/%s, to match a single one", line, name, pattern))
+		default:
+			warnings = append(warnings, fmt.Sprintf("pattern %q doesn't start with a slash, so it matches %s "+
+				"wherever it is below the roots, e.g. also a/%s. Start it with the absolute path of the root to "+
+				"match a single one", line, name, name))
+		}
+	}
+	return warnings
+}
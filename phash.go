@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// pHashTypes are the detected types, see detectType, whose perceptual hash is computed with -phash. Go can't decode
+// HEIC, so those photos have no perceptual hash.
+var pHashTypes = map[string]bool{"jpeg": true, "png": true}
+
+// dHash computes the 64-bit difference hash of img: the image is reduced to 9x8 cells of average brightness, and
+// each bit tells whether a cell is brighter than its right neighbor. Resized and re-encoded copies of a photo have
+// hashes within a few bits of each other.
+func dHash(img image.Image) uint64 {
+	const width, height = 9, 8
+	bounds := img.Bounds()
+	if bounds.Dx() < width || bounds.Dy() < height {
+		return 0
+	}
+	var cells [height][width]float64
+	for cy := 0; cy < height; cy++ {
+		y0 := bounds.Min.Y + cy*bounds.Dy()/height
+		y1 := bounds.Min.Y + (cy+1)*bounds.Dy()/height
+		for cx := 0; cx < width; cx++ {
+			x0 := bounds.Min.X + cx*bounds.Dx()/width
+			x1 := bounds.Min.X + (cx+1)*bounds.Dx()/width
+			// Large photos are sampled on a grid of about 16x16 pixels per cell
+			stepX, stepY := max(1, (x1-x0)/16), max(1, (y1-y0)/16)
+			var sum float64
+			var n int
+			for y := y0; y < y1; y += stepY {
+				for x := x0; x < x1; x += stepX {
+					sum += float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+					n++
+				}
+			}
+			cells[cy][cx] = sum / float64(n)
+		}
+	}
+	var hash uint64
+	for cy := 0; cy < height; cy++ {
+		for cx := 0; cx < width-1; cx++ {
+			hash <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// readPHash decodes the JPEG or PNG image in r and returns its dHash as 16 hex digits
+func readPHash(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", dHash(img)), nil
+}
+
+// needsPHash reports whether the stored file at path is an image that has no perceptual hash yet
+func needsPHash(db execQuerier, path string) (bool, error) {
+	var needed bool
+	err := db.QueryRow("SELECT phash IS NULL AND detected_type IN ('jpeg', 'png') FROM files WHERE path = ?",
+		path).Scan(&needed)
+	return needed, err
+}
+
+// bkTree is a BK-tree of 64-bit hashes under the Hamming distance, which finds the hashes within a distance of a
+// query without comparing it to all of them
+type bkTree struct {
+	hash     uint64
+	ids      []int // Indexes of the images with this hash
+	children map[int]*bkTree
+}
+
+// add inserts the image id with hash into the tree
+func (t *bkTree) add(hash uint64, id int) {
+	for {
+		d := bits.OnesCount64(t.hash ^ hash)
+		if d == 0 {
+			t.ids = append(t.ids, id)
+			return
+		}
+		child, ok := t.children[d]
+		if !ok {
+			if t.children == nil {
+				t.children = make(map[int]*bkTree)
+			}
+			t.children[d] = &bkTree{hash: hash, ids: []int{id}}
+			return
+		}
+		t = child
+	}
+}
+
+// search calls fn with the ids of the images whose hash is within maxDistance of hash
+func (t *bkTree) search(hash uint64, maxDistance int, fn func(id int)) {
+	d := bits.OnesCount64(t.hash ^ hash)
+	if d <= maxDistance {
+		for _, id := range t.ids {
+			fn(id)
+		}
+	}
+	for childDistance, child := range t.children {
+		if childDistance >= d-maxDistance && childDistance <= d+maxDistance {
+			child.search(hash, maxDistance, fn)
+		}
+	}
+}
+
+// runSimilarImages implements the similar-images subcommand, which lists groups of photos with close perceptual
+// hashes
+func runSimilarImages(args []string) error {
+	var dbFile string
+	var maxDistance int
+
+	flags := flag.NewFlagSet("similar-images", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.IntVar(&maxDistance, "distance", 6,
+		"Maximum number of the 64 bits of the perceptual hashes in which two images in a group may differ")
+	_ = flags.Parse(args)
+	if maxDistance < 0 || maxDistance > 64 {
+		return fmt.Errorf("distance must be between 0 and 64, got %d", maxDistance)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	return similarImagesReport(db, maxDistance, os.Stdout)
+}
+
+// similarImagesReport writes the groups of images that are connected by perceptual hashes within maxDistance of
+// each other, one path per line with its hash, and a blank line between groups. Exact copies are in a group too.
+func similarImagesReport(db *sql.DB, maxDistance int, w io.Writer) error {
+	rows, err := db.Query("SELECT path, phash FROM files WHERE phash IS NOT NULL ORDER BY path")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var paths []string
+	var hashes []uint64
+	var tree *bkTree
+	for rows.Next() {
+		var path, encoded string
+		if err := rows.Scan(&path, &encoded); err != nil {
+			return err
+		}
+		hash, err := strconv.ParseUint(encoded, 16, 64)
+		if err != nil {
+			continue
+		}
+		if tree == nil {
+			tree = &bkTree{hash: hash, ids: []int{len(paths)}}
+		} else {
+			tree.add(hash, len(paths))
+		}
+		paths = append(paths, path)
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if tree == nil {
+		return nil
+	}
+
+	// Images within maxDistance of each other are joined into groups with a union-find
+	parent := make([]int, len(paths))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i, hash := range hashes {
+		tree.search(hash, maxDistance, func(j int) {
+			if a, b := find(i), find(j); a != b {
+				parent[max(a, b)] = min(a, b)
+			}
+		})
+	}
+
+	groups := make(map[int][]int)
+	for i := range paths {
+		root := find(i)
+		groups[root] = append(groups[root], i)
+	}
+	var roots []int
+	for root, members := range groups {
+		if len(members) > 1 {
+			roots = append(roots, root)
+		}
+	}
+	sort.Ints(roots) // The root is the first path of its group, so groups are ordered by path
+
+	for n, root := range roots {
+		if n > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		for _, i := range groups[root] {
+			if _, err := fmt.Fprintf(w, "%016x %s\n", hashes[i], paths[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImage draws a 640x480 image with diagonal bands of brightness and a dark block
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			v := uint8((x*3 + y*2) % 256)
+			if x > 400 && x < 500 && y > 100 && y < 300 {
+				v = 10
+			}
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+// resize scales img to width x height by nearest-neighbor sampling
+func resize(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			resized.Set(x, y, img.At(x*bounds.Dx()/width, y*bounds.Dy()/height))
+		}
+	}
+	return resized
+}
+
+func TestDHash(t *testing.T) {
+	original := testImage()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, resize(original, 320, 240), &jpeg.Options{Quality: 50}); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := jpeg.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := bits.OnesCount64(dHash(original) ^ dHash(copied)); d > 4 {
+		t.Errorf("a resized JPEG copy differs in %d bits, want at most 4", d)
+	}
+
+	noise := image.NewGray(image.Rect(0, 0, 640, 480))
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(noise.Pix)
+	if d := bits.OnesCount64(dHash(original) ^ dHash(noise)); d < 16 {
+		t.Errorf("an unrelated image differs in %d bits, want at least 16", d)
+	}
+}
+
+func TestBKTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hashes := make([]uint64, 500)
+	tree := &bkTree{hash: rng.Uint64(), ids: []int{-1}}
+	for i := range hashes {
+		hashes[i] = rng.Uint64()
+		if i%50 == 0 && i > 0 {
+			hashes[i] = hashes[i-1] ^ 0b101 // Close to the previous hash
+		}
+		tree.add(hashes[i], i)
+	}
+	for _, query := range hashes[:100] {
+		expected := make(map[int]bool)
+		for i, hash := range hashes {
+			if bits.OnesCount64(hash^query) <= 20 {
+				expected[i] = true
+			}
+		}
+		found := make(map[int]bool)
+		tree.search(query, 20, func(id int) {
+			if id >= 0 {
+				found[id] = true
+			}
+		})
+		if len(found) != len(expected) {
+			t.Fatalf("search found %d hashes, want %d", len(found), len(expected))
+		}
+	}
+}
+
+func TestSimilarImages(t *testing.T) {
+	root := t.TempDir()
+	img := testImage()
+	write := func(name string, encode func(f *os.File) error) {
+		f, err := os.Create(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := encode(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("original.png", func(f *os.File) error { return png.Encode(f, img) })
+	write("small.jpg", func(f *os.File) error {
+		return jpeg.Encode(f, resize(img, 160, 120), &jpeg.Options{Quality: 60})
+	})
+	noise := image.NewGray(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	write("other.png", func(f *os.File) error { return png.Encode(f, noise) })
+	writeFiles(t, root, [][2]string{{"broken.jpg", "\xff\xd8\xff\xe0 truncated"}})
+
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, PHash: true}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE phash IS NOT NULL").Scan(&count)
+	if err != nil || count != 3 {
+		t.Errorf("got %d perceptual hashes, %v, want 3", count, err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM files WHERE error IS NOT NULL").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("got %d errors, %v, want none for images that can't be decoded", count, err)
+	}
+
+	var buf bytes.Buffer
+	if err := similarImagesReport(db, 6, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "/original.png") || !strings.HasSuffix(lines[1], "/small.jpg") {
+		t.Errorf("similarImagesReport() = %q, want original.png and small.jpg", buf.String())
+	}
+
+	// Unchanged images that were crawled without -phash get a hash on the next crawl
+	if _, err := db.Exec("UPDATE files SET phash = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM files WHERE phash IS NOT NULL").Scan(&count)
+	if err != nil || count != 3 {
+		t.Errorf("after a second crawl, got %d perceptual hashes, %v, want 3", count, err)
+	}
+}
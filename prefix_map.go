@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// prefixMapping translates paths below Old to the same paths below New
+type prefixMapping struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// prefixMap translates stored paths to where the files live now, e.g. after data moved to another disk. It is a
+// flag.Value, so that -map-prefix can be given several times.
+type prefixMap []prefixMapping
+
+func (m *prefixMap) String() string {
+	var mappings []string
+	for _, mapping := range *m {
+		mappings = append(mappings, mapping.Old+"="+mapping.New)
+	}
+	return strings.Join(mappings, ",")
+}
+
+// Set adds a mapping given as old=new
+func (m *prefixMap) Set(value string) error {
+	old, new, ok := strings.Cut(value, "=")
+	if !ok || old == "" || new == "" {
+		return fmt.Errorf("invalid prefix mapping %q, expected old=new", value)
+	}
+	*m = append(*m, prefixMapping{Old: filepath.Clean(old), New: filepath.Clean(new)})
+	return nil
+}
+
+// apply translates path with the mapping of the longest matching prefix. Prefixes only match whole path
+// components, so /mnt/old doesn't match /mnt/older.
+func (m prefixMap) apply(path string) string {
+	var best *prefixMapping
+	for i, mapping := range m {
+		if isUnderRoots(path, []string{mapping.Old}) && (best == nil || len(mapping.Old) > len(best.Old)) {
+			best = &m[i]
+		}
+	}
+	if best == nil {
+		return path
+	}
+	return replacePrefix(path, best.Old, best.New)
+}
+
+// replacePrefix replaces the prefix old of path, which must be equal to or below old, by new
+func replacePrefix(path, old, new string) string {
+	if path == old {
+		return new
+	}
+	return strings.TrimSuffix(new, "/") + "/" + strings.TrimPrefix(path[len(old):], "/")
+}
+
+// runRewritePrefix implements the rewrite-prefix subcommand, which permanently moves the stored paths below one
+// prefix to another
+func runRewritePrefix(args []string) error {
+	var dbFile string
+
+	flags := flag.NewFlagSet("rewrite-prefix", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: program rewrite-prefix [options] <old prefix> <new prefix>")
+		flags.PrintDefaults()
+		return nil
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	files, err := rewritePrefix(db, filepath.Clean(flags.Arg(0)), filepath.Clean(flags.Arg(1)))
+	fmt.Printf("Rewritten: %d\n", files)
+	return err
+}
+
+// rewritePrefix moves the paths of the files, folders and roots below old to new in a single transaction, and
+// returns the number of files moved. It fails without changing anything if any of the new paths already exists.
+func rewritePrefix(db *sql.DB, old, new string) (int64, error) {
+	if strings.Contains(old, "%") || strings.Contains(new, "%") {
+		// Percent-encoded paths would need the prefixes encoded as well
+		return 0, errors.New("prefixes containing '%' are not supported")
+	}
+	if old == new {
+		return 0, nil
+	}
+	if isUnderRoots(new, []string{old}) || isUnderRoots(old, []string{new}) {
+		return 0, fmt.Errorf("%s and %s are nested, which is not supported", old, new)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	files, err := rewritePrefixTx(tx, old, new)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return files, tx.Commit()
+}
+
+func rewritePrefixTx(tx *sql.Tx, old, new string) (int64, error) {
+	var files int64
+	for _, column := range []struct{ table, name string }{
+		{"files", "path"}, {"files", "final_target"}, {"folders", "path"}, {"roots", "path"}, {"roots", "location"},
+		{"media_info", "path"}, {"photo_info", "path"}, {"chunks", "path"}, {"corruptions", "path"},
+		{"run_folder_sizes", "root"}, {"run_folder_sizes", "path"},
+	} {
+		// The same as underRootCondition, for any column
+		under := fmt.Sprintf("(%[1]s = ? OR (%[1]s >= ? AND %[1]s < ?))", column.name)
+		rewritten := fmt.Sprintf("CASE WHEN %[1]s = ? THEN ? ELSE ? || substr(%[1]s, ?) END", column.name)
+		args := []any{old, new, strings.TrimSuffix(new, "/"), len(strings.TrimSuffix(old, "/")) + 1}
+		args = append(args, underRootArgs(old)...)
+		res, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s", column.table, column.name, rewritten, under),
+			args...)
+		if err != nil {
+			return 0, err
+		}
+		if column.table == "files" && column.name == "path" {
+			if files, err = res.RowsAffected(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// The top of the moved tree may now be in another directory
+	var folderId sql.NullInt64
+	err := tx.QueryRow("SELECT id FROM folders WHERE path = ?", new).Scan(&folderId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if parent := parentDir(new); parent != new {
+		parentId, err := getFolderID(tx, parent)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE files SET folder_id = ? WHERE path = ?", parentId, new); err != nil {
+			return 0, err
+		}
+		if folderId.Valid {
+			if _, err := tx.Exec("UPDATE folders SET parent_id = ? WHERE id = ?", parentId, folderId); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrefixMap(t *testing.T) {
+	var m prefixMap
+	for _, mapping := range []string{"/mnt/old=/mnt/new", "/mnt/old/photos=/photos/", "/=/root"} {
+		if err := m.Set(mapping); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Set("/mnt/old"); err == nil {
+		t.Error("Set() accepted a mapping without a new prefix")
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/mnt/old", "/mnt/new"},
+		{"/mnt/old/a.txt", "/mnt/new/a.txt"},
+		{"/mnt/old/photos/a.jpg", "/photos/a.jpg"}, // The longest prefix wins
+		{"/mnt/older/a.txt", "/root/mnt/older/a.txt"},
+		{"/", "/root"},
+	}
+	for _, tc := range testCases {
+		if path := m.apply(tc.path); path != tc.expected {
+			t.Errorf("apply(%q) = %q, want %q", tc.path, path, tc.expected)
+		}
+	}
+}
+
+func TestRewritePrefix(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, path := range []string{"/mnt/old-nas", "/mnt/old-nas/a", "/mnt/old-nas/a/b.txt", "/mnt/old-nas2/c.txt"} {
+		f := FileInfo{Path: sql.NullString{String: path, Valid: true}}
+		if err := f.UpdateFolderId(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.upsert(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recordRoot(db, "/mnt/old-nas", "/mnt/old-nas", 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := rewritePrefix(db, "/mnt/old-nas", "/data/nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 3 {
+		t.Errorf("rewritePrefix() moved %d files, want 3", files)
+	}
+
+	rows, err := db.Query(`
+	SELECT files.path, folders.path, COALESCE(parents.path, '') FROM files
+	JOIN folders ON files.folder_id = folders.id LEFT JOIN folders AS parents ON folders.parent_id = parents.id
+	ORDER BY files.path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][3]string
+	for rows.Next() {
+		var row [3]string
+		if err := rows.Scan(&row[0], &row[1], &row[2]); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	expected := [][3]string{
+		{"/data/nas", "/data", "/"},
+		{"/data/nas/a", "/data/nas", "/data"},
+		{"/data/nas/a/b.txt", "/data/nas/a", "/data/nas"},
+		{"/mnt/old-nas2/c.txt", "/mnt/old-nas2", "/mnt"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("after rewritePrefix(), files, folders and parents are %q, want %q", got, expected)
+	}
+	if err := requireKnownRoot(db, "/data/nas/a"); err != nil {
+		t.Errorf("the root was not moved: %v", err)
+	}
+
+	// Moving onto existing paths fails and changes nothing
+	if _, err := rewritePrefix(db, "/data/nas", "/mnt/old-nas2"); err == nil {
+		t.Error("rewritePrefix() onto existing paths succeeded")
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path LIKE '/data/nas%'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("after a failed rewrite, %d files are left below /data/nas, want 3", count)
+	}
+}
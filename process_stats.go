@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -13,12 +18,77 @@ type ProcessStats struct {
 	FilesProcessed    int64
 	BytesProcessed    int64
 	lastProcessedFile atomic.Value // Stores string
+	fileHashed        int64        // Bytes of the last processed file hashed so far, see HashProgress
+	fileSize          int64        // Size of the last processed file while HashProgress reports on it, or 0
 	printed           bool         // Default false
+	Now               func() time.Time
+	rootsMu           sync.Mutex
+	roots             []*rootStats // In the order in which the roots were first processed
+	ProgressJSON      io.Writer    // Receives a progressSnapshot as a line of JSON whenever the statistics are printed
+	ShowDBMetrics     bool         // Add dbMetrics to the status line, with -extra-logging
+}
+
+// rootStats are the counts for a single root of the crawl. Errors is updated atomically, since it is read while
+// the statistics are printed.
+type rootStats struct {
+	Root           string  `json:"root"`
+	Hashed         int64   `json:"hashed"`
+	Skipped        int64   `json:"skipped"` // Unchanged or previously failed
+	Excluded       int64   `json:"excluded"`
+	Errors         int64   `json:"errors"`
+	Bytes          int64   `json:"bytes"`                // Bytes hashed
+	SlowFiles      int64   `json:"slow_files,omitempty"` // Files slower than -slow-file-threshold
+	Linked         int64   `json:"linked,omitempty"`     // Hashed files whose hash came from a hard link, also in Hashed
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// root returns the counts for root, which are updated by the goroutine walking it
+func (stats *ProcessStats) root(root string) *rootStats {
+	stats.rootsMu.Lock()
+	defer stats.rootsMu.Unlock()
+	for _, r := range stats.roots {
+		if r.Root == root {
+			return r
+		}
+	}
+	r := &rootStats{Root: root}
+	stats.roots = append(stats.roots, r)
+	return r
+}
+
+// rootSummary formats a table with the counts of each root, in the given report format
+func (stats *ProcessStats) rootSummary(format string) string {
+	stats.rootsMu.Lock()
+	defer stats.rootsMu.Unlock()
+
+	table := reportTable{
+		Header: []string{"Hashed", "Skipped", "Excluded", "Errors", "MB", "Duration", "Root"},
+		Text:   "%10s %10s %10s %8s %12s %10s  %s\n",
+	}
+	for _, r := range stats.roots {
+		table.Rows = append(table.Rows, []string{fmt.Sprint(r.Hashed), fmt.Sprint(r.Skipped),
+			fmt.Sprint(r.Excluded), fmt.Sprint(r.Errors), fmt.Sprintf("%.2f", float64(r.Bytes)/1e6),
+			time.Duration(r.ElapsedSeconds * float64(time.Second)).Round(time.Second).String(), r.Root})
+	}
+	var b strings.Builder
+	_ = writeTable(&b, table, format)
+	return b.String()
+}
+
+// rootCounts returns a copy of the counts of each root
+func (stats *ProcessStats) rootCounts() []rootStats {
+	stats.rootsMu.Lock()
+	defer stats.rootsMu.Unlock()
+	counts := make([]rootStats, len(stats.roots))
+	for i, r := range stats.roots {
+		counts[i] = *r
+	}
+	return counts
 }
 
 // NewProcessStats creates a new ProcessStats object
 func NewProcessStats() *ProcessStats {
-	stats := &ProcessStats{}
+	stats := &ProcessStats{Now: time.Now}
 	stats.lastProcessedFile.Store("")
 	return stats
 }
@@ -26,29 +96,143 @@ func NewProcessStats() *ProcessStats {
 func (stats *ProcessStats) Update(path string, fileSize int64) {
 	atomic.AddInt64(&stats.FilesProcessed, 1)
 	atomic.AddInt64(&stats.BytesProcessed, fileSize)
+	atomic.StoreInt64(&stats.fileSize, 0)
 	stats.lastProcessedFile.Store(path)
 }
 
+// HashProgress records that hashed of the size bytes of the last processed file have been hashed, which Print
+// shows as a percentage until the next Update
+func (stats *ProcessStats) HashProgress(hashed, size int64) {
+	atomic.StoreInt64(&stats.fileHashed, hashed)
+	atomic.StoreInt64(&stats.fileSize, size)
+}
+
+// fileProgress formats the hashing progress of the last processed file, or "" if none is reported
+func (stats *ProcessStats) fileProgress() string {
+	size := atomic.LoadInt64(&stats.fileSize)
+	if size <= 0 {
+		return ""
+	}
+	hashed := min(atomic.LoadInt64(&stats.fileHashed), size)
+	return fmt.Sprintf(" (%d%%)", hashed*100/size)
+}
+
 func (stats *ProcessStats) Print(startTime time.Time) {
+	if stats.printed { // Move cursor 2 lines up
+		fmt.Printf("\033[2A")
+		fmt.Printf("\033[K") // Clear to the end of line
+	}
+	stats.printed = true
+
+	fmt.Println(stats.statusLine(startTime))
+	fmt.Printf("\033[K") // Clear to the end of line
+	progress := stats.fileProgress()
+	shortFilename := truncateString(stats.lastProcessedFile.Load().(string), getTerminalWidth()-21-len(progress))
+	fmt.Println("Last processed file:", shortFilename+progress)
+}
+
+// statusLine formats the elapsed time, the number of files and bytes processed, and the speed
+func (stats *ProcessStats) statusLine(startTime time.Time) string {
 	files := atomic.LoadInt64(&stats.FilesProcessed)
 	bytes := atomic.LoadInt64(&stats.BytesProcessed)
 
-	elapsed := time.Since(startTime)
+	elapsed := stats.Now().Sub(startTime)
 	h := int(elapsed.Hours())
 	m := int(elapsed.Minutes()) % 60
 	s := int(elapsed.Seconds()) % 60
 	speed := float64(bytes) / elapsed.Seconds() / 1e6 // in MB/s
 
-	if stats.printed { // Move cursor 2 lines up
-		fmt.Printf("\033[2A")
-		fmt.Printf("\033[K") // Clear to the end of line
+	line := fmt.Sprintf("Time: %02d:%02d:%02d, Files: %d, MB: %.2f, Speed: %.2f MB/s", h, m, s, files, float64(bytes)/1e6, speed)
+	if stats.ShowDBMetrics {
+		line += ", " + snapshotDBMetrics().String()
 	}
-	stats.printed = true
+	return line
+}
 
-	fmt.Printf("Time: %02d:%02d:%02d, Files: %d, MB: %.2f, Speed: %.2f MB/s\n", h, m, s, files, float64(bytes)/1e6, speed)
-	fmt.Printf("\033[K") // Clear to the end of line
-	shortFilename := truncateString(stats.lastProcessedFile.Load().(string), getTerminalWidth()-21)
-	fmt.Println("Last processed file:", shortFilename)
+// progressEvent returns a progress event of the given type with the current statistics
+func (stats *ProcessStats) progressEvent(eventType string, startTime time.Time) progressEvent {
+	return progressEvent{
+		Type:           eventType,
+		Path:           stats.lastProcessedFile.Load().(string),
+		Files:          atomic.LoadInt64(&stats.FilesProcessed),
+		Bytes:          atomic.LoadInt64(&stats.BytesProcessed),
+		ElapsedSeconds: stats.Now().Sub(startTime).Seconds(),
+	}
+}
+
+// PrintEvery starts a goroutine that prints the statistics every interval
+func (stats *ProcessStats) PrintEvery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		startTime := stats.Now()
+		stats.Print(startTime)
+		for range ticker.C {
+			stats.Print(startTime)
+			if err := stats.writeProgressJSON(startTime); err != nil {
+				log.Println("Error writing progress JSON:", err)
+			}
+			progress.Send(stats.progressEvent("stats", startTime))
+		}
+	}()
+}
+
+// progressSnapshot is the JSON form of the statistics printed by Print
+type progressSnapshot struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Files          int64   `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	SpeedMBps      float64 `json:"speed_mbps"`
+	LastFile       string  `json:"last_file"`
+	Errors         int64   `json:"errors"`
+}
+
+// writeProgressJSON writes the current statistics to ProgressJSON as a line of JSON, if it is set
+func (stats *ProcessStats) writeProgressJSON(startTime time.Time) error {
+	if stats.ProgressJSON == nil {
+		return nil
+	}
+	snapshot := progressSnapshot{
+		ElapsedSeconds: stats.Now().Sub(startTime).Seconds(),
+		Files:          atomic.LoadInt64(&stats.FilesProcessed),
+		Bytes:          atomic.LoadInt64(&stats.BytesProcessed),
+		LastFile:       stats.lastProcessedFile.Load().(string),
+		Errors:         stats.errorCount(),
+	}
+	if snapshot.ElapsedSeconds > 0 {
+		snapshot.SpeedMBps = float64(snapshot.Bytes) / snapshot.ElapsedSeconds / 1e6
+	}
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = stats.ProgressJSON.Write(append(line, '\n'))
+	return err
+}
+
+// errorCount returns the number of errors in all roots so far
+func (stats *ProcessStats) errorCount() int64 {
+	stats.rootsMu.Lock()
+	defer stats.rootsMu.Unlock()
+	var errors int64
+	for _, r := range stats.roots {
+		errors += atomic.LoadInt64(&r.Errors)
+	}
+	return errors
+}
+
+// progressReader reports the bytes read from a file of the given size to HashProgress of stats
+type progressReader struct {
+	r     io.Reader
+	stats *ProcessStats
+	size  int64
+	read  int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.stats.HashProgress(p.read, p.size)
+	return n, err
 }
 
 func truncateString(str string, num int) string {
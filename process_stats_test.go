@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStatusLine(t *testing.T) {
+	startTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	stats := NewProcessStats()
+	stats.Now = func() time.Time { return startTime.Add(time.Hour + 2*time.Minute + 5*time.Second) }
+	stats.Update("/a/b", 3725e6)
+	stats.Update("/a/c", 0)
+
+	expected := "Time: 01:02:05, Files: 2, MB: 3725.00, Speed: 1.00 MB/s"
+	if line := stats.statusLine(startTime); line != expected {
+		t.Errorf("statusLine() = %q, want %q", line, expected)
+	}
+}
+
+func TestRootStats(t *testing.T) {
+	db := newTestDatabase(t)
+	var roots []string
+	for i, files := range []map[string]string{
+		{"a.txt": "hello", "b.log": "world!"},
+		{"c.txt": "content"},
+	} {
+		root := t.TempDir()
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 1 {
+			if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		roots = append(roots, root)
+	}
+
+	stats := NewProcessStats()
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1, ExcludePatterns: []string{"*.log"}}}
+	for _, root := range roots {
+		if err := processDirectory(root, db, stats, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second crawl finds everything unchanged, and skips the FIFO, which failed
+	for _, root := range roots {
+		if err := processDirectory(root, db, stats, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := stats.rootCounts()
+	if len(counts) != 2 {
+		t.Fatalf("got counts for %d roots, want 2", len(counts))
+	}
+	expected := []rootStats{
+		{Root: roots[0], Hashed: 1, Skipped: 1, Excluded: 2, Bytes: 5},
+		{Root: roots[1], Hashed: 1, Skipped: 2, Errors: 1, Bytes: 7},
+	}
+	for i := range counts {
+		counts[i].ElapsedSeconds = 0
+		if counts[i] != expected[i] {
+			t.Errorf("got counts %+v, want %+v", counts[i], expected[i])
+		}
+	}
+}
+
+func TestWriteProgressJSON(t *testing.T) {
+	startTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	stats := NewProcessStats()
+	stats.Now = func() time.Time { return startTime.Add(10 * time.Second) }
+	stats.Update("/a/b", 25e6)
+	atomic.AddInt64(&stats.root("/a").Errors, 3)
+
+	// Without a writer, nothing happens
+	if err := stats.writeProgressJSON(startTime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stats.ProgressJSON = &buf
+	for i := 0; i < 2; i++ {
+		if err := stats.writeProgressJSON(startTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line := `{"elapsed_seconds":10,"files":1,"bytes":25000000,"speed_mbps":2.5,"last_file":"/a/b","errors":3}` + "\n"
+	if buf.String() != line+line {
+		t.Errorf("writeProgressJSON() wrote %q, want two lines of %q", buf.String(), line)
+	}
+}
+
+func TestHashProgress(t *testing.T) {
+	stats := NewProcessStats()
+	stats.Update("/big", 1000)
+	r := &progressReader{r: bytes.NewReader(make([]byte, 1000)), stats: stats, size: 1000}
+	if _, err := r.Read(make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+	if progress := stats.fileProgress(); progress != " (40%)" {
+		t.Errorf("fileProgress() = %q, want (40%%)", progress)
+	}
+	stats.Update("/small", 10)
+	if progress := stats.fileProgress(); progress != "" {
+		t.Errorf("after the next file, fileProgress() = %q, want nothing", progress)
+	}
+
+	// A crawl reports the progress of the files above the threshold
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"big", string(make([]byte, 5000))}})
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, HashProgressSize: 4096}
+	if err := processDirectory(root, newTestDatabase(t), stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	if progress := stats.fileProgress(); progress != " (100%)" {
+		t.Errorf("after a crawl, fileProgress() = %q, want (100%%)", progress)
+	}
+}
+
+func TestRootSummary(t *testing.T) {
+	stats := NewProcessStats()
+	r := stats.root("/data|old")
+	r.Hashed, r.Skipped, r.Bytes, r.ElapsedSeconds = 3, 2, 1_500_000, 61
+
+	expected := "    Hashed    Skipped   Excluded   Errors           MB   Duration  Root\n" +
+		"         3          2          0        0         1.50       1m1s  /data|old\n"
+	if summary := stats.rootSummary(textFormat); summary != expected {
+		t.Errorf("rootSummary(text) = %q, want %q", summary, expected)
+	}
+	expected = "| Hashed | Skipped | Excluded | Errors | MB | Duration | Root |\n" +
+		"| ---: | ---: | ---: | ---: | ---: | ---: | --- |\n" +
+		"| 3 | 2 | 0 | 0 | 1.50 | 1m1s | /data\\|old |\n"
+	if summary := stats.rootSummary(markdownFormat); summary != expected {
+		t.Errorf("rootSummary(markdown) = %q, want %q", summary, expected)
+	}
+}
+
+func TestDBMetrics(t *testing.T) {
+	db := newTestDatabase(t)
+	before := snapshotDBMetrics()
+	for _, path := range []string{"/a/b", "/a/b", "/a/c"} {
+		if _, err := getFolderID(db, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := snapshotDBMetrics()
+	if hits, misses := after.FolderCacheHits-before.FolderCacheHits,
+		after.FolderCacheMisses-before.FolderCacheMisses; hits != 1 || misses != 2 {
+		t.Errorf("got %d folder cache hits and %d misses, want 1 and 2", hits, misses)
+	}
+	// /a/b creates /, /a and /a/b, and /a/c only itself
+	if inserts := after.Inserts - before.Inserts; inserts != 4 {
+		t.Errorf("got %d inserts, want 4", inserts)
+	}
+
+	stats := NewProcessStats()
+	stats.ShowDBMetrics = true
+	if line := stats.statusLine(stats.Now()); !strings.Contains(line, ", Folder cache: ") {
+		t.Errorf("statusLine() = %q, want the database metrics", line)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressEvent is a single line of the progress file
+type progressEvent struct {
+	Type           string             `json:"type"` // stats, root-start, root-finish, error or summary
+	Time           time.Time          `json:"time"`
+	Root           string             `json:"root,omitempty"`
+	Path           string             `json:"path,omitempty"`
+	Error          string             `json:"error,omitempty"`
+	Files          int64              `json:"files,omitempty"`
+	Bytes          int64              `json:"bytes,omitempty"`
+	ElapsedSeconds float64            `json:"elapsed_seconds,omitempty"`
+	Dropped        int64              `json:"dropped,omitempty"`
+	Roots          []rootStats        `json:"roots,omitempty"`      // Per-root counts, in the summary
+	DBErrors       int64              `json:"db_errors,omitempty"`  // Failed database writes, in the summary
+	DBMetrics      *dbMetricsSnapshot `json:"db_metrics,omitempty"` // Database work of the crawl, in the summary
+}
+
+// progress receives the progress events of the current run. It is nil unless -progress-file is given.
+var progress *progressWriter
+
+// progressWriter appends events as JSON lines to a file or FIFO. Events are queued in a bounded buffer
+// and dropped when the consumer can't keep up, so that sending never blocks the crawl.
+type progressWriter struct {
+	events  chan progressEvent
+	done    chan struct{}
+	dropped atomic.Int64
+	mu      sync.Mutex // Guards closed and sending to events
+	closed  bool
+	Now     func() time.Time
+}
+
+func newProgressWriter(filename string) *progressWriter {
+	p := &progressWriter{
+		events: make(chan progressEvent, 1024),
+		done:   make(chan struct{}),
+		Now:    time.Now,
+	}
+	go p.run(filename)
+	return p
+}
+
+// run opens the file and writes the events. Opening a FIFO blocks until there is a reader,
+// which is why it's done here rather than in newProgressWriter.
+func (p *progressWriter) run(filename string) {
+	defer close(p.done)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Println("Error opening progress file:", err)
+		for range p.events {
+			p.dropped.Add(1)
+		}
+		return
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("Error closing progress file:", err)
+		}
+	}(file)
+
+	for event := range p.events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			log.Println("Error encoding progress event:", err)
+			continue
+		}
+		// One write per line, so that a tailing consumer sees complete events promptly
+		_, err = file.Write(append(line, '\n'))
+		if err != nil {
+			log.Println("Error writing progress event:", err)
+		}
+	}
+}
+
+// Send queues the event, dropping it if the buffer is full. It does nothing if p is nil.
+func (p *progressWriter) Send(event progressEvent) {
+	if p == nil {
+		return
+	}
+	event.Time = p.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.dropped.Add(1)
+		return
+	}
+	select {
+	case p.events <- event:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// Close flushes the queued events, waiting at most timeout for the consumer
+func (p *progressWriter) Close(timeout time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	close(p.events)
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Println("Timed out writing progress events")
+	}
+}
+
+// Dropped returns the number of events dropped so far
+func (p *progressWriter) Dropped() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.dropped.Load()
+}
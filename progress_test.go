@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "progress.jsonl")
+	p := newProgressWriter(filename)
+	p.Send(progressEvent{Type: "root-start", Root: "/a"})
+	p.Send(progressEvent{Type: "summary", Files: 2})
+	p.Close(time.Second)
+	p.Send(progressEvent{Type: "stats"}) // Must not panic after Close
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, event.Type)
+	}
+	if len(types) != 2 || types[0] != "root-start" || types[1] != "summary" {
+		t.Errorf("got events %q, want root-start and summary", types)
+	}
+	if p.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", p.Dropped())
+	}
+}
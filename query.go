@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// runQueryCommand implements the query subcommand, which runs read-only analyses of the index
+func runQueryCommand(args []string) error {
+	var dbFile string
+	var nameDuplicates bool
+	var query string
+	var format string
+	var limit int
+
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.BoolVar(&nameDuplicates, "name-duplicates", false,
+		"List files of the same size whose names only differ in Unicode normalization or case")
+	flags.StringVar(&query, "sql", "",
+		"SELECT statement to run, e.g. \"SELECT path, size FROM files WHERE size > 1e9 ORDER BY size DESC\"")
+	flags.StringVar(&format, "format", "text", "Output of -sql: text for a table, or json for an object per row")
+	flags.IntVar(&limit, "limit", 1000, "Maximum number of rows printed by -sql, 0 for all of them")
+	_ = flags.Parse(args)
+
+	if !nameDuplicates && query == "" {
+		flags.PrintDefaults()
+		return errors.New("no query given")
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, want text or json", format)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if query != "" {
+		return runQuery(db, query, limit, format, os.Stdout)
+	}
+	return nameDuplicatesQuery(db, os.Stdout)
+}
+
+// normalizedName is the form of a name used to compare names: NFC, then case folded
+func normalizedName(name string) string {
+	return cases.Fold().String(norm.NFC.String(name))
+}
+
+// nameDuplicatesQuery writes groups of files with the same size whose names are equal after normalization,
+// but differ as stored
+func nameDuplicatesQuery(db *sql.DB, w io.Writer) error {
+	type key struct {
+		name string
+		size int64
+	}
+	type file struct {
+		path string
+		name string
+	}
+
+	rows, err := db.Query(`
+	SELECT path, name, COALESCE(size, 0) FROM files
+	WHERE dir = 0 AND COALESCE(symlink, '') = '' AND error IS NULL AND exclusion_pattern IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	groups := make(map[key][]file)
+	for rows.Next() {
+		var f file
+		var size int64
+		if err := rows.Scan(&f.path, &f.name, &size); err != nil {
+			return err
+		}
+		k := key{normalizedName(f.name), size}
+		groups[k] = append(groups[k], f)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var keys []key
+	for k, files := range groups {
+		for _, f := range files[1:] {
+			if f.name != files[0].name {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].size < keys[j].size
+	})
+
+	for _, k := range keys {
+		files := groups[k]
+		sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+		if _, err := fmt.Fprintf(w, "%s (%d bytes)\n", k.name, k.size); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if _, err := fmt.Fprintf(w, "  %s\n", f.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNameDuplicatesQuery(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, file := range []struct {
+		path, name string
+		size       int64
+	}{
+		{"/mac/Cafe\u0301.txt", "Cafe\u0301.txt", 10}, // NFD, as written by macOS
+		{"/linux/Café.txt", "Café.txt", 10},           // NFC
+		{"/linux/CAFÉ.TXT", "CAFÉ.TXT", 10},
+		{"/other/Café.txt", "Café.txt", 11},  // Different size
+		{"/copy1/Straße.md", "Straße.md", 5}, // Same raw name, not a normalization issue
+		{"/copy2/Straße.md", "Straße.md", 5},
+		{"/copy3/STRASSE.md", "STRASSE.md", 5}, // Case folding of ß
+	} {
+		if _, err := db.Exec("INSERT INTO files(path, name, size) VALUES (?, ?, ?)",
+			file.path, file.name, file.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := nameDuplicatesQuery(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "café.txt (10 bytes)\n" +
+		"  /linux/CAFÉ.TXT\n" +
+		"  /linux/Café.txt\n" +
+		"  /mac/Cafe\u0301.txt\n" +
+		"strasse.md (5 bytes)\n" +
+		"  /copy1/Straße.md\n" +
+		"  /copy2/Straße.md\n" +
+		"  /copy3/STRASSE.md\n"
+	if buf.String() != expected {
+		t.Errorf("nameDuplicatesQuery() = %q, want %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// recentFilter selects the files listed by the recent command
+type recentFilter struct {
+	Since  time.Time // Start of the window
+	Prefix string    // Only list paths equal to or below this one, "" for all
+	Limit  int       // Maximum number of files, 0 for all of them
+	Offset int       // Number of files skipped before the first one listed
+}
+
+// recentFile is a file listed by recent
+type recentFile struct {
+	Path      string
+	Size      int64
+	Change    string // new or modified
+	ChangedAt string // first_seen for new files, the modification time for modified ones
+}
+
+// runRecent implements the recent subcommand, which lists the files that appeared or were modified recently
+func runRecent(args []string) error {
+	var dbFile string
+	var days int
+	var since string
+	var format string
+	var filter recentFilter
+
+	flags := flag.NewFlagSet("recent", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.IntVar(&days, "days", 7, "List the files that changed within this many days")
+	flags.StringVar(&since, "since", "",
+		"List the files that changed since this date, e.g. 2024-05-01 or 2024-05-01T12:00:00Z, instead of -days")
+	flags.StringVar(&filter.Prefix, "prefix", "", "Only list paths equal to or below this path")
+	flags.IntVar(&filter.Limit, "limit", 1000, "Maximum number of files listed, 0 for all of them")
+	flags.IntVar(&filter.Offset, "offset", 0, "Skip this many files first, to page through a long list with -limit")
+	flags.StringVar(&format, "format", textFormat,
+		"Output: text, markdown for a GitHub-flavored table, or json for an object per row")
+	_ = flags.Parse(args)
+
+	if format != "json" {
+		if err := checkReportFormat(format); err != nil {
+			return err
+		}
+	}
+	if filter.Limit < 0 || filter.Offset < 0 {
+		return errors.New("-limit and -offset must not be negative")
+	}
+	var err error
+	if since != "" {
+		if filter.Since, err = parseSinceDate(since); err != nil {
+			return err
+		}
+	} else if days <= 0 {
+		return fmt.Errorf("days must be positive, got %d", days)
+	} else {
+		filter.Since = time.Now().AddDate(0, 0, -days)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	files, more, err := recentFiles(db, filter)
+	if err != nil {
+		return err
+	}
+	if err := writeRecentFiles(os.Stdout, files, format); err != nil {
+		return err
+	}
+	if more {
+		log.Printf("Only files %d to %d are listed, see -limit and -offset\n", filter.Offset+1,
+			filter.Offset+len(files))
+	}
+	return nil
+}
+
+// parseSinceDate parses a date, in local time, or a time in RFC 3339
+func parseSinceDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// recentFiles returns the files that appeared or were modified since filter.Since, latest first. A file is new if
+// it was first seen by a crawl in the window, which is only known for files that appeared after the first crawl of
+// their root, and modified if its stored modification time is in the window. It also reports whether there are
+// more files after the page selected by filter.
+func recentFiles(db *sql.DB, filter recentFilter) ([]recentFile, bool, error) {
+	conditions := []string{"COALESCE(dir, 0) = 0", "exclusion_pattern IS NULL",
+		"(julianday(first_seen) >= julianday(?) OR julianday(modification_time) >= julianday(?))"}
+	since := filter.Since.UTC().Format(time.RFC3339)
+	args := []any{since, since, since}
+	if filter.Prefix != "" {
+		conditions = append(conditions, underRootCondition)
+		args = append(args, underRootArgs(filter.Prefix)...)
+	}
+	limit := -1
+	if filter.Limit > 0 {
+		// One more, to know whether there is another page
+		limit = filter.Limit + 1
+	}
+	args = append(args, limit, filter.Offset)
+
+	rows, err := db.Query(`
+	SELECT path, COALESCE(size, 0), new,
+	       CASE WHEN new THEN first_seen ELSE modification_time END AS changed_at
+	FROM (SELECT *, COALESCE(julianday(first_seen) >= julianday(?), 0) AS new FROM files)
+	WHERE `+strings.Join(conditions, " AND ")+`
+	ORDER BY julianday(changed_at) DESC, path
+	LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var files []recentFile
+	for rows.Next() {
+		var f recentFile
+		var isNew bool
+		if err := rows.Scan(&f.Path, &f.Size, &isNew, &f.ChangedAt); err != nil {
+			return nil, false, err
+		}
+		f.Change = "modified"
+		if isNew {
+			f.Change = "new"
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if filter.Limit > 0 && len(files) > filter.Limit {
+		return files[:filter.Limit], true, nil
+	}
+	return files, false, nil
+}
+
+// writeRecentFiles writes files in format, text, markdown or json
+func writeRecentFiles(w io.Writer, files []recentFile, format string) error {
+	table := reportTable{Header: []string{"Changed", "Change", "Size", "Path"}, Text: "%-25s %-8s %16s  %s\n"}
+	for _, f := range files {
+		if format == "json" {
+			err := writeJSONRow(w, []string{"changed_at", "change", "size", "path"},
+				[]any{f.ChangedAt, f.Change, f.Size, f.Path})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		table.Rows = append(table.Rows, []string{f.ChangedAt, f.Change, fmt.Sprint(f.Size), f.Path})
+	}
+	if format == "json" {
+		return nil
+	}
+	return writeTable(w, table, format)
+}
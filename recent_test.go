@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"old.txt", "old"}, {"docs/edited.txt", "edited"}})
+	setModTime := func(name string, age time.Duration) {
+		t.Helper()
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(root, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setModTime("old.txt", 30*24*time.Hour)
+	setModTime("docs/edited.txt", 48*time.Hour)
+
+	// The files of the first crawl of a root aren't new, but those that appear later are, even with an old
+	// modification time
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, InitialCrawl: true}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, [][2]string{{"docs/copied.txt", "copied"}})
+	setModTime("docs/copied.txt", 100*24*time.Hour)
+	opts.InitialCrawl = false
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := recentFilter{Since: time.Now().AddDate(0, 0, -7)}
+	list := func(filter recentFilter) ([]string, bool) {
+		t.Helper()
+		files, more, err := recentFiles(db, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, f := range files {
+			listed = append(listed, f.Change+" "+filepath.Base(f.Path))
+		}
+		return listed, more
+	}
+	expected := []string{"new copied.txt", "modified edited.txt"}
+	if listed, more := list(filter); !reflect.DeepEqual(listed, expected) || more {
+		t.Errorf("recentFiles() = %q, %v, want %q", listed, more, expected)
+	}
+	filter.Limit = 1
+	if listed, more := list(filter); !reflect.DeepEqual(listed, expected[:1]) || !more {
+		t.Errorf("first page = %q, %v, want %q and more", listed, more, expected[:1])
+	}
+	filter.Offset = 1
+	if listed, more := list(filter); !reflect.DeepEqual(listed, expected[1:]) || more {
+		t.Errorf("second page = %q, %v, want %q", listed, more, expected[1:])
+	}
+	filter = recentFilter{Since: time.Now().AddDate(0, 0, -60), Prefix: filepath.Join(root, "docs")}
+	if listed, _ := list(filter); len(listed) != 2 {
+		t.Errorf("recentFiles() under docs = %q, want 2 files", listed)
+	}
+
+	files, _, err := recentFiles(db, recentFilter{Since: time.Now().AddDate(0, 0, -7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeRecentFiles(&out, files, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 ||
+		!strings.Contains(lines[0], `"change":"new"`) || !strings.Contains(lines[1], `"size":6`) {
+		t.Errorf("writeRecentFiles() = %q", out.String())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+)
+
+// referenceIndex holds the paths and hashes of a reference database given with -exclude-from-db, so that a crawl
+// can skip what is already indexed there
+type referenceIndex struct {
+	MatchPaths  bool
+	MatchHashes bool
+	paths       map[string]bool
+	hashes      map[string]bool // Keyed by algorithm and hex hash, see referenceHashKey
+}
+
+// referenceHashKey combines algorithm and hash, since hashes are only comparable with the same algorithm
+func referenceHashKey(algorithm, hash string) string {
+	return algorithm + ":" + hash
+}
+
+// loadReferenceIndex reads the paths, the hashes or both, according to match, of the files in the database at
+// dbFile into memory. Directories, excluded files and files with errors are left out.
+func loadReferenceIndex(dbFile, match string) (*referenceIndex, error) {
+	ref := &referenceIndex{}
+	switch match {
+	case "path":
+		ref.MatchPaths = true
+	case "hash":
+		ref.MatchHashes = true
+	case "both":
+		ref.MatchPaths, ref.MatchHashes = true, true
+	default:
+		return nil, fmt.Errorf("invalid match %q, expected path, hash or both", match)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDatabase(db)
+
+	rows, err := db.Query(`
+	SELECT path, COALESCE(`+hashHexColumn+`, ''), COALESCE(hash_algorithm, ?) FROM files
+	WHERE COALESCE(dir, 0) = 0 AND exclusion_pattern IS NULL AND error IS NULL`, defaultHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ref.paths = make(map[string]bool)
+	ref.hashes = make(map[string]bool)
+	for rows.Next() {
+		var path, hash, algorithm string
+		if err := rows.Scan(&path, &hash, &algorithm); err != nil {
+			return nil, err
+		}
+		if ref.MatchPaths {
+			ref.paths[path] = true
+		}
+		if ref.MatchHashes && hash != "" {
+			ref.hashes[referenceHashKey(algorithm, hash)] = true
+		}
+	}
+	return ref, rows.Err()
+}
+
+// hasPath reports whether path, as stored, is in the reference database and paths are matched
+func (ref *referenceIndex) hasPath(path string) bool {
+	return ref != nil && ref.paths[path]
+}
+
+// hasHash reports whether a file with the given hash is in the reference database and hashes are matched
+func (ref *referenceIndex) hasHash(algorithm, hash string) bool {
+	return ref != nil && ref.hashes[referenceHashKey(algorithm, hash)]
+}
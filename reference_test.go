@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessDirectoryExcludeFromDB(t *testing.T) {
+	master := t.TempDir()
+	writeFiles(t, master, [][2]string{{"photo.jpg", "photo"}, {"notes.txt", "notes"}})
+	refFile := filepath.Join(t.TempDir(), "master.sqlite")
+	ref, err := openDatabase(refFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(master, ref, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	closeDatabase(ref)
+
+	disk := t.TempDir()
+	writeFiles(t, disk, [][2]string{{"copy of photo.jpg", "photo"}, {"new.txt", "new"}})
+	exclusions := func(root, match string) map[string]string {
+		t.Helper()
+		db := newTestDatabase(t)
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+		if opts.Reference, err = loadReferenceIndex(refFile, match); err != nil {
+			t.Fatal(err)
+		}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query("SELECT name, COALESCE(exclusion_pattern, '') FROM files WHERE dir = 0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		result := make(map[string]string)
+		for rows.Next() {
+			var name, pattern string
+			if err := rows.Scan(&name, &pattern); err != nil {
+				t.Fatal(err)
+			}
+			result[name] = pattern
+		}
+		return result
+	}
+
+	got := exclusions(disk, "hash")
+	if got["copy of photo.jpg"] != "ref-db:hash" || got["new.txt"] != "" {
+		t.Errorf("matching by hash, got exclusions %v, want only the copy", got)
+	}
+	if got := exclusions(disk, "path"); got["copy of photo.jpg"] != "" || got["new.txt"] != "" {
+		t.Errorf("matching by path, got exclusions %v for other paths, want none", got)
+	}
+	if got := exclusions(master, "both"); got["photo.jpg"] != "ref-db:path" || got["notes.txt"] != "ref-db:path" {
+		t.Errorf("matching by both, got exclusions %v for the same paths, want both excluded by path", got)
+	}
+	if _, err := loadReferenceIndex(refFile, "name"); err == nil {
+		t.Error("loadReferenceIndex() accepted an invalid match")
+	}
+}
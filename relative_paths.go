@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Values of the path_mode setting. In relative mode, a path is stored as the label of its root, a colon, and the
+// path below the root, e.g. backup:/photos/a.jpg for /Volumes/Backup/photos/a.jpg, and the root itself as backup:.
+const (
+	absolutePaths = "absolute"
+	relativePaths = "relative"
+)
+
+// pathMode is how paths are stored in the open database
+var pathMode = absolutePaths
+
+// loadPathMode sets pathMode from the database settings
+func loadPathMode(db *sql.DB) error {
+	mode, err := getSetting(db, "path_mode")
+	if err != nil {
+		return err
+	}
+	pathMode = absolutePaths
+	if mode != "" {
+		pathMode = mode
+	}
+	return nil
+}
+
+// initPathMode makes sure the database stores paths the way a crawl with the given root label would, and
+// records it for later runs. Absolute and relative paths can't be mixed in one database.
+func initPathMode(db *sql.DB, label string) error {
+	requested := absolutePaths
+	if label != "" {
+		requested = relativePaths
+	}
+	mode, err := getSetting(db, "path_mode")
+	if err != nil {
+		return err
+	}
+	if mode == "" {
+		// Databases created before the setting existed always have absolute paths
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&count); err != nil {
+			return err
+		}
+		mode = requested
+		if count > 0 {
+			mode = absolutePaths
+		}
+	}
+	if mode != requested {
+		if mode == absolutePaths {
+			return fmt.Errorf("the database stores absolute paths, so -relative can't be used with it")
+		}
+		return fmt.Errorf("the database stores paths relative to labeled roots, so -relative must be given")
+	}
+	pathMode = mode
+	return setSetting(db, "path_mode", mode)
+}
+
+// checkLabel returns an error if label can't be used as a root label
+func checkLabel(label string) error {
+	if label == "" || strings.ContainsAny(label, "/:%") {
+		return fmt.Errorf("invalid root label %q: it must be non-empty and not contain '/', ':' or '%%'", label)
+	}
+	return nil
+}
+
+// storedPath returns the path under which path, below root, is stored: path itself without a label, or the path
+// relative to root prefixed with the label
+func storedPath(label, root, path string) string {
+	if label == "" {
+		return path
+	}
+	if path == root {
+		return label + ":"
+	}
+	return label + ":" + strings.TrimPrefix(path, strings.TrimSuffix(root, "/"))
+}
+
+// splitRelativePath splits a path stored in relative mode into its label and the path below the root
+func splitRelativePath(path string) (label, rest string, ok bool) {
+	label, rest, ok = strings.Cut(path, ":")
+	if !ok || checkLabel(label) != nil {
+		return "", "", false
+	}
+	return label, rest, true
+}
+
+// parentDir returns the directory of a stored path. Like "/", the root of a relative path is its own parent,
+// so that each root has its own tree of folders.
+func parentDir(path string) string {
+	if _, rest, ok := splitRelativePath(path); ok && rest == "" {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// checkStoredPath returns an error unless path has the form of a stored path in the current path mode
+func checkStoredPath(path string) error {
+	if pathMode != relativePaths {
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+			return fmt.Errorf("path %q is not a clean absolute path", path)
+		}
+		return nil
+	}
+	_, rest, ok := splitRelativePath(path)
+	if !ok || (rest != "" && (!filepath.IsAbs(rest) || filepath.Clean(rest) != rest || rest == "/")) {
+		return fmt.Errorf("path %q is not a clean path relative to a labeled root", path)
+	}
+	return nil
+}
+
+// rootLocations maps the labels of relative roots to where they were last crawled
+type rootLocations map[string]string
+
+// loadRootLocations returns the locations of the labeled roots of the database
+func loadRootLocations(db *sql.DB) (rootLocations, error) {
+	rows, err := db.Query("SELECT path, location FROM roots WHERE location IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := make(rootLocations)
+	for rows.Next() {
+		var root, location string
+		if err := rows.Scan(&root, &location); err != nil {
+			return nil, err
+		}
+		if label, rest, ok := splitRelativePath(root); ok && rest == "" {
+			locations[label] = location
+		}
+	}
+	return locations, rows.Err()
+}
+
+// osPath returns the file system path of a decoded stored path. Relative paths whose root has no known location
+// are returned unchanged.
+func (l rootLocations) osPath(path string) string {
+	if pathMode != relativePaths {
+		return path
+	}
+	label, rest, ok := splitRelativePath(path)
+	if location, known := l[label]; ok && known {
+		return filepath.Join(location, rest)
+	}
+	return path
+}
+
+// storedPath returns the stored path of path on the file system, below the location of the labeled root that
+// contains it most closely. Paths outside all known locations are returned unchanged.
+func (l rootLocations) storedPath(path string) string {
+	if pathMode != relativePaths {
+		return path
+	}
+	best, bestLocation := "", ""
+	for label, location := range l {
+		if (path == location || strings.HasPrefix(path, strings.TrimSuffix(location, "/")+"/")) &&
+			len(location) > len(bestLocation) {
+			best, bestLocation = label, location
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return storedPath(best, bestLocation, path)
+}
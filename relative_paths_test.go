@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoredPath(t *testing.T) {
+	testCases := []struct {
+		label, root, path string
+		expected          string
+	}{
+		{"", "/mnt/backup", "/mnt/backup/a", "/mnt/backup/a"},
+		{"backup", "/mnt/backup", "/mnt/backup", "backup:"},
+		{"backup", "/mnt/backup", "/mnt/backup/photos/a.jpg", "backup:/photos/a.jpg"},
+		{"system", "/", "/", "system:"},
+		{"system", "/", "/etc/hosts", "system:/etc/hosts"},
+	}
+	for _, tc := range testCases {
+		if path := storedPath(tc.label, tc.root, tc.path); path != tc.expected {
+			t.Errorf("storedPath(%q, %q, %q) = %q, want %q", tc.label, tc.root, tc.path, path, tc.expected)
+		}
+	}
+}
+
+func TestCheckStoredPath(t *testing.T) {
+	t.Cleanup(func() { pathMode = absolutePaths })
+
+	testCases := []struct {
+		mode  string
+		path  string
+		valid bool
+	}{
+		{absolutePaths, "/a/b", true},
+		{absolutePaths, "backup:/a", false},
+		{relativePaths, "backup:", true},
+		{relativePaths, "backup:/a/b", true},
+		{relativePaths, "/a/b", false},
+		{relativePaths, "backup:a", false},
+		{relativePaths, "backup:/", false},
+		{relativePaths, "backup:/a/../b", false},
+	}
+	for _, tc := range testCases {
+		pathMode = tc.mode
+		if err := checkStoredPath(tc.path); (err == nil) != tc.valid {
+			t.Errorf("checkStoredPath(%q) in %s mode = %v, want valid %v", tc.path, tc.mode, err, tc.valid)
+		}
+	}
+}
+
+func TestInitPathMode(t *testing.T) {
+	t.Cleanup(func() { pathMode = absolutePaths })
+
+	db := newTestDatabase(t)
+	if err := initPathMode(db, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPathMode(db, ""); err == nil {
+		t.Error("initPathMode() succeeded crawling absolute paths into a relative database")
+	}
+
+	// Databases from before the setting have absolute paths
+	db = newTestDatabase(t)
+	if _, err := db.Exec("INSERT INTO files(path) VALUES ('/a')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initPathMode(db, "backup"); err == nil {
+		t.Error("initPathMode() succeeded crawling relative paths into an absolute database")
+	}
+}
+
+func TestProcessDirectoryRelative(t *testing.T) {
+	t.Cleanup(func() { pathMode = absolutePaths })
+
+	db := newTestDatabase(t)
+	if err := initPathMode(db, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "photos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "photos", "a.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, Label: "backup"}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordRoot(db, "backup:", root, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT files.path, folders.path FROM files JOIN folders ON files.folder_id = folders.id ORDER BY files.path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := make(map[string]string)
+	for rows.Next() {
+		var path, folder string
+		if err := rows.Scan(&path, &folder); err != nil {
+			t.Fatal(err)
+		}
+		stored[path] = folder
+	}
+	expected := map[string]string{"backup:": "backup:", "backup:/photos": "backup:", "backup:/photos/a.jpg": "backup:/photos"}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("stored paths and folders %v, want %v", stored, expected)
+	}
+
+	results, err := verifyFiles(db, 0, verifyParameters{Sample: 1, Seed: 1}, NewProcessStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Checked != 1 || results.OK != 1 {
+		t.Errorf("verifyFiles() = %+v, want one file checked OK", results)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// runReport implements the report subcommand
+func runReport(args []string) error {
+	var dbFile string
+	var reportType string
+	var target string
+	var hasNotes bool
+	var growth bool
+	var reportFormat string
+
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&reportType, "type", "", "Report type: deps, depth-histogram, category-stats, type-mismatch, long-names, "+
+		"special-permissions, shared-data, same-trees, hard-links")
+	flags.StringVar(&target, "target", "", "Target file for the deps report")
+	flags.BoolVar(&hasNotes, "has-notes", false, "List the files that have notes, with their notes, instead of a report")
+	flags.BoolVar(&growth, "growth", false, "Compare the number and size of the files of each root of the last crawl, "+
+		"and of its top-level folders, with the previous crawl of the root, instead of a report")
+	flags.StringVar(&reportFormat, "report-format", textFormat,
+		"Format of the depth-histogram, category-stats, shared-data and growth reports: text, or markdown for a GitHub-flavored table")
+	_ = flags.Parse(args)
+	if err := checkReportFormat(reportFormat); err != nil {
+		return err
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if hasNotes {
+		return notesReport(db, os.Stdout)
+	}
+	if growth {
+		return growthReport(db, os.Stdout, reportFormat)
+	}
+
+	switch reportType {
+	case "deps":
+		if target == "" {
+			return errors.New("the deps report requires -target")
+		}
+		return depsReport(db, target, os.Stdout)
+	case "depth-histogram":
+		return depthHistogramReport(db, os.Stdout, reportFormat)
+	case "category-stats":
+		return categoryStatsReport(db, os.Stdout, reportFormat)
+	case "type-mismatch":
+		return typeMismatchReport(db, os.Stdout)
+	case "long-names":
+		return longNamesReport(db, os.Stdout)
+	case "special-permissions":
+		return specialPermissionsReport(db, os.Stdout)
+	case "shared-data":
+		return sharedDataReport(db, os.Stdout, reportFormat)
+	case "same-trees":
+		return sameTreesReport(db, os.Stdout)
+	case "hard-links":
+		return hardLinkReport(db, os.Stdout)
+	default:
+		flags.PrintDefaults()
+		return fmt.Errorf("unknown report type %q", reportType)
+	}
+}
+
+// depsReport writes the files whose modification time is newer than that of target as a list of
+// Makefile prerequisites
+func depsReport(db *sql.DB, target string, w io.Writer) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	// Stored modification times have a resolution of one second
+	targetTime := info.ModTime().Truncate(time.Second)
+
+	rows, err := db.Query(`
+	SELECT path, modification_time FROM files
+	WHERE dir = 0 AND error IS NULL AND exclusion_pattern IS NULL AND modification_time IS NOT NULL
+	ORDER BY path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	const maxLineLength = 78
+	lineLength := 0
+	for rows.Next() {
+		var path, modificationTime string
+		if err := rows.Scan(&path, &modificationTime); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339, modificationTime)
+		if err != nil || !t.After(targetTime) {
+			continue
+		}
+
+		path = makeEscape(path)
+		if lineLength > 0 && lineLength+len(path)+1 > maxLineLength {
+			if _, err := fmt.Fprint(w, " \\\n"); err != nil {
+				return err
+			}
+			lineLength = 0
+		}
+		separator := " "
+		if lineLength == 0 {
+			separator = ""
+		}
+		if _, err := fmt.Fprint(w, separator, path); err != nil {
+			return err
+		}
+		lineLength += len(separator) + len(path)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if lineLength > 0 {
+		_, err = fmt.Fprintln(w)
+	}
+	return err
+}
+
+// depthHistogramReport writes the number and total size of the files at each depth below their crawl root
+func depthHistogramReport(db *sql.DB, w io.Writer, format string) error {
+	rows, err := db.Query(`
+	SELECT depth, COUNT(*), COALESCE(SUM(size), 0) FROM files
+	WHERE dir = 0 AND exclusion_pattern IS NULL AND depth IS NOT NULL
+	GROUP BY depth ORDER BY depth`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	table := reportTable{Header: []string{"Depth", "Files", "Bytes"}, Text: "%5s %10s %16s\n"}
+	for rows.Next() {
+		var depth, files, bytes int64
+		if err := rows.Scan(&depth, &files, &bytes); err != nil {
+			return err
+		}
+		table.Rows = append(table.Rows, []string{fmt.Sprint(depth), fmt.Sprint(files), fmt.Sprint(bytes)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeTable(w, table, format)
+}
+
+// categoryStatsReport writes the number and total size of the files in each category, largest first
+func categoryStatsReport(db *sql.DB, w io.Writer, format string) error {
+	rows, err := db.Query(`
+	SELECT category, COUNT(*), COALESCE(SUM(size), 0) AS bytes FROM files
+	WHERE dir = 0 AND exclusion_pattern IS NULL AND category IS NOT NULL
+	GROUP BY category ORDER BY bytes DESC, category`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	table := reportTable{Header: []string{"Category", "Files", "Bytes"}, Text: "%-10s %10s %16s\n"}
+	for rows.Next() {
+		var category string
+		var files, bytes int64
+		if err := rows.Scan(&category, &files, &bytes); err != nil {
+			return err
+		}
+		table.Rows = append(table.Rows, []string{category, fmt.Sprint(files), fmt.Sprint(bytes)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeTable(w, table, format)
+}
+
+// longNamesReport writes the length in bytes and the path of the files flagged with long_name, longest first
+func longNamesReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT path, LENGTH(CAST(name AS BLOB)) AS length FROM files
+	WHERE long_name = 1
+	ORDER BY length DESC, path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path string
+		var length int64
+		if err := rows.Scan(&path, &length); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%5d %s\n", length, path); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// specialPermissionsReport writes the files with the setuid or setgid bit, with the bits, the owner and the group.
+// setuid binaries outside of /usr/bin and /usr/sbin deserve a closer look. Owners are looked up on this machine, and
+// the IDs are written for those that aren't known here.
+func specialPermissionsReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT path, has_suid, has_sgid, uid, gid FROM files
+	WHERE has_suid = 1 OR has_sgid = 1
+	ORDER BY path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := make(map[int64]string)
+	groups := make(map[int64]string)
+	for rows.Next() {
+		var path string
+		var suid, sgid bool
+		var uid, gid sql.NullInt64
+		if err := rows.Scan(&path, &suid, &sgid, &uid, &gid); err != nil {
+			return err
+		}
+		var bits []string
+		if suid {
+			bits = append(bits, "suid")
+		}
+		if sgid {
+			bits = append(bits, "sgid")
+		}
+		owner := ownerName(users, uid, userName)
+		group := ownerName(groups, gid, groupName)
+		if _, err := fmt.Fprintf(w, "%-9s %-12s %-12s %s\n", strings.Join(bits, ","), owner, group, path); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// hardLinkReport writes the groups of indexed paths that are hard links to the same file, by device and inode,
+// those saving the most space first, followed by the totals: the apparent size counts the file once per path, as
+// tools that don't know about hard links do, and the disk usage counts it once. This shows how much space
+// hard-linked backups, such as those of Time Machine or rsnapshot, really use. Links outside of the indexed trees
+// aren't known, so a file with a single indexed path isn't reported even if it has other links.
+func hardLinkReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT files.dev_id, files.inode, COALESCE(files.size, 0), files.path
+	FROM files JOIN (
+		SELECT dev_id, inode FROM files
+		WHERE inode IS NOT NULL AND COALESCE(dir, 0) = 0
+		GROUP BY dev_id, inode HAVING COUNT(*) > 1
+	) linked USING (dev_id, inode)
+	WHERE COALESCE(files.dir, 0) = 0
+	ORDER BY files.dev_id, files.inode, files.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type group struct {
+		key   inodeKey
+		size  int64
+		paths []string
+	}
+	var groups []*group
+	for rows.Next() {
+		var key inodeKey
+		var size int64
+		var path string
+		if err := rows.Scan(&key.Device, &key.Inode, &size, &path); err != nil {
+			return err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].key != key {
+			groups = append(groups, &group{key: key})
+		}
+		g := groups[len(groups)-1]
+		g.size = max(g.size, size)
+		g.paths = append(g.paths, path)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	saved := func(g *group) int64 { return g.size * int64(len(g.paths)-1) }
+	sort.SliceStable(groups, func(i, j int) bool { return saved(groups[i]) > saved(groups[j]) })
+
+	var links, apparent, usage int64
+	for _, g := range groups {
+		links += int64(len(g.paths))
+		apparent += g.size * int64(len(g.paths))
+		usage += g.size
+		_, err := fmt.Fprintf(w, "%d bytes, %d links, device %d inode %d\n", g.size, len(g.paths), g.key.Device,
+			g.key.Inode)
+		if err != nil {
+			return err
+		}
+		for _, path := range g.paths {
+			if _, err := fmt.Fprintf(w, "  %s\n", path); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintf(w, "Files: %d, links: %d, apparent size: %d, disk usage: %d, saved by hard links: %d\n",
+		len(groups), links, apparent, usage, apparent-usage)
+	return err
+}
+
+// ownerName returns the name of the user or group id, looked up with lookup and cached in names. Unknown IDs are
+// returned as numbers, and missing ones as "-".
+func ownerName(names map[int64]string, id sql.NullInt64, lookup func(id string) (string, error)) string {
+	if !id.Valid {
+		return "-"
+	}
+	if name, ok := names[id.Int64]; ok {
+		return name
+	}
+	name, err := lookup(strconv.FormatInt(id.Int64, 10))
+	if err != nil {
+		name = strconv.FormatInt(id.Int64, 10)
+	}
+	names[id.Int64] = name
+	return name
+}
+
+// runQuery runs query, which must be a SELECT statement, and writes up to limit rows of the result to w: as a
+// table under the column names, or with the json format as a JSON object per line, like export. The connection is
+// read-only while the query runs, so that nothing that gets past the check can change the index.
+func runQuery(db *sql.DB, query string, limit int, format string, w io.Writer) error {
+	if fields := strings.Fields(query); len(fields) == 0 || !strings.EqualFold(fields[0], "SELECT") {
+		return errors.New("only SELECT statements are allowed")
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "PRAGMA query_only = OFF"); err != nil {
+			log.Println("Error resetting query_only:", err)
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if format == "text" {
+		if _, err := fmt.Fprintln(table, strings.Join(columns, "\t")); err != nil {
+			return err
+		}
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for n := 0; rows.Next(); n++ {
+		if limit > 0 && n == limit {
+			log.Printf("Only the first %d rows are printed, see -limit\n", limit)
+			break
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		if format == "json" {
+			err = writeJSONRow(w, columns, values)
+		} else {
+			err = writeTextRow(table, values)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return table.Flush()
+}
+
+// sqlValue converts a value returned by SQLite for printing: blobs that aren't text, such as hashes stored as
+// blobs, are hex-encoded
+func sqlValue(v any) any {
+	if b, ok := v.([]byte); ok {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		return hex.EncodeToString(b)
+	}
+	return v
+}
+
+// writeTextRow writes values as a row of a tabwriter table, with NULL for nil
+func writeTextRow(w io.Writer, values []any) error {
+	cells := make([]string, len(values))
+	for i, v := range values {
+		cells[i] = "NULL"
+		if v != nil {
+			cells[i] = fmt.Sprint(sqlValue(v))
+		}
+	}
+	_, err := fmt.Fprintln(w, strings.Join(cells, "\t"))
+	return err
+}
+
+// writeJSONRow writes values as a line with a JSON object, with the keys in the order of the columns
+func writeJSONRow(w io.Writer, columns []string, values []any) error {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(sqlValue(values[i]))
+		if err != nil {
+			return err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// runFindUnindexed implements the find-unindexed subcommand, which lists the files below a root that are not in
+// the database
+func runFindUnindexed(args []string) error {
+	var dbFile string
+
+	flags := flag.NewFlagSet("find-unindexed", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: program find-unindexed [options] <root>")
+		flags.PrintDefaults()
+		return nil
+	}
+	root, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return findUnindexedFiles(ctx, root, db, os.Stdout)
+}
+
+// findUnindexedFiles walks the tree at root and writes the files and symlinks that are not in the database, such as
+// those added since the last crawl or missed by an unfinished one, followed by their number. Each directory needs a
+// single query. The contents of directories that are stored as excluded or as bundles are not listed, since crawls
+// don't index them either. It stops when ctx is done.
+func findUnindexedFiles(ctx context.Context, root string, db *sql.DB, w io.Writer) error {
+	var locations rootLocations
+	if pathMode == relativePaths {
+		var err error
+		if locations, err = loadRootLocations(db); err != nil {
+			return err
+		}
+	}
+
+	// The stored names of the children of the indexed directories between the root and the current path, with
+	// whether each is excluded or a bundle
+	var dirs []string
+	indexed := make(map[string]map[string]bool)
+	total := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			log.Println("Error walking:", path, err)
+			return nil
+		}
+		for n := len(dirs); n > 0 && !strings.HasPrefix(path, strings.TrimSuffix(dirs[n-1], "/")+"/"); n-- {
+			delete(indexed, dirs[n-1])
+			dirs = dirs[:n-1]
+		}
+
+		name, _ := encodePath(d.Name())
+		children, parentIndexed := indexed[filepath.Dir(path)]
+		opaque, found := children[name]
+		if path != root && !(parentIndexed && found) {
+			if d.IsDir() {
+				return nil
+			}
+			total++
+			_, err := fmt.Fprintln(w, path)
+			return err
+		}
+		if d.IsDir() && path != root && opaque {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			stored, _ := encodePath(locations.storedPath(path))
+			if indexed[path], err = loadIndexedNames(db, stored); err != nil {
+				return err
+			}
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Unindexed files: %d\n", total)
+	return err
+}
+
+// loadIndexedNames returns the names of the stored children of the folder at the stored path, with whether each
+// is excluded or a bundle
+func loadIndexedNames(db *sql.DB, path string) (map[string]bool, error) {
+	rows, err := db.Query(`
+	SELECT files.name, files.exclusion_pattern IS NOT NULL OR COALESCE(files.bundle, 0)
+	FROM files JOIN folders ON files.folder_id = folders.id
+	WHERE folders.path = ?`, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var opaque bool
+		if err := rows.Scan(&name, &opaque); err != nil {
+			return nil, err
+		}
+		names[name] = opaque
+	}
+	return names, rows.Err()
+}
+
+// makeEscape escapes the characters that have a special meaning in Makefile prerequisites
+func makeEscape(path string) string {
+	return strings.NewReplacer(" ", "\\ ", "#", "\\#", "$", "$$").Replace(path)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Formats of the end-of-run summary and the tabular reports, selected with -report-format
+const (
+	textFormat     = "text"
+	markdownFormat = "markdown"
+)
+
+// checkReportFormat returns an error for an unknown -report-format
+func checkReportFormat(format string) error {
+	if format != textFormat && format != markdownFormat {
+		return fmt.Errorf("unknown report format %q, want %s or %s", format, textFormat, markdownFormat)
+	}
+	return nil
+}
+
+// reportTable is the data of a tabular report, which writeTable renders as aligned text or as a Markdown table
+type reportTable struct {
+	Header []string
+	Rows   [][]string
+	Text   string // Format of the header and each row as text, with a %s verb per column, e.g. "%-10s %10s\n"
+}
+
+// textVerb matches the verbs of reportTable.Text, with the flag that aligns a column to the left
+var textVerb = regexp.MustCompile(`%(-?)(\d*)s`)
+
+// writeTable writes table to w in format. Markdown tables align the columns like the text does: columns padded on
+// the left are aligned to the right.
+func writeTable(w io.Writer, table reportTable, format string) error {
+	if format != markdownFormat {
+		for _, row := range append([][]string{table.Header}, table.Rows...) {
+			if _, err := fmt.Fprintf(w, table.Text, toAny(row)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	writeMarkdownRow(&b, table.Header)
+	separators := make([]string, len(table.Header))
+	for i, verb := range textVerb.FindAllStringSubmatch(table.Text, len(separators)) {
+		separators[i] = "---"
+		if verb[1] == "" && verb[2] != "" {
+			separators[i] = "---:"
+		}
+	}
+	writeMarkdownRow(&b, separators)
+	for _, row := range table.Rows {
+		writeMarkdownRow(&b, row)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMarkdownRow writes cells as a row of a Markdown table, escaping the pipes in them
+func writeMarkdownRow(b *strings.Builder, cells []string) {
+	b.WriteString("|")
+	for _, cell := range cells {
+		b.WriteString(" " + strings.ReplaceAll(cell, "|", `\|`) + " |")
+	}
+	b.WriteString("\n")
+}
+
+// toAny converts cells to arguments for fmt
+func toAny(cells []string) []any {
+	args := make([]any, len(cells))
+	for i, cell := range cells {
+		args[i] = cell
+	}
+	return args
+}
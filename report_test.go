@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDatabase creates an empty index in a temporary directory
+func newTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := openDatabase(filepath.Join(t.TempDir(), "index.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDatabase(db) })
+	return db
+}
+
+func TestDepsReport(t *testing.T) {
+	db := newTestDatabase(t)
+
+	target := filepath.Join(t.TempDir(), "output.tar")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	targetTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(target, targetTime, targetTime); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, modificationTime := range map[string]string{
+		"/src/old.go":        "2023-06-01T11:59:59Z",
+		"/src/same.go":       "2023-06-01T14:00:00+02:00",
+		"/src/new.go":        "2023-06-01T12:00:01Z",
+		"/src/with space.go": "2023-06-02T00:00:00Z",
+	} {
+		_, err := db.Exec("INSERT INTO files(path, modification_time) VALUES (?, ?)", path, modificationTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := depsReport(db, target, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "/src/new.go /src/with\\ space.go\n"
+	if buf.String() != expected {
+		t.Errorf("depsReport() = %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestDepthHistogramReport(t *testing.T) {
+	db := newTestDatabase(t)
+
+	for _, file := range []struct {
+		path  string
+		depth int
+		size  int64
+		dir   bool
+	}{
+		{"/root", 0, 0, true},
+		{"/root/a", 1, 10, false},
+		{"/root/b", 1, 20, false},
+		{"/root/sub", 1, 0, true},
+		{"/root/sub/c", 2, 5, false},
+	} {
+		_, err := db.Exec("INSERT INTO files(path, depth, size, dir) VALUES (?, ?, ?, ?)",
+			file.path, file.depth, file.size, file.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := depthHistogramReport(db, &buf, textFormat); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Depth      Files            Bytes\n" +
+		"    1          2               30\n" +
+		"    2          1                5\n"
+	if buf.String() != expected {
+		t.Errorf("depthHistogramReport() = %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestCategoryStatsReport(t *testing.T) {
+	db := newTestDatabase(t)
+
+	// Rows without a category, as stored before categories were, get one from their type when the schema is
+	// migrated
+	for _, file := range []struct {
+		path string
+		size int64
+		dir  bool
+	}{
+		{"/root", 0, true},
+		{"/root/a.JPG", 10, false},
+		{"/root/b.png", 20, false},
+		{"/root/main.go", 5, false},
+		{"/root/notes", 1, false},
+	} {
+		_, err := db.Exec("INSERT INTO files(path, type, size, dir) VALUES (?, ?, ?, ?)",
+			file.path, filepath.Ext(file.path), file.size, file.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backfillCategories(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := categoryStatsReport(db, &buf, textFormat); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Category        Files            Bytes\n" +
+		"image               2               30\n" +
+		"code                1                5\n" +
+		"other               1                1\n"
+	if buf.String() != expected {
+		t.Errorf("categoryStatsReport() = %q, want %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := categoryStatsReport(db, &buf, markdownFormat); err != nil {
+		t.Fatal(err)
+	}
+	expected = "| Category | Files | Bytes |\n" +
+		"| --- | ---: | ---: |\n" +
+		"| image | 2 | 30 |\n" +
+		"| code | 1 | 5 |\n" +
+		"| other | 1 | 1 |\n"
+	if buf.String() != expected {
+		t.Errorf("categoryStatsReport() as markdown = %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestLongNamesReport(t *testing.T) {
+	root := t.TempDir()
+	long := strings.Repeat("n", 210) + ".txt"
+	writeFiles(t, root, [][2]string{{long, "long"}, {"short.txt", "short"}})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, WarnLongNames: 200}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := longNamesReport(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "  214 " + filepath.Join(root, long) + "\n"; buf.String() != expected {
+		t.Errorf("longNamesReport() = %q, want %q", buf.String(), expected)
+	}
+
+	// Unchanged files are flagged again with a new limit
+	opts.WarnLongNames = 250
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := longNamesReport(db, &buf); err != nil || buf.Len() != 0 {
+		t.Errorf("with a limit of 250, longNamesReport() = %q, %v, want nothing", buf.String(), err)
+	}
+}
+
+func TestSpecialPermissionsReport(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"suid", "suid"}, {"sgid", "sgid"}, {"plain", "plain"}})
+	if err := os.Chmod(filepath.Join(root, "suid"), 0o755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "sgid"), 0o755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := specialPermissionsReport(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "sgid ") || !strings.HasSuffix(lines[0], filepath.Join(root, "sgid")) ||
+		!strings.HasPrefix(lines[1], "suid ") || !strings.HasSuffix(lines[1], filepath.Join(root, "suid")) {
+		t.Errorf("specialPermissionsReport() = %q, want the sgid and suid files", buf.String())
+	}
+	if strings.Contains(buf.String(), " - ") {
+		t.Errorf("specialPermissionsReport() = %q, want owners", buf.String())
+	}
+
+	// Clearing the bit doesn't change the modification time, but it is noticed
+	if err := os.Chmod(filepath.Join(root, "suid"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := specialPermissionsReport(db, &buf); err != nil || strings.Contains(buf.String(), "suid ") {
+		t.Errorf("after clearing setuid, specialPermissionsReport() = %q, %v", buf.String(), err)
+	}
+}
+
+func TestHardLinkReport(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"snapshot-1/big", "0123456789"}, {"snapshot-1/small", "ab"}, {"alone", "alone"}})
+	for _, link := range [][2]string{
+		{"snapshot-1/big", "snapshot-2/big"}, {"snapshot-1/big", "snapshot-3/big"}, {"snapshot-1/small", "snapshot-2/small"},
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, link[1])), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(root, link[0]), filepath.Join(root, link[1])); err != nil {
+			t.Skip("hard links are not supported:", err)
+		}
+	}
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := hardLinkReport(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	if !strings.HasPrefix(report, "10 bytes, 3 links, ") || !strings.Contains(report, "\n2 bytes, 2 links, ") ||
+		!strings.Contains(report, "  "+filepath.Join(root, "snapshot-3/big")+"\n") || strings.Contains(report, "alone") ||
+		!strings.HasSuffix(report, "Files: 2, links: 5, apparent size: 34, disk usage: 12, saved by hard links: 22\n") {
+		t.Errorf("hardLinkReport() = %q", report)
+	}
+}
+
+func TestFindUnindexedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"a.txt", "a"},
+		{"dir/b.txt", "b"},
+		{"skipped.tmp", "excluded"},
+		{"cache/CACHEDIR.TAG", "Signature: 8a477f597d28d172789f06886806bc55"},
+		{"cache/c.txt", "c"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1, ExcludePatterns: []string{"*.tmp"}}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, root, [][2]string{{"new.txt", "new"}, {"dir/new.txt", "new"}, {"new-dir/d.txt", "d"}})
+	var buf bytes.Buffer
+	if err := findUnindexedFiles(context.Background(), root, db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(root, "dir/new.txt") + "\n" + filepath.Join(root, "new-dir/d.txt") + "\n" +
+		filepath.Join(root, "new.txt") + "\nUnindexed files: 3\n"
+	if buf.String() != expected {
+		t.Errorf("findUnindexedFiles() = %q, want %q", buf.String(), expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := findUnindexedFiles(ctx, root, db, io.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("findUnindexedFiles() with a canceled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, file := range []struct {
+		path string
+		size int64
+	}{{"/data/big.iso", 2e9}, {"/data/notes.txt", 10}, {"/data/video.mkv", 3e9}} {
+		if _, err := db.Exec("INSERT INTO files(path, size) VALUES (?, ?)", file.path, file.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := "SELECT path, size, hash FROM files WHERE size > 1e9 ORDER BY size DESC"
+	var buf bytes.Buffer
+	if err := runQuery(db, query, 0, "text", &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "path             size        hash\n" +
+		"/data/video.mkv  3000000000  NULL\n" +
+		"/data/big.iso    2000000000  NULL\n"
+	if buf.String() != expected {
+		t.Errorf("runQuery(text) = %q, want %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := runQuery(db, query, 1, "json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"path":"/data/video.mkv","size":3000000000,"hash":null}` + "\n"; buf.String() != expected {
+		t.Errorf("runQuery(json, limit 1) = %q, want %q", buf.String(), expected)
+	}
+
+	// Only SELECT statements are run, and nothing can write to the index
+	for _, query := range []string{"DELETE FROM files", "  update files SET size = 0", "PRAGMA user_version = 1", ""} {
+		if err := runQuery(db, query, 0, "text", &bytes.Buffer{}); err == nil {
+			t.Errorf("runQuery(%q) succeeded, want an error", query)
+		}
+	}
+	_ = runQuery(db, "SELECT 1; DELETE FROM files", 0, "text", &bytes.Buffer{})
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&count); err != nil || count != 3 {
+		t.Errorf("after the rejected statements, got %d files, %v, want 3", count, err)
+	}
+	if _, err := db.Exec("UPDATE files SET size = 1 WHERE path = '/data/notes.txt'"); err != nil {
+		t.Errorf("the index is still read-only after runQuery: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// crawlParameters is what the runs table records for a crawl: the flags given on the command line and the roots
+type crawlParameters struct {
+	Flags map[string]string `json:"flags"`
+	Roots []string          `json:"roots"`
+}
+
+// newCrawlParameters collects the flags that were set in flags, and the roots to crawl
+func newCrawlParameters(flags *flag.FlagSet, roots []string) crawlParameters {
+	params := crawlParameters{Flags: make(map[string]string), Roots: roots}
+	flags.Visit(func(f *flag.Flag) {
+		params.Flags[f.Name] = f.Value.String()
+	})
+	return params
+}
+
+// recordRoot adds root, as stored, to the roots table, or updates when and where it was last crawled and by which
+// run, at now. location is the path of the root on the file system.
+func recordRoot(db execQuerier, root, location string, runId int64, now time.Time) error {
+	crawled := now.Format(time.RFC3339)
+	_, err := db.Exec(`
+	INSERT INTO roots(path, first_crawled, last_crawled, last_run_id, location) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(path) DO UPDATE
+	SET last_crawled=excluded.last_crawled, last_run_id=excluded.last_run_id, location=excluded.location`,
+		root, crawled, crawled, runId, location)
+	return err
+}
+
+// rootRecorded reports whether root, as stored, is in the roots table. Crawls call it before recordRoot, to find
+// out whether they are the initial crawl of the root.
+func rootRecorded(db execQuerier, root string) (bool, error) {
+	var recorded bool
+	err := db.QueryRow("SELECT 1 FROM roots WHERE path = ?", root).Scan(&recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return recorded, err
+}
+
+// firstSeenTime returns the first_seen of the rows that a crawl inserts at now. It is NULL during the initial crawl
+// of a root, whose files were there before the index, so that they aren't all reported as new by recent.
+func firstSeenTime(initialCrawl bool, now time.Time) sql.NullString {
+	return sql.NullString{String: now.UTC().Format(time.RFC3339), Valid: !initialCrawl}
+}
+
+// knownRoots returns the roots recorded in the database
+func knownRoots(db crawlDB) ([]string, error) {
+	rows, err := db.Query("SELECT path FROM roots ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roots []string
+	for rows.Next() {
+		var root string
+		if err := rows.Scan(&root); err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, rows.Err()
+}
+
+// rootOf returns the root that contains path most closely, or "" if none does
+func rootOf(path string, roots []string) string {
+	best := ""
+	for _, root := range roots {
+		if len(root) > len(best) && isUnderRoots(path, []string{root}) {
+			best = root
+		}
+	}
+	return best
+}
+
+// requireKnownRoot returns an error unless path is a recorded root or below one. Commands that delete rows
+// must call it first, so that a mistyped directory can't make them treat a whole tree as gone.
+func requireKnownRoot(db crawlDB, path string) error {
+	roots, err := knownRoots(db)
+	if err != nil {
+		return err
+	}
+	if !isUnderRoots(filepath.Clean(path), roots) {
+		return fmt.Errorf("%s is not below any root crawled into this database", path)
+	}
+	return nil
+}
+
+// runRoots implements the roots subcommand, which lists the roots the database covers
+func runRoots(args []string) error {
+	var dbFile string
+
+	flags := flag.NewFlagSet("roots", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	_ = flags.Parse(args)
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	return rootsReport(db, os.Stdout)
+}
+
+// rootsReport writes each recorded root with when it was first and last crawled, and the flags of the last crawl
+func rootsReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT roots.path, COALESCE(roots.location, roots.path), roots.first_crawled, roots.last_crawled,
+	       roots.last_run_id, runs.parameters
+	FROM roots LEFT JOIN runs ON roots.last_run_id = runs.id
+	ORDER BY roots.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root, location, firstCrawled, lastCrawled string
+		var runId int64
+		var parameters sql.NullString
+		if err := rows.Scan(&root, &location, &firstCrawled, &lastCrawled, &runId, &parameters); err != nil {
+			return err
+		}
+		flags := "unknown"
+		if parameters.Valid {
+			var params crawlParameters
+			if err := json.Unmarshal([]byte(parameters.String), &params); err != nil {
+				return fmt.Errorf("parameters of run %d: %w", runId, err)
+			}
+			flags = formatFlags(params.Flags)
+		}
+		if location != root {
+			root += " (last crawled at " + location + ")"
+		}
+		_, err := fmt.Fprintf(w, "%s\n  first crawled %s, last crawled %s (run %d)\n  flags: %s\n",
+			root, firstCrawled, lastCrawled, runId, flags)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// formatFlags formats flags as they would be given on the command line, sorted by name
+func formatFlags(flags map[string]string) string {
+	if len(flags) == 0 {
+		return "none"
+	}
+	var formatted []string
+	for name, value := range flags {
+		formatted = append(formatted, fmt.Sprintf("-%s=%s", name, value))
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, " ")
+}
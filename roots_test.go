@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCrawlParameters(t *testing.T) {
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	flags.Int("max-depth", -1, "")
+	flags.Bool("acls", false, "")
+	flags.String("db", "index.sqlite", "")
+	if err := flags.Parse([]string{"-max-depth", "2", "-acls", "/data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	params := newCrawlParameters(flags, flags.Args())
+	expected := crawlParameters{Flags: map[string]string{"max-depth": "2", "acls": "true"}, Roots: []string{"/data"}}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("newCrawlParameters() = %+v, want %+v", params, expected)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	db := newTestDatabase(t)
+
+	if err := requireKnownRoot(db, "/data"); err == nil {
+		t.Error("requireKnownRoot() in an empty database succeeded")
+	}
+
+	params := crawlParameters{Flags: map[string]string{"max-depth": "2", "acls": "true"}, Roots: []string{"/data"}}
+	runId, err := startRun(db, "crawl", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded, err := rootRecorded(db, "/data"); err != nil || recorded {
+		t.Errorf("rootRecorded() before recording = %v, %v, want false", recorded, err)
+	}
+	first := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 2 {
+		if err := recordRoot(db, "/data", "/data", runId, first.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if recorded, err := rootRecorded(db, "/data"); err != nil || !recorded {
+		t.Errorf("rootRecorded() after recording = %v, %v, want true", recorded, err)
+	}
+	var firstCrawled, lastCrawled string
+	err = db.QueryRow("SELECT first_crawled, last_crawled FROM roots WHERE path = '/data'").
+		Scan(&firstCrawled, &lastCrawled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstCrawled != "2024-01-02T03:04:05Z" || lastCrawled != "2024-01-02T04:04:05Z" {
+		t.Errorf("got first and last crawled %v and %v, want the times of the clock", firstCrawled, lastCrawled)
+	}
+
+	for _, tc := range []struct {
+		path  string
+		known bool
+	}{
+		{"/data", true},
+		{"/data/photos/", true},
+		{"/dat", false},
+		{"/data2", false},
+		{"/", false},
+	} {
+		if err := requireKnownRoot(db, tc.path); (err == nil) != tc.known {
+			t.Errorf("requireKnownRoot(%q) = %v, want known %v", tc.path, err, tc.known)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := rootsReport(db, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[0] != "/data" || lines[2] != "  flags: -acls=true -max-depth=2" {
+		t.Errorf("rootsReport() = %q", out.String())
+	}
+}
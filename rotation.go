@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// databaseFullError stops a crawl when the database reaches its maximum size
+type databaseFullError struct {
+	LastPath string // The last path processed before stopping
+}
+
+func (e *databaseFullError) Error() string {
+	return "database size limit reached after " + e.LastPath
+}
+
+// databaseSize returns the size of the database file together with its write-ahead log
+func databaseSize(dbFile string) (int64, error) {
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if wal, err := os.Stat(dbFile + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
+}
+
+// rotatedDBFile returns the name of the n-th successor of dbFile, e.g. index.001.sqlite for index.sqlite
+func rotatedDBFile(dbFile string, n int) string {
+	ext := filepath.Ext(dbFile)
+	return fmt.Sprintf("%s.%03d%s", strings.TrimSuffix(dbFile, ext), n, ext)
+}
+
+// rotateDatabase closes db and opens the first successor of baseDBFile that isn't full yet, recording the
+// roll-over in the settings of both databases
+func rotateDatabase(db *sql.DB, dbFile, baseDBFile string, maxSize int64) (*sql.DB, string, error) {
+	var nextDBFile string
+	for n := 1; ; n++ {
+		nextDBFile = rotatedDBFile(baseDBFile, n)
+		size, err := databaseSize(nextDBFile)
+		if err != nil || size < maxSize {
+			break
+		}
+	}
+
+	err := setSetting(db, "next_database", nextDBFile)
+	if err != nil {
+		return nil, "", err
+	}
+	closeDatabase(db)
+
+	log.Println("Database", dbFile, "reached its maximum size, continuing in", nextDBFile)
+	db, err = openDatabase(nextDBFile)
+	if err != nil {
+		return nil, "", err
+	}
+	err = setSetting(db, "previous_database", dbFile)
+	if err != nil {
+		closeDatabase(db)
+		return nil, "", err
+	}
+	return db, nextDBFile, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// startRun records the start of a command in the runs table, with its parameters encoded as JSON,
+// and returns the ID of the run
+func startRun(db *sql.DB, command string, parameters any) (int64, error) {
+	encoded, err := json.Marshal(parameters)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("INSERT INTO runs(command, started_at, parameters) VALUES (?, ?, ?)",
+		command, time.Now().Format(time.RFC3339), string(encoded))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// finishRun records the end of a run together with its results encoded as JSON
+func finishRun(db *sql.DB, id int64, results any) error {
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE runs SET finished_at=?, results=? WHERE id=?",
+		time.Now().Format(time.RFC3339), string(encoded), id)
+	return err
+}
+
+// checkCrawlRun returns an error unless id is the ID of a crawl in the runs table
+func checkCrawlRun(db *sql.DB, id int64) error {
+	var command string
+	err := db.QueryRow("SELECT command FROM runs WHERE id=?", id).Scan(&command)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("there is no run %d", id)
+	} else if err == nil && command != "crawl" {
+		return fmt.Errorf("run %d is a %s, not a crawl", id, command)
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// scanTransaction is the connection of a crawl with -transactional-scan, which runs in a single BEGIN IMMEDIATE
+// transaction, so that other processes reading the database see the index as it was before the crawl until it
+// commits, rather than a mix of old and new rows.
+//
+// The tradeoff is that the write lock is held for the whole crawl, so that any other writer, such as another crawl
+// or rewrite-prefix, fails or waits until it commits. SQLite also needs an exclusive lock, which blocks readers too,
+// once the changes outgrow its page cache, and everything is lost if the crawl is interrupted. This is only
+// practical for crawls of minutes. For long crawls, the better alternative is WAL mode, in which readers don't
+// block the writer nor the writer the readers, with a transaction per directory, so that readers see each directory
+// either before or after it was crawled.
+type scanTransaction struct {
+	conn *sql.Conn
+}
+
+// beginScanTransaction takes a connection from db and begins the transaction of the crawl on it
+func beginScanTransaction(db *sql.DB) (*scanTransaction, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &scanTransaction{conn: conn}, nil
+}
+
+func (t *scanTransaction) Exec(query string, args ...any) (sql.Result, error) {
+	return t.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (t *scanTransaction) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (t *scanTransaction) QueryRow(query string, args ...any) *sql.Row {
+	return t.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// Commit commits the transaction and returns the connection to db
+func (t *scanTransaction) Commit() error {
+	_, err := t.Exec("COMMIT")
+	if closeErr := t.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Rollback discards everything the crawl wrote and returns the connection to db
+func (t *scanTransaction) Rollback() error {
+	_, err := t.Exec("ROLLBACK")
+	if closeErr := t.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScanTransaction(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"a/1.txt", "one"}, {"a/2.txt", "two"}, {"b/3.txt", "three"}})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, ChunkThreshold: 1}
+	countFiles := func() int {
+		t.Helper()
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE hash IS NOT NULL").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Other connections don't see a crawl until it commits, nor one that is rolled back
+	for _, commit := range []bool{false, true} {
+		tx, err := beginScanTransaction(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processDirectory(root, tx, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := updateTreeHashes(tx, root); err != nil {
+			t.Fatal(err)
+		}
+		if count := countFiles(); count != 0 {
+			t.Errorf("%d files are visible during the crawl, want 0", count)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := countFiles(); count != 3 {
+		t.Errorf("%d files are visible after the commit, want 3", count)
+	}
+	var chunks, treeHashes int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM chunks), (SELECT COUNT(tree_hash) FROM folders)`).
+		Scan(&chunks, &treeHashes)
+	if err != nil || chunks != 3 || treeHashes == 0 {
+		t.Errorf("got %d chunks and %d tree hashes, %v, want 3 chunks and the tree hashes", chunks, treeHashes, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// getSetting returns the value stored for key in the settings table, or "" if there is none
+func getSetting(db execQuerier, key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func setSetting(db execQuerier, key, value string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO settings(key, value) VALUES (?, ?)", key, value)
+	return err
+}
+
+// hashStorage is how hashes are stored in the open database: "hex" for hex-encoded TEXT, or "blob" for the
+// raw digest bytes, which halves the size of the hash column and its index
+var hashStorage = "hex"
+
+// hashHexColumn selects the hash as hex, regardless of how it is stored
+const hashHexColumn = "CASE typeof(hash) WHEN 'blob' THEN lower(hex(hash)) ELSE hash END"
+
+// loadHashStorage sets hashStorage from the database settings
+func loadHashStorage(db *sql.DB) error {
+	storage, err := getSetting(db, "hash_storage")
+	if err != nil {
+		return err
+	}
+	if storage != "" {
+		hashStorage = storage
+	}
+	return nil
+}
+
+// initHashStorage makes sure the database uses the requested hash storage, and records it for later runs. An empty
+// request keeps the storage of the database, or uses hex for a new one. The storage of a database can't be changed
+// once it contains hashes, except by convert-hashes.
+func initHashStorage(db *sql.DB, requested string) error {
+	if requested != "" && requested != "hex" && requested != "blob" {
+		return fmt.Errorf("unknown hash storage %q", requested)
+	}
+	storage, err := getSetting(db, "hash_storage")
+	if err != nil {
+		return err
+	}
+	if storage == "" {
+		// Databases created before the setting existed always have hex hashes
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM files WHERE typeof(hash) = 'text'").Scan(&count)
+		if err != nil {
+			return err
+		}
+		storage = requested
+		if count > 0 || requested == "" {
+			storage = "hex"
+		}
+	}
+	if requested == "" {
+		requested = storage
+	}
+	if storage != requested && requested == "blob" {
+		return fmt.Errorf("the database stores hashes as %s, but %s was requested; convert them with the "+
+			"convert-hashes command first", storage, requested)
+	} else if storage != requested {
+		return fmt.Errorf("the database stores hashes as %s, but %s was requested", storage, requested)
+	}
+	hashStorage = storage
+	return setSetting(db, "hash_storage", storage)
+}
+
+// hashValue converts a hex hash to the value stored in the database
+func hashValue(hash sql.NullString) any {
+	if !hash.Valid || hashStorage != "blob" {
+		return hash
+	}
+	digest, err := hex.DecodeString(hash.String)
+	if err != nil {
+		return hash
+	}
+	return digest
+}
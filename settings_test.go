@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestBlobHashStorage(t *testing.T) {
+	db := newTestDatabase(t)
+	t.Cleanup(func() { hashStorage = "hex" })
+
+	if err := initHashStorage(db, "blob"); err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.Repeat("0f", 32)
+	f := &FileInfo{
+		Path: sql.NullString{String: "/a/file", Valid: true},
+		Hash: sql.NullString{String: hash, Valid: true},
+	}
+	if err := f.upsert(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var storedType, storedHash string
+	err := db.QueryRow("SELECT typeof(hash), "+hashHexColumn+" FROM files WHERE path=?", "/a/file").
+		Scan(&storedType, &storedHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedType != "blob" || storedHash != hash {
+		t.Errorf("got %s hash %q, want blob hash %q", storedType, storedHash, hash)
+	}
+
+	if err := initHashStorage(db, "hex"); err == nil {
+		t.Error("initHashStorage() succeeded switching a blob database to hex")
+	}
+	// Without a requested storage, the database keeps its own
+	hashStorage = "hex"
+	if err := initHashStorage(db, ""); err != nil || hashStorage != "blob" {
+		t.Errorf("initHashStorage(\"\") on a blob database = %v, storage %s, want blob", err, hashStorage)
+	}
+	if err := initHashStorage(newTestDatabase(t), ""); err != nil || hashStorage != "hex" {
+		t.Errorf("initHashStorage(\"\") on a new database = %v, storage %s, want hex", err, hashStorage)
+	}
+}
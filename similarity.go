@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// similarityAlgorithm computes digests of file contents that are close for files that are mostly the same, unlike
+// cryptographic hashes. Digests are computed by a hash.Hash during the hashing read, and Sum returns them as text.
+type similarityAlgorithm struct {
+	New     func() hash.Hash
+	Compare func(a, b string) int // Similarity of two digests from 0 to 100
+}
+
+// similarityAlgorithms maps the names accepted by -similarity-digest to their implementations
+var similarityAlgorithms = map[string]similarityAlgorithm{
+	"ctph": {New: newCTPH, Compare: compareCTPH},
+}
+
+// newSimilarityDigest returns a new digest of the named algorithm, or nil for "" and unknown names
+func newSimilarityDigest(name string) hash.Hash {
+	if algorithm, ok := similarityAlgorithms[name]; ok {
+		return algorithm.New()
+	}
+	return nil
+}
+
+// teeHash is a hash that also writes what it hashes to w, so that a second digest is computed from the same read
+type teeHash struct {
+	hash.Hash
+	w io.Writer
+}
+
+func (h teeHash) Write(p []byte) (int, error) {
+	_, _ = h.w.Write(p)
+	return h.Hash.Write(p)
+}
+
+const (
+	ctphWindow          = 7  // Bytes covered by the rolling hash
+	ctphMinBlockSize    = 3  // Block size of the first level, doubled at each following level
+	ctphLevels          = 31 // Number of block sizes tracked, up to 3 GiB
+	ctphSignatureLength = 64 // Maximum length of the first signature, the second one is half as long
+	ctphPieceInit       = 0x28021967
+	ctphPiecePrime      = 0x01000193
+)
+
+const ctphAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// ctph is a context-triggered piecewise hash in the style of ssdeep. A rolling hash over the last ctphWindow bytes
+// cuts the contents into pieces wherever it hits a value determined by the block size, and each piece adds one
+// character to the signature. Since the cuts depend on the contents, an insertion or deletion only changes the
+// signature around it. The block size is chosen at the end for a signature of 32 to 64 characters, so every level
+// is tracked during the read, except for those that have become too small. The digests are not compatible with
+// ssdeep's.
+type ctph struct {
+	window     [ctphWindow]byte
+	h1, h2, h3 uint32
+	n          uint32
+	pieces     [ctphLevels]uint32
+	signatures [ctphLevels][]byte
+	total      int64
+	low        int // Levels below this one are no longer tracked
+}
+
+func newCTPH() hash.Hash {
+	h := &ctph{}
+	h.Reset()
+	return h
+}
+
+func (h *ctph) Reset() {
+	*h = ctph{}
+	for k := range h.pieces {
+		h.pieces[k] = ctphPieceInit
+	}
+}
+
+func (h *ctph) Size() int      { return 0 } // Digests have a variable length
+func (h *ctph) BlockSize() int { return 1 }
+
+// roll adds c to the rolling hash and returns its new value
+func (h *ctph) roll(c byte) uint32 {
+	h.h2 -= h.h1
+	h.h2 += ctphWindow * uint32(c)
+	h.h1 += uint32(c)
+	h.h1 -= uint32(h.window[h.n%ctphWindow])
+	h.window[h.n%ctphWindow] = c
+	h.n++
+	h.h3 = h.h3<<5 ^ uint32(c)
+	return h.h1 + h.h2 + h.h3
+}
+
+func (h *ctph) Write(p []byte) (int, error) {
+	for _, c := range p {
+		r := h.roll(c)
+		for k := h.low; k < ctphLevels; k++ {
+			h.pieces[k] = h.pieces[k]*ctphPiecePrime ^ uint32(c)
+		}
+		// A cut at one level is also a cut at all smaller levels, since the block sizes double
+		for k := h.low; k < ctphLevels; k++ {
+			blockSize := uint32(ctphMinBlockSize) << k
+			if r%blockSize != blockSize-1 {
+				break
+			}
+			if len(h.signatures[k]) < ctphSignatureLength-1 {
+				h.signatures[k] = append(h.signatures[k], ctphAlphabet[h.pieces[k]%64])
+				h.pieces[k] = ctphPieceInit
+			}
+		}
+	}
+	h.total += int64(len(p))
+	// Levels far below the block size the total calls for will not be chosen
+	for h.low < ctphLevels-2 && int64(ctphMinBlockSize)<<(h.low+3)*ctphSignatureLength < h.total {
+		h.low++
+	}
+	return len(p), nil
+}
+
+// signature returns the signature of level k, including the piece after the last cut, truncated to length
+func (h *ctph) signature(k, length int) string {
+	signature := string(h.signatures[k])
+	if h.pieces[k] != ctphPieceInit {
+		signature += string(ctphAlphabet[h.pieces[k]%64])
+	}
+	return signature[:min(len(signature), length)]
+}
+
+// Sum appends the digest blockSize:signature:signature at twice the block size to b
+func (h *ctph) Sum(b []byte) []byte {
+	k := h.low
+	for k < ctphLevels-1 && int64(ctphMinBlockSize)<<k*ctphSignatureLength < h.total {
+		k++
+	}
+	for k > h.low && len(h.signature(k, ctphSignatureLength)) < ctphSignatureLength/2 {
+		k--
+	}
+	second := ""
+	if k+1 < ctphLevels {
+		second = h.signature(k+1, ctphSignatureLength/2)
+	}
+	digest := fmt.Sprintf("%d:%s:%s", ctphMinBlockSize<<k, h.signature(k, ctphSignatureLength), second)
+	return append(b, digest...)
+}
+
+// parseCTPH splits a digest into its block size and signatures
+func parseCTPH(digest string) (blockSize int64, first, second string, ok bool) {
+	parts := strings.Split(digest, ":")
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	blockSize, err := strconv.ParseInt(parts[0], 10, 64)
+	return blockSize, parts[1], parts[2], err == nil && blockSize >= ctphMinBlockSize
+}
+
+// compareCTPH returns the similarity of two ctph digests from 0 to 100. Only signatures of the same block size
+// can be compared, so digests whose block sizes differ by more than a factor of 2 have a similarity of 0.
+func compareCTPH(a, b string) int {
+	aSize, a1, a2, okA := parseCTPH(a)
+	bSize, b1, b2, okB := parseCTPH(b)
+	switch {
+	case !okA || !okB:
+		return 0
+	case aSize == bSize:
+		return max(compareSignatures(a1, b1, aSize), compareSignatures(a2, b2, 2*aSize))
+	case 2*aSize == bSize:
+		return compareSignatures(a2, b1, bSize)
+	case aSize == 2*bSize:
+		return compareSignatures(a1, b2, aSize)
+	}
+	return 0
+}
+
+// compareSignatures scores two signatures of the given block size from their edit distance. Signatures without
+// a common substring of ctphWindow characters score 0, and signatures of small files can't score higher than their
+// length allows, to avoid matches between short signatures by chance.
+func compareSignatures(a, b string, blockSize int64) int {
+	a, b = squeezeRuns(a), squeezeRuns(b)
+	if a == b && a != "" {
+		return 100
+	}
+	if !haveCommonSubstring(a, b, ctphWindow) {
+		return 0
+	}
+	score := 100 - editDistance(a, b)*100/(len(a)+len(b))
+	if limit := int64(min(len(a), len(b))) * blockSize / ctphMinBlockSize; int64(score) > limit {
+		score = int(limit)
+	}
+	return score
+}
+
+// squeezeRuns shortens runs of more than three identical characters to three, since they carry little information
+func squeezeRuns(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if i >= 3 && s[i] == s[i-1] && s[i] == s[i-2] && s[i] == s[i-3] {
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// haveCommonSubstring reports whether a and b have a common substring of length n
+func haveCommonSubstring(a, b string, n int) bool {
+	substrings := make(map[string]bool)
+	for i := 0; i+n <= len(a); i++ {
+		substrings[a[i:i+n]] = true
+	}
+	for i := 0; i+n <= len(b); i++ {
+		if substrings[b[i:i+n]] {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance returns the number of insertions and deletions that turn a into b, counting a substitution as both
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution += 2
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, substitution)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// similarPair is a pair of files reported by the similar command
+type similarPair struct {
+	Score int
+	A, B  string
+}
+
+// runSimilar implements the similar subcommand, which lists pairs of files with close similarity digests
+func runSimilar(args []string) error {
+	var dbFile string
+	var minScore int
+	var sizeRatio float64
+
+	flags := flag.NewFlagSet("similar", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.IntVar(&minScore, "min-score", 60, "Minimum similarity from 0 to 100 of the pairs to list")
+	flags.Float64Var(&sizeRatio, "size-ratio", 2,
+		"Only compare files whose sizes differ by at most this factor, which keeps the number of comparisons down")
+	_ = flags.Parse(args)
+	if sizeRatio < 1 {
+		return fmt.Errorf("size ratio must be at least 1, got %v", sizeRatio)
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	pairs, err := findSimilarFiles(db, minScore, sizeRatio)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		fmt.Printf("%3d %s\n    %s\n", pair.Score, pair.A, pair.B)
+	}
+	return nil
+}
+
+// findSimilarFiles compares the similarity digests of the files whose sizes are within sizeRatio of each other,
+// and returns the pairs scoring at least minScore, most similar first. Exact copies, with equal hashes, are left to
+// the duplicate reports.
+func findSimilarFiles(db *sql.DB, minScore int, sizeRatio float64) ([]similarPair, error) {
+	rows, err := db.Query(`
+	SELECT path, COALESCE(size, 0), fuzzy_hash, fuzzy_algorithm, COALESCE(` + hashHexColumn + `, '') FROM files
+	WHERE fuzzy_hash IS NOT NULL AND exclusion_pattern IS NULL
+	ORDER BY size, path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type digest struct {
+		path, digest, algorithm, hash string
+		size                          int64
+	}
+	var digests []digest
+	for rows.Next() {
+		var d digest
+		if err := rows.Scan(&d.path, &d.size, &d.digest, &d.algorithm, &d.hash); err != nil {
+			return nil, err
+		}
+		digests = append(digests, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pairs []similarPair
+	for i, a := range digests {
+		for _, b := range digests[i+1:] {
+			if float64(b.size) > float64(a.size)*sizeRatio {
+				break
+			}
+			algorithm, ok := similarityAlgorithms[a.algorithm]
+			if !ok || a.algorithm != b.algorithm || (a.hash != "" && a.hash == b.hash) {
+				continue
+			}
+			if score := algorithm.Compare(a.digest, b.digest); score >= minScore {
+				pairs = append(pairs, similarPair{Score: score, A: a.path, B: b.path})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Score > pairs[j].Score })
+	return pairs, nil
+}
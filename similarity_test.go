@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ctphDigest returns the ctph digest of data
+func ctphDigest(data []byte) string {
+	h := newCTPH()
+	_, _ = h.Write(data)
+	return string(h.Sum(nil))
+}
+
+// testText returns size bytes of random lowercase words
+func testText(rng *rand.Rand, size int) []byte {
+	var b strings.Builder
+	for b.Len() < size {
+		for n := 1 + rng.Intn(8); n > 0; n-- {
+			b.WriteByte(byte('a' + rng.Intn(26)))
+		}
+		b.WriteByte(" \n"[rng.Intn(2)])
+	}
+	return []byte(b.String()[:size])
+}
+
+func TestCTPH(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	original := testText(rng, 200_000)
+
+	// An edit in the middle only changes the signature around it
+	edited := append(append(append([]byte{}, original[:100_000]...), "an inserted sentence"...),
+		original[100_500:]...)
+	if score := compareCTPH(ctphDigest(original), ctphDigest(edited)); score < 90 {
+		t.Errorf("an edited copy scores %d, want at least 90", score)
+	}
+	// Appending a quarter more only changes the end of the signatures
+	appended := append(append([]byte{}, original...), testText(rng, 50_000)...)
+	if score := compareCTPH(ctphDigest(original), ctphDigest(appended)); score < 70 {
+		t.Errorf("a copy with data appended scores %d, want at least 70", score)
+	}
+	if score := compareCTPH(ctphDigest(original), ctphDigest(testText(rng, 200_000))); score != 0 {
+		t.Errorf("unrelated data scores %d, want 0", score)
+	}
+	if score := compareCTPH(ctphDigest(original), ctphDigest(original)); score != 100 {
+		t.Errorf("the same data scores %d, want 100", score)
+	}
+
+	// Digests are the same whatever the writes are split into, and after a reset
+	h := newCTPH()
+	_, _ = h.Write([]byte("something else"))
+	h.Reset()
+	for i := 0; i < len(original); i += 1000 {
+		_, _ = h.Write(original[i:min(i+1000, len(original))])
+	}
+	if digest := string(h.Sum(nil)); digest != ctphDigest(original) {
+		t.Errorf("digest written in parts = %s, want %s", digest, ctphDigest(original))
+	}
+
+	for _, digest := range []string{"", "3:abc", "x:abc:def", "1:abcdefgh:abcdefgh"} {
+		if score := compareCTPH(digest, digest); score != 0 {
+			t.Errorf("compareCTPH(%q) = %d, want 0 for an invalid digest", digest, score)
+		}
+	}
+}
+
+func TestSimilarFiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	original := testText(rng, 100_000)
+	edited := append(append([]byte{}, original[:50_000]...), original[50_200:]...)
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"report.txt", string(original)},
+		{"copy/report.txt", string(original)},
+		{"report-v2.txt", string(edited)},
+		{"other.txt", string(testText(rng, 100_000))},
+		{"small.txt", "small"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files crawled without a digest are hashed again to get one
+	opts.SimilarityDigest = "ctph"
+	stats := NewProcessStats()
+	if err := processDirectory(root, db, stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE fuzzy_algorithm = 'ctph'").Scan(&count)
+	if err != nil || count != 5 {
+		t.Fatalf("got %d files with a digest, %v, want 5", count, err)
+	}
+
+	pairs, err := findSimilarFiles(db, 60, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Exact copies are not reported, so each copy of report.txt is paired with report-v2.txt
+	if len(pairs) != 2 {
+		t.Fatalf("got %+v, want 2 pairs", pairs)
+	}
+	for _, pair := range pairs {
+		if filepath.Base(pair.A) != "report-v2.txt" && filepath.Base(pair.B) != "report-v2.txt" {
+			t.Errorf("unexpected pair %+v", pair)
+		}
+	}
+}
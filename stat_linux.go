@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"syscall"
+)
+
+// getDeviceID returns the ID of the device containing the file
+func getDeviceID(info os.FileInfo) uint64 {
+	if statT, ok := info.Sys().(*syscall.Stat_t); ok {
+		return statT.Dev
+	}
+	return 0
+}
+
+// getInode returns the inode number of the file and its number of hard links, or zeros if they are unknown
+func getInode(info os.FileInfo) (inode, links uint64) {
+	if statT, ok := info.Sys().(*syscall.Stat_t); ok {
+		return statT.Ino, uint64(statT.Nlink)
+	}
+	return 0, 0
+}
+
+// getOwner returns the user and group IDs of the owner of the file, or NULLs if they are unknown
+func getOwner(info os.FileInfo) (uid, gid sql.NullInt64) {
+	if statT, ok := info.Sys().(*syscall.Stat_t); ok {
+		return sql.NullInt64{Int64: int64(statT.Uid), Valid: true}, sql.NullInt64{Int64: int64(statT.Gid), Valid: true}
+	}
+	return uid, gid
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errorClasses are the classes of the stored errors, by a fragment of their message, in the order they are tested
+var errorClasses = []struct {
+	Class     string
+	Fragments []string
+}{
+	{"short-read", []string{"short read"}},
+	{"fifo", []string{"FIFO"}},
+	{"permission", []string{"permission denied", "operation not permitted"}},
+	{"missing", []string{"no such file or directory"}},
+	{"io", []string{"input/output error"}},
+}
+
+// errorClass returns the class of a stored error message, or other
+func errorClass(message string) string {
+	for _, c := range errorClasses {
+		for _, fragment := range c.Fragments {
+			if strings.Contains(message, fragment) {
+				return c.Class
+			}
+		}
+	}
+	return "other"
+}
+
+// errorFilter selects the stored errors listed or cleared by the errors command
+type errorFilter struct {
+	Class     string        // See errorClass, "" for all
+	Prefix    string        // Only paths equal to or below this one, "" for all
+	OlderThan time.Duration // Only errors recorded at least this long ago, 0 for all
+	NewerThan time.Duration // Only errors recorded less than this long ago, 0 for all
+	RunId     int64         // Only errors recorded by this crawl, 0 for all
+}
+
+// storedError is a file with a stored error. Errors stored before their time and crawl were recorded have
+// neither, and count as older than any age.
+type storedError struct {
+	Path       string
+	Error      string
+	Class      string
+	RecordedAt string
+	RunId      int64
+}
+
+// runErrors implements the errors subcommand, which lists, counts or clears the stored errors
+func runErrors(args []string) error {
+	var dbFile string
+	var olderThan, newerThan string
+	var groupBy string
+	var format string
+	var clear, yes bool
+	var filter errorFilter
+
+	flags := flag.NewFlagSet("errors", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.StringVar(&filter.Class, "class", "",
+		"Only errors of this class: permission, missing, io, short-read, fifo or other")
+	flags.StringVar(&filter.Prefix, "prefix", "", "Only errors of paths equal to or below this path")
+	flags.StringVar(&olderThan, "older-than", "", "Only errors recorded at least this long ago, e.g. 30d")
+	flags.StringVar(&newerThan, "newer-than", "", "Only errors recorded less than this long ago, e.g. 12h")
+	flags.Int64Var(&filter.RunId, "run", 0, "Only errors recorded by the crawl with this ID in the runs table")
+	flags.StringVar(&groupBy, "group-by", "", "Count the errors by class or by dir instead of listing them")
+	flags.StringVar(&format, "format", textFormat, "Output: text, or markdown for a GitHub-flavored table")
+	flags.BoolVar(&clear, "clear", false,
+		"Clear the matching errors, so that the next crawl retries their paths; only counts them without -yes")
+	flags.BoolVar(&yes, "yes", false, "Confirm -clear")
+	_ = flags.Parse(args)
+
+	if err := checkReportFormat(format); err != nil {
+		return err
+	}
+	if groupBy != "" && groupBy != "class" && groupBy != "dir" {
+		return fmt.Errorf("unknown -group-by %q, want class or dir", groupBy)
+	}
+	if filter.Class != "" && filter.Class != "other" && !knownErrorClass(filter.Class) {
+		return fmt.Errorf("unknown error class %q", filter.Class)
+	}
+	if yes && !clear {
+		return errors.New("-yes only confirms -clear")
+	}
+	var err error
+	if olderThan != "" {
+		if filter.OlderThan, err = parseAge(olderThan); err != nil {
+			return err
+		}
+	}
+	if newerThan != "" {
+		if filter.NewerThan, err = parseAge(newerThan); err != nil {
+			return err
+		}
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	stored, err := listStoredErrors(db, filter, time.Now())
+	if err != nil {
+		return err
+	}
+	if clear {
+		if !yes {
+			fmt.Printf("Would clear %d errors, run again with -yes to clear them\n", len(stored))
+			return nil
+		}
+		cleared, err := clearStoredErrors(db, stored)
+		fmt.Printf("Cleared: %d\n", cleared)
+		return err
+	}
+	if groupBy != "" {
+		return writeErrorGroups(os.Stdout, stored, groupBy, format)
+	}
+	return writeStoredErrors(os.Stdout, stored, format)
+}
+
+// knownErrorClass returns whether class is one of errorClasses
+func knownErrorClass(class string) bool {
+	for _, c := range errorClasses {
+		if c.Class == class {
+			return true
+		}
+	}
+	return false
+}
+
+// listStoredErrors returns the stored errors matching filter, by path
+func listStoredErrors(db *sql.DB, filter errorFilter, now time.Time) ([]storedError, error) {
+	query := "SELECT path, error, COALESCE(error_at, ''), COALESCE(error_run_id, 0) FROM files WHERE error IS NOT NULL"
+	var args []any
+	if filter.Prefix != "" {
+		query += " AND " + underRootCondition
+		args = append(args, underRootArgs(filter.Prefix)...)
+	}
+	if filter.RunId != 0 {
+		query += " AND error_run_id = ?"
+		args = append(args, filter.RunId)
+	}
+	rows, err := db.Query(query+" ORDER BY path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stored []storedError
+	for rows.Next() {
+		var e storedError
+		if err := rows.Scan(&e.Path, &e.Error, &e.RecordedAt, &e.RunId); err != nil {
+			return nil, err
+		}
+		e.Class = errorClass(e.Error)
+		if filter.Class != "" && e.Class != filter.Class {
+			continue
+		}
+		if filter.OlderThan > 0 || filter.NewerThan > 0 {
+			age := time.Duration(1<<63 - 1)
+			if recordedAt, err := time.Parse(time.RFC3339, e.RecordedAt); err == nil {
+				age = now.Sub(recordedAt)
+			}
+			if (filter.OlderThan > 0 && age < filter.OlderThan) || (filter.NewerThan > 0 && age >= filter.NewerThan) {
+				continue
+			}
+		}
+		stored = append(stored, e)
+	}
+	return stored, rows.Err()
+}
+
+// clearStoredErrors clears the errors of the given files, in a single transaction, and returns how many were
+// cleared
+func clearStoredErrors(db *sql.DB, stored []storedError) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var cleared int64
+	for _, e := range stored {
+		result, err := tx.Exec(
+			"UPDATE files SET error = NULL, error_at = NULL, error_run_id = NULL WHERE path = ? AND error IS NOT NULL",
+			e.Path)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		cleared += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return cleared, nil
+}
+
+// writeStoredErrors writes a row per stored error
+func writeStoredErrors(w io.Writer, stored []storedError, format string) error {
+	table := reportTable{Header: []string{"Class", "Recorded", "Run", "Path", "Error"}, Text: "%-10s %-20s %6s  %s  %s\n"}
+	for _, e := range stored {
+		recordedAt, runId := e.RecordedAt, ""
+		if recordedAt == "" {
+			recordedAt = "-"
+		}
+		if e.RunId != 0 {
+			runId = fmt.Sprint(e.RunId)
+		}
+		table.Rows = append(table.Rows, []string{e.Class, recordedAt, runId, e.Path, e.Error})
+	}
+	return writeTable(w, table, format)
+}
+
+// writeErrorGroups writes the number of stored errors by class or by the directory they are in, most first
+func writeErrorGroups(w io.Writer, stored []storedError, groupBy, format string) error {
+	counts := make(map[string]int)
+	for _, e := range stored {
+		key := e.Class
+		if groupBy == "dir" {
+			key = parentDir(e.Path)
+		}
+		counts[key]++
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	column := "Class"
+	if groupBy == "dir" {
+		column = "Directory"
+	}
+	table := reportTable{Header: []string{"Errors", column}, Text: "%10s  %s\n"}
+	for _, key := range keys {
+		table.Rows = append(table.Rows, []string{fmt.Sprint(counts[key]), key})
+	}
+	return writeTable(w, table, format)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoredErrors(t *testing.T) {
+	db := newTestDatabase(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, row := range []struct {
+		path, message string
+		at            any
+		runId         any
+	}{
+		{"/srv/locked/a", "opening file: open /srv/locked/a: permission denied", "2024-05-31T12:00:00Z", 2},
+		{"/srv/locked/b", "opening file: open /srv/locked/b: permission denied", "2024-05-01T12:00:00Z", 1},
+		{"/srv/data/c", "hashing file: read /srv/data/c: input/output error", "2024-05-31T12:00:00Z", 2},
+		{"/srv/data/d", "short read: got 10 bytes, want 20", nil, nil},
+		{"/srv/data/e", "getting folder ID: database is locked", "2024-05-31T12:00:00Z", 2},
+	} {
+		_, err := db.Exec("INSERT INTO files(path, error, error_at, error_run_id) VALUES (?, ?, ?, ?)",
+			row.path, row.message, row.at, row.runId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO files(path, size) VALUES ('/srv/data/ok', 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(filter errorFilter) string {
+		t.Helper()
+		stored, err := listStoredErrors(db, filter, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range stored {
+			names = append(names, e.Path[strings.LastIndex(e.Path, "/")+1:])
+		}
+		return strings.Join(names, ",")
+	}
+	for _, tc := range []struct {
+		filter   errorFilter
+		expected string
+	}{
+		{errorFilter{}, "c,d,e,a,b"},
+		{errorFilter{Class: "permission"}, "a,b"},
+		{errorFilter{Class: "short-read"}, "d"},
+		{errorFilter{Class: "other"}, "e"},
+		{errorFilter{Prefix: "/srv/data"}, "c,d,e"},
+		{errorFilter{OlderThan: 7 * 24 * time.Hour}, "d,b"}, // Errors without a time count as old
+		{errorFilter{NewerThan: 7 * 24 * time.Hour}, "c,e,a"},
+		{errorFilter{RunId: 1}, "b"},
+		{errorFilter{Class: "permission", RunId: 2}, "a"},
+	} {
+		if got := paths(tc.filter); got != tc.expected {
+			t.Errorf("listStoredErrors(%+v) = %s, want %s", tc.filter, got, tc.expected)
+		}
+	}
+
+	stored, err := listStoredErrors(db, errorFilter{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeErrorGroups(&buf, stored, "dir", textFormat); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	if !strings.Contains(report, "3  /srv/data\n") || !strings.Contains(report, "2  /srv/locked\n") ||
+		strings.Index(report, "/srv/data") > strings.Index(report, "/srv/locked") {
+		t.Errorf("writeErrorGroups(dir) = %q", report)
+	}
+	buf.Reset()
+	if err := writeErrorGroups(&buf, stored, "class", textFormat); err != nil {
+		t.Fatal(err)
+	}
+	if report := buf.String(); !strings.Contains(report, "2  permission\n") || !strings.Contains(report, "1  io\n") {
+		t.Errorf("writeErrorGroups(class) = %q", report)
+	}
+
+	// Clearing only touches the matching errors, which are then retried
+	stored, err = listStoredErrors(db, errorFilter{Class: "permission"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared, err := clearStoredErrors(db, stored)
+	if err != nil || cleared != 2 {
+		t.Fatalf("clearStoredErrors() = %d, %v, want 2", cleared, err)
+	}
+	if got := paths(errorFilter{}); got != "c,d,e" {
+		t.Errorf("errors left after clearing = %s, want c,d,e", got)
+	}
+	erroredPaths, err := loadErroredPaths(db, "/srv/locked")
+	if err != nil || len(erroredPaths) != 0 {
+		t.Errorf("loadErroredPaths() after clearing = %v, %v", erroredPaths, err)
+	}
+}
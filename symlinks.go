@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// symlinkTarget returns the absolute path a symlink at path points to. Relative targets are resolved against
+// the directory of the symlink. The result is cleaned lexically, so it doesn't depend on the target existing.
+func symlinkTarget(path, target string) string {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return filepath.Clean(target)
+}
+
+// isUnderRoots reports whether path is equal to or below one of the absolute roots
+func isUnderRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSymlinkChain is the number of links followed before a chain is considered a loop, the same as on Linux
+const maxSymlinkChain = 40
+
+// symlinkChain describes where a chain of symlinks ends
+type symlinkChain struct {
+	FinalTarget string // Absolute path at which resolution stopped
+	Length      int    // Number of links followed
+	// TargetType is "file", "dir" or "other" for an existing target, "missing" for a dangling link, "loop" for
+	// a cycle of links or one longer than maxSymlinkChain, or "error" if a link can't be examined
+	TargetType string
+}
+
+// resolveSymlinkChain follows the symlink at path on the live file system, one link at a time, until it reaches
+// something that isn't a symlink
+func resolveSymlinkChain(path string) symlinkChain {
+	current := path
+	visited := make(map[string]bool)
+	for length := 0; ; length++ {
+		info, err := os.Lstat(current)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return symlinkChain{current, length, "missing"}
+		case err != nil:
+			return symlinkChain{current, length, "error"}
+		case info.Mode()&os.ModeSymlink == 0:
+			// Directories in the target may still be symlinks
+			if dir, err := filepath.EvalSymlinks(filepath.Dir(current)); err == nil {
+				current = filepath.Join(dir, filepath.Base(current))
+			}
+			return symlinkChain{current, length, fileTypeName(info)}
+		case visited[current] || length == maxSymlinkChain:
+			return symlinkChain{current, length, "loop"}
+		}
+		visited[current] = true
+
+		link, err := os.Readlink(current)
+		if err != nil {
+			return symlinkChain{current, length, "error"}
+		}
+		// A relative target is relative to the directory as resolved by the kernel, which matters for ".."
+		dir, err := filepath.EvalSymlinks(filepath.Dir(current))
+		if err != nil {
+			return symlinkChain{current, length, "error"}
+		}
+		current = symlinkTarget(filepath.Join(dir, filepath.Base(current)), link)
+	}
+}
+
+// fileTypeName describes a file that isn't a symlink as "file", "dir" or "other"
+func fileTypeName(info fs.FileInfo) string {
+	switch {
+	case info.IsDir():
+		return "dir"
+	case info.Mode().IsRegular():
+		return "file"
+	default:
+		return "other"
+	}
+}
+
+// brokenTargetTypes are the target types of the links listed by the broken-links command
+const brokenTargetTypes = "('missing', 'loop')"
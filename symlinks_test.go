@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExternalSymlinks(t *testing.T) {
+	roots := []string{"/data/photos", "/data/docs/"}
+
+	testCases := []struct {
+		path     string
+		target   string
+		expected bool
+	}{
+		{"/data/photos/a.jpg", "b.jpg", false},
+		{"/data/photos/2023/a.jpg", "../2022/b.jpg", false},
+		{"/data/photos/a.jpg", "../docs/b.pdf", false},
+		{"/data/photos/a.jpg", "../music/b.mp3", true},
+		{"/data/photos/a.jpg", "/data/photos-old/b.jpg", true},
+		{"/data/photos/a.jpg", "/data/docs", false},
+		{"/data/photos/a.jpg", "../../../etc/passwd", true},
+	}
+
+	for _, tc := range testCases {
+		target := symlinkTarget(tc.path, tc.target)
+		if external := !isUnderRoots(target, roots); external != tc.expected {
+			t.Errorf("symlink %s -> %s resolved to %s: external = %v, want %v",
+				tc.path, tc.target, target, external, tc.expected)
+		}
+	}
+}
+
+func TestResolveSymlinkChain(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"opt/app-1.0/bin", "opt/app-1.0/lib"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "opt/app-1.0/bin/app"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"opt/current":         "app-1.0",
+		"opt/app":             "current/bin/app",
+		"usr-bin-app":         "opt/app",
+		"opt/bin":             "current/bin",
+		"opt/app-1.0/bin/lib": "../lib",
+		"dangling":            "opt/missing",
+		"loop1":               "loop2",
+		"loop2":               "loop1",
+		"opt/absolute":        filepath.Join(root, "opt/current/bin/app"),
+		"to-dangling":         "dangling",
+		"opt/self-loop":       "self-loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := filepath.Join(root, "opt/app-1.0/bin/app")
+	testCases := []struct {
+		path     string
+		expected symlinkChain
+	}{
+		{"usr-bin-app", symlinkChain{app, 2, "file"}},
+		{"opt/bin", symlinkChain{filepath.Join(root, "opt/app-1.0/bin"), 1, "dir"}},
+		// ".." applies to the resolved directory of the link, not to opt/bin
+		{"opt/bin/lib", symlinkChain{filepath.Join(root, "opt/app-1.0/lib"), 1, "dir"}},
+		{"opt/absolute", symlinkChain{app, 1, "file"}},
+		{"to-dangling", symlinkChain{filepath.Join(root, "opt/missing"), 2, "missing"}},
+		{"loop1", symlinkChain{filepath.Join(root, "loop1"), 2, "loop"}},
+		{"opt/self-loop", symlinkChain{filepath.Join(root, "opt/self-loop"), 1, "loop"}},
+	}
+	for _, tc := range testCases {
+		if chain := resolveSymlinkChain(filepath.Join(root, tc.path)); chain != tc.expected {
+			t.Errorf("resolveSymlinkChain(%s) = %+v, want %+v", tc.path, chain, tc.expected)
+		}
+	}
+}
+
+func TestProcessDirectoryStrictSymlinks(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"target.txt", "twelve bytes"}})
+	for link, target := range map[string]string{"link": "target.txt", "dangling": "missing.txt"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(root, "target.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		db := newTestDatabase(t)
+		opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, StrictSymlinks: strict}
+		if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		var size sql.NullInt64
+		var modTime, targetType sql.NullString
+		err := db.QueryRow("SELECT target_size, target_mtime, target_type FROM files WHERE path = ?",
+			filepath.Join(root, "link")).Scan(&size, &modTime, &targetType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strict && (size.Int64 != 12 || modTime.String != info.ModTime().Format(time.RFC3339)) {
+			t.Errorf("with -strict-symlinks, got target size %v and modification time %v for link", size, modTime)
+		} else if !strict && (size.Valid || modTime.Valid) {
+			t.Errorf("without -strict-symlinks, got target size %v and modification time %v for link", size, modTime)
+		}
+
+		err = db.QueryRow("SELECT target_size, target_type FROM files WHERE path = ?",
+			filepath.Join(root, "dangling")).Scan(&size, &targetType)
+		if err != nil || size.Valid || targetType.String != "missing" {
+			t.Errorf("got target size %v and type %v, %v for a dangling link, want NULL and missing", size,
+				targetType, err)
+		}
+	}
+}
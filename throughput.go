@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	throughputMinSize          = 1 << 20 // Smaller files are dominated by per-file overhead and not recorded
+	throughputBucketsPerDecade = 10
+	throughputMinSpeed         = 0.01 // MB/s, the lower bound of the first bucket
+	throughputDecades          = 7    // Up to 100 GB/s
+	throughputSlowestFiles     = 10
+)
+
+// logSlowFile logs a file of size bytes that took elapsed to read and hash, longer than -slow-file-threshold
+func logSlowFile(path string, size int64, elapsed time.Duration) {
+	sizeMb := float64(size) / (1024 * 1024)
+	log.Printf("Slow file %s [%.2f MB]: %v, %.2f MB/s\n", path, sizeMb, elapsed.Round(time.Millisecond),
+		sizeMb/elapsed.Seconds())
+}
+
+// throughputSample is the read speed of a single file
+type throughputSample struct {
+	Path  string
+	Size  int64
+	Speed float64 // MB/s
+}
+
+// throughputHistogram aggregates per-file read speeds into logarithmic buckets, and keeps the slowest files.
+// It is safe for concurrent use.
+type throughputHistogram struct {
+	mu      sync.Mutex
+	buckets [throughputBucketsPerDecade*throughputDecades + 1]int64 // The last bucket collects everything faster
+	count   int64
+	slowest []throughputSample // Sorted by increasing speed
+}
+
+// Add records the speed of a file, ignoring files smaller than throughputMinSize
+func (h *throughputHistogram) Add(path string, size int64, speed float64) {
+	if size < throughputMinSize || math.IsNaN(speed) {
+		return
+	}
+	bucket := 0
+	if speed > throughputMinSpeed {
+		bucket = int(math.Log10(speed/throughputMinSpeed) * throughputBucketsPerDecade)
+		bucket = min(bucket, len(h.buckets)-1)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[bucket]++
+	h.count++
+	if len(h.slowest) < throughputSlowestFiles || speed < h.slowest[len(h.slowest)-1].Speed {
+		i := sort.Search(len(h.slowest), func(i int) bool { return h.slowest[i].Speed > speed })
+		h.slowest = append(h.slowest, throughputSample{})
+		copy(h.slowest[i+1:], h.slowest[i:])
+		h.slowest[i] = throughputSample{Path: path, Size: size, Speed: speed}
+		h.slowest = h.slowest[:min(len(h.slowest), throughputSlowestFiles)]
+	}
+}
+
+// Percentile returns an upper bound for the speed below which p percent of the files were read, with the
+// precision of a bucket
+func (h *throughputHistogram) Percentile(p float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.percentile(p)
+}
+
+func (h *throughputHistogram) percentile(p float64) float64 {
+	rank := int64(math.Ceil(p / 100 * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank && seen > 0 {
+			if i == len(h.buckets)-1 {
+				return math.Inf(1)
+			}
+			return throughputMinSpeed * math.Pow(10, float64(i+1)/throughputBucketsPerDecade)
+		}
+	}
+	return 0
+}
+
+// Summary formats the percentiles and the slowest files
+func (h *throughputHistogram) Summary() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var b strings.Builder
+	if h.count == 0 {
+		fmt.Fprintf(&b, "Read throughput: no files of at least %d MB\n", throughputMinSize>>20)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Read throughput of %d files: p50 <= %.2f MB/s, p90 <= %.2f MB/s, p99 <= %.2f MB/s\n",
+		h.count, h.percentile(50), h.percentile(90), h.percentile(99))
+	fmt.Fprintln(&b, "Slowest files:")
+	for _, sample := range h.slowest {
+		fmt.Fprintf(&b, "  %10.2f MB/s %10.2f MB  %s\n", sample.Speed, float64(sample.Size)/(1024*1024), sample.Path)
+	}
+	return b.String()
+}
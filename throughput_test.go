@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestThroughputHistogram(t *testing.T) {
+	h := &throughputHistogram{}
+	h.Add("/small", 1000, 0.001) // Ignored
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.Add(fmt.Sprintf("/file%03d", i), throughputMinSize, float64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, tc := range []struct{ p, speed float64 }{{50, 50}, {90, 90}, {99, 99}, {100, 100}} {
+		// Each bucket covers a factor of 10^0.1, about 26%
+		if upper := h.Percentile(tc.p); upper < tc.speed || upper > tc.speed*math.Pow(10, 0.1) {
+			t.Errorf("Percentile(%v) = %v, want a bound within a bucket above %v", tc.p, upper, tc.speed)
+		}
+	}
+
+	summary := h.Summary()
+	if !strings.Contains(summary, "Read throughput of 100 files") {
+		t.Errorf("Summary() = %q, want the number of recorded files", summary)
+	}
+	if len(h.slowest) != throughputSlowestFiles {
+		t.Fatalf("got %d slowest files, want %d", len(h.slowest), throughputSlowestFiles)
+	}
+	for i, sample := range h.slowest {
+		if expected := fmt.Sprintf("/file%03d", i+1); sample.Path != expected {
+			t.Errorf("slowest[%d] = %s, want %s", i, sample.Path, expected)
+		}
+	}
+}
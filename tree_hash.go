@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// updateTreeHashes sets the tree hash and size of the folders under root, from the deepest up. The tree hash of a
+// folder is the sha256 of the name, kind and content hash of each child, sorted by name, where the content hash of
+// a subfolder is its own tree hash and that of a symlink is its target. Two folders with the same tree hash have
+// the same contents all the way down. Folders with a child that has an error or no hash, e.g. because it is
+// excluded, have a NULL tree hash, as do the folders above them. The folders are updated in a single transaction, or
+// in the transaction db belongs to.
+func updateTreeHashes(db crawlDB, root string) error {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return updateTreeHashesIn(db, root)
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := updateTreeHashesIn(tx, root); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateTreeHashesIn does the work of updateTreeHashes in db
+func updateTreeHashesIn(db crawlDB, root string) error {
+	rows, err := db.Query(`
+	SELECT id, path FROM folders
+	WHERE `+underRootCondition+`
+	ORDER BY length(path) - length(replace(path, '/', '')) DESC`, underRootArgs(root)...)
+	if err != nil {
+		return err
+	}
+	type folder struct {
+		id   int64
+		path string
+	}
+	var folders []folder
+	for rows.Next() {
+		var f folder
+		if err := rows.Scan(&f.id, &f.path); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		folders = append(folders, f)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range folders {
+		hash, size, err := treeHash(db, f.id)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE folders SET tree_hash = ?, tree_size = ? WHERE id = ?", hash, size, f.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeHash computes the tree hash and the total size of the files in the folder with the given ID, whose
+// subfolders already have their tree hashes
+func treeHash(db crawlDB, folderId int64) (sql.NullString, sql.NullInt64, error) {
+	rows, err := db.Query(`
+	SELECT files.name, files.dir, COALESCE(files.bundle, 0), COALESCE(files.symlink, ''), COALESCE(files.size, 0),
+	       files.hash_algorithm || ':' || `+hashHexColumn+`,
+	       files.error IS NOT NULL OR files.exclusion_pattern IS NOT NULL, child.tree_hash, child.tree_size
+	FROM files LEFT JOIN folders child ON child.path = files.path
+	WHERE files.folder_id = ?
+	ORDER BY files.name`, folderId)
+	if err != nil {
+		return sql.NullString{}, sql.NullInt64{}, err
+	}
+	defer rows.Close()
+
+	digest := sha256.New()
+	var total int64
+	complete := true
+	for rows.Next() {
+		var name, symlink string
+		var dir, bundle, failed bool
+		var size int64
+		var hash, childHash sql.NullString
+		var childSize sql.NullInt64
+		if err := rows.Scan(&name, &dir, &bundle, &symlink, &size, &hash, &failed, &childHash, &childSize); err != nil {
+			return sql.NullString{}, sql.NullInt64{}, err
+		}
+		kind, content := "file", hash
+		switch {
+		case symlink != "":
+			kind, content, size = "symlink", sql.NullString{String: symlink, Valid: true}, 0
+		case dir && !bundle:
+			kind, content, size = "dir", childHash, childSize.Int64
+		case bundle:
+			kind = "bundle"
+		}
+		if failed || !content.Valid {
+			complete = false
+		}
+		total += size
+		fmt.Fprintf(digest, "%s\x00%s\x00%s\n", name, kind, content.String)
+	}
+	if err := rows.Err(); err != nil || !complete {
+		return sql.NullString{}, sql.NullInt64{Int64: total, Valid: true}, err
+	}
+	return sql.NullString{String: fmt.Sprintf("%x", digest.Sum(nil)), Valid: true},
+		sql.NullInt64{Int64: total, Valid: true}, nil
+}
+
+// sameTreesReport writes the groups of folders with the same tree hash, largest first, with their size. Empty
+// trees are left out, and so are groups that only repeat a larger group one level down, such as the subfolders of
+// two identical snapshots.
+func sameTreesReport(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`
+	SELECT folders.path, folders.tree_hash, folders.tree_size, COALESCE(folders.parent_id, 0), parent.tree_hash
+	FROM folders LEFT JOIN folders parent ON parent.id = folders.parent_id
+	WHERE folders.tree_size > 0 AND folders.tree_hash IN (
+		SELECT tree_hash FROM folders WHERE tree_hash IS NOT NULL GROUP BY tree_hash HAVING COUNT(*) > 1
+	)
+	ORDER BY folders.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type group struct {
+		size         int64
+		paths        []string
+		parents      map[int64]bool
+		parentHashes map[string]bool // Tree hashes of the parents, with "" for those that have none
+	}
+	groups := make(map[string]*group)
+	var hashes []string
+	for rows.Next() {
+		var path, hash string
+		var size, parentId int64
+		var parentHash sql.NullString
+		if err := rows.Scan(&path, &hash, &size, &parentId, &parentHash); err != nil {
+			return err
+		}
+		g, ok := groups[hash]
+		if !ok {
+			g = &group{size: size, parents: make(map[int64]bool), parentHashes: make(map[string]bool)}
+			groups[hash] = g
+			hashes = append(hashes, hash)
+		}
+		g.paths = append(g.paths, path)
+		g.parents[parentId] = true
+		g.parentHashes[parentHash.String] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// A group with one folder in each of the folders of another group is implied by that group
+	var reported []*group
+	for _, hash := range hashes {
+		g := groups[hash]
+		implied := false
+		if len(g.parents) == len(g.paths) && len(g.parentHashes) == 1 {
+			for parentHash := range g.parentHashes {
+				_, implied = groups[parentHash]
+			}
+		}
+		if !implied {
+			reported = append(reported, g)
+		}
+	}
+	sort.SliceStable(reported, func(i, j int) bool { return reported[i].size > reported[j].size })
+
+	for _, g := range reported {
+		if _, err := fmt.Fprintf(w, "%d bytes, %d folders\n", g.size, len(g.paths)); err != nil {
+			return err
+		}
+		for _, path := range g.paths {
+			if _, err := fmt.Fprintf(w, "  %s\n", path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
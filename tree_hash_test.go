@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestSameTrees(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{
+		{"photos/2023/a.jpg", "first photo"},
+		{"photos/2023/b.jpg", "second photo"},
+		{"photos/notes.txt", "notes"},
+		{"backup/photos/2023/a.jpg", "first photo"},
+		{"backup/photos/2023/b.jpg", "second photo"},
+		{"backup/photos/notes.txt", "notes"},
+		{"other/2023/a.jpg", "first photo"},
+		{"other/2023/b.jpg", "second photo"},
+		{"other/notes.txt", "other notes"},
+		{"excluded/a.jpg", "first photo"},
+		{"excluded/b.tmp", "temporary"},
+	})
+	db := newTestDatabase(t)
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1, ExcludePatterns: []string{"*.tmp"}}}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateTreeHashes(db, root); err != nil {
+		t.Fatal(err)
+	}
+
+	treeHash := func(path string) sql.NullString {
+		var hash sql.NullString
+		err := db.QueryRow("SELECT tree_hash FROM folders WHERE path = ?", filepath.Join(root, path)).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	if photos := treeHash("photos"); !photos.Valid || photos != treeHash("backup/photos") {
+		t.Errorf("copies have the tree hashes %v and %v", photos, treeHash("backup/photos"))
+	}
+	if treeHash("photos") == treeHash("other") {
+		t.Errorf("folders with different contents have the same tree hash")
+	}
+	for _, path := range []string{"excluded", "."} {
+		if hash := treeHash(path); hash.Valid {
+			t.Errorf("%s has the tree hash %s, want NULL for an excluded file", path, hash.String)
+		}
+	}
+
+	// The copies of 2023 are listed, since other/2023 isn't in a copy of photos
+	var buf bytes.Buffer
+	if err := sameTreesReport(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "28 bytes, 2 folders\n" +
+		"  " + filepath.Join(root, "backup/photos") + "\n" +
+		"  " + filepath.Join(root, "photos") + "\n" +
+		"23 bytes, 3 folders\n" +
+		"  " + filepath.Join(root, "backup/photos/2023") + "\n" +
+		"  " + filepath.Join(root, "other/2023") + "\n" +
+		"  " + filepath.Join(root, "photos/2023") + "\n"
+	if report := buf.String(); report != expected {
+		t.Errorf("sameTreesReport() = %q, want %q", report, expected)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix (powers of 1024), e.g. 4G
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(s))
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(number, suffix) {
+			multiplier = int64(1) << (10 * (i + 1))
+			number = strings.TrimSuffix(number, suffix)
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// parseAge parses a duration in the units of time.ParseDuration, or in days, weeks or years of 365 days with a d, w
+// or y suffix, e.g. 365d
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(value * float64(unit)), nil
+		}
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
+
+// minPrintInterval is the shortest -interval, since printing the statistics more often would keep a core busy
+const minPrintInterval = 10 * time.Millisecond
+
+// parseInterval parses an -interval in the units of time.ParseDuration, e.g. 500ms, or as a number of seconds,
+// which is what the flag used to take. Intervals of 0 or less are allowed, and disable the statistics.
+func parseInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval %q", s)
+		}
+		interval = time.Duration(seconds * float64(time.Second))
+	}
+	if interval > 0 && interval < minPrintInterval {
+		return 0, fmt.Errorf("interval %v is shorter than %v", interval, minPrintInterval)
+	}
+	return interval, nil
+}
+
+const intervalUsage = "Time interval for printing statistics, e.g. 500ms or 2s, at least 10ms. A number is in " +
+	"seconds, and 0 disables them"
+
+// intervalValue is the flag.Value of -interval, see parseInterval
+type intervalValue time.Duration
+
+func (v *intervalValue) String() string { return time.Duration(*v).String() }
+
+func (v *intervalValue) Set(s string) error {
+	interval, err := parseInterval(s)
+	*v = intervalValue(interval)
+	return err
+}
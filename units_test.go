@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	testCases := []struct {
+		size     string
+		expected int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"4K", 4096},
+		{"1.5m", 1536 * 1024},
+		{"4G", 4 << 30},
+		{"2T", 2 << 40},
+	}
+
+	for _, tc := range testCases {
+		if size, err := parseSize(tc.size); err != nil || size != tc.expected {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tc.size, size, err, tc.expected)
+		}
+	}
+
+	for _, size := range []string{"", "G", "-1", "4X"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) succeeded, want an error", size)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	testCases := []struct {
+		age      string
+		expected time.Duration
+	}{
+		{"365d", 365 * 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"0.5d", 12 * time.Hour},
+		{"90m", 90 * time.Minute},
+	}
+
+	for _, tc := range testCases {
+		if age, err := parseAge(tc.age); err != nil || age != tc.expected {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", tc.age, age, err, tc.expected)
+		}
+	}
+
+	for _, age := range []string{"", "d", "-1d", "3x", "-5m"} {
+		if _, err := parseAge(age); err == nil {
+			t.Errorf("parseAge(%q) succeeded, want an error", age)
+		}
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	testCases := []struct {
+		interval string
+		expected time.Duration
+	}{
+		{"500ms", 500 * time.Millisecond},
+		{"2s", 2 * time.Second},
+		{"0.1s", 100 * time.Millisecond},
+		{"10ms", 10 * time.Millisecond},
+		{"1", time.Second},
+		{"0.25", 250 * time.Millisecond},
+		{"0", 0},
+		{"-1", -time.Second},
+	}
+
+	for _, tc := range testCases {
+		if interval, err := parseInterval(tc.interval); err != nil || interval != tc.expected {
+			t.Errorf("parseInterval(%q) = %v, %v, want %v", tc.interval, interval, err, tc.expected)
+		}
+	}
+
+	for _, interval := range []string{"", "fast", "5ms", "0.001"} {
+		if _, err := parseInterval(interval); err == nil {
+			t.Errorf("parseInterval(%q) succeeded, want an error", interval)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// verifyParameters select the files checked by verify, and are recorded in the runs table
+type verifyParameters struct {
+	Sample float64 `json:"sample"` // Fraction of the files to check
+	Seed   int64   `json:"seed"`   // Seed for selecting the sample
+	// MapPrefix translates stored paths to where the files are now
+	MapPrefix prefixMap `json:"map_prefix,omitempty"`
+	// Budget selects the files verified least recently, never verified first, up to this many bytes, instead of
+	// a sample. 0 for no budget.
+	Budget int64 `json:"budget,omitempty"`
+}
+
+// verifyResults are the outcome of verify, recorded in the runs table
+type verifyResults struct {
+	Checked                int64   `json:"checked"`
+	OK                     int64   `json:"ok"`
+	Mismatched             int64   `json:"mismatched"`
+	Modified               int64   `json:"modified"` // Mismatched with a new modification time
+	Missing                int64   `json:"missing"`
+	Errors                 int64   `json:"errors"`
+	MismatchRate           float64 `json:"mismatch_rate"`
+	MismatchRateUpperBound float64 `json:"mismatch_rate_upper_bound"` // 95% confidence
+	// Bitrot are the mismatched files whose modification time is still the stored one, see detectBitrot
+	Bitrot []string `json:"bitrot,omitempty"`
+}
+
+// verifyCandidate is a file selected for verification
+type verifyCandidate struct {
+	Path       string
+	StoredPath string
+	Size       int64 // Stored size
+	Hash       string
+	Algorithm  string
+	Bundle     bool   // Whether Hash is the aggregate hash of a bundle
+	ModTime    string // Stored modification time, empty if unknown
+}
+
+// runVerify implements the verify subcommand, which re-hashes indexed files and compares them to the stored hashes
+func runVerify(args []string) error {
+	var dbFile string
+	printInterval := intervalValue(time.Second)
+	var budget string
+	var params verifyParameters
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", "index.sqlite", "Path to the SQLite database file")
+	addDatabaseFlags(flags)
+	flags.Var(&printInterval, "interval", intervalUsage)
+	flags.Float64Var(&params.Sample, "sample", 1, "Fraction of the files to verify, chosen at random (1 verifies all files)")
+	flags.Int64Var(&params.Seed, "seed", 0, "Seed for choosing the sample, to repeat a previous run (default random)")
+	flags.Var(&params.MapPrefix, "map-prefix",
+		"Check the files stored below old at the same place below new, given as old=new. Can be repeated; the "+
+			"longest matching prefix wins")
+	flags.StringVar(&budget, "budget", "",
+		"Verify the files verified least recently, those never verified first, up to this many bytes, e.g. 200G. "+
+			"Running it regularly cycles through the whole index (default no budget)")
+	_ = flags.Parse(args)
+
+	if params.Sample <= 0 || params.Sample > 1 {
+		return fmt.Errorf("sample must be in (0, 1], got %v", params.Sample)
+	}
+	if budget != "" {
+		var err error
+		if params.Budget, err = parseSize(budget); err != nil {
+			return fmt.Errorf("parsing budget: %w", err)
+		}
+		if params.Budget <= 0 {
+			return fmt.Errorf("budget must be positive, got %s", budget)
+		}
+		if params.Sample < 1 {
+			return errors.New("-budget and -sample can't be combined")
+		}
+	}
+	if params.Seed == 0 {
+		params.Seed = time.Now().UnixNano()
+	}
+
+	db, err := openExistingDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	runId, err := startRun(db, "verify", params)
+	if err != nil {
+		return err
+	}
+
+	stats := NewProcessStats()
+	if printInterval > 0 {
+		stats.PrintEvery(time.Duration(printInterval))
+	}
+
+	results, err := verifyFiles(db, runId, params, stats)
+	if err != nil {
+		return err
+	}
+	if err := finishRun(db, runId, results); err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked: %d, OK: %d, mismatched: %d (%d modified, %d bitrot), missing: %d, errors: %d "+
+		"(sample %v, seed %d)\n", results.Checked, results.OK, results.Mismatched, results.Modified,
+		len(results.Bitrot), results.Missing, results.Errors, params.Sample, params.Seed)
+	fmt.Printf("Mismatch rate: %.4f%% (95%% confidence upper bound %.4f%%)\n",
+		100*results.MismatchRate, 100*results.MismatchRateUpperBound)
+	if err := detectBitrot(db, os.Stdout); err != nil {
+		return err
+	}
+
+	open, err := countOpenCorruptions(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Open corruptions: %d\n", open)
+	if open == 0 {
+		return nil
+	}
+	return &openCorruptionsError{Count: open}
+}
+
+// selectVerifyCandidates returns the hashed files, sampled according to params. The same seed selects the same
+// files as long as the database doesn't change. With a budget, the files are those verified least recently instead,
+// until their stored sizes add up to the budget. The last one may go over it, so that a file larger than the
+// budget doesn't stop the cycle.
+func selectVerifyCandidates(db *sql.DB, params verifyParameters) ([]verifyCandidate, error) {
+	locations, err := loadRootLocations(db)
+	if err != nil {
+		return nil, err
+	}
+	order := "path"
+	if params.Budget > 0 {
+		order = "last_verified IS NOT NULL, last_verified, path"
+	}
+	rows, err := db.Query(`
+	SELECT path, COALESCE(path_encoding, 'utf8'), `+hashHexColumn+`, COALESCE(hash_algorithm, ?),
+	       COALESCE(bundle, 0), COALESCE(modification_time, ''), COALESCE(size, 0)
+	FROM files
+	WHERE hash IS NOT NULL AND error IS NULL
+	ORDER BY `+order, defaultHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rng := rand.New(rand.NewSource(params.Seed))
+	var candidates []verifyCandidate
+	var selected int64
+	for rows.Next() {
+		var c verifyCandidate
+		var encoding string
+		if err := rows.Scan(&c.StoredPath, &encoding, &c.Hash, &c.Algorithm, &c.Bundle, &c.ModTime, &c.Size); err != nil {
+			return nil, err
+		}
+		c.Path = params.MapPrefix.apply(locations.osPath(decodePath(c.StoredPath, encoding)))
+		if params.Budget > 0 {
+			candidates = append(candidates, c)
+			if selected += c.Size; selected >= params.Budget {
+				break
+			}
+		} else if rng.Float64() < params.Sample {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates, rows.Err()
+}
+
+// markVerified records that the stored hash of c was confirmed at now. Rows whose hash has changed since c was
+// selected, e.g. by a crawl running at the same time, are left alone.
+func markVerified(db *sql.DB, c verifyCandidate, now time.Time) error {
+	_, err := db.Exec("UPDATE files SET last_verified = ? WHERE path = ? AND "+hashHexColumn+" = ?",
+		now.UTC().Format(time.RFC3339), c.StoredPath, c.Hash)
+	return err
+}
+
+// verifyFiles re-hashes the selected files and compares them to the stored hashes, recording each mismatch in the
+// corruptions table with the ID of the verify run
+func verifyFiles(db *sql.DB, runId int64, params verifyParameters, stats *ProcessStats) (verifyResults, error) {
+	var results verifyResults
+	candidates, err := selectVerifyCandidates(db, params)
+	if err != nil {
+		return results, err
+	}
+
+	for _, c := range candidates {
+		hash, n, err := verifyHash(c)
+		stats.Update(c.Path, n)
+		results.Checked++
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			log.Println("MISSING", c.Path)
+			results.Missing++
+		case err != nil:
+			log.Println("ERROR", c.Path, err)
+			results.Errors++
+		case hash != c.Hash:
+			results.Mismatched++
+			modTime, err := verifyModTime(c)
+			switch {
+			case err != nil || c.ModTime == "":
+				// Without both modification times, the change can't be told apart from bitrot
+				log.Println("CORRUPT", c.Path)
+			case modTime == c.ModTime:
+				log.Println("BITROT", c.Path)
+				results.Bitrot = append(results.Bitrot, c.Path)
+			default:
+				log.Println("MODIFIED", c.Path)
+				results.Modified++
+			}
+			if err := recordCorruption(db, c, hash, modTime, runId, time.Now()); err != nil {
+				return results, err
+			}
+		default:
+			results.OK++
+			// Each file is marked as soon as it is confirmed, so an interrupted run loses nothing and marks
+			// nothing it didn't check
+			if err := markVerified(db, c, time.Now()); err != nil {
+				return results, err
+			}
+		}
+	}
+
+	compared := results.OK + results.Mismatched
+	if compared > 0 {
+		results.MismatchRate = float64(results.Mismatched) / float64(compared)
+		results.MismatchRateUpperBound = wilsonUpperBound(results.Mismatched, compared)
+	}
+	return results, nil
+}
+
+// verifyHash hashes the file or bundle of c again, returning the hash and the number of bytes hashed
+func verifyHash(c verifyCandidate) (string, int64, error) {
+	if !c.Bundle {
+		return hashFile(c.Path, c.Algorithm)
+	}
+	contents, err := scanBundle(c.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	hash, err := hashBundle(c.Path, contents, c.Algorithm)
+	return hash, contents.Size, err
+}
+
+// verifyModTime returns the current modification time of the file or bundle of c, formatted like the stored one
+func verifyModTime(c verifyCandidate) (string, error) {
+	if c.Bundle {
+		contents, err := scanBundle(c.Path)
+		if err != nil {
+			return "", err
+		}
+		return contents.ModificationTime.Format(time.RFC3339), nil
+	}
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return "", err
+	}
+	return info.ModTime().Format(time.RFC3339), nil
+}
+
+// detectBitrot writes the files of the latest verify run whose contents changed although their modification time
+// didn't. Editors and copies update the modification time, so this usually means silent corruption on the disk
+// or a NAS that rewrote the file behind the back of the filesystem, and is worse than a plain mismatch.
+func detectBitrot(db *sql.DB, w io.Writer) error {
+	var encoded sql.NullString
+	err := db.QueryRow(`SELECT results FROM runs WHERE command = 'verify' AND finished_at IS NOT NULL
+	ORDER BY id DESC LIMIT 1`).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) || !encoded.Valid {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var results verifyResults
+	if err := json.Unmarshal([]byte(encoded.String), &results); err != nil {
+		return err
+	}
+	if len(results.Bitrot) == 0 {
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "\nWARNING: %d files changed without a new modification time, a sign of bitrot:\n",
+		len(results.Bitrot))
+	for _, path := range results.Bitrot {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintln(w, "BITROT", path)
+	}
+	return err
+}
+
+// wilsonUpperBound returns the upper bound of the 95% Wilson score interval for k successes in n trials
+func wilsonUpperBound(k, n int64) float64 {
+	const z = 1.96
+	p := float64(k) / float64(n)
+	nf := float64(n)
+	center := p + z*z/(2*nf)
+	margin := z * math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf))
+	return (center + margin) / (1 + z*z/nf)
+}
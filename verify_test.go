@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertHashedFile writes content to a file under dir and inserts a row for it with the given content's hash
+func insertHashedFile(t *testing.T, db execQuerier, dir, name, content, hashedContent string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO files(path, hash, size) VALUES (?, ?, ?)",
+		path, fmt.Sprintf("%x", sha256.Sum256([]byte(hashedContent))), len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyFiles(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	insertHashedFile(t, db, dir, "ok", "content", "content")
+	insertHashedFile(t, db, dir, "changed", "new content", "old content")
+	if err := os.Remove(insertHashedFile(t, db, dir, "missing", "content", "content")); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := verifyFiles(db, 0, verifyParameters{Sample: 1, Seed: 1}, NewProcessStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Checked != 3 || results.OK != 1 || results.Mismatched != 1 || results.Missing != 1 {
+		t.Errorf("verifyFiles() = %+v, want 1 ok, 1 mismatched and 1 missing", results)
+	}
+	if results.MismatchRate != 0.5 {
+		t.Errorf("mismatch rate = %v, want 0.5", results.MismatchRate)
+	}
+}
+
+func TestSelectVerifyCandidatesIsDeterministic(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	for i := 0; i < 100; i++ {
+		insertHashedFile(t, db, dir, fmt.Sprintf("file%d", i), "content", "content")
+	}
+
+	params := verifyParameters{Sample: 0.3, Seed: 42}
+	first, err := selectVerifyCandidates(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := selectVerifyCandidates(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("the same seed selected different samples")
+	}
+	if len(first) < 10 || len(first) > 50 {
+		t.Errorf("selected %d of 100 files with sample 0.3", len(first))
+	}
+}
+
+func TestWilsonUpperBound(t *testing.T) {
+	if bound := wilsonUpperBound(0, 1000); bound < 0.003 || bound > 0.004 {
+		t.Errorf("wilsonUpperBound(0, 1000) = %v, want about 0.0038", bound)
+	}
+}
+
+func TestVerifyFilesBitrot(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	rotten := insertHashedFile(t, db, dir, "rotten", "flipped bit", "original")
+	edited := insertHashedFile(t, db, dir, "edited", "new content", "old content")
+	unknown := insertHashedFile(t, db, dir, "unknown", "new content", "old content")
+	info, err := os.Stat(rotten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, modTime := range map[string]string{
+		rotten: info.ModTime().Format(time.RFC3339),
+		edited: "2001-01-01T00:00:00Z",
+	} {
+		if _, err := db.Exec("UPDATE files SET modification_time = ? WHERE path = ?", modTime, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params := verifyParameters{Sample: 1, Seed: 1}
+	results, err := verifyFiles(db, 0, params, NewProcessStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Mismatched != 3 || results.Modified != 1 || !reflect.DeepEqual(results.Bitrot, []string{rotten}) {
+		t.Errorf("verifyFiles() = %+v, want 3 mismatched, 1 modified and bitrot in %s, not %s", results, rotten,
+			unknown)
+	}
+
+	var out bytes.Buffer
+	if err := detectBitrot(db, &out); err != nil || out.Len() != 0 {
+		t.Errorf("detectBitrot() before any verify run = %q, %v, want nothing", out.String(), err)
+	}
+	runId, err := startRun(db, "verify", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finishRun(db, runId, results); err != nil {
+		t.Fatal(err)
+	}
+	if err := detectBitrot(db, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "WARNING: 1 files") || !strings.Contains(out.String(), "BITROT "+rotten+"\n") ||
+		strings.Contains(out.String(), edited) {
+		t.Errorf("detectBitrot() = %q, want a warning for %s only", out.String(), rotten)
+	}
+}
+
+func TestVerifyBudget(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		insertHashedFile(t, db, dir, name, "ten bytes.", "ten bytes.")
+	}
+	insertHashedFile(t, db, dir, "d", "changed", "original")
+
+	// Each run takes the files verified least recently until the budget is used, so the runs cycle through them
+	params := verifyParameters{Sample: 1, Seed: 1, Budget: 15}
+	for i, expected := range [][]string{{"a", "b"}, {"c", "d"}, {"d", "a"}} {
+		candidates, err := selectVerifyCandidates(db, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range candidates {
+			names = append(names, filepath.Base(c.Path))
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("run %d selected %q, want %q", i+1, names, expected)
+		}
+		if _, err := verifyFiles(db, 0, params, NewProcessStats()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A mismatched file is never marked as verified
+	var verified int
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE last_verified IS NOT NULL").Scan(&verified)
+	if err != nil || verified != 3 {
+		t.Errorf("%d files are marked as verified, %v, want 3", verified, err)
+	}
+}
+
+func TestCorruptions(t *testing.T) {
+	db := newTestDatabase(t)
+	dir := t.TempDir()
+	insertHashedFile(t, db, dir, "ok", "content", "content")
+	changed := insertHashedFile(t, db, dir, "changed", "new content", "old content")
+
+	// Verifying again only updates the open entry
+	params := verifyParameters{Sample: 1, Seed: 1}
+	for _, runId := range []int64{1, 2} {
+		if _, err := verifyFiles(db, runId, params, NewProcessStats()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var id, crawlId int64
+	var path string
+	err := db.QueryRow("SELECT id, path, crawl_id FROM corruptions").Scan(&id, &path, &crawlId)
+	if err != nil || path != changed || crawlId != 1 {
+		t.Fatalf("corruption = %s from run %d, %v, want %s from run 1", path, crawlId, err, changed)
+	}
+	if open, err := countOpenCorruptions(db); err != nil || open != 1 {
+		t.Errorf("countOpenCorruptions() = %d, %v, want 1", open, err)
+	}
+
+	// Once resolved, the entry is kept and the same mismatch is recorded again
+	if resolved, err := resolveCorruptions(db, []int64{id}, time.Now()); err != nil || resolved != 1 {
+		t.Fatalf("resolveCorruptions() = %d, %v, want 1", resolved, err)
+	}
+	if _, err := resolveCorruptions(db, []int64{id}, time.Now()); err == nil {
+		t.Errorf("resolving an entry twice succeeded")
+	}
+	if open, err := countOpenCorruptions(db); err != nil || open != 0 {
+		t.Errorf("countOpenCorruptions() after resolving = %d, %v, want 0", open, err)
+	}
+	if _, err := verifyFiles(db, 3, params, NewProcessStats()); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := corruptionsReport(db, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Corruptions: 2\n") || !strings.Contains(out.String(), ", resolved ") {
+		t.Errorf("corruptionsReport() = %q, want a resolved and an open entry", out.String())
+	}
+}
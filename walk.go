@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkOptions restricts which parts of a tree are visited. They are shared by the crawl and the estimate
+// command, so that an estimate matches what a real crawl would do.
+type walkOptions struct {
+	ExcludePatterns   []string
+	ExcludeExtensions extensionList // Extensions of files to exclude, see excludedExtension
+	MaxDepth          int           // Maximum number of levels below the root to descend, negative for unlimited
+	OneFileSystem     bool          // Don't descend into directories on other file systems
+	IgnoreMarkers     bool          // Crawl directories with a .nocrawl or CACHEDIR.TAG marker, see excludingMarker
+	OnlyOwners        ownerList     // Owners of the files to crawl, all of them if empty, see excludedOwner
+	ExcludeOwners     ownerList     // Owners of the files to exclude
+	exclusions        *ExclusionMatcher
+}
+
+// isExcluded matches path, with the attributes file for the qualifiers of patterns, against ExcludePatterns. The
+// patterns are compiled on first use, and again whenever patterns have been appended since.
+func (opts *walkOptions) isExcluded(path string, file *fileAttributes) (bool, string) {
+	if len(opts.ExcludePatterns) == 0 {
+		return false, ""
+	}
+	if opts.exclusions == nil || len(opts.exclusions.Patterns()) != len(opts.ExcludePatterns) {
+		opts.exclusions = NewExclusionMatcher(opts.ExcludePatterns)
+	}
+	return opts.exclusions.IsExcluded(path, file)
+}
+
+// excludedExtension returns the entry of ExcludeExtensions that the name of the file at path ends with, or "" if
+// there is none. Extensions are compared without regard to case. An entry such as gz matches the final extension,
+// like the type column, so it also matches archive.tar.gz, while tar.gz matches only names ending with .tar.gz.
+func (opts *walkOptions) excludedExtension(path string) string {
+	if len(opts.ExcludeExtensions) == 0 {
+		return ""
+	}
+	name := strings.ToLower(filepath.Base(path))
+	for _, ext := range opts.ExcludeExtensions {
+		if strings.HasSuffix(name, "."+ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// extensionList is a list of lowercase extensions without their leading dot. It is a flag.Value that accepts
+// comma-separated lists, so that -exclude-ext can be given either way, or both.
+type extensionList []string
+
+func (l *extensionList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds the extensions of a comma-separated list, with or without their leading dots
+func (l *extensionList) Set(value string) error {
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			return fmt.Errorf("invalid extension list %q", value)
+		}
+		*l = append(*l, ext)
+	}
+	return nil
+}
+
+// addFlags registers the command line flags for walk options, except for the exclusion patterns
+func (opts *walkOptions) addFlags(flags *flag.FlagSet) {
+	flags.IntVar(&opts.MaxDepth, "max-depth", -1, "Maximum number of directory levels to descend below each root (-1 for unlimited)")
+	flags.BoolVar(&opts.OneFileSystem, "one-file-system", false, "Don't descend into directories on other file systems")
+	flags.BoolVar(&opts.IgnoreMarkers, "ignore-markers", false,
+		"Crawl directories containing a .nocrawl file or a CACHEDIR.TAG, which are otherwise skipped")
+	flags.Var(&opts.ExcludeExtensions, "exclude-ext",
+		"Comma-separated extensions of files to exclude, e.g. iso,vmdk,part, in any case. Can be given several times. "+
+			"An extension matches the last one of a name, so gz excludes archive.tar.gz; tar.gz excludes only those")
+	flags.Var(&opts.OnlyOwners, "only-owner",
+		"Comma-separated owners of the files to crawl, as user names or IDs, or groups prefixed with a colon, e.g. "+
+			"alice,:staff; other files are excluded. Can be given several times. Directories are crawled whoever owns them")
+	flags.Var(&opts.ExcludeOwners, "exclude-owner",
+		"Comma-separated owners of the files to exclude, like -only-owner, e.g. root,:wheel. Can be given several times")
+}
+
+// walkRoot is a root directory together with the options used to walk it
+type walkRoot struct {
+	*walkOptions
+	Path   string
+	Device uint64
+	Label  string // Label under which paths are stored relative to Path, "" to store them as they are
+}
+
+// storedPath returns the path under which path is stored
+func (r *walkRoot) storedPath(path string) string {
+	return storedPath(r.Label, r.Path, path)
+}
+
+func (opts *walkOptions) newRoot(root string) (*walkRoot, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	return &walkRoot{walkOptions: opts, Path: root, Device: getDeviceID(info)}, nil
+}
+
+// depth returns the number of directory levels between the root and path
+func (r *walkRoot) depth(path string) int {
+	if path == r.Path {
+		return 0
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(path, r.Path), string(filepath.Separator))
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// descend reports whether the walk should continue into the directory at path, which lives on device
+func (r *walkRoot) descend(path string, device uint64) bool {
+	if r.MaxDepth >= 0 && r.depth(path) >= r.MaxDepth {
+		return false
+	}
+	return !r.OneFileSystem || device == r.Device
+}
+
+// walkPosition is the position of a path relative to another one in the order in which WalkDir visits them
+type walkPosition int
+
+const (
+	beforeTarget walkPosition = iota
+	ancestorOfTarget
+	atTarget
+	afterTarget
+)
+
+// walkOrder returns the position of path relative to target in WalkDir's lexical order
+func walkOrder(path, target string) walkPosition {
+	if path == target {
+		return atTarget
+	}
+	pathComponents := strings.Split(path, string(filepath.Separator))
+	targetComponents := strings.Split(target, string(filepath.Separator))
+	for i, component := range pathComponents {
+		if component == "" && i > 0 { // The root directory
+			break
+		}
+		if i >= len(targetComponents) {
+			return afterTarget
+		}
+		if component != targetComponents[i] {
+			if component < targetComponents[i] {
+				return beforeTarget
+			}
+			return afterTarget
+		}
+	}
+	return ancestorOfTarget
+}
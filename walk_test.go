@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestWalkRootDescend(t *testing.T) {
+	testCases := []struct {
+		root     string
+		path     string
+		maxDepth int
+		expected bool
+	}{
+		{"/a", "/a", -1, true},
+		{"/a", "/a/b/c/d", -1, true},
+		{"/a", "/a", 0, false},
+		{"/a", "/a", 1, true},
+		{"/a", "/a/b", 1, false},
+		{"/a", "/a/b", 2, true},
+		{"/a", "/a/b/c", 2, false},
+		{"/", "/a", 1, false},
+		{"/", "/a", 2, true},
+	}
+
+	for _, tc := range testCases {
+		walk := &walkRoot{walkOptions: &walkOptions{MaxDepth: tc.maxDepth}, Path: tc.root}
+		if descend := walk.descend(tc.path, 0); descend != tc.expected {
+			t.Errorf("descend(%q) with root %q and max depth %d = %v, want %v",
+				tc.path, tc.root, tc.maxDepth, descend, tc.expected)
+		}
+	}
+}
+
+func TestWalkOrder(t *testing.T) {
+	testCases := []struct {
+		path     string
+		target   string
+		expected walkPosition
+	}{
+		{"/a/b", "/a/b", atTarget},
+		{"/a", "/a/b", ancestorOfTarget},
+		{"/", "/a/b", ancestorOfTarget},
+		{"/a/a", "/a/b", beforeTarget},
+		{"/a/a/z/z", "/a/b", beforeTarget},
+		{"/a/b/c", "/a/b", afterTarget}, // Directory contents are visited after the directory itself
+		{"/a/c", "/a/b/c", afterTarget},
+		{"/a-b", "/a/b", afterTarget}, // Ordered by name, not by full path
+		{"/a/b", "/a-b", beforeTarget},
+	}
+
+	for _, tc := range testCases {
+		if position := walkOrder(tc.path, tc.target); position != tc.expected {
+			t.Errorf("walkOrder(%q, %q) = %v, want %v", tc.path, tc.target, position, tc.expected)
+		}
+	}
+}
+
+func TestExcludedExtension(t *testing.T) {
+	var opts walkOptions
+	for _, value := range []string{"ISO, .vmdk", "tar.gz"} {
+		if err := opts.ExcludeExtensions.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := opts.ExcludeExtensions.Set("iso,"); err == nil {
+		t.Error("Set accepted an empty extension")
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/a/disk.iso", "iso"},
+		{"/a/DISK.Iso", "iso"},
+		{"/a/vm.vmdk", "vmdk"},
+		{"/a/archive.tar.gz", "tar.gz"},
+		{"/a/notes.gz", ""},
+		{"/a/iso", ""},
+		{"/a/image.iso.txt", ""},
+		{"/a.iso/file.txt", ""},
+	}
+	for _, tc := range testCases {
+		if ext := opts.excludedExtension(tc.path); ext != tc.expected {
+			t.Errorf("excludedExtension(%q) = %q, want %q", tc.path, ext, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// watchSettleDelay is how long changes are collected before they are processed, so that a file written in many
+// small steps is hashed once
+const watchSettleDelay = 2 * time.Second
+
+// watchEvent is a change reported by a fileWatcher
+type watchEvent struct {
+	Path     string // Path that was created, modified, moved or deleted
+	Overflow bool   // Events were lost, so the whole tree must be reconciled
+}
+
+// errTooManyWatches is returned by fileWatcher.Add when the system limit of watches is reached
+var errTooManyWatches = errors.New("too many watched directories")
+
+// fileWatcher reports changes in the directories it watches. Watches aren't recursive, so every directory is added
+// on its own.
+type fileWatcher interface {
+	Add(dir string) error
+	Events() <-chan watchEvent // Closed when the watcher is closed
+	Close() error
+}
+
+// runWatch keeps the index of roots up to date after a crawl until ctx is done. Changes reported by the file
+// watcher are processed as they happen: changed paths are crawled again, and deleted ones are removed from the
+// index. Since watchers can lose events or run out of watches, every reconcileInterval the roots are crawled
+// again in full, and the rows of the paths that no longer exist are deleted. Where there is no file watcher, only
+// the reconciliation crawls are done.
+func runWatch(ctx context.Context, db *sql.DB, stats *ProcessStats, opts *crawlOptions, roots []string,
+	reconcileInterval time.Duration) error {
+	// Whatever appears while watching is new, even right after the initial crawl of a root
+	watchOpts := *opts
+	watchOpts.InitialCrawl = false
+	opts = &watchOpts
+
+	var walks []*walkRoot
+	for _, root := range roots {
+		walk, err := opts.newRoot(root)
+		if err != nil {
+			return err
+		}
+		walk.Label = opts.Label
+		walks = append(walks, walk)
+	}
+
+	var events <-chan watchEvent
+	watcher, err := newFileWatcher()
+	if err != nil {
+		log.Println("Not watching for changes, only crawling again every", reconcileInterval, "-", err)
+	} else {
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				log.Println("Error closing file watcher:", err)
+			}
+		}()
+		events = watcher.Events()
+		for _, walk := range walks {
+			watchTree(watcher, walk, walk.Path, opts.BundleExtensions)
+		}
+	}
+
+	reconcile := time.NewTicker(reconcileInterval)
+	defer reconcile.Stop()
+	settle := time.NewTimer(watchSettleDelay)
+	settle.Stop()
+	pending := make(map[string]bool)
+
+	for {
+		reconcileNow := false
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				log.Println("File watcher stopped, only crawling again every", reconcileInterval)
+				events = nil
+			} else if event.Overflow {
+				log.Println("File watcher lost events, crawling again")
+				reconcileNow = true
+			} else {
+				if len(pending) == 0 {
+					settle.Reset(watchSettleDelay)
+				}
+				pending[event.Path] = true
+			}
+		case <-settle.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			clear(pending)
+			// Parents come before their children, which are then processed with them
+			sort.Strings(paths)
+			for _, path := range paths {
+				if err := applyChange(db, stats, opts, watcher, walks, path); err != nil {
+					return err
+				}
+			}
+		case <-reconcile.C:
+			reconcileNow = true
+		}
+
+		if reconcileNow {
+			for _, walk := range walks {
+				if err := processTree(walk, walk.Path, db, stats, opts); err != nil {
+					return err
+				}
+				// The crawl only adds and updates rows, so deletions whose events were lost are found here
+				if err := pruneMissingPaths(db, walk); err != nil {
+					return err
+				}
+				if watcher != nil {
+					watchTree(watcher, walk, walk.Path, opts.BundleExtensions)
+				}
+			}
+		}
+	}
+}
+
+// deleteIndexedTree deletes the rows of the path stored as path, and of everything below it, unless it is outside
+// the recorded roots
+func deleteIndexedTree(db *sql.DB, path string) error {
+	if err := requireKnownRoot(db, path); err != nil {
+		log.Println("Error deleting missing path:", err)
+		return nil
+	}
+	for _, table := range []string{"files", "media_info", "photo_info", "chunks"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE "+underRootCondition, underRootArgs(path)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneMissingPaths deletes the rows under the root of walk whose paths no longer exist, such as those deleted
+// while events were lost or in directories beyond the limit of watches. Everything below a missing directory is
+// deleted with it.
+func pruneMissingPaths(db *sql.DB, walk *walkRoot) error {
+	rows, err := db.Query("SELECT path, COALESCE(path_encoding, ?) FROM files WHERE "+underRootCondition+
+		" ORDER BY path", append([]any{utf8Encoding}, underRootArgs(walk.storedPath(walk.Path))...)...)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for rows.Next() {
+		var path, encoding string
+		if err := rows.Scan(&path, &encoding); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if len(missing) > 0 && isUnderRoots(path, missing[len(missing)-1:]) {
+			continue
+		}
+		osPath := decodePath(path, encoding)
+		if walk.Label != "" {
+			osPath = rootLocations{walk.Label: walk.Path}.osPath(osPath)
+		}
+		if _, err := os.Lstat(osPath); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, path)
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, path := range missing {
+		if err := deleteIndexedTree(db, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchTree adds the directories of the tree at start, which is walk.Path or below it, to watcher, except for
+// bundles with bundleExtensions. It stops at the limit of watches, leaving the rest to the reconciliation crawls.
+func watchTree(watcher fileWatcher, walk *walkRoot, start string, bundleExtensions []string) {
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if match, _ := walk.isExcluded(path, nil); match {
+			return filepath.SkipDir
+		}
+		if path != walk.Path && (isBundle(path, bundleExtensions) || walk.excludingMarker(path) != "") {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil && !walk.descend(path, getDeviceID(info)) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if errors.Is(err, errTooManyWatches) {
+		log.Println("Not watching all directories below", start, "- the limit of watches is reached")
+	} else if err != nil {
+		log.Println("Error watching", start, err)
+	}
+}
+
+// applyChange updates the index for a change at path reported by the file watcher: the path is crawled again,
+// including everything below it, or removed from the index if it no longer exists and is under a recorded root. A
+// change inside a bundle updates the whole bundle.
+func applyChange(db *sql.DB, stats *ProcessStats, opts *crawlOptions, watcher fileWatcher, walks []*walkRoot,
+	path string) error {
+	var walk *walkRoot
+	for _, w := range walks {
+		if isUnderRoots(path, []string{w.Path}) {
+			walk = w
+			break
+		}
+	}
+	if walk == nil {
+		return nil
+	}
+	// Bundles are stored as a whole, the outermost one if they are nested
+	for dir := filepath.Dir(path); isUnderRoots(dir, []string{walk.Path}) && dir != walk.Path; dir = filepath.Dir(dir) {
+		if isBundle(dir, opts.BundleExtensions) {
+			path = dir
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return deleteIndexedTree(db, walk.storedPath(path))
+	} else if err != nil {
+		log.Println("Error reading changed path:", path, err)
+		return nil
+	}
+	if info.IsDir() && watcher != nil {
+		watchTree(watcher, walk, path, opts.BundleExtensions)
+	}
+	return processTree(walk, path, db, stats, opts)
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that can change the index. Files are processed when they are closed after
+// writing rather than on every write.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyWatcher is a fileWatcher using Linux inotify
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File // fd, read through the runtime poller so that Close interrupts a pending read
+	mu     sync.Mutex
+	dirs   map[int]string // Watched directories by watch descriptor
+	events chan watchEvent
+}
+
+func newFileWatcher() (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int]string),
+		events: make(chan watchEvent, 1024),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Add watches dir. Adding a directory again, e.g. after it moved, updates its path.
+func (w *inotifyWatcher) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if errors.Is(err, syscall.ENOSPC) {
+		return errTooManyWatches
+	} else if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[wd] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *inotifyWatcher) Events() <-chan watchEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+// run reads and decodes the inotify events until the watcher is closed
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.events <- watchEvent{Overflow: true}
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[int(raw.Wd)]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || raw.Mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			w.events <- watchEvent{Path: path}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newFileWatcher fails outside Linux, where the index is only kept up to date by reconciliation crawls
+func newFileWatcher() (fileWatcher, error) {
+	return nil, errors.New("file system notifications are only supported on Linux")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunWatch(t *testing.T) {
+	if watcher, err := newFileWatcher(); err != nil {
+		t.Skip("no file watcher:", err)
+	} else if err := watcher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newTestDatabase(t)
+	root := t.TempDir()
+	writeFiles(t, root, [][2]string{{"old.txt", "old"}, {"sub/kept.txt", "kept"}, {"unwatched/gone.txt", "gone"}})
+	// Watching follows the initial crawl of the root, as with -watch on a new database
+	opts := &crawlOptions{walkOptions: walkOptions{MaxDepth: -1}, InitialCrawl: true}
+	if err := processDirectory(root, db, NewProcessStats(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordRoot(db, root, root, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(reconcileInterval time.Duration) (stop func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- runWatch(ctx, db, NewProcessStats(), opts, []string{root}, reconcileInterval) }()
+		return func() {
+			cancel()
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	stop := watch(time.Hour)
+
+	// Changes are picked up without crawling again
+	time.Sleep(100 * time.Millisecond) // Let the watches be added
+	writeFiles(t, root, [][2]string{{"sub/new.txt", "new"}, {"newdir/deep.txt", "deep"}})
+	if err := os.Remove(filepath.Join(root, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed := func(path string) bool {
+		var hash sql.NullString
+		err := db.QueryRow("SELECT hash FROM files WHERE path = ?", filepath.Join(root, path)).Scan(&hash)
+		return err == nil && hash.Valid
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if indexed("sub/new.txt") && indexed("newdir/deep.txt") && !indexed("old.txt") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !indexed("sub/new.txt") || !indexed("newdir/deep.txt") || !indexed("sub/kept.txt") || indexed("old.txt") {
+		t.Errorf("after the changes, indexed new: %v, deep: %v, kept: %v, deleted: %v, want only the deleted "+
+			"file missing", indexed("sub/new.txt"), indexed("newdir/deep.txt"), indexed("sub/kept.txt"),
+			indexed("old.txt"))
+	}
+	for path, expected := range map[string]bool{"sub/kept.txt": false, "sub/new.txt": true, "newdir/deep.txt": true} {
+		var firstSeen sql.NullString
+		err := db.QueryRow("SELECT first_seen FROM files WHERE path = ?", filepath.Join(root, path)).Scan(&firstSeen)
+		if err != nil || firstSeen.Valid != expected {
+			t.Errorf("%s has first_seen %v, %v, want it set %v", path, firstSeen, err, expected)
+		}
+	}
+	stop()
+
+	// A deletion while nothing watches, like one whose event was lost, is pruned by the reconciliation crawl
+	if !indexed("unwatched/gone.txt") {
+		t.Fatal("unwatched/gone.txt isn't indexed before it is deleted")
+	}
+	if err := os.RemoveAll(filepath.Join(root, "unwatched")); err != nil {
+		t.Fatal(err)
+	}
+	stop = watch(100 * time.Millisecond)
+	defer stop()
+	gone := func() bool {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path LIKE ?", filepath.Join(root, "unwatched")+"%").
+			Scan(&count)
+		return err == nil && count == 0
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && !gone() {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !gone() || !indexed("sub/kept.txt") {
+		t.Errorf("after reconciling, unwatched pruned: %v, kept: %v, want the deleted tree pruned only", gone(),
+			indexed("sub/kept.txt"))
+	}
+}